@@ -16,7 +16,9 @@ If not, see <https://www.gnu.org/licenses/>.
 package btrfs
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"syscall"
@@ -134,6 +136,59 @@ func DeleteSubvolume(path string, force bool) error {
 	return os.RemoveAll(path)
 }
 
+// dirItemNameOffset is the offset of the name in a btrfs_dir_item, after the location
+// key, transid, data_len, name_len and type.
+const dirItemNameOffset = 30
+
+// GetDefaultSubvolume returns the ID of the default subvolume of the filesystem at the
+// given path, which is mounted when no subvolume is given in the mount options.
+func GetDefaultSubvolume(path string) (ObjectID, error) {
+	params := SearchParams{
+		Tree_id:      uint64(RootTreeObjectID),
+		Min_objectid: uint64(RootTreeDirObjectID),
+		Max_objectid: uint64(RootTreeDirObjectID),
+		Min_type:     uint32(DirItemKey),
+		Max_type:     uint32(DirItemKey),
+		Max_offset:   math.MaxUint64,
+		Max_transid:  math.MaxUint64,
+	}
+	id := FSTreeObjectID
+	err := WalkBtrfsTree(path, params, func(hdr SearchHeader, item TreeItem, lastErr error) error {
+		if lastErr != nil {
+			return lastErr
+		}
+		if len(item.Data) < dirItemNameOffset {
+			return nil
+		}
+		nameLen := int(binary.LittleEndian.Uint16(item.Data[dirItemNameOffset-3:]))
+		if len(item.Data) < dirItemNameOffset+nameLen || string(item.Data[dirItemNameOffset:dirItemNameOffset+nameLen]) != "default" {
+			return nil
+		}
+		dirItem, err := item.DirItem()
+		if err != nil {
+			return err
+		}
+		id = ObjectID(dirItem.Location.Objectid)
+		return ErrStopWalk
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to find default subvolume: %w", err)
+	}
+	return id, nil
+}
+
+// SetDefaultSubvolume sets the subvolume with the given ID as the default subvolume of
+// the filesystem at the given path.
+func SetDefaultSubvolume(path string, id ObjectID) error {
+	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	objectID := uint64(id)
+	return ioctlUint64(f.Fd(), BTRFS_IOC_DEFAULT_SUBVOL, &objectID)
+}
+
 // IsSubvolumeReadOnly returns true if the subvolume at the given path is read-only.
 func IsSubvolumeReadOnly(path string) (bool, error) {
 	f, err := os.OpenFile(path, os.O_RDONLY, os.ModeDir)
@@ -40,6 +40,10 @@ type searchContext struct {
 	receivedUUID uuid.UUID
 	// Whether to search for snapshots.
 	searchSnapshots bool
+	// Whether to include the snapshots of the subvolumes the subvolume descends from.
+	searchAncestorSnapshots bool
+	// UUIDs of subvolumes to treat as ancestors of the subvolume.
+	ancestors []uuid.UUID
 }
 
 // SearchWithRootID searches for a subvolume starting from the given root ID.
@@ -98,6 +102,20 @@ func SearchWithSnapshots() SearchOption {
 	}
 }
 
+// SearchWithAncestorSnapshots searches for snapshots of the given subvolume as well as
+// snapshots of the subvolumes it was snapshotted or received from. This finds the
+// snapshots taken before a subvolume was replaced by a snapshot of one of them. The
+// UUIDs of subvolumes it replaced can be given as additional ancestors, for when it is
+// not a descendant of them. Implies SearchWithSnapshots.
+func SearchWithAncestorSnapshots(ancestors ...uuid.UUID) SearchOption {
+	return func(opts *searchContext) error {
+		opts.searchSnapshots = true
+		opts.searchAncestorSnapshots = true
+		opts.ancestors = ancestors
+		return nil
+	}
+}
+
 // SubvolumeSearch searches for a subvolume using the given options.
 func SubvolumeSearch(opts ...SearchOption) (*RootInfo, error) {
 	// Apply search options
@@ -171,12 +189,58 @@ func SubvolumeSearch(opts ...SearchOption) (*RootInfo, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to build root tree: %w", err)
 		}
-		return info, tree.InOrderIterate(func(item *RootInfo, lastErr error) error {
-			if item.ParentUUID == info.UUID {
+		var roots []*RootInfo
+		if err := tree.InOrderIterate(func(item *RootInfo, lastErr error) error {
+			roots = append(roots, item)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		parents := map[uuid.UUID]bool{info.UUID: true}
+		if ctx.searchAncestorSnapshots {
+			parents = ancestorUUIDs(info, roots, ctx.ancestors)
+		}
+		for _, item := range roots {
+			if item.UUID != info.UUID && parents[item.ParentUUID] {
 				info.Snapshots = append(info.Snapshots, item)
 			}
-			return nil
-		})
+		}
 	}
 	return info, nil
 }
+
+// ancestorUUIDs returns the UUIDs of the subvolume and every subvolume it descends from,
+// following both the parent UUIDs of snapshots and the received UUIDs of received
+// subvolumes, starting from the subvolume and the given extra ancestors. Ancestors that
+// no longer exist are included, as their snapshots may still.
+func ancestorUUIDs(info *RootInfo, roots []*RootInfo, extra []uuid.UUID) map[uuid.UUID]bool {
+	byUUID := make(map[uuid.UUID]*RootInfo, len(roots))
+	for _, root := range roots {
+		byUUID[root.UUID] = root
+	}
+	ancestors := map[uuid.UUID]bool{info.UUID: true}
+	queue := []*RootInfo{info}
+	for _, id := range extra {
+		if id == uuid.Nil || ancestors[id] {
+			continue
+		}
+		ancestors[id] = true
+		if ancestor, ok := byUUID[id]; ok {
+			queue = append(queue, ancestor)
+		}
+	}
+	for len(queue) > 0 {
+		root := queue[0]
+		queue = queue[1:]
+		for _, id := range []uuid.UUID{root.ParentUUID, root.ReceivedUUID} {
+			if id == uuid.Nil || ancestors[id] {
+				continue
+			}
+			ancestors[id] = true
+			if ancestor, ok := byUUID[id]; ok {
+				queue = append(queue, ancestor)
+			}
+		}
+	}
+	return ancestors
+}
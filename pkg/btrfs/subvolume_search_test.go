@@ -0,0 +1,154 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package btrfs
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestAncestorUUIDs(t *testing.T) {
+	// ids maps the names used in the tests to UUIDs
+	ids := make(map[string]uuid.UUID)
+	id := func(name string) uuid.UUID {
+		if name == "" {
+			return uuid.Nil
+		}
+		if _, ok := ids[name]; !ok {
+			ids[name] = uuid.New()
+		}
+		return ids[name]
+	}
+	// root describes a subvolume by its name, the name of the subvolume it is a
+	// snapshot of and the name of the subvolume it was received from
+	type root struct {
+		name, parent, received string
+	}
+	tests := []struct {
+		name  string
+		roots []root
+		start string
+		extra []string
+		want  []string
+	}{
+		{
+			name:  "original subvolume",
+			roots: []root{{"subvol", "", ""}, {"snap1", "subvol", ""}},
+			start: "subvol",
+			want:  []string{"subvol"},
+		},
+		{
+			name: "restored from a local snapshot",
+			roots: []root{
+				{"snap1", "original", ""},
+				{"subvol", "snap1", ""},
+			},
+			start: "subvol",
+			want:  []string{"original", "snap1", "subvol"},
+		},
+		{
+			name: "restored from a received snapshot",
+			roots: []root{
+				{"received", "", "sent"},
+				{"subvol", "received", ""},
+			},
+			start: "subvol",
+			want:  []string{"received", "sent", "subvol"},
+		},
+		{
+			name: "rolled back twice",
+			roots: []root{
+				{"snap1", "original", ""},
+				{"rollback1", "snap1", ""},
+				{"snap2", "rollback1", ""},
+				{"subvol", "snap2", ""},
+			},
+			start: "subvol",
+			want:  []string{"original", "rollback1", "snap1", "snap2", "subvol"},
+		},
+		{
+			name: "extra ancestors recorded by a restore",
+			roots: []root{
+				{"replaced", "older", ""},
+				{"subvol", "", "sent"},
+			},
+			start: "subvol",
+			extra: []string{"replaced", ""},
+			want:  []string{"older", "replaced", "sent", "subvol"},
+		},
+		{
+			name: "extra ancestor that no longer exists",
+			roots: []root{
+				{"subvol", "", ""},
+			},
+			start: "subvol",
+			extra: []string{"deleted", "subvol"},
+			want:  []string{"deleted", "subvol"},
+		},
+		{
+			name: "unrelated subvolumes are not followed",
+			roots: []root{
+				{"subvol", "snap1", ""},
+				{"snap1", "original", ""},
+				{"other", "unrelated", ""},
+				{"snap2", "subvol", ""},
+			},
+			start: "subvol",
+			want:  []string{"original", "snap1", "subvol"},
+		},
+		{
+			name: "cycles end",
+			roots: []root{
+				{"a", "b", ""},
+				{"b", "a", ""},
+			},
+			start: "a",
+			want:  []string{"a", "b"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var roots []*RootInfo
+			var start *RootInfo
+			for _, r := range tc.roots {
+				info := &RootInfo{Name: r.name, UUID: id(r.name), ParentUUID: id(r.parent), ReceivedUUID: id(r.received)}
+				roots = append(roots, info)
+				if r.name == tc.start {
+					start = info
+				}
+			}
+			var extra []uuid.UUID
+			for _, name := range tc.extra {
+				extra = append(extra, id(name))
+			}
+			names := make(map[uuid.UUID]string, len(ids))
+			for name, u := range ids {
+				names[u] = name
+			}
+			var got []string
+			for u := range ancestorUUIDs(start, roots, extra) {
+				got = append(got, names[u])
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got ancestors %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -37,6 +37,13 @@ type Config struct {
 	SnapshotsDir string `mapstructure:"snapshots_dir" toml:"snapshots_dir,omitempty"`
 	// SnapshotInterval is the global interval between snapshots.
 	SnapshotInterval Duration `mapstructure:"snapshot_interval" toml:"snapshot_interval,omitempty"`
+	// SnapshotSkipUnchanged is a flag to skip new snapshots of subvolumes that have not
+	// changed since their latest snapshot.
+	SnapshotSkipUnchanged bool `mapstructure:"snapshot_skip_unchanged" toml:"snapshot_skip_unchanged,omitempty"`
+	// SnapshotMaxAge is the global age after which a new snapshot is taken even if the
+	// subvolume has not changed. If left unset, unchanged subvolumes are still snapshotted
+	// once in every calendar period their retention policy keeps a snapshot of.
+	SnapshotMaxAge Duration `mapstructure:"snapshot_max_age" toml:"snapshot_max_age,omitempty"`
 	// SnapshotMinimumRetention is the global minimum retention time for snapshots.
 	SnapshotMinimumRetention Duration `mapstructure:"snapshot_min_retention" toml:"snapshot_min_retention,omitempty"`
 	// SnapshotRetention is the global retention time for snapshots.
@@ -44,8 +51,13 @@ type Config struct {
 	// SnapshotRetentionInterval is the global interval for which snapshots will be retained in
 	// the snapshot_retention.
 	SnapshotRetentionInterval Duration `mapstructure:"snapshot_retention_interval" toml:"snapshot_retention_interval,omitempty"`
+	// Retention is the global retention policy for snapshots. When set it replaces the
+	// snapshot_min_retention, snapshot_retention and snapshot_retention_interval settings.
+	Retention *RetentionPolicy `mapstructure:"retention" toml:"retention,omitempty"`
 	// TimeFormat is the global time format for snapshots.
 	TimeFormat string `mapstructure:"time_format" toml:"time_format,omitempty"`
+	// Hooks are the global hooks, run for every subvolume and mirror.
+	Hooks *Hooks `mapstructure:"hooks" toml:"hooks,omitempty"`
 	// SSHUser is the user to use for SSH connections to this mirror. If left unset, defaults
 	// to the current user.
 	SSHUser string `mapstructure:"ssh_user" toml:"ssh_user,omitempty"`
@@ -77,6 +89,12 @@ type Volume struct {
 	// SnapshotInterval is the interval between snapshots for this volume. If left unset
 	// the global value is used.
 	SnapshotInterval time.Duration `mapstructure:"snapshot_interval" toml:"snapshot_interval,omitempty"`
+	// SnapshotSkipUnchanged is a flag to skip new snapshots of the subvolumes of this
+	// volume that have not changed since their latest snapshot.
+	SnapshotSkipUnchanged bool `mapstructure:"snapshot_skip_unchanged" toml:"snapshot_skip_unchanged,omitempty"`
+	// SnapshotMaxAge is the age after which a new snapshot is taken even if the subvolume
+	// has not changed. If left unset the global value is used.
+	SnapshotMaxAge time.Duration `mapstructure:"snapshot_max_age" toml:"snapshot_max_age,omitempty"`
 	// SnapshotMinimumRetention is the minimum retention time for snapshots for this volume.
 	// If left unset the global value is used.
 	SnapshotMinimumRetention time.Duration `mapstructure:"snapshot_min_retention" toml:"snapshot_min_retention,omitempty"`
@@ -86,9 +104,14 @@ type Volume struct {
 	// SnapshotRetentionInterval is the interval for which snapshots will be retained in
 	// the snapshot_retention. If left unset the global value is used.
 	SnapshotRetentionInterval time.Duration `mapstructure:"snapshot_retention_interval" toml:"snapshot_retention_interval,omitempty"`
+	// Retention is the retention policy for snapshots for this volume. If left unset the
+	// global value is used.
+	Retention *RetentionPolicy `mapstructure:"retention" toml:"retention,omitempty"`
 	// TimeFormat is the time format for snapshots for this volume. If left unset the global
 	// value is used.
 	TimeFormat string `mapstructure:"time_format" toml:"time_format,omitempty"`
+	// Hooks are run for every subvolume of this volume, after the global hooks.
+	Hooks *Hooks `mapstructure:"hooks" toml:"hooks,omitempty"`
 	// Subvolumes is a list of subvolumes to manage.
 	Subvolumes []Subvolume `mapstructure:"subvolumes" toml:"subvolumes,omitempty"`
 	// Mirrors is a list of mirror names to sync snapshots to.
@@ -112,6 +135,13 @@ type Subvolume struct {
 	// SnapshotInterval is the interval between snapshots for this subvolume. If left unset
 	// either the volume or global value is used respectively.
 	SnapshotInterval time.Duration `mapstructure:"snapshot_interval" toml:"snapshot_interval,omitempty"`
+	// SnapshotSkipUnchanged is a flag to skip new snapshots of this subvolume when it has
+	// not changed since its latest snapshot. It is also enabled by setting it on the
+	// volume or globally.
+	SnapshotSkipUnchanged bool `mapstructure:"snapshot_skip_unchanged" toml:"snapshot_skip_unchanged,omitempty"`
+	// SnapshotMaxAge is the age after which a new snapshot is taken even if the subvolume
+	// has not changed. If left unset either the volume or global value is used respectively.
+	SnapshotMaxAge time.Duration `mapstructure:"snapshot_max_age" toml:"snapshot_max_age,omitempty"`
 	// SnapshotMinimumRetention is the minimum retention time for snapshots for this subvolume.
 	// If left unset either the volume or global value is used respectively.
 	SnapshotMinimumRetention time.Duration `mapstructure:"snapshot_min_retention" toml:"snapshot_min_retention,omitempty"`
@@ -121,9 +151,14 @@ type Subvolume struct {
 	// SnapshotRetentionInterval is the interval for which snapshots will be retained in
 	// the snapshot_retention. If left unset either the volume or global value is used respectively.
 	SnapshotRetentionInterval time.Duration `mapstructure:"snapshot_retention_interval" toml:"snapshot_retention_interval,omitempty"`
+	// Retention is the retention policy for snapshots for this subvolume. If left unset
+	// either the volume or global value is used respectively.
+	Retention *RetentionPolicy `mapstructure:"retention" toml:"retention,omitempty"`
 	// TimeFormat is the time format for snapshots for this subvolume. If left unset either
 	// the volume or global value is used respectively.
 	TimeFormat string `mapstructure:"time_format" toml:"time_format,omitempty"`
+	// Hooks are run for this subvolume, after the global and volume hooks.
+	Hooks *Hooks `mapstructure:"hooks" toml:"hooks,omitempty"`
 	// Mirrors is a list of mirror names to sync snapshots to. Automatically includes the
 	// volume mirrors.
 	Mirrors []string `mapstructure:"mirrors" toml:"mirrors,omitempty"`
@@ -155,6 +190,70 @@ type Mirror struct {
 	// SSHHostKey is the host key to use for SSH connections to this mirror. If left unset,
 	// the global value is used.
 	SSHHostKey string `mapstructure:"ssh_host_key" toml:"ssh_host_key,omitempty"`
+	// UseSFTP is a flag to write ssh:// directory mirrors over the SFTP subsystem instead
+	// of running coreutils commands on the remote host. This is much faster for large files.
+	UseSFTP bool `mapstructure:"use_sftp" toml:"use_sftp,omitempty"`
+	// Catalog is a flag to index the files of every snapshot sent to this mirror in a
+	// catalog database, so they can be searched without mounting or receiving anything.
+	Catalog bool `mapstructure:"catalog" toml:"catalog,omitempty"`
+	// CatalogPath is the local directory holding the catalogs of this mirror. It defaults
+	// to the mirror path for local mirrors and is required for remote mirrors.
+	CatalogPath string `mapstructure:"catalog_path" toml:"catalog_path,omitempty"`
+	// CatalogHashes is a flag to record the SHA-256 of file contents in the catalog.
+	CatalogHashes bool `mapstructure:"catalog_hashes" toml:"catalog_hashes,omitempty"`
+	// EncryptionKeys are references to the keys used to encrypt snapshots sent to this
+	// mirror, in the form file:<path>, env:<variable> or command:<command>. The first key
+	// encrypts new data and every key can decrypt existing data, so keys are rotated by
+	// adding a new key in front of the old ones. Only compressed and repository formats
+	// support encryption.
+	EncryptionKeys []string `mapstructure:"encryption_keys" toml:"encryption_keys,omitempty"`
+	// SigningKey is a reference to an ed25519 private key used to sign the manifests of
+	// snapshots sent to compressed mirrors, in the same form as EncryptionKeys. The key
+	// is the 32 byte seed or the 64 byte private key, raw or hex or base64 encoded.
+	SigningKey string `mapstructure:"signing_key" toml:"signing_key,omitempty"`
+	// FullSendInterval is how often snapshots sent to compressed mirrors start a new
+	// chain with a full send. Snapshots in between are sent incrementally to the snapshot
+	// mirrored before them. If left unset, every snapshot is sent in full.
+	FullSendInterval Duration `mapstructure:"full_send_interval" toml:"full_send_interval,omitempty"`
+	// Retention is the retention policy of the snapshots on this mirror. It is applied
+	// to the mirror independently of the source, so a mirror can keep more history than
+	// the source does. Snapshots it does not keep are not sent, and the newest snapshot
+	// the mirror shares with the source is always kept as the next incremental parent.
+	// If left unset, the mirror keeps exactly the snapshots that exist on the source.
+	Retention *RetentionPolicy `mapstructure:"retention" toml:"retention,omitempty"`
+	// MaxParentHold is how long the newest snapshot this mirror received is held back
+	// from local pruning while the mirror is not syncing, so that it can continue with an
+	// incremental send. Once the mirror has not synced for longer, the snapshot is
+	// released with a warning and the mirror needs a full send. If left unset, the
+	// snapshot is held until the mirror syncs again.
+	MaxParentHold Duration `mapstructure:"max_parent_hold" toml:"max_parent_hold,omitempty"`
+	// Hooks are run when subvolumes are synced to this mirror, after the global, volume
+	// and subvolume hooks. Only the pre_sync and post_sync hooks apply to mirrors.
+	Hooks *Hooks `mapstructure:"hooks" toml:"hooks,omitempty"`
+	// WriteCoalescing is the size in KiB that adjacent writes to a file are buffered up
+	// to before they are written to local directory and subvolume mirrors. This speeds
+	// up streams with many small writes. If left unset, every write is made as received.
+	WriteCoalescing int `mapstructure:"write_coalescing" toml:"write_coalescing,omitempty"`
+	// SyncOnClose is a flag to sync every file written to local directory and subvolume
+	// mirrors to disk once a snapshot is received, before it is marked as received.
+	SyncOnClose bool `mapstructure:"sync_on_close" toml:"sync_on_close,omitempty"`
+	// S3Endpoint is the URL of the S3-compatible service of s3:// mirrors. If left unset,
+	// AWS is used. Buckets are addressed in the path when an endpoint is set.
+	S3Endpoint string `mapstructure:"s3_endpoint" toml:"s3_endpoint,omitempty"`
+	// S3Region is the region of s3:// mirrors. If left unset, defaults to the AWS_REGION
+	// environment variable or us-east-1.
+	S3Region string `mapstructure:"s3_region" toml:"s3_region,omitempty"`
+	// S3AccessKeyID is the access key of s3:// mirrors. If left unset, the
+	// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables are used.
+	S3AccessKeyID string `mapstructure:"s3_access_key_id" toml:"s3_access_key_id,omitempty"`
+	// S3SecretAccessKey is the secret key of s3:// mirrors.
+	S3SecretAccessKey string `mapstructure:"s3_secret_access_key" toml:"s3_secret_access_key,omitempty"`
+	// S3StorageClass is the storage class of snapshots sent to s3:// mirrors, such as
+	// STANDARD_IA or GLACIER. If left unset, the default of the bucket is used.
+	S3StorageClass string `mapstructure:"s3_storage_class" toml:"s3_storage_class,omitempty"`
+	// S3PartSize is the size in MiB of the parts snapshots are uploaded in to s3://
+	// mirrors. Interrupted uploads resume from the last complete part. Defaults to 64.
+	S3PartSize int `mapstructure:"s3_part_size" toml:"s3_part_size,omitempty"`
 	// Disabled is a flag to disable managing this mirror temporarily.
 	Disabled bool `mapstructure:"disabled" toml:"disabled,omitempty"`
 }
@@ -177,6 +276,18 @@ const (
 	// atomic snapshots. The most recent snapshot's contents will be stored
 	// in the mirror path and retention settings will be ignored.
 	MirrorFormatDirectory MirrorFormat = "directory"
+	// MirrorFormatVersionedDirectory is the versioned directory format. This
+	// format is compatible with all filesystems that support hardlinks. Each
+	// snapshot is stored in its own directory named after the snapshot's
+	// timestamp, with files that did not change hardlinked to the previous
+	// snapshot. Expired snapshots are pruned from the mirror. Only local
+	// mirrors are currently supported.
+	MirrorFormatVersionedDirectory MirrorFormat = "versioned-directory"
+	// MirrorFormatRepository is the deduplicating repository format. This format
+	// is compatible with all filesystems. Snapshots are sent in stream format and
+	// split into content-defined chunks, which are stored once in a repository
+	// at the mirror path that can be shared by any number of subvolumes.
+	MirrorFormatRepository MirrorFormat = "repository"
 	// // MirrorFormatZfs is the ZFS format. This format is compatible with
 	// // ZFS filesystems. ZFS snapshots are used to create atomic snapshots
 	// // of the subvolume and are stored in the mirror path.
@@ -199,6 +310,11 @@ const (
 	MirrorFormatZstd MirrorFormat = "zstd"
 )
 
+// SupportsEncryption returns true if snapshots in this format can be encrypted.
+func (m MirrorFormat) SupportsEncryption() bool {
+	return m.IsCompressed() || m == MirrorFormatRepository
+}
+
 func (m MirrorFormat) IsCompressed() bool {
 	switch m {
 	case MirrorFormatGzip, MirrorFormatLzw, MirrorFormatZlib, MirrorFormatZstd:
@@ -207,6 +323,10 @@ func (m MirrorFormat) IsCompressed() bool {
 	return false
 }
 
+func (m MirrorFormat) IsSubvolume() bool {
+	return m == MirrorFormatSubvolume || m == ""
+}
+
 type Duration time.Duration
 
 func (d *Duration) Type() string {
@@ -301,6 +421,31 @@ func NewDefaultConfig() Config {
 }
 
 func (c Config) Validate() error {
+	if c.Retention != nil {
+		if err := c.Retention.Validate(); err != nil {
+			return fmt.Errorf("invalid global retention: %w", err)
+		}
+	}
+	if c.Hooks != nil {
+		if err := c.Hooks.Validate(); err != nil {
+			return fmt.Errorf("invalid global hooks: %w", err)
+		}
+	}
+	for _, mirror := range c.Mirrors {
+		if mirror.Retention != nil {
+			if err := mirror.Retention.Validate(); err != nil {
+				return fmt.Errorf("invalid retention for mirror %s: %w", mirror.Name, err)
+			}
+		}
+		if mirror.WriteCoalescing < 0 {
+			return fmt.Errorf("write coalescing for mirror %s cannot be negative", mirror.Name)
+		}
+		if mirror.Hooks != nil {
+			if err := mirror.Hooks.ValidateMirror(); err != nil {
+				return fmt.Errorf("invalid hooks for mirror %s: %w", mirror.Name, err)
+			}
+		}
+	}
 	var volNames []string
 	for _, volume := range c.Volumes {
 		if !isUnique(volNames, volume.GetName()) {
@@ -360,6 +505,11 @@ func (v Volume) Validate() error {
 	if v.Path == "" {
 		return fmt.Errorf("volume path is required")
 	}
+	if v.Hooks != nil {
+		if err := v.Hooks.Validate(); err != nil {
+			return fmt.Errorf("invalid hooks for volume %s: %w", v.GetName(), err)
+		}
+	}
 	return nil
 }
 
@@ -375,15 +525,29 @@ func (c Config) ValidateSubvolume(vol Volume, subvol Subvolume) error {
 		return fmt.Errorf("subvolume path is required")
 	}
 	snapshotDir := c.ResolveSnapshotPath(volName, subvolName)
+	if snapshotDir == "" {
+		return fmt.Errorf("snapshot directory required for subvolume %s:%s", volName, subvolName)
+	}
+	if subvol.Hooks != nil {
+		if err := subvol.Hooks.Validate(); err != nil {
+			return fmt.Errorf("invalid hooks for subvolume %s:%s: %w", volName, subvolName, err)
+		}
+	}
+	if c.ResolveSnapshotMaxAge(volName, subvolName) < 0 {
+		return fmt.Errorf("snapshot max age cannot be negative for subvolume %s:%s", volName, subvolName)
+	}
+	if policy := c.configuredRetention(volName, subvolName); policy != nil {
+		if err := policy.Validate(); err != nil {
+			return fmt.Errorf("invalid retention for subvolume %s:%s: %w", volName, subvolName, err)
+		}
+		return nil
+	}
+
 	snapshotInterval := c.ResolveSnapshotInterval(volName, subvolName)
 	snapshotMinRetention := c.ResolveSnapshotMinimumRetention(volName, subvolName)
 	snapshotRetention := c.ResolveSnapshotRetention(volName, subvolName)
 	snapshotRetentionInterval := c.ResolveSnapshotRetentionInterval(volName, subvolName)
 
-	if snapshotDir == "" {
-		return fmt.Errorf("snapshot directory required for subvolume %s:%s", volName, subvolName)
-	}
-
 	if snapshotInterval >= snapshotMinRetention {
 		return fmt.Errorf("snapshot interval must be less than minimum retention for subvolume %s:%s", volName, subvolName)
 	}
@@ -466,6 +630,37 @@ func (c Config) ResolveSnapshotInterval(vol, subvol string) (interval time.Durat
 	return
 }
 
+func (c Config) ResolveSnapshotSkipUnchanged(vol, subvol string) bool {
+	v := c.GetVolume(vol)
+	if v == nil {
+		return false
+	}
+	s := v.GetSubvolume(subvol)
+	if s == nil {
+		return false
+	}
+	return s.SnapshotSkipUnchanged || v.SnapshotSkipUnchanged || c.SnapshotSkipUnchanged
+}
+
+func (c Config) ResolveSnapshotMaxAge(vol, subvol string) (age time.Duration) {
+	v := c.GetVolume(vol)
+	if v == nil {
+		return
+	}
+	s := v.GetSubvolume(subvol)
+	if s == nil {
+		return
+	}
+	if s.SnapshotMaxAge != 0 {
+		age = s.SnapshotMaxAge
+	} else if v.SnapshotMaxAge != 0 {
+		age = v.SnapshotMaxAge
+	} else {
+		age = time.Duration(c.SnapshotMaxAge)
+	}
+	return
+}
+
 func (c Config) ResolveSnapshotMinimumRetention(vol, subvol string) (retention time.Duration) {
 	v := c.GetVolume(vol)
 	if v == nil {
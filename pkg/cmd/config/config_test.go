@@ -0,0 +1,89 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveSkipUnchanged(t *testing.T) {
+	tests := []struct {
+		name        string
+		global      Config
+		vol         Volume
+		subvol      Subvolume
+		wantSkip    bool
+		wantMaxAge  time.Duration
+		wantInvalid bool
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:       "global",
+			global:     Config{SnapshotSkipUnchanged: true, SnapshotMaxAge: Duration(time.Hour)},
+			wantSkip:   true,
+			wantMaxAge: time.Hour,
+		},
+		{
+			name:       "volume overrides the global maximum age",
+			global:     Config{SnapshotMaxAge: Duration(time.Hour)},
+			vol:        Volume{SnapshotSkipUnchanged: true, SnapshotMaxAge: 2 * time.Hour},
+			wantSkip:   true,
+			wantMaxAge: 2 * time.Hour,
+		},
+		{
+			name:       "subvolume overrides the volume maximum age",
+			vol:        Volume{SnapshotMaxAge: 2 * time.Hour},
+			subvol:     Subvolume{SnapshotSkipUnchanged: true, SnapshotMaxAge: 3 * time.Hour},
+			wantSkip:   true,
+			wantMaxAge: 3 * time.Hour,
+		},
+		{
+			name:        "negative maximum age",
+			subvol:      Subvolume{SnapshotMaxAge: -time.Hour},
+			wantMaxAge:  -time.Hour,
+			wantInvalid: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.global
+			vol := tc.vol
+			vol.Path = "/mnt/data"
+			subvol := tc.subvol
+			subvol.Path = "home"
+			vol.Subvolumes = []Subvolume{subvol}
+			cfg.Volumes = []Volume{vol}
+			if got := cfg.ResolveSnapshotSkipUnchanged("data", "home"); got != tc.wantSkip {
+				t.Errorf("skip unchanged is %v, want %v", got, tc.wantSkip)
+			}
+			if got := cfg.ResolveSnapshotMaxAge("data", "home"); got != tc.wantMaxAge {
+				t.Errorf("maximum age is %s, want %s", got, tc.wantMaxAge)
+			}
+			err := cfg.ValidateSubvolume(vol, subvol)
+			if !tc.wantInvalid {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), "snapshot max age cannot be negative") {
+				t.Errorf("got error %v, want negative maximum age", err)
+			}
+		})
+	}
+}
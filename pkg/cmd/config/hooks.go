@@ -0,0 +1,174 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// HookEvent is the point at which hooks are run.
+type HookEvent string
+
+const (
+	// HookPreSnapshot hooks run before a snapshot of a subvolume is created.
+	HookPreSnapshot HookEvent = "pre_snapshot"
+	// HookPostSnapshot hooks run after a snapshot was created, or failed to be created,
+	// including when a pre_snapshot hook failed.
+	HookPostSnapshot HookEvent = "post_snapshot"
+	// HookPreSync hooks run before snapshots are synced to a mirror.
+	HookPreSync HookEvent = "pre_sync"
+	// HookPostSync hooks run after a mirror finished syncing, whether it succeeded or not.
+	HookPostSync HookEvent = "post_sync"
+)
+
+// HookFailurePolicy is what happens when a hook fails.
+type HookFailurePolicy string
+
+const (
+	// HookFailureAbort stops the operation the hook runs for. A failed pre_snapshot
+	// hook skips the snapshot, and a failed pre_sync hook skips the mirror. This is the
+	// default policy.
+	HookFailureAbort HookFailurePolicy = "abort"
+	// HookFailureWarn logs the failure and carries on.
+	HookFailureWarn HookFailurePolicy = "warn"
+)
+
+// DefaultHookTimeout is how long hooks may run for when no timeout is configured.
+var DefaultHookTimeout = Duration(5 * time.Minute)
+
+// Hooks are shell commands run before and after snapshots are created and mirrors are
+// synced. Commands are run with /bin/sh and the operation is described to them in
+// BTRSYNC_* environment variables.
+type Hooks struct {
+	// PreSnapshot are the commands to run before a snapshot is created.
+	PreSnapshot []string `mapstructure:"pre_snapshot" toml:"pre_snapshot,omitempty"`
+	// PostSnapshot are the commands to run after a snapshot is created.
+	PostSnapshot []string `mapstructure:"post_snapshot" toml:"post_snapshot,omitempty"`
+	// PreSync are the commands to run before a mirror is synced.
+	PreSync []string `mapstructure:"pre_sync" toml:"pre_sync,omitempty"`
+	// PostSync are the commands to run after a mirror is synced.
+	PostSync []string `mapstructure:"post_sync" toml:"post_sync,omitempty"`
+	// Timeout is how long each command may run before it is killed and considered
+	// failed. Defaults to 5 minutes.
+	Timeout Duration `mapstructure:"timeout" toml:"timeout,omitempty"`
+	// OnFailure is what happens when a command fails, either "abort" or "warn".
+	// Defaults to "abort".
+	OnFailure HookFailurePolicy `mapstructure:"on_failure" toml:"on_failure,omitempty"`
+}
+
+// Validate returns an error if the hooks have an invalid timeout or failure policy.
+func (h Hooks) Validate() error {
+	if h.Timeout < 0 {
+		return errors.New("hook timeout cannot be negative")
+	}
+	switch h.OnFailure {
+	case "", HookFailureAbort, HookFailureWarn:
+	default:
+		return fmt.Errorf("invalid hook failure policy %q, expected abort or warn", h.OnFailure)
+	}
+	return nil
+}
+
+// ValidateMirror returns an error if the hooks are invalid or have snapshot hooks,
+// which are not run for mirrors.
+func (h Hooks) ValidateMirror() error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	if len(h.PreSnapshot) > 0 || len(h.PostSnapshot) > 0 {
+		return errors.New("only pre_sync and post_sync hooks can be set on mirrors")
+	}
+	return nil
+}
+
+// Commands returns the commands of the hooks for an event.
+func (h Hooks) Commands(event HookEvent) []string {
+	switch event {
+	case HookPreSnapshot:
+		return h.PreSnapshot
+	case HookPostSnapshot:
+		return h.PostSnapshot
+	case HookPreSync:
+		return h.PreSync
+	case HookPostSync:
+		return h.PostSync
+	}
+	return nil
+}
+
+// Hook is a single resolved hook command.
+type Hook struct {
+	// Event is when the command runs.
+	Event HookEvent
+	// Command is the shell command to run.
+	Command string
+	// Timeout is how long the command may run for.
+	Timeout time.Duration
+	// OnFailure is what happens when the command fails.
+	OnFailure HookFailurePolicy
+}
+
+// ResolveHooks returns the hooks of a subvolume for every event. The global hooks come
+// first, followed by the hooks of the volume and the subvolume. When a mirror is named,
+// its sync hooks are appended last. Snapshot hooks of mirrors are never returned.
+func (c Config) ResolveHooks(vol, subvol, mirror string) []Hook {
+	v := c.GetVolume(vol)
+	if v == nil {
+		return nil
+	}
+	s := v.GetSubvolume(subvol)
+	if s == nil {
+		return nil
+	}
+	levels := []*Hooks{c.Hooks, v.Hooks, s.Hooks}
+	if mirror != "" {
+		if m := c.GetMirror(mirror); m != nil && m.Hooks != nil {
+			levels = append(levels, &Hooks{
+				PreSync:   m.Hooks.PreSync,
+				PostSync:  m.Hooks.PostSync,
+				Timeout:   m.Hooks.Timeout,
+				OnFailure: m.Hooks.OnFailure,
+			})
+		}
+	}
+	var hooks []Hook
+	for _, event := range []HookEvent{HookPreSnapshot, HookPostSnapshot, HookPreSync, HookPostSync} {
+		for _, h := range levels {
+			if h == nil {
+				continue
+			}
+			timeout := h.Timeout
+			if timeout == 0 {
+				timeout = DefaultHookTimeout
+			}
+			onFailure := h.OnFailure
+			if onFailure == "" {
+				onFailure = HookFailureAbort
+			}
+			for _, command := range h.Commands(event) {
+				hooks = append(hooks, Hook{
+					Event:     event,
+					Command:   command,
+					Timeout:   time.Duration(timeout),
+					OnFailure: onFailure,
+				})
+			}
+		}
+	}
+	return hooks
+}
@@ -0,0 +1,203 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHooksValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		hooks   Hooks
+		mirror  bool
+		wantErr string
+	}{
+		{
+			name:  "defaults",
+			hooks: Hooks{PreSnapshot: []string{"true"}},
+		},
+		{
+			name:  "warn policy and timeout",
+			hooks: Hooks{PostSync: []string{"true"}, Timeout: Duration(time.Minute), OnFailure: HookFailureWarn},
+		},
+		{
+			name:    "negative timeout",
+			hooks:   Hooks{Timeout: Duration(-time.Second)},
+			wantErr: "hook timeout cannot be negative",
+		},
+		{
+			name:    "unknown failure policy",
+			hooks:   Hooks{OnFailure: "ignore"},
+			wantErr: `invalid hook failure policy "ignore"`,
+		},
+		{
+			name:   "sync hooks on a mirror",
+			hooks:  Hooks{PreSync: []string{"true"}, PostSync: []string{"true"}},
+			mirror: true,
+		},
+		{
+			name:    "pre_snapshot hooks on a mirror",
+			hooks:   Hooks{PreSnapshot: []string{"true"}},
+			mirror:  true,
+			wantErr: "only pre_sync and post_sync hooks can be set on mirrors",
+		},
+		{
+			name:    "post_snapshot hooks on a mirror",
+			hooks:   Hooks{PostSnapshot: []string{"true"}},
+			mirror:  true,
+			wantErr: "only pre_sync and post_sync hooks can be set on mirrors",
+		},
+		{
+			name:    "invalid mirror hooks",
+			hooks:   Hooks{OnFailure: "ignore"},
+			mirror:  true,
+			wantErr: `invalid hook failure policy "ignore"`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			validate := tc.hooks.Validate
+			if tc.mirror {
+				validate = tc.hooks.ValidateMirror
+			}
+			err := validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveHooks(t *testing.T) {
+	cfg := Config{
+		Hooks: &Hooks{
+			PreSnapshot: []string{"global-pre-snapshot"},
+			PostSync:    []string{"global-post-sync"},
+		},
+		Volumes: []Volume{
+			{
+				Path: "/mnt/data",
+				Hooks: &Hooks{
+					PreSnapshot: []string{"volume-pre-snapshot-1", "volume-pre-snapshot-2"},
+					PreSync:     []string{"volume-pre-sync"},
+					Timeout:     Duration(time.Minute),
+					OnFailure:   HookFailureWarn,
+				},
+				Subvolumes: []Subvolume{
+					{
+						Path: "home",
+						Hooks: &Hooks{
+							PreSnapshot:  []string{"subvolume-pre-snapshot"},
+							PostSnapshot: []string{"subvolume-post-snapshot"},
+						},
+					},
+					{Path: "var"},
+				},
+			},
+		},
+		Mirrors: []Mirror{
+			{
+				Name: "backup",
+				Hooks: &Hooks{
+					// Rejected by validation, and never run when set anyway
+					PreSnapshot: []string{"mirror-pre-snapshot"},
+					PreSync:     []string{"mirror-pre-sync"},
+					Timeout:     Duration(time.Second),
+				},
+			},
+			{Name: "plain"},
+		},
+	}
+	hook := func(event HookEvent, command string, timeout time.Duration, onFailure HookFailurePolicy) Hook {
+		return Hook{Event: event, Command: command, Timeout: timeout, OnFailure: onFailure}
+	}
+	def := time.Duration(DefaultHookTimeout)
+	tests := []struct {
+		name                string
+		vol, subvol, mirror string
+		want                []Hook
+	}{
+		{
+			name:   "subvolume hooks follow the global and volume hooks",
+			vol:    "data",
+			subvol: "home",
+			want: []Hook{
+				hook(HookPreSnapshot, "global-pre-snapshot", def, HookFailureAbort),
+				hook(HookPreSnapshot, "volume-pre-snapshot-1", time.Minute, HookFailureWarn),
+				hook(HookPreSnapshot, "volume-pre-snapshot-2", time.Minute, HookFailureWarn),
+				hook(HookPreSnapshot, "subvolume-pre-snapshot", def, HookFailureAbort),
+				hook(HookPostSnapshot, "subvolume-post-snapshot", def, HookFailureAbort),
+				hook(HookPreSync, "volume-pre-sync", time.Minute, HookFailureWarn),
+				hook(HookPostSync, "global-post-sync", def, HookFailureAbort),
+			},
+		},
+		{
+			name:   "mirror sync hooks come last",
+			vol:    "data",
+			subvol: "var",
+			mirror: "backup",
+			want: []Hook{
+				hook(HookPreSnapshot, "global-pre-snapshot", def, HookFailureAbort),
+				hook(HookPreSnapshot, "volume-pre-snapshot-1", time.Minute, HookFailureWarn),
+				hook(HookPreSnapshot, "volume-pre-snapshot-2", time.Minute, HookFailureWarn),
+				hook(HookPreSync, "volume-pre-sync", time.Minute, HookFailureWarn),
+				hook(HookPreSync, "mirror-pre-sync", time.Second, HookFailureAbort),
+				hook(HookPostSync, "global-post-sync", def, HookFailureAbort),
+			},
+		},
+		{
+			name:   "mirror without hooks",
+			vol:    "data",
+			subvol: "var",
+			mirror: "plain",
+			want: []Hook{
+				hook(HookPreSnapshot, "global-pre-snapshot", def, HookFailureAbort),
+				hook(HookPreSnapshot, "volume-pre-snapshot-1", time.Minute, HookFailureWarn),
+				hook(HookPreSnapshot, "volume-pre-snapshot-2", time.Minute, HookFailureWarn),
+				hook(HookPreSync, "volume-pre-sync", time.Minute, HookFailureWarn),
+				hook(HookPostSync, "global-post-sync", def, HookFailureAbort),
+			},
+		},
+		{
+			name:   "unknown volume",
+			vol:    "other",
+			subvol: "home",
+		},
+		{
+			name:   "unknown subvolume",
+			vol:    "data",
+			subvol: "other",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := cfg.ResolveHooks(tc.vol, tc.subvol, tc.mirror)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got hooks %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
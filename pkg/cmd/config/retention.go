@@ -0,0 +1,170 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy is a grandfather-father-son retention policy. Snapshots are grouped
+// into calendar-aligned hours, days, weeks, months and years, and the newest snapshot
+// in each of the most recent groups is kept. Only groups that contain a snapshot are
+// counted, so a policy keeps the same history after a period without snapshots.
+type RetentionPolicy struct {
+	// KeepWithin keeps every snapshot taken within this duration.
+	KeepWithin Duration `mapstructure:"keep_within" toml:"keep_within,omitempty"`
+	// Hourly is the number of hours to keep the newest snapshot of.
+	Hourly int `mapstructure:"hourly" toml:"hourly,omitempty"`
+	// Daily is the number of days to keep the newest snapshot of.
+	Daily int `mapstructure:"daily" toml:"daily,omitempty"`
+	// Weekly is the number of ISO weeks to keep the newest snapshot of.
+	Weekly int `mapstructure:"weekly" toml:"weekly,omitempty"`
+	// Monthly is the number of months to keep the newest snapshot of.
+	Monthly int `mapstructure:"monthly" toml:"monthly,omitempty"`
+	// Yearly is the number of years to keep the newest snapshot of.
+	Yearly int `mapstructure:"yearly" toml:"yearly,omitempty"`
+}
+
+// Validate returns an error if the policy has negative counts or keeps nothing.
+func (r RetentionPolicy) Validate() error {
+	if r.KeepWithin < 0 || r.Hourly < 0 || r.Daily < 0 || r.Weekly < 0 || r.Monthly < 0 || r.Yearly < 0 {
+		return errors.New("retention values cannot be negative")
+	}
+	if r.KeepWithin == 0 && r.Hourly == 0 && r.Daily == 0 && r.Weekly == 0 && r.Monthly == 0 && r.Yearly == 0 {
+		return errors.New("retention policy does not keep any snapshots")
+	}
+	return nil
+}
+
+func (r RetentionPolicy) String() string {
+	s := fmt.Sprintf("hourly=%d daily=%d weekly=%d monthly=%d yearly=%d", r.Hourly, r.Daily, r.Weekly, r.Monthly, r.Yearly)
+	if r.KeepWithin > 0 {
+		s = fmt.Sprintf("keep_within=%s %s", r.KeepWithin, s)
+	}
+	return s
+}
+
+// ParseRetentionPolicy parses a policy written as comma-separated settings, such as
+// "keep_within=24h,daily=7,weekly=4,monthly=12".
+func ParseRetentionPolicy(s string) (RetentionPolicy, error) {
+	var policy RetentionPolicy
+	for _, setting := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(setting), "=")
+		if !ok {
+			return policy, fmt.Errorf("invalid retention setting %q, expected key=value", setting)
+		}
+		if key == "keep_within" {
+			if err := policy.KeepWithin.Set(value); err != nil {
+				return policy, fmt.Errorf("invalid keep_within: %w", err)
+			}
+			continue
+		}
+		var count *int
+		switch key {
+		case "hourly":
+			count = &policy.Hourly
+		case "daily":
+			count = &policy.Daily
+		case "weekly":
+			count = &policy.Weekly
+		case "monthly":
+			count = &policy.Monthly
+		case "yearly":
+			count = &policy.Yearly
+		default:
+			return policy, fmt.Errorf("unknown retention setting %q", key)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return policy, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*count = n
+	}
+	return policy, policy.Validate()
+}
+
+// retentionUnits are the calendar groups legacy retention intervals are mapped to,
+// with their approximate and longest lengths.
+var retentionUnits = []struct {
+	length  time.Duration
+	longest time.Duration
+	count   func(*RetentionPolicy) *int
+}{
+	{time.Hour, time.Hour, func(r *RetentionPolicy) *int { return &r.Hourly }},
+	{24 * time.Hour, 24 * time.Hour, func(r *RetentionPolicy) *int { return &r.Daily }},
+	{7 * 24 * time.Hour, 7 * 24 * time.Hour, func(r *RetentionPolicy) *int { return &r.Weekly }},
+	{730 * time.Hour, 31 * 24 * time.Hour, func(r *RetentionPolicy) *int { return &r.Monthly }},
+	{8760 * time.Hour, 366 * 24 * time.Hour, func(r *RetentionPolicy) *int { return &r.Yearly }},
+}
+
+// LegacyRetentionPolicy returns the policy equivalent to the snapshot_min_retention,
+// snapshot_retention and snapshot_retention_interval settings. Every snapshot within
+// the minimum retention is kept, and one snapshot per calendar group is kept for the
+// retention period. The group is the largest that is never longer than the interval,
+// so the policy never keeps fewer snapshots than the interval did. Intervals shorter
+// than an hour keep every snapshot within the retention period.
+func LegacyRetentionPolicy(minRetention, retention, interval time.Duration) RetentionPolicy {
+	if interval < retentionUnits[0].longest {
+		if minRetention > retention {
+			retention = minRetention
+		}
+		return RetentionPolicy{KeepWithin: Duration(retention)}
+	}
+	policy := RetentionPolicy{KeepWithin: Duration(minRetention)}
+	unit := retentionUnits[0]
+	for _, u := range retentionUnits {
+		if u.longest <= interval {
+			unit = u
+		}
+	}
+	*unit.count(&policy) = int((retention + unit.length - 1) / unit.length)
+	return policy
+}
+
+// ResolveRetention returns the retention policy of the local snapshots of a subvolume.
+// A policy set on the subvolume, volume or globally is used in that order, otherwise
+// the policy is derived from the snapshot_retention settings.
+func (c Config) ResolveRetention(vol, subvol string) RetentionPolicy {
+	if policy := c.configuredRetention(vol, subvol); policy != nil {
+		return *policy
+	}
+	return LegacyRetentionPolicy(
+		c.ResolveSnapshotMinimumRetention(vol, subvol),
+		c.ResolveSnapshotRetention(vol, subvol),
+		c.ResolveSnapshotRetentionInterval(vol, subvol),
+	)
+}
+
+func (c Config) configuredRetention(vol, subvol string) *RetentionPolicy {
+	v := c.GetVolume(vol)
+	if v == nil {
+		return nil
+	}
+	s := v.GetSubvolume(subvol)
+	if s == nil {
+		return nil
+	}
+	if s.Retention != nil {
+		return s.Retention
+	} else if v.Retention != nil {
+		return v.Retention
+	}
+	return c.Retention
+}
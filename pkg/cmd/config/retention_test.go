@@ -0,0 +1,113 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLegacyRetentionPolicy(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		name                              string
+		minRetention, retention, interval time.Duration
+		want                              RetentionPolicy
+	}{
+		{
+			name:      "no interval keeps everything within the retention",
+			retention: 7 * day,
+			want:      RetentionPolicy{KeepWithin: Duration(7 * day)},
+		},
+		{
+			name:         "sub-hour interval keeps everything within the retention",
+			minRetention: day,
+			retention:    2 * day,
+			interval:     30 * time.Minute,
+			want:         RetentionPolicy{KeepWithin: Duration(2 * day)},
+		},
+		{
+			name:         "sub-hour interval keeps the longer minimum retention",
+			minRetention: 3 * day,
+			retention:    2 * day,
+			interval:     30 * time.Minute,
+			want:         RetentionPolicy{KeepWithin: Duration(3 * day)},
+		},
+		{
+			name:      "hourly",
+			retention: day,
+			interval:  time.Hour,
+			want:      RetentionPolicy{Hourly: 24},
+		},
+		{
+			name:      "between hours and days maps to hours",
+			retention: day,
+			interval:  20 * time.Hour,
+			want:      RetentionPolicy{Hourly: 24},
+		},
+		{
+			name:         "daily",
+			minRetention: day,
+			retention:    30 * day,
+			interval:     day,
+			want:         RetentionPolicy{KeepWithin: Duration(day), Daily: 30},
+		},
+		{
+			name:      "six days maps to days",
+			retention: 28 * day,
+			interval:  6 * day,
+			want:      RetentionPolicy{Daily: 28},
+		},
+		{
+			name:      "weekly",
+			retention: 28 * day,
+			interval:  7 * day,
+			want:      RetentionPolicy{Weekly: 4},
+		},
+		{
+			name:      "thirty days maps to weeks",
+			retention: 90 * day,
+			interval:  30 * day,
+			want:      RetentionPolicy{Weekly: 13},
+		},
+		{
+			name:      "monthly",
+			retention: 365 * day,
+			interval:  31 * day,
+			want:      RetentionPolicy{Monthly: 12},
+		},
+		{
+			name:      "one year maps to months",
+			retention: 730 * day,
+			interval:  365 * day,
+			want:      RetentionPolicy{Monthly: 24},
+		},
+		{
+			name:      "yearly",
+			retention: 5 * 365 * day,
+			interval:  366 * day,
+			want:      RetentionPolicy{Yearly: 5},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := LegacyRetentionPolicy(tc.minRetention, tc.retention, tc.interval)
+			if got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
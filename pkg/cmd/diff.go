@@ -0,0 +1,129 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/receive"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/changes"
+)
+
+var (
+	diffOutput  string
+	diffNoTimes bool
+)
+
+func NewDiffCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff [flags] <snapshotA> <snapshotB>",
+		Short: "Show the paths changed between two snapshots",
+		Long: `Show the paths changed between two snapshots.
+
+Snapshot B is sent incrementally from snapshot A without any file data, and the
+stream is interpreted into a list of added, modified, deleted and renamed paths, as
+well as paths where only metadata changed. Both snapshots must be read-only.`,
+		Args: cobra.ExactArgs(2),
+		RunE: runDiff,
+	}
+	cmd.Flags().StringVarP(&diffOutput, "output", "o", "text", "output format (text or json)")
+	cmd.Flags().BoolVar(&diffNoTimes, "no-times", false, "omit paths where only timestamps changed")
+	return cmd
+}
+
+func runDiff(cmd *cobra.Command, args []string) error {
+	if diffOutput != "text" && diffOutput != "json" {
+		return fmt.Errorf("invalid output format %q", diffOutput)
+	}
+	snapA, snapB := args[0], args[1]
+	for _, snap := range []string{snapA, snapB} {
+		readonly, err := btrfs.IsSubvolumeReadOnly(snap)
+		if err != nil {
+			return err
+		}
+		if !readonly {
+			return fmt.Errorf("%s is not a read-only snapshot", snap)
+		}
+	}
+	logLevel(1, "Comparing %s to %s", snapB, snapA)
+	streamOpt, stream, err := btrfs.SendToPipe()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- btrfs.Send(snapB,
+			streamOpt,
+			btrfs.SendWithParentRoot(snapA),
+			btrfs.SendWithoutData(),
+			btrfs.SendWithLogger(log.New(os.Stderr, "[send]", log.LstdFlags|log.Lshortfile), conf.Verbosity),
+		)
+	}()
+	rcvr := changes.New()
+	err = receive.ProcessSendStream(stream,
+		receive.WithLogger(logger, conf.Verbosity),
+		receive.HonorEndCommand(),
+		receive.To(rcvr),
+	)
+	if err != nil {
+		return fmt.Errorf("error processing send stream: %w", err)
+	}
+	if err := <-errCh; err != nil {
+		return err
+	}
+	var report []*changes.Change
+	for _, change := range rcvr.Changes() {
+		if diffNoTimes && change.OnlyTimes() {
+			continue
+		}
+		report = append(report, change)
+	}
+	if diffOutput == "json" {
+		if report == nil {
+			report = []*changes.Change{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	for _, change := range report {
+		p := change.Path
+		if change.Kind == changes.Renamed {
+			p = change.OldPath + " -> " + change.Path
+		}
+		var details []string
+		if change.Content && change.Kind == changes.Renamed {
+			details = append(details, "content")
+		}
+		details = append(details, change.Metadata...)
+		if change.LinkTo != "" {
+			details = append(details, "link to "+change.LinkTo)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", change.Kind, p, strings.Join(details, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/syncmanager"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/catalog"
+)
+
+var (
+	findSince   string
+	findUntil   string
+	findRegex   bool
+	findMirror  string
+	findHistory string
+)
+
+func NewFindCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "find [flags] <volume:subvolume> [<glob|regex>]",
+		Short: "Find files across the snapshots of a subvolume",
+		Long: `Find files across the snapshots of a subvolume.
+
+Every snapshot containing paths that match the pattern is listed along with the size
+and modification time of each match. Glob patterns containing a slash are matched
+against the full path inside the snapshot, otherwise against the file name. With
+--regex the pattern is a regular expression matched against the full path.
+
+With --history the pattern is replaced by a single path, and each version of that
+path is shown with a marker for how it changed from the previous snapshot:
+"+" added, "~" modified, "=" unchanged and "-" removed.
+
+Local snapshots are searched by default. Use --mirror to search the catalog of a
+mirror instead, which requires the mirror to have catalog enabled.`,
+		Args: cobra.RangeArgs(1, 2),
+		RunE: runFind,
+	}
+	cmd.Flags().StringVar(&findSince, "since", "", "only search snapshots taken at or after this time (a date, RFC3339 time or a duration ago)")
+	cmd.Flags().StringVar(&findUntil, "until", "", "only search snapshots taken at or before this time (a date, RFC3339 time or a duration ago)")
+	cmd.Flags().BoolVarP(&findRegex, "regex", "r", false, "treat the pattern as a regular expression")
+	cmd.Flags().StringVarP(&findMirror, "mirror", "m", "", "search the catalog of the named mirror instead of local snapshots")
+	cmd.Flags().StringVar(&findHistory, "history", "", "show each version of a single path across snapshots")
+	return cmd
+}
+
+func runFind(cmd *cobra.Command, args []string) error {
+	if findHistory == "" && len(args) < 2 {
+		return errors.New("a pattern is required unless --history is given")
+	}
+	since, err := parseTimeArg(findSince)
+	if err != nil {
+		return fmt.Errorf("invalid --since: %w", err)
+	}
+	until, err := parseTimeArg(findUntil)
+	if err != nil {
+		return fmt.Errorf("invalid --until: %w", err)
+	}
+	src, err := newFindSource(args[0], findMirror)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	snaps, err := src.Snapshots()
+	if err != nil {
+		return err
+	}
+	var filtered []*findSnapshot
+	for _, snap := range snaps {
+		if !since.IsZero() && snap.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && snap.Time.After(until) {
+			continue
+		}
+		filtered = append(filtered, snap)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	if findHistory != "" {
+		return printHistory(w, src, filtered, findHistory)
+	}
+	match, err := newPathMatcher(args[1], findRegex)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "SNAPSHOT\tTAKEN\tSIZE\tMODIFIED\tPATH")
+	for _, snap := range filtered {
+		err := src.Walk(snap, func(info *catalog.FileInfo) error {
+			if !match(info.Path) {
+				return nil
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n",
+				snap.Name, formatFindTime(snap.Time), info.Size, formatFindTime(info.ModTime), info.Path)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error searching %s: %w", snap.Name, err)
+		}
+	}
+	return nil
+}
+
+func printHistory(w *tabwriter.Writer, src findSource, snaps []*findSnapshot, filePath string) error {
+	filePath = catalog.CleanPath(filePath)
+	fmt.Fprintln(w, "\tSNAPSHOT\tTAKEN\tSIZE\tMODIFIED\tMODE\tOWNER\tSHA256")
+	var last *catalog.FileInfo
+	for _, snap := range snaps {
+		info, err := src.Lookup(snap, filePath)
+		if err != nil {
+			return fmt.Errorf("error looking up %q in %s: %w", filePath, snap.Name, err)
+		}
+		var marker string
+		switch {
+		case info == nil && last == nil:
+			continue
+		case info == nil:
+			fmt.Fprintf(w, "-\t%s\t%s\t\t\t\t\t\n", snap.Name, formatFindTime(snap.Time))
+			last = nil
+			continue
+		case last == nil:
+			marker = "+"
+		case !info.Equal(last):
+			marker = "~"
+		default:
+			marker = "="
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%d:%d\t%s\n",
+			marker, snap.Name, formatFindTime(snap.Time), info.Size, formatFindTime(info.ModTime),
+			info.Mode, info.UID, info.GID, info.Hash)
+		last = info
+	}
+	return nil
+}
+
+func formatFindTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// parseTimeArg parses a time given on the command line. Durations are taken as the
+// time that long ago. An empty string returns the zero time.
+func parseTimeArg(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as a time or duration", s)
+}
+
+// newPathMatcher returns a function matching absolute paths inside a snapshot.
+func newPathMatcher(pattern string, regex bool) (func(string) bool, error) {
+	if regex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %w", pattern, err)
+	}
+	if strings.Contains(pattern, "/") {
+		pattern = catalog.CleanPath(pattern)
+		return func(p string) bool {
+			ok, _ := path.Match(pattern, p)
+			return ok
+		}, nil
+	}
+	return func(p string) bool {
+		ok, _ := path.Match(pattern, path.Base(p))
+		return ok
+	}, nil
+}
+
+// findSnapshot is a snapshot that can be searched by find.
+type findSnapshot struct {
+	Name string
+	UUID uuid.UUID
+	Time time.Time
+}
+
+// findSource lists the snapshots of a subvolume and the files they contain, either
+// from the local snapshot directory or from the catalog of a mirror.
+type findSource interface {
+	// Snapshots returns the snapshots oldest first.
+	Snapshots() ([]*findSnapshot, error)
+	// Walk calls fn for every file in the snapshot.
+	Walk(snap *findSnapshot, fn func(*catalog.FileInfo) error) error
+	// Lookup returns the file at path in the snapshot, or nil if it does not exist.
+	Lookup(snap *findSnapshot, path string) (*catalog.FileInfo, error)
+	Close() error
+}
+
+func newFindSource(subvolArg, mirrorName string) (findSource, error) {
+	vol, subvol, err := resolveSubvolumeArg(subvolArg)
+	if err != nil {
+		return nil, err
+	}
+	volumeName, subvolName := vol.GetName(), subvol.GetName()
+	if mirrorName == "" {
+		return &localFindSource{config: newSyncConfig(vol, subvol, nil)}, nil
+	}
+	var mirror *config.Mirror
+	for _, m := range conf.ResolveMirrors(volumeName, subvolName) {
+		if m.Name == mirrorName {
+			mirror = &m
+			break
+		}
+	}
+	if mirror == nil {
+		return nil, fmt.Errorf("mirror %q is not configured for %s", mirrorName, subvolArg)
+	}
+	if !mirror.Catalog {
+		return nil, fmt.Errorf("mirror %q does not have a catalog", mirrorName)
+	}
+	cfg := newSyncConfig(vol, subvol, mirror)
+	dbPath, err := cfg.CatalogFile()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, fmt.Errorf("catalog for mirror %q is not available: %w", mirrorName, err)
+	}
+	logLevel(1, "Searching catalog %s", dbPath)
+	c, err := catalog.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	return &catalogFindSource{catalog: c}, nil
+}
+
+// resolveSubvolumeArg resolves a "volume:subvolume" argument to its configuration.
+func resolveSubvolumeArg(arg string) (*config.Volume, *config.Subvolume, error) {
+	volumeName, subvolName, ok := strings.Cut(arg, ":")
+	if !ok || volumeName == "" || subvolName == "" {
+		return nil, nil, fmt.Errorf("invalid subvolume %q, expected <volume>:<subvolume>", arg)
+	}
+	vol := conf.GetVolume(volumeName)
+	if vol == nil {
+		return nil, nil, fmt.Errorf("volume %q is not configured", volumeName)
+	}
+	subvol := vol.GetSubvolume(subvolName)
+	if subvol == nil {
+		return nil, nil, fmt.Errorf("subvolume %q is not configured for volume %q", subvolName, volumeName)
+	}
+	return vol, subvol, nil
+}
+
+type localFindSource struct {
+	config *syncmanager.Config
+}
+
+func (s *localFindSource) Snapshots() ([]*findSnapshot, error) {
+	info, err := snaputil.ResolveSubvolumeDetails(logger, conf.Verbosity, s.config.FullSubvolumePath, s.config.SnapshotDirectory, s.config.SnapshotName)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving subvolume details: %w", err)
+	}
+	snaputil.SortSnapshots(info.Snapshots, snaputil.SortAscending)
+	snaps := make([]*findSnapshot, len(info.Snapshots))
+	for i, snap := range info.Snapshots {
+		snaps[i] = &findSnapshot{Name: snap.Name, UUID: snap.UUID, Time: snap.CreationTime}
+	}
+	return snaps, nil
+}
+
+func (s *localFindSource) Walk(snap *findSnapshot, fn func(*catalog.FileInfo) error) error {
+	root := filepath.Join(s.config.SnapshotDirectory, snap.Name)
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		info, err := localFileInfo(p, catalog.CleanPath(rel))
+		if err != nil {
+			return err
+		}
+		return fn(info)
+	})
+}
+
+func (s *localFindSource) Lookup(snap *findSnapshot, filePath string) (*catalog.FileInfo, error) {
+	info, err := localFileInfo(filepath.Join(s.config.SnapshotDirectory, snap.Name, filePath), filePath)
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return info, err
+}
+
+func (s *localFindSource) Close() error { return nil }
+
+// localFileInfo describes the file at fullPath in the same way as the catalog.
+func localFileInfo(fullPath, filePath string) (*catalog.FileInfo, error) {
+	stat, err := os.Lstat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	info := &catalog.FileInfo{
+		Path:    filePath,
+		Mode:    stat.Mode(),
+		ModTime: stat.ModTime(),
+	}
+	if !stat.IsDir() {
+		info.Size = uint64(stat.Size())
+	}
+	if st, ok := stat.Sys().(*syscall.Stat_t); ok {
+		info.UID, info.GID = uint64(st.Uid), uint64(st.Gid)
+		if stat.Mode()&fs.ModeDevice != 0 {
+			info.Rdev = uint64(st.Rdev)
+		}
+	}
+	if stat.Mode()&fs.ModeSymlink != 0 {
+		if info.LinkTarget, err = os.Readlink(fullPath); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+type catalogFindSource struct {
+	catalog *catalog.Catalog
+}
+
+func (s *catalogFindSource) Snapshots() ([]*findSnapshot, error) {
+	infos, err := s.catalog.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	snaps := make([]*findSnapshot, len(infos))
+	for i, info := range infos {
+		t := info.CreationTime
+		if t.IsZero() {
+			t = info.CatalogedAt
+		}
+		snaps[i] = &findSnapshot{Name: info.Name, UUID: info.UUID, Time: t}
+	}
+	return snaps, nil
+}
+
+func (s *catalogFindSource) Walk(snap *findSnapshot, fn func(*catalog.FileInfo) error) error {
+	return s.catalog.Walk(snap.UUID, fn)
+}
+
+func (s *catalogFindSource) Lookup(snap *findSnapshot, filePath string) (*catalog.FileInfo, error) {
+	return s.catalog.Lookup(snap.UUID, filePath)
+}
+
+func (s *catalogFindSource) Close() error { return s.catalog.Close() }
@@ -0,0 +1,299 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tinyzimmer/btrsync/pkg/cmd/syncmanager"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/catalog"
+)
+
+func TestPathMatcher(t *testing.T) {
+	paths := []string{"/notes.txt", "/docs/notes.txt", "/docs/report.pdf", "/docs/old/notes.txt.bak"}
+	tests := []struct {
+		name    string
+		pattern string
+		regex   bool
+		want    []string
+	}{
+		{
+			name:    "glob without a slash matches the file name at any depth",
+			pattern: "*.txt",
+			want:    []string{"/notes.txt", "/docs/notes.txt"},
+		},
+		{
+			name:    "glob with a slash matches the full path",
+			pattern: "docs/*.txt",
+			want:    []string{"/docs/notes.txt"},
+		},
+		{
+			name:    "glob with a leading slash",
+			pattern: "/docs/*",
+			want:    []string{"/docs/notes.txt", "/docs/report.pdf"},
+		},
+		{
+			name:    "glob does not cross directories",
+			pattern: "/*/notes.txt",
+			want:    []string{"/docs/notes.txt"},
+		},
+		{
+			name:    "regex matches anywhere in the full path",
+			pattern: `notes\.txt`,
+			regex:   true,
+			want:    []string{"/notes.txt", "/docs/notes.txt", "/docs/old/notes.txt.bak"},
+		},
+		{
+			name:    "anchored regex",
+			pattern: `^/docs/.*\.(pdf|bak)$`,
+			regex:   true,
+			want:    []string{"/docs/report.pdf", "/docs/old/notes.txt.bak"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			match, err := newPathMatcher(tc.pattern, tc.regex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range paths {
+				if match(p) {
+					got = append(got, p)
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		pattern string
+		regex   bool
+	}{{"[", false}, {"(", true}} {
+		if _, err := newPathMatcher(tc.pattern, tc.regex); err == nil {
+			t.Errorf("expected an error for pattern %q", tc.pattern)
+		}
+	}
+}
+
+func TestParseTimeArg(t *testing.T) {
+	tests := []struct {
+		name    string
+		arg     string
+		want    time.Time
+		wantErr bool
+	}{
+		{name: "empty", arg: ""},
+		{name: "RFC3339", arg: "2023-04-05T06:07:08Z", want: time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)},
+		{name: "date", arg: "2023-04-05", want: time.Date(2023, 4, 5, 0, 0, 0, 0, time.Local)},
+		{name: "date and minutes", arg: "2023-04-05 06:07", want: time.Date(2023, 4, 5, 6, 7, 0, 0, time.Local)},
+		{name: "date and seconds", arg: "2023-04-05 06:07:08", want: time.Date(2023, 4, 5, 6, 7, 8, 0, time.Local)},
+		{name: "garbage", arg: "last tuesday", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseTimeArg(tc.arg)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tc.want) {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("duration ago", func(t *testing.T) {
+		before := time.Now()
+		got, err := parseTimeArg("2h")
+		after := time.Now()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Before(before.Add(-2*time.Hour)) || got.After(after.Add(-2*time.Hour)) {
+			t.Errorf("got %s, want 2h before %s", got, before)
+		}
+	})
+}
+
+// fakeFindSource is a find source with the files of each snapshot in memory.
+type fakeFindSource struct {
+	files map[string]map[string]*catalog.FileInfo
+}
+
+func (s *fakeFindSource) Snapshots() ([]*findSnapshot, error) { return nil, nil }
+
+func (s *fakeFindSource) Walk(snap *findSnapshot, fn func(*catalog.FileInfo) error) error {
+	for _, info := range s.files[snap.Name] {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeFindSource) Lookup(snap *findSnapshot, path string) (*catalog.FileInfo, error) {
+	return s.files[snap.Name][path], nil
+}
+
+func (s *fakeFindSource) Close() error { return nil }
+
+func TestPrintHistory(t *testing.T) {
+	mtime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	version := func(size uint64, hash string) *catalog.FileInfo {
+		return &catalog.FileInfo{Path: "/file", Mode: 0644, Size: size, ModTime: mtime, Hash: hash}
+	}
+	tests := []struct {
+		name     string
+		versions []*catalog.FileInfo
+		// want is the marker and snapshot name of every line after the header
+		want []string
+	}{
+		{
+			name:     "unchanged",
+			versions: []*catalog.FileInfo{version(1, ""), version(1, "")},
+			want:     []string{"+ snap0", "= snap1"},
+		},
+		{
+			name:     "modified size",
+			versions: []*catalog.FileInfo{version(1, ""), version(2, "")},
+			want:     []string{"+ snap0", "~ snap1"},
+		},
+		{
+			name:     "modified contents",
+			versions: []*catalog.FileInfo{version(1, "aa"), version(1, "bb")},
+			want:     []string{"+ snap0", "~ snap1"},
+		},
+		{
+			name:     "contents not compared without both hashes",
+			versions: []*catalog.FileInfo{version(1, "aa"), version(1, "")},
+			want:     []string{"+ snap0", "= snap1"},
+		},
+		{
+			name:     "missing before it was added",
+			versions: []*catalog.FileInfo{nil, nil, version(1, "")},
+			want:     []string{"+ snap2"},
+		},
+		{
+			name:     "removed and added again",
+			versions: []*catalog.FileInfo{version(1, ""), nil, nil, version(1, "")},
+			want:     []string{"+ snap0", "- snap1", "+ snap3"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			src := &fakeFindSource{files: make(map[string]map[string]*catalog.FileInfo)}
+			var snaps []*findSnapshot
+			for i, info := range tc.versions {
+				name := fmt.Sprintf("snap%d", i)
+				snaps = append(snaps, &findSnapshot{Name: name, Time: mtime})
+				src.files[name] = map[string]*catalog.FileInfo{}
+				if info != nil {
+					src.files[name]["/file"] = info
+				}
+			}
+			var buf bytes.Buffer
+			w := tabwriter.NewWriter(&buf, 0, 0, 1, ' ', 0)
+			if err := printHistory(w, src, snaps, "file"); err != nil {
+				t.Fatal(err)
+			}
+			w.Flush()
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")[1:]
+			got := make([]string, len(lines))
+			for i, line := range lines {
+				got[i] = strings.Join(strings.Fields(line)[:2], " ")
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLocalFindSource(t *testing.T) {
+	dir := t.TempDir()
+	snap := &findSnapshot{Name: "snap"}
+	root := filepath.Join(dir, snap.Name)
+	if err := os.MkdirAll(filepath.Join(root, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "docs", "notes.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("docs/notes.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	src := &localFindSource{config: &syncmanager.Config{SnapshotDirectory: dir}}
+
+	var paths []string
+	err := src.Walk(snap, func(info *catalog.FileInfo) error {
+		paths = append(paths, info.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	if want := []string{"/", "/docs", "/docs/notes.txt", "/link"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("walked %v, want %v", paths, want)
+	}
+
+	tests := []struct {
+		path       string
+		wantNil    bool
+		wantSize   uint64
+		wantTarget string
+	}{
+		{path: "/docs/notes.txt", wantSize: 5},
+		{path: "/docs"},
+		{path: "/link", wantSize: uint64(len("docs/notes.txt")), wantTarget: "docs/notes.txt"},
+		{path: "/missing", wantNil: true},
+	}
+	for _, tc := range tests {
+		info, err := src.Lookup(snap, tc.path)
+		if err != nil {
+			t.Fatalf("looking up %s: %s", tc.path, err)
+		}
+		if tc.wantNil {
+			if info != nil {
+				t.Errorf("%s: expected no file, got %+v", tc.path, info)
+			}
+			continue
+		}
+		if info == nil {
+			t.Fatalf("%s: file not found", tc.path)
+		}
+		if info.Path != tc.path || info.Size != tc.wantSize || info.LinkTarget != tc.wantTarget {
+			t.Errorf("%s: got path %s, size %d and target %q", tc.path, info.Path, info.Size, info.LinkTarget)
+		}
+	}
+}
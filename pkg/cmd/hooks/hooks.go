@@ -0,0 +1,143 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package hooks runs the commands configured to run around snapshots and mirror syncs.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+)
+
+// Env describes the subvolume and mirror hooks run for. It is passed to the commands
+// as BTRSYNC_* environment variables.
+type Env struct {
+	// Volume is the name of the volume.
+	Volume string
+	// Subvolume is the name of the subvolume.
+	Subvolume string
+	// SubvolumePath is the full path of the subvolume.
+	SubvolumePath string
+	// Mirror is the name of the mirror, empty for snapshot hooks.
+	Mirror string
+	// MirrorPath is the location of the mirror, empty for snapshot hooks.
+	MirrorPath string
+}
+
+// Runner runs the hooks of a subvolume, or of a subvolume and one of its mirrors.
+// A nil Runner runs nothing.
+type Runner struct {
+	Hooks     []config.Hook
+	Env       Env
+	Logger    *log.Logger
+	Verbosity int
+}
+
+func (r *Runner) logLevel(level int, format string, args ...interface{}) {
+	if r.Logger != nil && r.Verbosity >= level {
+		r.Logger.Printf(format, args...)
+	}
+}
+
+// Run runs the hooks for an event in order. The snapshot path is the snapshot the
+// operation is for, and result is the error of the operation for post hooks. A hook
+// that fails with the abort policy stops the hooks after it and its error is returned,
+// failures of hooks with the warn policy are logged.
+func (r *Runner) Run(ctx context.Context, event config.HookEvent, snapshotPath string, result error) error {
+	if r == nil {
+		return nil
+	}
+	env := r.environ(event, snapshotPath, result)
+	for _, h := range r.Hooks {
+		if h.Event != event {
+			continue
+		}
+		if err := r.run(ctx, h, env); err != nil {
+			err = fmt.Errorf("%s hook %q failed: %w", event, h.Command, err)
+			if h.OnFailure == config.HookFailureWarn {
+				r.logLevel(0, "WARNING: %s\n", err)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Runner) environ(event config.HookEvent, snapshotPath string, result error) []string {
+	env := append(os.Environ(),
+		"BTRSYNC_EVENT="+string(event),
+		"BTRSYNC_VOLUME="+r.Env.Volume,
+		"BTRSYNC_SUBVOLUME="+r.Env.Subvolume,
+		"BTRSYNC_SUBVOLUME_PATH="+r.Env.SubvolumePath,
+		"BTRSYNC_SNAPSHOT_PATH="+snapshotPath,
+		"BTRSYNC_MIRROR="+r.Env.Mirror,
+		"BTRSYNC_MIRROR_PATH="+r.Env.MirrorPath,
+	)
+	if event == config.HookPostSnapshot || event == config.HookPostSync {
+		if result != nil {
+			env = append(env, "BTRSYNC_RESULT=failure", "BTRSYNC_ERROR="+result.Error())
+		} else {
+			env = append(env, "BTRSYNC_RESULT=success")
+		}
+	}
+	return env
+}
+
+func (r *Runner) run(ctx context.Context, h config.Hook, env []string) error {
+	r.logLevel(1, "Running %s hook: %s\n", h.Event, h.Command)
+	var out bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", h.Command)
+	cmd.Env = env
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// The command runs in its own process group, so that everything it started can be
+	// killed when it times out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		err = ctx.Err()
+		if err == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", h.Timeout)
+		}
+	}
+	output := strings.TrimSpace(out.String())
+	if output != "" {
+		r.logLevel(2, "Output of %s hook %q: %s\n", h.Event, h.Command, output)
+	}
+	if err != nil && output != "" {
+		return fmt.Errorf("%w: %s", err, output)
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package hooks
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+)
+
+func TestRun(t *testing.T) {
+	hook := func(event config.HookEvent, command string, onFailure config.HookFailurePolicy) config.Hook {
+		return config.Hook{Event: event, Command: command, Timeout: 10 * time.Second, OnFailure: onFailure}
+	}
+	tests := []struct {
+		name   string
+		hooks  []config.Hook
+		event  config.HookEvent
+		result error
+		// want are the lines the hooks wrote to $OUT
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "only hooks of the event run, in order",
+			hooks: []config.Hook{
+				hook(config.HookPreSnapshot, "echo one >> $OUT", config.HookFailureAbort),
+				hook(config.HookPreSync, "echo sync >> $OUT", config.HookFailureAbort),
+				hook(config.HookPreSnapshot, "echo two >> $OUT", config.HookFailureAbort),
+			},
+			event: config.HookPreSnapshot,
+			want:  []string{"one", "two"},
+		},
+		{
+			name: "failed hook aborts the hooks after it",
+			hooks: []config.Hook{
+				hook(config.HookPreSync, "echo one >> $OUT", config.HookFailureAbort),
+				hook(config.HookPreSync, "echo broken; exit 3", config.HookFailureAbort),
+				hook(config.HookPreSync, "echo two >> $OUT", config.HookFailureAbort),
+			},
+			event:   config.HookPreSync,
+			want:    []string{"one"},
+			wantErr: `pre_sync hook "echo broken; exit 3" failed: exit status 3: broken`,
+		},
+		{
+			name: "failed hook with the warn policy carries on",
+			hooks: []config.Hook{
+				hook(config.HookPreSync, "exit 1", config.HookFailureWarn),
+				hook(config.HookPreSync, "echo two >> $OUT", config.HookFailureAbort),
+			},
+			event: config.HookPreSync,
+			want:  []string{"two"},
+		},
+		{
+			name: "hook that runs too long is killed",
+			hooks: []config.Hook{
+				{Event: config.HookPreSync, Command: "sleep 10; echo late >> $OUT", Timeout: 100 * time.Millisecond},
+			},
+			event:   config.HookPreSync,
+			wantErr: "timed out after 100ms",
+		},
+		{
+			name: "environment of pre hooks",
+			hooks: []config.Hook{
+				hook(config.HookPreSync, `echo "$BTRSYNC_EVENT $BTRSYNC_VOLUME $BTRSYNC_SUBVOLUME $BTRSYNC_SUBVOLUME_PATH" >> $OUT`, config.HookFailureAbort),
+				hook(config.HookPreSync, `echo "$BTRSYNC_SNAPSHOT_PATH $BTRSYNC_MIRROR $BTRSYNC_MIRROR_PATH ${BTRSYNC_RESULT-unset}" >> $OUT`, config.HookFailureAbort),
+			},
+			event: config.HookPreSync,
+			want:  []string{"pre_sync data home /mnt/data/home", "/mnt/data/.snapshots/home.1 backup /backup unset"},
+		},
+		{
+			name: "environment of post hooks after success",
+			hooks: []config.Hook{
+				hook(config.HookPostSnapshot, `echo "$BTRSYNC_RESULT ${BTRSYNC_ERROR-unset}" >> $OUT`, config.HookFailureAbort),
+			},
+			event: config.HookPostSnapshot,
+			want:  []string{"success unset"},
+		},
+		{
+			name: "environment of post hooks after failure",
+			hooks: []config.Hook{
+				hook(config.HookPostSync, `echo "$BTRSYNC_RESULT $BTRSYNC_ERROR" >> $OUT`, config.HookFailureAbort),
+			},
+			event:  config.HookPostSync,
+			result: errors.New("mirror unreachable"),
+			want:   []string{"failure mirror unreachable"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "out")
+			t.Setenv("OUT", out)
+			r := &Runner{
+				Hooks: tc.hooks,
+				Env: Env{
+					Volume:        "data",
+					Subvolume:     "home",
+					SubvolumePath: "/mnt/data/home",
+					Mirror:        "backup",
+					MirrorPath:    "/backup",
+				},
+			}
+			err := r.Run(context.Background(), tc.event, "/mnt/data/.snapshots/home.1", tc.result)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+			data, err := os.ReadFile(out)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			var got []string
+			if len(data) > 0 {
+				got = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("hooks wrote %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunNil(t *testing.T) {
+	var r *Runner
+	if err := r.Run(context.Background(), config.HookPreSnapshot, "", nil); err != nil {
+		t.Fatalf("nil runner returned %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/syncmanager"
+)
+
+// newSyncConfig returns the configuration of a subvolume's mirror. The mirror may be
+// nil for commands that only work with the local snapshots.
+func newSyncConfig(vol *config.Volume, subvol *config.Subvolume, mirror *config.Mirror) *syncmanager.Config {
+	volumeName, subvolName := vol.GetName(), subvol.GetName()
+	cfg := newMirrorConfig(mirror)
+	cfg.SubvolumeIdentifier = subvol.GetSnapshotName(volumeName)
+	cfg.FullSubvolumePath = filepath.Join(vol.Path, subvol.Path)
+	cfg.SnapshotDirectory = conf.ResolveSnapshotPath(volumeName, subvolName)
+	cfg.SnapshotName = subvol.GetSnapshotName(volumeName)
+	cfg.TimeFormat = conf.ResolveTimeFormat(volumeName, subvolName)
+	return cfg
+}
+
+// newMirrorConfig returns the configuration of a mirror that is not tied to a subvolume.
+func newMirrorConfig(mirror *config.Mirror) *syncmanager.Config {
+	if mirror == nil {
+		return &syncmanager.Config{Logger: logger, Verbosity: conf.Verbosity}
+	}
+	return &syncmanager.Config{
+		Logger:            logger,
+		Verbosity:         conf.Verbosity,
+		MirrorPath:        mirror.Path,
+		MirrorFormat:      mirror.Format,
+		SSHUser:           conf.ResolveMirrorSSHUser(mirror.Name),
+		SSHPassword:       conf.ResolveMirrorSSHPassword(mirror.Name),
+		SSHKeyFile:        conf.ResolveMirrorSSHKeyFile(mirror.Name),
+		SSHHostKey:        conf.ResolveMirrorSSHHostKey(mirror.Name),
+		UseSFTP:           mirror.UseSFTP,
+		CatalogPath:       mirror.CatalogPath,
+		CatalogHashes:     mirror.CatalogHashes,
+		EncryptionKeys:    mirror.EncryptionKeys,
+		SigningKey:        mirror.SigningKey,
+		FullSendInterval:  time.Duration(mirror.FullSendInterval),
+		Retention:         mirror.Retention,
+		S3Endpoint:        mirror.S3Endpoint,
+		S3Region:          mirror.S3Region,
+		S3AccessKeyID:     mirror.S3AccessKeyID,
+		S3SecretAccessKey: mirror.S3SecretAccessKey,
+		S3StorageClass:    mirror.S3StorageClass,
+		S3PartSize:        mirror.S3PartSize,
+		WriteCoalescing:   mirror.WriteCoalescing,
+		SyncOnClose:       mirror.SyncOnClose,
+	}
+}
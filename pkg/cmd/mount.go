@@ -30,12 +30,18 @@ import (
 )
 
 func NewMountCommand() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "mount [file] [mountpoint]",
 		Short: "Create and mount a FUSE filesystem of a sent snapshot",
-		Args:  cobra.ExactArgs(2),
-		RunE:  mount,
+		Long: `Create and mount a FUSE filesystem of a sent snapshot.
+
+Files written to compressed mirrors are decompressed, and decrypted if the mirror is
+encrypted.`,
+		Args: cobra.ExactArgs(2),
+		RunE: mount,
 	}
+	addKeyFlag(cmd.Flags())
+	return cmd
 }
 
 func mount(cmd *cobra.Command, args []string) error {
@@ -45,7 +51,7 @@ func mount(cmd *cobra.Command, args []string) error {
 	} else if !stat.IsDir() {
 		return fmt.Errorf("cannot mount to %s: not a directory", dest)
 	}
-	snap, err := os.Open(src)
+	snap, err := openStreamFile(src)
 	if err != nil {
 		return err
 	}
@@ -21,32 +21,46 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"github.com/tinyzimmer/btrsync/pkg/cmd/retention"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/snapmanager"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/syncmanager"
 )
 
+var pruneDryRun bool
+
 func NewPruneCommand() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "prune",
 		Short: "Prune local and remote snapshots",
-		RunE:  prune,
+		Long: `Prune local and remote snapshots.
+
+With --dry-run nothing is deleted, and every local and mirrored snapshot that would be
+deleted is printed along with the retention rules that expired it. Mirrors are checked
+as if the local snapshots had been deleted first, like a real prune does.`,
+		RunE: prune,
 	}
+	cmd.Flags().BoolVarP(&pruneDryRun, "dry-run", "n", false, "print the snapshots that would be deleted and why, without deleting them")
+	return cmd
 }
 
 func prune(cmd *cobra.Command, args []string) error {
 	logLevel(0, "Running prune of local snapshots...")
-	if err := pruneLocalSnapshots(); err != nil {
+	expired, err := pruneLocalSnapshots()
+	if err != nil {
 		return err
 	}
 	logLevel(0, "Running prune of mirrored snapshots...")
-	if err := pruneMirrors(); err != nil {
+	if err := pruneMirrors(expired); err != nil {
 		return err
 	}
 	logLevel(0, "Done.")
 	return nil
 }
 
-func pruneLocalSnapshots() error {
+// pruneLocalSnapshots prunes the local snapshots of every subvolume, and returns the
+// snapshots that expired by the path of their subvolume.
+func pruneLocalSnapshots() (map[string][]*retention.Decision, error) {
+	expired := make(map[string][]*retention.Decision)
 	for _, vol := range conf.Volumes {
 		volumeName := vol.GetName()
 		if vol.Disabled {
@@ -63,29 +77,32 @@ func pruneLocalSnapshots() error {
 			snapDir := conf.ResolveSnapshotPath(volumeName, subvolName)
 			sourcePath := filepath.Join(vol.Path, subvol.Path)
 			manager, err := snapmanager.New(&snapmanager.Config{
-				FullSubvolumePath:         sourcePath,
-				SnapshotName:              subvol.GetSnapshotName(volumeName),
-				SnapshotDirectory:         snapDir,
-				SnapshotInterval:          conf.ResolveSnapshotInterval(volumeName, subvolName),
-				SnapshotMinimumRetention:  conf.ResolveSnapshotMinimumRetention(volumeName, subvolName),
-				SnapshotRetention:         conf.ResolveSnapshotRetention(volumeName, subvolName),
-				SnapshotRetentionInterval: conf.ResolveSnapshotRetentionInterval(volumeName, subvolName),
-				TimeFormat:                conf.ResolveTimeFormat(volumeName, subvolName),
-				Logger:                    logger,
-				Verbosity:                 conf.Verbosity,
+				FullSubvolumePath: sourcePath,
+				SnapshotName:      subvol.GetSnapshotName(volumeName),
+				SnapshotDirectory: snapDir,
+				SnapshotInterval:  conf.ResolveSnapshotInterval(volumeName, subvolName),
+				Retention:         conf.ResolveRetention(volumeName, subvolName),
+				Mirrors:           conf.ResolveMirrors(volumeName, subvolName),
+				DryRun:            pruneDryRun,
+				TimeFormat:        conf.ResolveTimeFormat(volumeName, subvolName),
+				Logger:            logger,
+				Verbosity:         conf.Verbosity,
 			})
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if err := manager.PruneSnapshots(); err != nil {
-				return err
+				return nil, err
 			}
+			expired[sourcePath] = manager.Expired()
 		}
 	}
-	return nil
+	return expired, nil
 }
 
-func pruneMirrors() error {
+// pruneMirrors prunes the mirrors of every subvolume. In a dry run the snapshots that
+// expired locally are treated as deleted.
+func pruneMirrors(expired map[string][]*retention.Decision) error {
 	for _, vol := range conf.Volumes {
 		volumeName := vol.GetName()
 		if vol.Disabled {
@@ -104,35 +121,43 @@ func pruneMirrors() error {
 				continue
 			}
 			logger.Printf("Pruning mirrors for subvolume %s/%s...", vol.Path, subvol.Path)
-			snapDir := conf.ResolveSnapshotPath(volumeName, subvolName)
 			sourcePath := filepath.Join(vol.Path, subvol.Path)
 			for _, mirror := range mirrors {
 				if mirror.Disabled {
 					logLevel(1, "Skipping disabled mirror: %s", mirror.Path)
 					continue
 				}
-				manager, err := syncmanager.New(&syncmanager.Config{
-					Logger:              logger,
-					Verbosity:           conf.Verbosity,
-					SubvolumeIdentifier: subvol.GetName(),
-					FullSubvolumePath:   sourcePath,
-					SnapshotDirectory:   snapDir,
-					SnapshotName:        subvol.GetSnapshotName(volumeName),
-					MirrorPath:          mirror.Path,
-					MirrorFormat:        mirror.Format,
-					SSHUser:             conf.ResolveMirrorSSHUser(mirror.Name),
-					SSHPassword:         conf.ResolveMirrorSSHPassword(mirror.Name),
-					SSHKeyFile:          conf.ResolveMirrorSSHKeyFile(mirror.Name),
-					SSHHostKey:          conf.ResolveMirrorSSHHostKey(mirror.Name),
-				})
+				cfg := newSyncConfig(&vol, &subvol, &mirror)
+				cfg.DryRun = pruneDryRun
+				if pruneDryRun {
+					cfg.SourceExpired = expired[sourcePath]
+				}
+				manager, err := syncmanager.New(cfg)
 				if err != nil {
 					return err
 				}
 				if err := manager.Prune(context.Background()); err != nil {
 					return err
 				}
+				if err := syncmanager.PropagateMetadata(context.Background(), cfg); err != nil {
+					return err
+				}
+				if mirror.Catalog {
+					if err := pruneCatalog(cfg); err != nil {
+						return err
+					}
+				}
 			}
 		}
 	}
 	return nil
 }
+
+func pruneCatalog(cfg *syncmanager.Config) error {
+	manager, err := syncmanager.NewCatalogManager(cfg)
+	if err != nil {
+		return err
+	}
+	defer manager.Close()
+	return manager.Prune(context.Background())
+}
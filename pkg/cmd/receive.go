@@ -23,41 +23,70 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/tinyzimmer/btrsync/pkg/receive"
+	"github.com/tinyzimmer/btrsync/pkg/receive/filecache"
 	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/local"
 )
 
 var (
-	receivefile string
+	receivefile            string
+	receiveVerify          bool
+	receiveWriteCoalescing int
+	receiveSyncOnClose     bool
 )
 
 func NewReceiveCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "receive [flags] <dest>",
 		Short: "Receive a snapshot from a local or remote host",
-		Args:  cobra.MinimumNArgs(1),
-		RunE:  runReceive,
+		Long: `Receive a snapshot from a local or remote host.
+
+Encrypted streams are decrypted with the keys given with --key, or with the keys of
+every configured mirror. Files written to compressed mirrors are also decompressed.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: runReceive,
 	}
 	cmd.Flags().StringVarP(&receivefile, "file", "f", "", "receive from encoded file")
+	cmd.Flags().BoolVar(&receiveVerify, "verify", false, "verify each subvolume against the stream before marking it as received")
+	cmd.Flags().IntVar(&receiveWriteCoalescing, "write-coalescing", 0, "buffer adjacent writes to a file up to this size in KiB before writing them")
+	cmd.Flags().BoolVar(&receiveSyncOnClose, "sync-on-close", false, "sync every file written to disk before marking each subvolume as received")
+	addKeyFlag(cmd.Flags())
 	return cmd
 }
 
 func runReceive(cmd *cobra.Command, args []string) error {
-	var src io.Reader = os.Stdin
-	var err error
+	var src io.Reader
 	if receivefile != "" {
 		logLevel(1, "Receiving from file %s\n", receivefile)
-		src, err = os.Open(receivefile)
+		f, err := openStreamFile(receivefile)
 		if err != nil {
 			return err
 		}
+		defer f.Close()
+		src = f
 	} else {
 		logLevel(1, "Receiving stream from stdin")
+		var err error
+		if src, err = decryptStream(os.Stdin); err != nil {
+			return err
+		}
 	}
 	dest := args[0]
 	logLevel(0, "Receiving to %q", dest)
+	var opts []local.Option
+	if receiveVerify {
+		opts = append(opts, local.WithVerification())
+	}
+	var cacheOpts []filecache.Option
+	if receiveWriteCoalescing > 0 {
+		cacheOpts = append(cacheOpts, filecache.WithWriteCoalescing(receiveWriteCoalescing*1024))
+	}
+	if receiveSyncOnClose {
+		cacheOpts = append(cacheOpts, filecache.WithSyncOnClose())
+	}
+	opts = append(opts, local.WithFileCache(cacheOpts...))
 	return receive.ProcessSendStream(src,
 		receive.WithLogger(log.New(os.Stderr, "[receive]", log.LstdFlags|log.Lshortfile), conf.Verbosity),
 		receive.HonorEndCommand(),
-		receive.To(local.New(dest)),
+		receive.To(local.New(dest, opts...)),
 	)
 }
@@ -0,0 +1,279 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/syncmanager"
+	"github.com/tinyzimmer/btrsync/pkg/repository"
+)
+
+var (
+	repoReadData bool
+	repoDumpFile string
+)
+
+func NewRepositoryCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:     "repository",
+		Short:   "Work with deduplicating repository mirrors",
+		Aliases: []string{"repo"},
+		Long: `Work with deduplicating repository mirrors.
+
+The repository is given as the name of a configured mirror or as a path or ssh:// URL.
+Encrypted repositories are opened with the keys of the mirror, or the keys given
+with --key.`,
+	}
+	addKeyFlag(root.PersistentFlags())
+
+	snapshots := &cobra.Command{
+		Use:   "snapshots [flags] <mirror>",
+		Short: "List the snapshots in a repository",
+		Args:  cobra.ExactArgs(1),
+		RunE:  repositorySnapshots,
+	}
+
+	check := &cobra.Command{
+		Use:   "check [flags] <mirror>",
+		Short: "Check that every snapshot in a repository can be restored",
+		Args:  cobra.ExactArgs(1),
+		RunE:  repositoryCheck,
+	}
+	check.Flags().BoolVar(&repoReadData, "read-data", false, "read and verify the contents of every chunk")
+
+	repair := &cobra.Command{
+		Use:   "repair [flags] <mirror>",
+		Short: "Remove broken snapshots and unused data from a repository",
+		Long: `Remove broken snapshots and unused data from a repository.
+
+Snapshots that cannot be restored are removed, along with corrupt and unreferenced
+chunks, files left behind by interrupted writes and stale locks. Removed snapshots
+are sent again by the next sync as long as they still exist locally.`,
+		Args: cobra.ExactArgs(1),
+		RunE: repositoryRepair,
+	}
+	repair.Flags().BoolVar(&repoReadData, "read-data", false, "read and verify the contents of every chunk")
+
+	dump := &cobra.Command{
+		Use:   "dump [flags] <mirror> <subvolume> <snapshot>",
+		Short: "Write the send stream of a snapshot in a repository",
+		Long: `Write the send stream of a snapshot in a repository.
+
+The subvolume is the identifier snapshots are stored under, as listed by the
+snapshots command. The stream can be piped to "btrsync receive" or "btrfs receive".`,
+		Args: cobra.ExactArgs(3),
+		RunE: repositoryDump,
+	}
+	dump.Flags().StringVarP(&repoDumpFile, "output", "o", "", "write the stream to a file instead of stdout")
+
+	rotate := &cobra.Command{
+		Use:   "rotate-key [flags] <mirror>",
+		Short: "Make the primary key the only key that can open a repository",
+		Long: `Make the primary key the only key that can open a repository.
+
+To rotate keys, add the new key in front of the encryption keys of the mirror, run
+this command, and then remove the old keys from the configuration. Snapshots do not
+need to be sent again.`,
+		Args: cobra.ExactArgs(1),
+		RunE: repositoryRotateKey,
+	}
+
+	root.AddCommand(snapshots)
+	root.AddCommand(check)
+	root.AddCommand(repair)
+	root.AddCommand(dump)
+	root.AddCommand(rotate)
+
+	return root
+}
+
+// openRepositoryArg opens the repository of a configured mirror, or at the given path
+// or URL using the global ssh settings.
+func openRepositoryArg(arg string) (*repository.Repository, error) {
+	cfg := &syncmanager.Config{
+		Logger:      logger,
+		Verbosity:   conf.Verbosity,
+		MirrorPath:  arg,
+		SSHUser:     conf.SSHUser,
+		SSHPassword: conf.SSHPassword,
+		SSHKeyFile:  conf.SSHKeyIdentityFile,
+		SSHHostKey:  conf.SSHHostKey,
+	}
+	if len(keyRefs) > 0 {
+		cfg.EncryptionKeys = keyRefs
+	}
+	if mirror := conf.GetMirror(arg); mirror != nil {
+		if mirror.Format != config.MirrorFormatRepository {
+			return nil, fmt.Errorf("mirror %q is not a repository", arg)
+		}
+		cfg.MirrorPath = mirror.Path
+		cfg.SSHUser = conf.ResolveMirrorSSHUser(arg)
+		cfg.SSHPassword = conf.ResolveMirrorSSHPassword(arg)
+		cfg.SSHKeyFile = conf.ResolveMirrorSSHKeyFile(arg)
+		cfg.SSHHostKey = conf.ResolveMirrorSSHHostKey(arg)
+		if len(keyRefs) == 0 {
+			cfg.EncryptionKeys = mirror.EncryptionKeys
+		}
+	}
+	return syncmanager.OpenRepository(cfg)
+}
+
+func repositorySnapshots(cmd *cobra.Command, args []string) error {
+	repo, err := openRepositoryArg(args[0])
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	subvolumes, err := repo.Subvolumes()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "SUBVOLUME\tSNAPSHOT\tUUID\tTAKEN\tSIZE\tCHUNKS")
+	for _, subvolume := range subvolumes {
+		indexes, err := repo.Snapshots(subvolume)
+		if err != nil {
+			return err
+		}
+		for _, idx := range indexes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\n",
+				idx.Subvolume, idx.Name, idx.UUID, formatFindTime(idx.CreationTime), idx.Size, len(idx.Chunks))
+		}
+	}
+	return nil
+}
+
+func repositoryCheck(cmd *cobra.Command, args []string) error {
+	repo, err := openRepositoryArg(args[0])
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	res, err := repo.Check(context.Background(), repoReadData)
+	if err != nil {
+		return err
+	}
+	printCheckResult(cmd.OutOrStdout(), res)
+	if !res.OK() {
+		return errors.New("repository has broken snapshots, run repair to remove them")
+	}
+	return nil
+}
+
+func repositoryRepair(cmd *cobra.Command, args []string) error {
+	repo, err := openRepositoryArg(args[0])
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	res, err := repo.Repair(context.Background(), repoReadData)
+	if err != nil {
+		return err
+	}
+	printCheckResult(cmd.OutOrStdout(), res)
+	fmt.Fprintf(cmd.OutOrStdout(), "Removed %d broken snapshots, %d corrupt chunks, %d unreferenced chunks, %d leftover files and %d stale locks\n",
+		len(res.BrokenSnapshots), len(res.CorruptChunks), len(res.UnreferencedChunks), len(res.TempFiles), res.StaleLocks)
+	return nil
+}
+
+func printCheckResult(w io.Writer, res *repository.CheckResult) {
+	fmt.Fprintf(w, "Checked %d snapshots and %d chunks\n", res.Snapshots, res.Chunks)
+	for _, name := range res.BrokenSnapshots {
+		fmt.Fprintf(w, "Broken snapshot: %s\n", name)
+	}
+	for _, id := range res.MissingChunks {
+		fmt.Fprintf(w, "Missing chunk: %s\n", id)
+	}
+	for _, id := range res.CorruptChunks {
+		fmt.Fprintf(w, "Corrupt chunk: %s\n", id)
+	}
+	if n := len(res.UnreferencedChunks); n > 0 {
+		fmt.Fprintf(w, "Unreferenced chunks: %d\n", n)
+	}
+	if n := len(res.TempFiles); n > 0 {
+		fmt.Fprintf(w, "Leftover files: %d\n", n)
+	}
+	if res.StaleLocks > 0 {
+		fmt.Fprintf(w, "Stale locks: %d\n", res.StaleLocks)
+	}
+	if res.OK() {
+		fmt.Fprintln(w, "No errors were found")
+	}
+}
+
+func repositoryDump(cmd *cobra.Command, args []string) error {
+	repo, err := openRepositoryArg(args[0])
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	idx, err := repo.Snapshot(args[1], args[2])
+	if err != nil {
+		return err
+	}
+	var dest *os.File
+	if repoDumpFile != "" {
+		logLevel(0, "Writing stream to file %s", repoDumpFile)
+		if dest, err = os.Create(repoDumpFile); err != nil {
+			return err
+		}
+		defer dest.Close()
+	} else {
+		if _, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ); err == nil {
+			return errors.New("stdout is a terminal, please specify an output file")
+		}
+		dest = os.Stdout
+	}
+	stream := repo.OpenSnapshot(idx)
+	defer stream.Close()
+	if _, err := io.Copy(dest, stream); err != nil {
+		return fmt.Errorf("error writing stream: %w", err)
+	}
+	return nil
+}
+
+func repositoryRotateKey(cmd *cobra.Command, args []string) error {
+	repo, err := openRepositoryArg(args[0])
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	if !repo.Encrypted() {
+		return errors.New("repository is not encrypted")
+	}
+	lock, err := repo.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	keys := repo.Keys()
+	if err := repo.RotateKeys(keys[:1]); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Repository can now only be opened with key %s\n", keys.Primary().ID())
+	return nil
+}
@@ -0,0 +1,259 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/syncmanager"
+)
+
+var (
+	restoreSnapshot string
+	restoreAt       string
+	restoreFrom     string
+	restoreReplace  bool
+	restoreList     bool
+	restoreLabel    string
+)
+
+func NewRestoreCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore [flags] <volume:subvolume> <dest>",
+		Short: "Restore a snapshot of a subvolume from a mirror",
+		Long: `Restore a snapshot of a subvolume from a mirror.
+
+The snapshot is received as a new read-only subvolume in the dest directory. The latest
+snapshot in the mirror is restored unless --snapshot or --at selects another one, and
+the first mirror of the subvolume is used unless --from names another one. With --label
+only the snapshots given that label are considered.
+
+Subvolume mirrors send the snapshot back, compressed mirrors receive the chain of
+streams from the last full send up to the snapshot, repositories reassemble the stream
+and directory mirrors are copied into a new subvolume. Plain directory mirrors only
+hold the latest snapshot.
+
+With --replace a writable snapshot of the restored subvolume is swapped into the place
+of the original subvolume with a single atomic rename, and the original is kept next to
+it. The dest directory must then be on the same filesystem as the subvolume. The local
+snapshots of the original keep being managed for the restored subvolume.`,
+		Args: cobra.ExactArgs(2),
+		RunE: runRestore,
+	}
+	cmd.Flags().StringVarP(&restoreSnapshot, "snapshot", "s", "", "name of the snapshot to restore")
+	cmd.Flags().StringVar(&restoreAt, "at", "", "restore the latest snapshot taken at or before this time (a date, RFC3339 time or a duration ago)")
+	cmd.Flags().StringVarP(&restoreFrom, "from", "m", "", "name of the mirror to restore from")
+	cmd.Flags().BoolVar(&restoreReplace, "replace", false, "replace the original subvolume with the restored snapshot")
+	cmd.Flags().BoolVarP(&restoreList, "list", "l", false, "list the snapshots in the mirror instead of restoring")
+	cmd.Flags().StringVar(&restoreLabel, "label", "", "only consider the snapshots with this label")
+	addKeyFlag(cmd.Flags())
+	return cmd
+}
+
+func runRestore(cmd *cobra.Command, args []string) error {
+	if restoreSnapshot != "" && restoreAt != "" {
+		return errors.New("--snapshot and --at cannot be used together")
+	}
+	at, err := parseTimeArg(restoreAt)
+	if err != nil {
+		return fmt.Errorf("invalid --at: %w", err)
+	}
+	vol, subvol, err := resolveSubvolumeArg(args[0])
+	if err != nil {
+		return err
+	}
+	mirror, err := resolveRestoreMirror(vol, subvol, restoreFrom)
+	if err != nil {
+		return err
+	}
+	if mirror.Format == config.MirrorFormatDirectory && (restoreSnapshot != "" || restoreAt != "") {
+		return fmt.Errorf("mirror %q only holds the latest snapshot", mirror.Name)
+	}
+	cfg := newSyncConfig(vol, subvol, mirror)
+	if len(keyRefs) > 0 {
+		cfg.EncryptionKeys = keyRefs
+	}
+	restorer, err := syncmanager.NewRestorer(cfg)
+	if err != nil {
+		return err
+	}
+	defer restorer.Close()
+
+	ctx := context.Background()
+	snaps, err := restorer.Snapshots(ctx)
+	if err != nil {
+		return err
+	}
+	metadata, err := syncmanager.MirrorMetadata(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if restoreLabel != "" {
+		labeled := make([]*syncmanager.RestorePoint, 0, len(snaps))
+		for _, snap := range snaps {
+			if metadata[snap.Name].HasLabel(restoreLabel) {
+				labeled = append(labeled, snap)
+			}
+		}
+		snaps = labeled
+	}
+	if restoreList {
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		defer w.Flush()
+		fmt.Fprintln(w, "SNAPSHOT\tTAKEN\tLABELS\tNOTE")
+		for _, snap := range snaps {
+			var labels []string
+			var note string
+			if m := metadata[snap.Name]; m != nil {
+				labels, note = m.Labels, m.Note
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", snap.Name, formatFindTime(snap.CreationTime), formatLabels(labels), note)
+		}
+		return nil
+	}
+	snap, err := selectRestorePoint(snaps, restoreSnapshot, at)
+	if err != nil {
+		if restoreLabel != "" {
+			return fmt.Errorf("%w with label %q in mirror %q", err, restoreLabel, mirror.Name)
+		}
+		return fmt.Errorf("%w in mirror %q", err, mirror.Name)
+	}
+
+	dest := args[1]
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	logLevel(0, "Restoring snapshot %q from mirror %q to %q", snap.Name, mirror.Name, dest)
+	restored, err := restorer.Restore(ctx, snap, dest)
+	if err != nil {
+		return err
+	}
+	logLevel(0, "Restored snapshot %q to %q", snap.Name, restored)
+	if !restoreReplace {
+		return nil
+	}
+	original := filepath.Join(vol.Path, subvol.Path)
+	if _, err := os.Lstat(original); err == nil {
+		info, err := btrfs.SubvolumeSearch(btrfs.SearchWithPath(original))
+		if err != nil {
+			return fmt.Errorf("failed to look up subvolume: %w", err)
+		}
+		// The restored subvolume does not always descend from the original, so the
+		// original is recorded to keep finding its snapshots. It is recorded before
+		// the swap, so a replaced subvolume is never left without a record.
+		if err := snaputil.RecordReplaced(conf.ResolveSnapshotPath(vol.GetName(), subvol.GetName()), subvol.GetSnapshotName(vol.GetName()), info.UUID); err != nil {
+			return err
+		}
+	}
+	kept, err := replaceSubvolume(restored, original, conf.ResolveTimeFormat(vol.GetName(), subvol.GetName()))
+	if err != nil {
+		return err
+	}
+	if kept != "" {
+		logLevel(0, "Replaced %q, the original subvolume was kept at %q", original, kept)
+	} else {
+		logLevel(0, "Created %q from the restored snapshot", original)
+	}
+	return nil
+}
+
+// resolveRestoreMirror returns the named mirror of a subvolume, or its first mirror if
+// no name is given.
+func resolveRestoreMirror(vol *config.Volume, subvol *config.Subvolume, name string) (*config.Mirror, error) {
+	mirrors := conf.ResolveMirrors(vol.GetName(), subvol.GetName())
+	for _, m := range mirrors {
+		if name == "" || m.Name == name {
+			return &m, nil
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no mirrors are configured for %s:%s", vol.GetName(), subvol.GetName())
+	}
+	return nil, fmt.Errorf("mirror %q is not configured for %s:%s", name, vol.GetName(), subvol.GetName())
+}
+
+// selectRestorePoint returns the named snapshot, the latest snapshot taken at or
+// before a time, or the latest snapshot.
+func selectRestorePoint(snaps []*syncmanager.RestorePoint, name string, at time.Time) (*syncmanager.RestorePoint, error) {
+	if name != "" {
+		for _, snap := range snaps {
+			if snap.Name == name {
+				return snap, nil
+			}
+		}
+		return nil, fmt.Errorf("snapshot %q not found", name)
+	}
+	for i := len(snaps) - 1; i >= 0; i-- {
+		if at.IsZero() || (!snaps[i].CreationTime.IsZero() && !snaps[i].CreationTime.After(at)) {
+			return snaps[i], nil
+		}
+	}
+	if at.IsZero() {
+		return nil, errors.New("no snapshots found")
+	}
+	return nil, fmt.Errorf("no snapshot taken before %s found", at.Format(time.RFC3339))
+}
+
+// replaceSubvolume swaps a writable snapshot of a restored subvolume into the place of
+// the original subvolume, and returns the path the original is kept at. The swap is a
+// single rename, so the original path always holds one of the two.
+func replaceSubvolume(restored, original, timeFormat string) (kept string, err error) {
+	staging := original + ".btrsync-restore"
+	if _, err := os.Lstat(staging); err == nil {
+		return "", fmt.Errorf("%q already exists", staging)
+	}
+	logLevel(1, "Creating writable snapshot of %q at %q", restored, staging)
+	if err := btrfs.CreateSnapshot(restored, btrfs.WithSnapshotPath(staging)); err != nil {
+		return "", fmt.Errorf("failed to snapshot restored subvolume: %w", err)
+	}
+	if _, err := os.Lstat(original); os.IsNotExist(err) {
+		if err := os.Rename(staging, original); err != nil {
+			return "", removeStaging(staging, fmt.Errorf("failed to move %q into place: %w", staging, err))
+		}
+		return "", nil
+	}
+	logLevel(1, "Exchanging %q with %q", staging, original)
+	if err := unix.Renameat2(unix.AT_FDCWD, staging, unix.AT_FDCWD, original, unix.RENAME_EXCHANGE); err != nil {
+		return "", removeStaging(staging, fmt.Errorf("failed to swap %q into place: %w", staging, err))
+	}
+	kept = fmt.Sprintf("%s.replaced.%s", original, time.Now().Format(timeFormat))
+	if err := os.Rename(staging, kept); err != nil {
+		return staging, fmt.Errorf("failed to rename original subvolume: %w", err)
+	}
+	return kept, nil
+}
+
+// removeStaging deletes the writable snapshot of a swap that failed with err, so it
+// does not block the next attempt, and returns err.
+func removeStaging(staging string, err error) error {
+	logLevel(1, "Removing %q", staging)
+	if rerr := btrfs.DeleteSnapshot(staging); rerr != nil {
+		return fmt.Errorf("%w, and failed to remove %q: %s", err, staging, rerr)
+	}
+	return err
+}
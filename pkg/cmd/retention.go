@@ -0,0 +1,154 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/retention"
+)
+
+var (
+	simulatePolicy   string
+	simulateMirror   string
+	simulateInterval time.Duration
+	simulateDays     int
+	simulateEvery    time.Duration
+	simulateList     bool
+)
+
+func NewRetentionCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:   "retention",
+		Short: "Work with snapshot retention policies",
+	}
+
+	simulate := &cobra.Command{
+		Use:   "simulate [flags] [volume:subvolume]",
+		Short: "Simulate a retention policy over a synthetic timeline of snapshots",
+		Long: `Simulate a retention policy over a synthetic timeline of snapshots.
+
+A snapshot is taken every --interval for --days, and the policy prunes the snapshots
+after each one like a run does. The snapshots that survive are summarized every
+--every, and listed with the rules that keep them at the end.
+
+The policy is given with --policy as comma-separated settings, for example
+"keep_within=24h,daily=7,weekly=4,monthly=12,yearly=2". Otherwise the policy of the
+mirror named by --mirror or of the given subvolume is simulated.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: retentionSimulate,
+	}
+	simulate.Flags().StringVarP(&simulatePolicy, "policy", "p", "", "the retention policy to simulate")
+	simulate.Flags().StringVarP(&simulateMirror, "mirror", "m", "", "simulate the retention policy of the named mirror")
+	simulate.Flags().DurationVar(&simulateInterval, "interval", time.Hour, "the interval between snapshots")
+	simulate.Flags().IntVar(&simulateDays, "days", 30, "the number of days to simulate")
+	simulate.Flags().DurationVar(&simulateEvery, "every", 24*time.Hour, "how often to summarize the surviving snapshots")
+	simulate.Flags().BoolVarP(&simulateList, "list", "l", false, "list the surviving snapshots in every summary")
+
+	root.AddCommand(simulate)
+	return root
+}
+
+func retentionSimulate(cmd *cobra.Command, args []string) error {
+	policy, err := simulatedPolicy(args)
+	if err != nil {
+		return err
+	}
+	if simulateInterval <= 0 {
+		return errors.New("--interval must be positive")
+	}
+	if simulateDays <= 0 {
+		return errors.New("--days must be positive")
+	}
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "Simulating %s with a snapshot every %s for %d days\n\n", policy, simulateInterval, simulateDays)
+
+	start := time.Now().Truncate(simulateInterval)
+	end := start.Add(time.Duration(simulateDays) * 24 * time.Hour)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tTAKEN\tKEPT\tOLDEST")
+	var taken int
+	var last time.Time
+	var final []*retention.Decision
+	retention.Simulate(policy, start, end, simulateInterval, config.DefaultTimeFormat, func(now time.Time, decisions []*retention.Decision) {
+		taken++
+		final = decisions
+		if now.Sub(last) < simulateEvery && !now.Add(simulateInterval).After(end) {
+			return
+		}
+		last = now
+		var kept []*retention.Decision
+		for _, d := range decisions {
+			if d.Keep {
+				kept = append(kept, d)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", formatFindTime(now), taken, len(kept), formatFindTime(kept[len(kept)-1].Time))
+		if simulateList {
+			for _, d := range kept {
+				fmt.Fprintf(w, "\t\t\t%s\n", d.Name)
+			}
+		}
+	})
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "\nSnapshots kept at the end of the simulation:\n\n")
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SNAPSHOT\tKEPT BY")
+	for _, d := range final {
+		if d.Keep {
+			fmt.Fprintf(w, "%s\t%s\n", d.Name, d.Reason())
+		}
+	}
+	return w.Flush()
+}
+
+// simulatedPolicy returns the policy given on the command line, or the policy of the
+// mirror or subvolume it names.
+func simulatedPolicy(args []string) (config.RetentionPolicy, error) {
+	switch {
+	case simulatePolicy != "":
+		policy, err := config.ParseRetentionPolicy(simulatePolicy)
+		if err != nil {
+			return policy, fmt.Errorf("invalid --policy: %w", err)
+		}
+		return policy, nil
+	case simulateMirror != "":
+		mirror := conf.GetMirror(simulateMirror)
+		if mirror == nil {
+			return config.RetentionPolicy{}, fmt.Errorf("mirror %q is not configured", simulateMirror)
+		}
+		if mirror.Retention == nil {
+			return config.RetentionPolicy{}, fmt.Errorf("mirror %q has no retention policy", simulateMirror)
+		}
+		return *mirror.Retention, nil
+	case len(args) == 1:
+		vol, subvol, err := resolveSubvolumeArg(args[0])
+		if err != nil {
+			return config.RetentionPolicy{}, err
+		}
+		return conf.ResolveRetention(vol.GetName(), subvol.GetName()), nil
+	}
+	return config.RetentionPolicy{}, errors.New("a --policy, --mirror or subvolume is required")
+}
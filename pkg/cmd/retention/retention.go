@@ -0,0 +1,196 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package retention applies grandfather-father-son retention policies to snapshots.
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+)
+
+// Snapshot is a snapshot a retention policy is applied to.
+type Snapshot struct {
+	Name string
+	Time time.Time
+}
+
+// Decision is the outcome of a retention policy for a snapshot.
+type Decision struct {
+	Snapshot
+	// Keep is true if the policy retains the snapshot.
+	Keep bool
+	// Reasons are the rules that retain the snapshot, or why it expired.
+	Reasons []string
+}
+
+// Reason returns the reasons of the decision as a single string.
+func (d *Decision) Reason() string { return strings.Join(d.Reasons, "; ") }
+
+// rule keeps the newest snapshot in each of the most recent count calendar groups.
+type rule struct {
+	name  string
+	count int
+	group func(time.Time) string
+}
+
+func rules(policy config.RetentionPolicy) []rule {
+	return []rule{
+		{"hourly", policy.Hourly, func(t time.Time) string { return t.Format("2006-01-02 15h") }},
+		{"daily", policy.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", policy.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", policy.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", policy.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+}
+
+// NewPeriod returns the name of the first calendar period the policy keeps snapshots of
+// that the time now is in, but a snapshot taken at last is not. It returns false if
+// now is in the same periods as last.
+func NewPeriod(policy config.RetentionPolicy, last, now time.Time) (string, bool) {
+	for _, r := range rules(policy) {
+		if r.count > 0 && r.group(last) != r.group(now) {
+			return fmt.Sprintf("%s %s", r.name, r.group(now)), true
+		}
+	}
+	return "", false
+}
+
+// Apply applies a policy to snapshots at the time now and returns a decision for each
+// snapshot, newest first. The newest snapshot and snapshots without a time are always
+// kept.
+func Apply(policy config.RetentionPolicy, now time.Time, snapshots []Snapshot) []*Decision {
+	decisions := make([]*Decision, len(snapshots))
+	for i, snap := range snapshots {
+		decisions[i] = &Decision{Snapshot: snap}
+	}
+	sort.SliceStable(decisions, func(i, j int) bool {
+		return decisions[i].Time.After(decisions[j].Time)
+	})
+	keep := func(d *Decision, reason string) {
+		d.Keep = true
+		d.Reasons = append(d.Reasons, reason)
+	}
+	dated := decisions[:0:0]
+	for _, d := range decisions {
+		if d.Time.IsZero() {
+			keep(d, "creation time unknown")
+			continue
+		}
+		dated = append(dated, d)
+	}
+	if len(dated) > 0 {
+		keep(dated[0], "latest")
+	}
+	within := time.Duration(policy.KeepWithin)
+	if within > 0 {
+		for _, d := range dated {
+			if now.Sub(d.Time) <= within {
+				keep(d, fmt.Sprintf("within %s", within))
+			}
+		}
+	}
+	var active []rule
+	for _, r := range rules(policy) {
+		if r.count > 0 {
+			active = append(active, r)
+		}
+	}
+	// The snapshot kept for each group of each rule
+	kept := make([]map[string]*Decision, len(active))
+	for i, r := range active {
+		kept[i] = make(map[string]*Decision)
+		var last string
+		for _, d := range dated {
+			if len(kept[i]) == r.count {
+				break
+			}
+			group := r.group(d.Time)
+			if group == last {
+				continue
+			}
+			last = group
+			kept[i][group] = d
+			keep(d, fmt.Sprintf("%s %s", r.name, group))
+		}
+	}
+	// Explain why each rule did not keep the expired snapshots
+	for _, d := range dated {
+		if d.Keep {
+			continue
+		}
+		if within > 0 {
+			d.Reasons = append(d.Reasons, fmt.Sprintf("older than %s", within))
+		}
+		for i, r := range active {
+			group := r.group(d.Time)
+			if newer, ok := kept[i][group]; ok {
+				d.Reasons = append(d.Reasons, fmt.Sprintf("%s %s keeps %s", r.name, group, newer.Name))
+			} else {
+				d.Reasons = append(d.Reasons, fmt.Sprintf("older than the %d %s periods kept", r.count, r.name))
+			}
+		}
+		if len(d.Reasons) == 0 {
+			d.Reasons = append(d.Reasons, "not kept by any rule")
+		}
+	}
+	return decisions
+}
+
+// Partition applies a policy to btrfs snapshots at the time now, and returns the
+// snapshots it keeps and the decisions for the snapshots that expired.
+func Partition(policy config.RetentionPolicy, now time.Time, snapshots []*btrfs.RootInfo) (keep []*btrfs.RootInfo, expire []*Decision) {
+	byName := make(map[string]*btrfs.RootInfo, len(snapshots))
+	snaps := make([]Snapshot, len(snapshots))
+	for i, info := range snapshots {
+		byName[info.Name] = info
+		snaps[i] = Snapshot{Name: info.Name, Time: info.CreationTime}
+	}
+	for _, d := range Apply(policy, now, snaps) {
+		if d.Keep {
+			keep = append(keep, byName[d.Name])
+		} else {
+			expire = append(expire, d)
+		}
+	}
+	return keep, expire
+}
+
+// Simulate simulates taking a snapshot every interval from start until end, pruning
+// with the policy after each snapshot like a run does. The snapshots are named by their
+// time in the given format. fn is called after each prune with the time and the
+// decisions for the snapshots that existed, newest first.
+func Simulate(policy config.RetentionPolicy, start, end time.Time, interval time.Duration, timeFormat string, fn func(now time.Time, decisions []*Decision)) {
+	var snapshots []Snapshot
+	for now := start; !now.After(end); now = now.Add(interval) {
+		snapshots = append(snapshots, Snapshot{Name: now.Format(timeFormat), Time: now})
+		decisions := Apply(policy, now, snapshots)
+		snapshots = snapshots[:0]
+		for _, d := range decisions {
+			if d.Keep {
+				snapshots = append(snapshots, d.Snapshot)
+			}
+		}
+		fn(now, decisions)
+	}
+}
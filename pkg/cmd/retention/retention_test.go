@@ -0,0 +1,233 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package retention
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    config.RetentionPolicy
+		now       string
+		snapshots []string
+		want      []string
+	}{
+		{
+			name:   "daily keeps the newest snapshot of each day",
+			policy: config.RetentionPolicy{Daily: 2},
+			now:    "2022-11-03 12:00",
+			snapshots: []string{
+				"2022-11-01 08:00", "2022-11-01 20:00",
+				"2022-11-02 08:00", "2022-11-02 20:00",
+				"2022-11-03 08:00",
+			},
+			want: []string{"2022-11-03 08:00", "2022-11-02 20:00"},
+		},
+		{
+			name:   "ISO weeks spanning the new year are one week",
+			policy: config.RetentionPolicy{Weekly: 2},
+			now:    "2021-01-05 12:00",
+			snapshots: []string{
+				// 2020-W52
+				"2020-12-27 12:00",
+				// 2020-W53 runs from Monday 2020-12-28 to Sunday 2021-01-03
+				"2020-12-28 12:00", "2020-12-31 12:00", "2021-01-03 12:00",
+				// 2021-W01
+				"2021-01-04 12:00",
+			},
+			want: []string{"2021-01-04 12:00", "2021-01-03 12:00"},
+		},
+		{
+			name:   "ISO week 1 can start in the previous year",
+			policy: config.RetentionPolicy{Weekly: 1},
+			now:    "2020-01-02 12:00",
+			snapshots: []string{
+				// 2019-12-30 is in 2020-W01
+				"2019-12-29 12:00", "2019-12-30 12:00", "2020-01-01 12:00",
+			},
+			want: []string{"2020-01-01 12:00"},
+		},
+		{
+			name:   "years and months split at the new year",
+			policy: config.RetentionPolicy{Monthly: 2, Yearly: 2},
+			now:    "2022-01-15 12:00",
+			snapshots: []string{
+				"2020-06-01 12:00",
+				"2021-11-30 12:00",
+				"2021-12-01 12:00", "2021-12-31 23:00",
+				"2022-01-01 00:00",
+			},
+			want: []string{"2022-01-01 00:00", "2021-12-31 23:00"},
+		},
+		{
+			name:   "yearly keeps the newest snapshot of each year",
+			policy: config.RetentionPolicy{Yearly: 3},
+			now:    "2022-06-01 12:00",
+			snapshots: []string{
+				"2019-12-31 12:00",
+				"2020-01-01 12:00", "2020-12-31 12:00",
+				"2021-12-31 12:00",
+				"2022-01-01 12:00",
+			},
+			want: []string{"2022-01-01 12:00", "2021-12-31 12:00", "2020-12-31 12:00"},
+		},
+		{
+			name:   "gaps without snapshots are not counted",
+			policy: config.RetentionPolicy{Daily: 3},
+			now:    "2022-11-30 12:00",
+			snapshots: []string{
+				"2022-11-01 12:00", "2022-11-02 12:00",
+				"2022-11-10 12:00",
+				"2022-11-29 12:00",
+			},
+			want: []string{"2022-11-29 12:00", "2022-11-10 12:00", "2022-11-02 12:00"},
+		},
+		{
+			name:   "keep within and rules combine",
+			policy: config.RetentionPolicy{KeepWithin: config.Duration(2 * time.Hour), Daily: 2},
+			now:    "2022-11-02 12:00",
+			snapshots: []string{
+				"2022-11-01 10:00", "2022-11-01 11:00",
+				"2022-11-02 09:00", "2022-11-02 10:00", "2022-11-02 11:00",
+			},
+			want: []string{"2022-11-02 11:00", "2022-11-02 10:00", "2022-11-01 11:00"},
+		},
+		{
+			name:      "the latest snapshot is always kept",
+			policy:    config.RetentionPolicy{KeepWithin: config.Duration(time.Hour)},
+			now:       "2022-11-02 12:00",
+			snapshots: []string{"2022-11-01 10:00", "2022-11-01 11:00"},
+			want:      []string{"2022-11-01 11:00"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var snapshots []Snapshot
+			for _, s := range tc.snapshots {
+				snapshots = append(snapshots, Snapshot{Name: s, Time: date(s)})
+			}
+			var got []string
+			for _, d := range Apply(tc.policy, date(tc.now), snapshots) {
+				if d.Keep {
+					got = append(got, d.Name)
+				} else if len(d.Reasons) == 0 {
+					t.Errorf("expired snapshot %s has no reason", d.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("kept %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyUnknownTime(t *testing.T) {
+	decisions := Apply(config.RetentionPolicy{Daily: 1}, date("2022-11-02 12:00"), []Snapshot{
+		{Name: "unknown"},
+		{Name: "old", Time: date("2022-10-01 12:00")},
+		{Name: "new", Time: date("2022-11-02 11:00")},
+	})
+	for _, d := range decisions {
+		if want := d.Name != "old"; d.Keep != want {
+			t.Errorf("%s: keep = %v, want %v", d.Name, d.Keep, want)
+		}
+	}
+}
+
+func TestNewPeriod(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    config.RetentionPolicy
+		last, now string
+		want      string
+	}{
+		{
+			name:   "same hour",
+			policy: config.RetentionPolicy{Hourly: 24},
+			last:   "2022-11-02 10:05",
+			now:    "2022-11-02 10:55",
+		},
+		{
+			name:   "next hour",
+			policy: config.RetentionPolicy{Hourly: 24, Daily: 7},
+			last:   "2022-11-02 10:55",
+			now:    "2022-11-02 11:05",
+			want:   "hourly 2022-11-02 11h",
+		},
+		{
+			name:   "next day",
+			policy: config.RetentionPolicy{Daily: 7},
+			last:   "2022-11-02 23:59",
+			now:    "2022-11-03 00:01",
+			want:   "daily 2022-11-03",
+		},
+		{
+			name:   "same ISO week across the new year",
+			policy: config.RetentionPolicy{Weekly: 4},
+			last:   "2020-12-28 12:00",
+			now:    "2021-01-03 12:00",
+		},
+		{
+			name:   "next ISO week",
+			policy: config.RetentionPolicy{Weekly: 4},
+			last:   "2021-01-03 12:00",
+			now:    "2021-01-04 12:00",
+			want:   "weekly 2021-W01",
+		},
+		{
+			name:   "next month",
+			policy: config.RetentionPolicy{Monthly: 12, Yearly: 5},
+			last:   "2022-10-31 12:00",
+			now:    "2022-11-01 12:00",
+			want:   "monthly 2022-11",
+		},
+		{
+			name:   "next year",
+			policy: config.RetentionPolicy{Yearly: 5},
+			last:   "2022-12-31 23:00",
+			now:    "2023-01-01 01:00",
+			want:   "yearly 2023",
+		},
+		{
+			name:   "keep within only has no periods",
+			policy: config.RetentionPolicy{KeepWithin: config.Duration(time.Hour)},
+			last:   "2022-01-01 12:00",
+			now:    "2022-11-01 12:00",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := NewPeriod(tc.policy, date(tc.last), date(tc.now))
+			if ok != (tc.want != "") || got != tc.want {
+				t.Errorf("got %q, %v, want %q", got, ok, tc.want)
+			}
+		})
+	}
+}
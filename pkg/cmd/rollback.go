@@ -0,0 +1,137 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snapmanager"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+)
+
+func NewRollbackCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rollback [flags] <volume:subvolume> <snapshot>",
+		Short: "Roll a subvolume back to one of its local snapshots",
+		Long: `Roll a subvolume back to one of its local snapshots.
+
+A snapshot of the current state of the subvolume is taken first, so the rollback can be
+undone by rolling back to it. A writable snapshot of the chosen snapshot is then swapped
+into the place of the subvolume with a single atomic rename, and the replaced subvolume
+is kept next to it. The local snapshots of the replaced subvolume keep being managed
+for the new one.
+
+If the subvolume was the default subvolume of the filesystem, the new subvolume is made
+the default. Mounts of the subvolume keep showing the replaced subvolume until they are
+remounted, and mounts by subvolid= need the ID of the new subvolume.`,
+		Args: cobra.ExactArgs(2),
+		RunE: rollback,
+	}
+}
+
+func rollback(cmd *cobra.Command, args []string) error {
+	vol, subvol, err := resolveSubvolumeArg(args[0])
+	if err != nil {
+		return err
+	}
+	volumeName, subvolName := vol.GetName(), subvol.GetName()
+	original := filepath.Join(vol.Path, subvol.Path)
+	snapDir := conf.ResolveSnapshotPath(volumeName, subvolName)
+	timeFormat := conf.ResolveTimeFormat(volumeName, subvolName)
+	manager, err := snapmanager.New(&snapmanager.Config{
+		FullSubvolumePath: original,
+		SnapshotName:      subvol.GetSnapshotName(volumeName),
+		SnapshotDirectory: snapDir,
+		TimeFormat:        timeFormat,
+		Logger:            logger,
+		Verbosity:         conf.Verbosity,
+	})
+	if err != nil {
+		return err
+	}
+	snap := snaputil.GetSnapshotByName(manager.Snapshots(), filepath.Base(args[1]))
+	if snap == nil {
+		return fmt.Errorf("snapshot %q of %s:%s not found", args[1], volumeName, subvolName)
+	}
+
+	mounts, err := btrfs.ListBtrfsMounts()
+	if err != nil {
+		return err
+	}
+	abspath, err := filepath.Abs(original)
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		if mount.Path == abspath {
+			return fmt.Errorf("%q is a mount point, configure the subvolume by its path from the top-level subvolume to roll it back", original)
+		}
+	}
+	info, err := btrfs.SubvolumeSearch(btrfs.SearchWithPath(original))
+	if err != nil {
+		return fmt.Errorf("failed to look up subvolume: %w", err)
+	}
+	defaultID, err := btrfs.GetDefaultSubvolume(original)
+	if err != nil {
+		return err
+	}
+
+	logLevel(0, "Creating a snapshot of the current state of %q", original)
+	safety, err := manager.CreateSnapshot()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot current state: %w", err)
+	}
+	logLevel(0, "Current state saved to %q", safety)
+
+	// The lineage is written before the swap, so a rolled back subvolume is never left
+	// without a record of the one it replaced. Recording the current UUID is harmless
+	// if the swap then fails.
+	if err := snaputil.RecordReplaced(snapDir, subvol.GetSnapshotName(volumeName), info.UUID); err != nil {
+		return err
+	}
+	logLevel(0, "Rolling %q back to snapshot %q", original, snap.Name)
+	kept, err := replaceSubvolume(filepath.Join(snapDir, snap.Name), original, timeFormat)
+	if err != nil {
+		return err
+	}
+	logLevel(0, "Rolled back %q, the replaced subvolume was kept at %q", original, kept)
+
+	newInfo, err := btrfs.SubvolumeSearch(btrfs.SearchWithPath(original))
+	if err != nil {
+		return fmt.Errorf("failed to look up rolled back subvolume: %w", err)
+	}
+	if defaultID == info.RootID {
+		logLevel(0, "Setting subvolume %d as the default subvolume", newInfo.RootID)
+		if err := btrfs.SetDefaultSubvolume(original, newInfo.RootID); err != nil {
+			return fmt.Errorf("failed to set default subvolume: %w", err)
+		}
+	}
+	subvolid := "subvolid=" + strconv.FormatUint(uint64(info.RootID), 10)
+	for _, mount := range mounts {
+		for _, opt := range mount.Options {
+			if opt == subvolid {
+				logLevel(0, "WARNING: %q is mounted from the replaced subvolume, remount it to use the rolled back state", mount.Path)
+				logLevel(0, "Mounts by subvolid= must use subvolid=%d", newInfo.RootID)
+			}
+		}
+	}
+	return nil
+}
@@ -77,10 +77,18 @@ from a btrsync.toml file. The config file is searched for in the following locat
 	rootCommand.AddCommand(NewRunCommand())
 	rootCommand.AddCommand(NewSendCommand())
 	rootCommand.AddCommand(NewReceiveCommand())
+	rootCommand.AddCommand(NewRestoreCommand())
+	rootCommand.AddCommand(NewRollbackCommand())
+	rootCommand.AddCommand(NewSnapshotCommand())
 	rootCommand.AddCommand(NewPruneCommand())
+	rootCommand.AddCommand(NewRetentionCommand())
 	rootCommand.AddCommand(NewTreeCommand())
 	rootCommand.AddCommand(NewMountCommand())
+	rootCommand.AddCommand(NewDiffCommand())
+	rootCommand.AddCommand(NewFindCommand())
 	rootCommand.AddCommand(NewConfigCommand())
+	rootCommand.AddCommand(NewRepositoryCommand())
+	rootCommand.AddCommand(NewVerifyCommand())
 
 	return rootCommand
 }
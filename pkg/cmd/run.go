@@ -17,11 +17,14 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"path/filepath"
 	"time"
 
 	"github.com/spf13/cobra"
 
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/hooks"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/queue"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/snapmanager"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/syncmanager"
@@ -101,16 +104,18 @@ func handleSnapshots() error {
 				sourcePath := filepath.Join(vol.Path, subvol.Path)
 				logLevel(2, "Initiating snapshot manager for %s/%s...", vol.Path, subvol.Path)
 				manager, err := snapmanager.New(&snapmanager.Config{
-					FullSubvolumePath:         sourcePath,
-					SnapshotName:              subvol.GetSnapshotName(volumeName),
-					SnapshotDirectory:         snapDir,
-					SnapshotInterval:          conf.ResolveSnapshotInterval(volumeName, subvolName),
-					SnapshotMinimumRetention:  conf.ResolveSnapshotMinimumRetention(volumeName, subvolName),
-					SnapshotRetention:         conf.ResolveSnapshotRetention(volumeName, subvolName),
-					SnapshotRetentionInterval: conf.ResolveSnapshotRetentionInterval(volumeName, subvolName),
-					TimeFormat:                conf.ResolveTimeFormat(volumeName, subvolName),
-					Logger:                    logger,
-					Verbosity:                 conf.Verbosity,
+					FullSubvolumePath: sourcePath,
+					SnapshotName:      subvol.GetSnapshotName(volumeName),
+					SnapshotDirectory: snapDir,
+					SnapshotInterval:  conf.ResolveSnapshotInterval(volumeName, subvolName),
+					SkipUnchanged:     conf.ResolveSnapshotSkipUnchanged(volumeName, subvolName),
+					MaxSnapshotAge:    conf.ResolveSnapshotMaxAge(volumeName, subvolName),
+					Retention:         conf.ResolveRetention(volumeName, subvolName),
+					Mirrors:           conf.ResolveMirrors(volumeName, subvolName),
+					TimeFormat:        conf.ResolveTimeFormat(volumeName, subvolName),
+					Hooks:             newHookRunner(vol, subvol, nil),
+					Logger:            logger,
+					Verbosity:         conf.Verbosity,
 				})
 				if err != nil {
 					return err
@@ -152,43 +157,139 @@ func handleSync() error {
 				continue
 			}
 			logLevel(0, "Running sync for subvolume %s/%s...", vol.Path, subvol.Path)
-			snapDir := conf.ResolveSnapshotPath(volumeName, subvolName)
-			sourcePath := filepath.Join(vol.Path, subvol.Path)
-			for _, m := range mirrors {
-				mirror := m
-				queue.Push(func() error {
+			queue.Push(func() (err error) {
+				// Every mirror of the subvolume is synced together so that each
+				// snapshot only needs to be sent once.
+				var managers []syncmanager.Manager
+				var synced []*syncmanager.Config
+				var hooked []*mirrorHooks
+				var replErr *syncmanager.ReplicationError
+				hookFailures := make(map[string]error)
+				defer func() {
+					// The post_sync hooks of every mirror whose pre_sync hooks ran are
+					// told how its sync went
+					for _, h := range hooked {
+						result := hookFailures[h.mirrorPath]
+						if replErr != nil && replErr.Errors[h.mirrorPath] != nil {
+							result = replErr.Errors[h.mirrorPath]
+						} else if result == nil && err != nil && !errors.As(err, new(*syncmanager.ReplicationError)) {
+							result = err
+						}
+						hookErr := h.runner.Run(context.Background(), config.HookPostSync, h.snapshotPath, result)
+						if hookErr != nil && err == nil {
+							err = hookErr
+						}
+					}
+				}()
+				defer func() {
+					for _, manager := range managers {
+						manager.Close()
+					}
+				}()
+				for _, mirror := range mirrors {
 					if mirror.Disabled {
 						logLevel(1, "Skipping disabled mirror: %s", mirror.Path)
-						return nil
+						continue
 					}
-					manager, err := syncmanager.New(&syncmanager.Config{
-						Logger:              logger,
-						Verbosity:           conf.Verbosity,
-						SubvolumeIdentifier: subvol.GetSnapshotName(volumeName),
-						FullSubvolumePath:   sourcePath,
-						SnapshotDirectory:   snapDir,
-						SnapshotName:        subvol.GetSnapshotName(volumeName),
-						MirrorPath:          mirror.Path,
-						MirrorFormat:        mirror.Format,
-						SSHUser:             conf.ResolveMirrorSSHUser(mirror.Name),
-						SSHPassword:         conf.ResolveMirrorSSHPassword(mirror.Name),
-						SSHKeyFile:          conf.ResolveMirrorSSHKeyFile(mirror.Name),
-						SSHHostKey:          conf.ResolveMirrorSSHHostKey(mirror.Name),
-					})
+					cfg := newSyncConfig(&vol, &subvol, &mirror)
+					manager, err := syncmanager.New(cfg)
 					if err != nil {
 						return err
 					}
-					defer manager.Close()
-					if err := manager.Sync(context.Background()); err != nil {
+					h := &mirrorHooks{
+						mirrorPath:   mirror.Path,
+						snapshotPath: cfg.LatestSnapshotPath(),
+						runner:       newHookRunner(vol, subvol, &mirror),
+					}
+					hooked = append(hooked, h)
+					if err := h.runner.Run(context.Background(), config.HookPreSync, h.snapshotPath, nil); err != nil {
+						logLevel(0, "Skipping mirror %s: %s", mirror.Path, err)
+						hookFailures[mirror.Path] = err
+						manager.Close()
+						continue
+					}
+					managers = append(managers, manager)
+					synced = append(synced, cfg)
+					if mirror.Catalog {
+						catalogManager, err := syncmanager.NewCatalogManager(cfg)
+						if err != nil {
+							return err
+						}
+						managers = append(managers, catalogManager)
+					}
+				}
+				syncErr := syncmanager.Replicate(context.Background(), managers...)
+				if syncErr != nil && !errors.As(syncErr, &replErr) {
+					return syncErr
+				}
+				// Mirrors skipped by their pre_sync hooks failed as well
+				if len(hookFailures) > 0 {
+					if replErr == nil {
+						replErr = &syncmanager.ReplicationError{Errors: make(map[string]error)}
+					}
+					for path, hookErr := range hookFailures {
+						replErr.Errors[path] = hookErr
+					}
+					syncErr = replErr
+				}
+				// Record what each mirror received so local pruning keeps the
+				// parent of its next incremental send.
+				for _, cfg := range synced {
+					if replErr != nil && replErr.Failed(cfg.MirrorPath) {
+						continue
+					}
+					if err := syncmanager.RecordSynced(cfg); err != nil {
 						return err
 					}
+				}
+				// Only prune the mirrors that synced successfully
+				for _, manager := range managers {
+					if replErr != nil && replErr.Failed(manager.Config().MirrorPath) {
+						continue
+					}
 					if err := manager.Prune(context.Background()); err != nil {
 						return err
 					}
-					return nil
-				})
-			}
+				}
+				for _, cfg := range synced {
+					if replErr != nil && replErr.Failed(cfg.MirrorPath) {
+						continue
+					}
+					if err := syncmanager.PropagateMetadata(context.Background(), cfg); err != nil {
+						return err
+					}
+				}
+				return syncErr
+			})
 		}
 	}
 	return queue.Wait()
 }
+
+// mirrorHooks are the hooks run around the sync of a subvolume to a mirror.
+type mirrorHooks struct {
+	mirrorPath   string
+	snapshotPath string
+	runner       *hooks.Runner
+}
+
+// newHookRunner returns the hook runner of a subvolume. The sync hooks of the mirror are
+// included when one is given.
+func newHookRunner(vol config.Volume, subvol config.Subvolume, mirror *config.Mirror) *hooks.Runner {
+	volumeName, subvolName := vol.GetName(), subvol.GetName()
+	runner := &hooks.Runner{
+		Env: hooks.Env{
+			Volume:        volumeName,
+			Subvolume:     subvolName,
+			SubvolumePath: filepath.Join(vol.Path, subvol.Path),
+		},
+		Logger:    logger,
+		Verbosity: conf.Verbosity,
+	}
+	if mirror != nil {
+		runner.Env.Mirror = mirror.Name
+		runner.Env.MirrorPath = mirror.Path
+	}
+	runner.Hooks = conf.ResolveHooks(volumeName, subvolName, runner.Env.Mirror)
+	return runner
+}
@@ -17,6 +17,7 @@ If not, see <https://www.gnu.org/licenses/>.
 package snapmanager
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -24,21 +25,27 @@ import (
 	"time"
 
 	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/hooks"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/retention"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
 )
 
 // Config is the config for a snapshot manager.
 type Config struct {
-	FullSubvolumePath         string
-	SnapshotDirectory         string
-	SnapshotName              string
-	SnapshotInterval          time.Duration
-	SnapshotMinimumRetention  time.Duration
-	SnapshotRetention         time.Duration
-	SnapshotRetentionInterval time.Duration
-	TimeFormat                string
-	Logger                    *log.Logger
-	Verbosity                 int
+	FullSubvolumePath string
+	SnapshotDirectory string
+	SnapshotName      string
+	SnapshotInterval  time.Duration
+	SkipUnchanged     bool
+	MaxSnapshotAge    time.Duration
+	Retention         config.RetentionPolicy
+	Mirrors           []config.Mirror
+	DryRun            bool
+	TimeFormat        string
+	Hooks             *hooks.Runner
+	Logger            *log.Logger
+	Verbosity         int
 }
 
 func (c *Config) logLevel(level int, format string, args ...interface{}) {
@@ -51,6 +58,7 @@ func (c *Config) logLevel(level int, format string, args ...interface{}) {
 type SnapManager struct {
 	config   *Config
 	rootInfo *btrfs.RootInfo
+	expired  []*retention.Decision
 }
 
 // New prepares a new snapshot manager for the given subvolume path and config.
@@ -65,16 +73,17 @@ func New(cfg *Config) (*SnapManager, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &SnapManager{cfg, info}, nil
+	return &SnapManager{config: cfg, rootInfo: info}, nil
 }
 
 // EnsureMostRecentSnapshot ensures that a snapshot exists for the subvolume within
 // the configured snapshot interval. If a snapshot does not exist, it will be created
-// with the name and timestamp format provided in the configuration.
+// with the name and timestamp format provided in the configuration. When unchanged
+// subvolumes are skipped, no snapshot is created if the subvolume has not changed
+// since the most recent snapshot, unless that snapshot reached the maximum age. Without
+// a maximum age, a snapshot is still created once in every calendar period the
+// retention policy keeps a snapshot of.
 func (sm *SnapManager) EnsureMostRecentSnapshot() error {
-	if err := sm.ensureSnapshotSubvol(); err != nil {
-		return err
-	}
 	mostRecent, err := sm.GetMostRecentSnapshot()
 	if err != nil {
 		return err
@@ -85,11 +94,72 @@ func (sm *SnapManager) EnsureMostRecentSnapshot() error {
 			sm.config.logLevel(2, "Most recent snapshot is within interval, skipping new snapshot creation\n")
 			return nil
 		}
+		if sm.config.SkipUnchanged && !sm.changedSince(mostRecent) {
+			if reason, ok := sm.unchangedSnapshotReason(mostRecent); ok {
+				sm.config.logLevel(1, "Subvolume has not changed since %q, taking a snapshot anyway: %s\n", mostRecent.Name, reason)
+			} else {
+				sm.config.logLevel(1, "Subvolume has not changed since %q, skipping new snapshot creation\n", mostRecent.Name)
+				return nil
+			}
+		}
+	}
+	_, err = sm.CreateSnapshot()
+	return err
+}
+
+// changedSince returns true if the subvolume changed after the snapshot was taken. The
+// generation of the subvolume moves past the generation of its snapshot once anything
+// in it is written.
+func (sm *SnapManager) changedSince(snap *btrfs.RootInfo) bool {
+	sm.config.logLevel(3, "Subvolume generation is %d, snapshot %q generation is %d\n", sm.rootInfo.Generation, snap.Name, snap.Generation)
+	return sm.rootInfo.Generation > snap.Generation
+}
+
+// unchangedSnapshotReason returns why a snapshot of the unchanged subvolume should be
+// taken anyway, either because the most recent snapshot reached the maximum age or
+// because the retention policy keeps a snapshot of a period that has none yet.
+func (sm *SnapManager) unchangedSnapshotReason(mostRecent *btrfs.RootInfo) (string, bool) {
+	if sm.config.MaxSnapshotAge > 0 {
+		if age := time.Since(mostRecent.CreationTime); age >= sm.config.MaxSnapshotAge {
+			return fmt.Sprintf("most recent snapshot is older than %s", sm.config.MaxSnapshotAge), true
+		}
+		return "", false
+	}
+	if period, ok := retention.NewPeriod(sm.config.Retention, mostRecent.CreationTime, time.Now()); ok {
+		return fmt.Sprintf("no snapshot for %s yet", period), true
+	}
+	return "", false
+}
+
+// CreateSnapshot creates a read-only snapshot of the subvolume now, named with the
+// name and timestamp format provided in the configuration, and returns its path. The
+// pre_snapshot hooks run first and the snapshot is not created if they fail. The
+// post_snapshot hooks always run, with the error of the failed pre_snapshot hook or
+// the result of the snapshot, so they can undo what the earlier pre_snapshot hooks did.
+func (sm *SnapManager) CreateSnapshot() (string, error) {
+	if err := sm.ensureSnapshotSubvol(); err != nil {
+		return "", err
 	}
 	snapshotPath := filepath.Join(
 		sm.config.SnapshotDirectory,
 		fmt.Sprintf("%s.%s", sm.config.SnapshotName, time.Now().Format(sm.config.TimeFormat)),
 	)
+	ctx := context.Background()
+	if err := sm.config.Hooks.Run(ctx, config.HookPreSnapshot, snapshotPath, nil); err != nil {
+		if hookErr := sm.config.Hooks.Run(ctx, config.HookPostSnapshot, snapshotPath, err); hookErr != nil {
+			sm.config.logLevel(0, "WARNING: %s\n", hookErr)
+		}
+		return "", err
+	}
+	err := sm.createSnapshot(snapshotPath)
+	hookErr := sm.config.Hooks.Run(ctx, config.HookPostSnapshot, snapshotPath, err)
+	if err != nil {
+		return "", err
+	}
+	return snapshotPath, hookErr
+}
+
+func (sm *SnapManager) createSnapshot(snapshotPath string) error {
 	sm.config.logLevel(0, "Creating read-only snapshot %q from %q\n", snapshotPath, sm.config.FullSubvolumePath)
 	if err := btrfs.CreateSnapshot(
 		sm.config.FullSubvolumePath,
@@ -102,6 +172,11 @@ func (sm *SnapManager) EnsureMostRecentSnapshot() error {
 	return btrfs.SyncFilesystem(snapshotPath)
 }
 
+// Snapshots returns the snapshots of the subvolume.
+func (sm *SnapManager) Snapshots() []*btrfs.RootInfo {
+	return sm.rootInfo.Snapshots
+}
+
 // GetMostRecentSnapshot returns the most recent snapshot of the subvolume.
 func (sm *SnapManager) GetMostRecentSnapshot() (*btrfs.RootInfo, error) {
 	var latest *btrfs.RootInfo
@@ -113,74 +188,111 @@ func (sm *SnapManager) GetMostRecentSnapshot() (*btrfs.RootInfo, error) {
 	return latest, nil
 }
 
-// PruneSnapshots prunes snapshots that are older than the configured retention period and that are
-// within the minimum retention period according to the configured intervals.
+// PruneSnapshots deletes the snapshots that expired according to the configured
+// retention policy. Snapshots with a hold are never deleted, and the newest snapshot
+// each configured mirror has received is held back, so the mirror can continue with an
+// incremental send. In a dry run the snapshots are only reported.
 func (sm *SnapManager) PruneSnapshots() error {
-	if sm.config.SnapshotRetention == 0 {
-		return nil
+	sm.config.logLevel(1, "Pruning snapshots with retention policy %s\n", sm.config.Retention)
+	keep, expire := retention.Partition(sm.config.Retention, time.Now(), sm.rootInfo.Snapshots)
+	held := make(map[string]bool)
+	if err := sm.holdPinned(expire, held); err != nil {
+		return err
 	}
-	// Delete snapshots older than the retention period
-	sm.config.logLevel(1, "Pruning snapshots older than %s\n", sm.config.SnapshotRetention)
-
-	remaining := make([]*btrfs.RootInfo, 0)
-	for _, snap := range sm.rootInfo.Snapshots {
-		fullPath := filepath.Join(sm.config.SnapshotDirectory, snap.Name)
-		sm.config.logLevel(3, "Considering snapshot %q created at %s for max retention deletion\n", fullPath, snap.CreationTime)
-		if time.Since(snap.CreationTime) > sm.config.SnapshotRetention {
-			sm.config.logLevel(0, "Deleting snapshot %q\n", fullPath)
-			if err := btrfs.DeleteSubvolume(fullPath, true); err != nil {
-				return err
+	if err := sm.holdMirrorParents(expire, held); err != nil {
+		return err
+	}
+	if len(held) > 0 {
+		remaining := make([]*retention.Decision, 0, len(expire))
+		for _, d := range expire {
+			if !held[d.Name] {
+				remaining = append(remaining, d)
+			}
+		}
+		for _, snap := range sm.rootInfo.Snapshots {
+			if held[snap.Name] {
+				keep = append(keep, snap)
 			}
-		} else {
-			remaining = append(remaining, snap)
 		}
+		expire = remaining
 	}
-	sm.rootInfo.Snapshots = remaining
-
-	// Prune snapshots within the retention period according to the retention interval
-	if sm.config.SnapshotRetentionInterval == 0 {
-		return nil
+	sm.expired = expire
+	for _, d := range expire {
+		fullPath := filepath.Join(sm.config.SnapshotDirectory, d.Name)
+		if sm.config.DryRun {
+			sm.config.Logger.Printf("Would delete snapshot %q: %s\n", fullPath, d.Reason())
+			continue
+		}
+		sm.config.logLevel(0, "Deleting snapshot %q\n", fullPath)
+		sm.config.logLevel(1, "Snapshot %q expired: %s\n", d.Name, d.Reason())
+		if err := btrfs.DeleteSubvolume(fullPath, true); err != nil {
+			return err
+		}
+		if err := snaputil.RemoveMetadata(sm.config.SnapshotDirectory, d.Name); err != nil {
+			return err
+		}
 	}
+	if !sm.config.DryRun {
+		sm.rootInfo.Snapshots = keep
+	}
+	return nil
+}
 
-	sm.config.logLevel(1, "Pruning snapshots within retention period %s according to interval %s\n", sm.config.SnapshotRetention, sm.config.SnapshotRetentionInterval)
-	snapshots := make([]*btrfs.RootInfo, 0)
-	for _, snap := range sm.rootInfo.Snapshots {
-		sm.config.logLevel(3, "Considering snapshot %q created at %s for minimum retention deletion\n", snap.Path, snap.CreationTime)
-		if time.Since(snap.CreationTime) < sm.config.SnapshotRetention {
-			if time.Since(snap.CreationTime) > sm.config.SnapshotMinimumRetention {
-				sm.config.logLevel(3, "Snapshot %q is within the maximum and minimum retention periods\n", snap.Path)
-				snapshots = append(snapshots, snap)
-			}
+// holdPinned adds the expired snapshots that have a hold to the held snapshots.
+func (sm *SnapManager) holdPinned(expire []*retention.Decision, held map[string]bool) error {
+	for _, d := range expire {
+		m, err := snaputil.LoadMetadata(sm.config.SnapshotDirectory, d.Name)
+		if err != nil {
+			return err
+		}
+		if m.Hold {
+			sm.config.logLevel(1, "Keeping expired snapshot %q, it has a hold\n", d.Name)
+			held[d.Name] = true
 		}
 	}
-	if len(snapshots) == 0 {
-		sm.config.logLevel(1, "No long-term snapshots to prune\n")
+	return nil
+}
+
+// holdMirrorParents adds the expired snapshots that are the newest snapshot received
+// by a mirror to the held snapshots. A mirror that has not synced for longer than its
+// maximum parent hold no longer holds its snapshot.
+func (sm *SnapManager) holdMirrorParents(expire []*retention.Decision, held map[string]bool) error {
+	if len(sm.config.Mirrors) == 0 || len(expire) == 0 {
 		return nil
 	}
-
-	snapshotChunks := toTimedChunks(snapshots, sm.config.SnapshotRetentionInterval)
-
-	// if len(snapshotChunks) <= 1 {
-	// 	sm.config.logLevel(1, "No long-term snapshots to prune\n")
-	// 	return nil
-	// }
-
-	for _, chunk := range snapshotChunks {
-		if len(chunk) <= 1 {
+	state, err := snaputil.LoadMirrorState(snaputil.MirrorStatePath(sm.config.SnapshotDirectory, sm.config.SnapshotName))
+	if err != nil {
+		return err
+	}
+	for _, mirror := range sm.config.Mirrors {
+		last, ok := state.Mirrors[mirror.Path]
+		if !ok {
+			sm.config.logLevel(2, "Mirror %s has no recorded snapshot to hold\n", mirror.Path)
 			continue
 		}
-		for _, toDel := range chunk[1:] { // The latest snapshots in the chunk
-			snap := toDel
-			fullPath := filepath.Join(sm.config.SnapshotDirectory, snap.Name)
-			sm.config.logLevel(0, "Deleting snapshot %q\n", fullPath)
-			if err := btrfs.DeleteSubvolume(fullPath, true); err != nil {
-				return err
+		for _, d := range expire {
+			if d.Name != last.Name || held[d.Name] {
+				continue
 			}
+			since := time.Since(last.SyncedAt).Round(time.Second)
+			if mirror.MaxParentHold > 0 && since > time.Duration(mirror.MaxParentHold) {
+				sm.config.Logger.Printf("WARNING: Mirror %s has not synced in %s, releasing its last snapshot %q, the next sync to it will be a full send\n",
+					mirror.Path, since, d.Name)
+				break
+			}
+			sm.config.logLevel(0, "Holding expired snapshot %q for mirror %s, which last synced %s ago\n", d.Name, mirror.Path, since)
+			held[d.Name] = true
+			break
 		}
 	}
 	return nil
 }
 
+// Expired returns the snapshots the last prune expired, along with the reasons.
+func (sm *SnapManager) Expired() []*retention.Decision {
+	return sm.expired
+}
+
 func (sm *SnapManager) ensureSnapshotSubvol() error {
 	snapDir := sm.config.SnapshotDirectory
 	isSubvol, err := btrfs.IsSubvolume(snapDir)
@@ -200,26 +312,3 @@ func (sm *SnapManager) ensureSnapshotSubvol() error {
 	sm.config.logLevel(2, "Snapshot subvolume %s already exists\n", snapDir)
 	return nil
 }
-
-func toTimedChunks(snapshots []*btrfs.RootInfo, interval time.Duration) [][]*btrfs.RootInfo {
-	if len(snapshots) == 0 {
-		return nil
-	}
-	snaputil.SortSnapshots(snapshots, snaputil.SortAscending)
-	var chunks [][]*btrfs.RootInfo
-	var chunk []*btrfs.RootInfo
-	var lastTime time.Time
-	for _, snap := range snapshots {
-		if lastTime.IsZero() {
-			lastTime = snap.CreationTime
-		}
-		if snap.CreationTime.Sub(lastTime) > interval {
-			chunks = append(chunks, chunk)
-			chunk = make([]*btrfs.RootInfo, 0)
-			lastTime = snap.CreationTime
-		}
-		chunk = append(chunk, snap)
-	}
-	chunks = append(chunks, chunk)
-	return chunks
-}
@@ -0,0 +1,365 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package snapmanager
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+)
+
+const day = 24 * time.Hour
+
+// testSnapshotName returns the name of the test snapshot taken the given number of
+// days ago.
+func testSnapshotName(days int) string {
+	return fmt.Sprintf("root.%d-days-ago", days)
+}
+
+// newTestManager returns a manager for a dry run over snapshots taken the given
+// numbers of days ago, keeping those taken within the last three days.
+func newTestManager(t *testing.T, ages ...int) *SnapManager {
+	t.Helper()
+	now := time.Now()
+	snapshots := make([]*btrfs.RootInfo, len(ages))
+	for i, days := range ages {
+		snapshots[i] = &btrfs.RootInfo{
+			Name:         testSnapshotName(days),
+			UUID:         uuid.New(),
+			CreationTime: now.Add(-time.Duration(days) * day),
+		}
+	}
+	cfg := &Config{
+		SnapshotDirectory: t.TempDir(),
+		SnapshotName:      "root",
+		Retention:         config.RetentionPolicy{KeepWithin: config.Duration(3 * day)},
+		DryRun:            true,
+		Logger:            log.New(io.Discard, "", 0),
+	}
+	return &SnapManager{config: cfg, rootInfo: &btrfs.RootInfo{Snapshots: snapshots}}
+}
+
+// expiredAges prunes the snapshots of the manager and returns the ages in days of the
+// snapshots it expired.
+func expiredAges(t *testing.T, sm *SnapManager) []int {
+	t.Helper()
+	if err := sm.PruneSnapshots(); err != nil {
+		t.Fatal(err)
+	}
+	ages := []int{}
+	for _, d := range sm.Expired() {
+		for _, snap := range sm.rootInfo.Snapshots {
+			if snap.Name == d.Name {
+				ages = append(ages, int(time.Since(snap.CreationTime)/day))
+			}
+		}
+	}
+	return ages
+}
+
+func TestPruneSnapshotsMirrorHolds(t *testing.T) {
+	// mirrorState is the snapshot a mirror last received and how long ago it synced
+	type mirrorState struct {
+		snapshot int
+		synced   time.Duration
+	}
+	tests := []struct {
+		name    string
+		mirrors []config.Mirror
+		state   map[string]mirrorState
+		want    []int
+	}{
+		{
+			name: "no mirrors",
+			want: []int{4, 8, 16},
+		},
+		{
+			name:    "mirror holds its expired snapshot",
+			mirrors: []config.Mirror{{Path: "/mirror"}},
+			state:   map[string]mirrorState{"/mirror": {8, time.Hour}},
+			want:    []int{4, 16},
+		},
+		{
+			name:    "mirror snapshot kept by the policy",
+			mirrors: []config.Mirror{{Path: "/mirror"}},
+			state:   map[string]mirrorState{"/mirror": {2, time.Hour}},
+			want:    []int{4, 8, 16},
+		},
+		{
+			name:    "mirror without a recorded snapshot",
+			mirrors: []config.Mirror{{Path: "/mirror"}},
+			state:   map[string]mirrorState{"/other": {8, time.Hour}},
+			want:    []int{4, 8, 16},
+		},
+		{
+			name:    "state of a mirror that is no longer configured",
+			mirrors: []config.Mirror{{Path: "/mirror"}},
+			state:   map[string]mirrorState{"/removed": {8, time.Hour}},
+			want:    []int{4, 8, 16},
+		},
+		{
+			name:    "every mirror holds its own snapshot",
+			mirrors: []config.Mirror{{Path: "/mirror"}, {Path: "/offsite"}},
+			state:   map[string]mirrorState{"/mirror": {4, time.Hour}, "/offsite": {16, 15 * day}},
+			want:    []int{8},
+		},
+		{
+			name:    "mirrors holding the same snapshot",
+			mirrors: []config.Mirror{{Path: "/mirror"}, {Path: "/offsite"}},
+			state:   map[string]mirrorState{"/mirror": {8, time.Hour}, "/offsite": {8, time.Hour}},
+			want:    []int{4, 16},
+		},
+		{
+			name:    "within the maximum parent hold",
+			mirrors: []config.Mirror{{Path: "/mirror", MaxParentHold: config.Duration(10 * day)}},
+			state:   map[string]mirrorState{"/mirror": {8, 7 * day}},
+			want:    []int{4, 16},
+		},
+		{
+			name:    "past the maximum parent hold",
+			mirrors: []config.Mirror{{Path: "/mirror", MaxParentHold: config.Duration(5 * day)}},
+			state:   map[string]mirrorState{"/mirror": {8, 7 * day}},
+			want:    []int{4, 8, 16},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sm := newTestManager(t, 1, 2, 4, 8, 16)
+			sm.config.Mirrors = tc.mirrors
+			state := &snaputil.MirrorState{Mirrors: make(map[string]*snaputil.MirrorSnapshot)}
+			for path, s := range tc.state {
+				state.Mirrors[path] = &snaputil.MirrorSnapshot{
+					Name:     testSnapshotName(s.snapshot),
+					SyncedAt: time.Now().Add(-s.synced),
+				}
+			}
+			if err := state.Save(snaputil.MirrorStatePath(sm.config.SnapshotDirectory, sm.config.SnapshotName)); err != nil {
+				t.Fatal(err)
+			}
+			if got := expiredAges(t, sm); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expired snapshots taken %v days ago, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPruneSnapshotsPinnedHolds(t *testing.T) {
+	tests := []struct {
+		name string
+		// metadata is the metadata of the snapshots taken the given number of days ago
+		metadata map[int]*snaputil.SnapshotMetadata
+		// mirrored is the age of the snapshot a mirror last received, 0 for none
+		mirrored int
+		want     []int
+	}{
+		{
+			name: "no holds",
+			want: []int{4, 8, 16},
+		},
+		{
+			name:     "expired snapshot with a hold",
+			metadata: map[int]*snaputil.SnapshotMetadata{8: {Hold: true}},
+			want:     []int{4, 16},
+		},
+		{
+			name:     "hold on a kept snapshot",
+			metadata: map[int]*snaputil.SnapshotMetadata{1: {Hold: true}},
+			want:     []int{4, 8, 16},
+		},
+		{
+			name:     "labels are not holds",
+			metadata: map[int]*snaputil.SnapshotMetadata{8: {Labels: []string{"pre-upgrade"}, Note: "note"}},
+			want:     []int{4, 8, 16},
+		},
+		{
+			name:     "held snapshot received by a mirror",
+			metadata: map[int]*snaputil.SnapshotMetadata{8: {Hold: true}},
+			mirrored: 8,
+			want:     []int{4, 16},
+		},
+		{
+			name:     "hold and mirror parent",
+			metadata: map[int]*snaputil.SnapshotMetadata{16: {Hold: true}},
+			mirrored: 4,
+			want:     []int{8},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sm := newTestManager(t, 1, 2, 4, 8, 16)
+			for days, m := range tc.metadata {
+				if err := snaputil.SaveMetadata(sm.config.SnapshotDirectory, testSnapshotName(days), m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.mirrored > 0 {
+				sm.config.Mirrors = []config.Mirror{{Path: "/mirror"}}
+				state := &snaputil.MirrorState{Mirrors: map[string]*snaputil.MirrorSnapshot{
+					"/mirror": {Name: testSnapshotName(tc.mirrored), SyncedAt: time.Now()},
+				}}
+				if err := state.Save(snaputil.MirrorStatePath(sm.config.SnapshotDirectory, sm.config.SnapshotName)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := expiredAges(t, sm); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expired snapshots taken %v days ago, want %v", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("unreadable metadata", func(t *testing.T) {
+		sm := newTestManager(t, 1, 8)
+		path := snaputil.MetadataPath(sm.config.SnapshotDirectory, testSnapshotName(8))
+		if err := snaputil.SaveMetadata(sm.config.SnapshotDirectory, testSnapshotName(8), &snaputil.SnapshotMetadata{Hold: true}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// A snapshot that might have a hold is never deleted
+		if err := sm.PruneSnapshots(); err == nil {
+			t.Errorf("expected an error, expired %d snapshots", len(sm.Expired()))
+		}
+	})
+}
+
+func TestUnchangedSnapshotReason(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxAge       time.Duration
+		policy       config.RetentionPolicy
+		age          time.Duration
+		want         string
+		wantSnapshot bool
+	}{
+		{
+			name:         "maximum age reached",
+			maxAge:       2 * day,
+			age:          3 * day,
+			want:         "most recent snapshot is older than 48h0m0s",
+			wantSnapshot: true,
+		},
+		{
+			name:   "maximum age not reached",
+			maxAge: 2 * day,
+			age:    time.Hour,
+		},
+		{
+			name:   "maximum age overrides the calendar periods",
+			maxAge: 2 * day,
+			policy: config.RetentionPolicy{Daily: 7},
+			age:    day,
+		},
+		{
+			name:         "period without a snapshot",
+			policy:       config.RetentionPolicy{Yearly: 5},
+			age:          400 * day,
+			want:         "no snapshot for yearly ",
+			wantSnapshot: true,
+		},
+		{
+			name:   "period with a snapshot",
+			policy: config.RetentionPolicy{Yearly: 5},
+		},
+		{
+			name:   "policy without periods",
+			policy: config.RetentionPolicy{KeepWithin: config.Duration(7 * day)},
+			age:    30 * day,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sm := newTestManager(t)
+			sm.config.MaxSnapshotAge = tc.maxAge
+			sm.config.Retention = tc.policy
+			snap := &btrfs.RootInfo{Name: "root.latest", CreationTime: time.Now().Add(-tc.age)}
+			reason, ok := sm.unchangedSnapshotReason(snap)
+			if ok != tc.wantSnapshot || !strings.HasPrefix(reason, tc.want) || (tc.want == "" && reason != "") {
+				t.Errorf("got %q, %v, want %q, %v", reason, ok, tc.want, tc.wantSnapshot)
+			}
+		})
+	}
+}
+
+func TestEnsureMostRecentSnapshotSkipsUnchanged(t *testing.T) {
+	tests := []struct {
+		name          string
+		skipUnchanged bool
+		interval      time.Duration
+		maxAge        time.Duration
+		// generation is the generation of the subvolume, the snapshot has generation 10
+		generation   uint64
+		wantSnapshot bool
+	}{
+		{
+			name:         "unchanged subvolume without skipping",
+			generation:   10,
+			wantSnapshot: true,
+		},
+		{
+			name:          "unchanged subvolume",
+			skipUnchanged: true,
+			generation:    10,
+		},
+		{
+			name:          "changed subvolume",
+			skipUnchanged: true,
+			generation:    11,
+			wantSnapshot:  true,
+		},
+		{
+			name:          "unchanged subvolume past the maximum age",
+			skipUnchanged: true,
+			maxAge:        day,
+			generation:    10,
+			wantSnapshot:  true,
+		},
+		{
+			name:       "changed subvolume within the interval",
+			interval:   3 * day,
+			generation: 11,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sm := newTestManager(t, 5, 2)
+			for _, snap := range sm.rootInfo.Snapshots {
+				snap.Generation = 10
+			}
+			sm.rootInfo.Generation = tc.generation
+			sm.config.SkipUnchanged = tc.skipUnchanged
+			sm.config.SnapshotInterval = tc.interval
+			sm.config.MaxSnapshotAge = tc.maxAge
+			// The snapshot directory is not a btrfs subvolume, so taking a snapshot
+			// fails before anything is created
+			err := sm.EnsureMostRecentSnapshot()
+			if tookSnapshot := err != nil; tookSnapshot != tc.wantSnapshot {
+				t.Errorf("snapshot taken: %v (%v), want %v", tookSnapshot, err, tc.wantSnapshot)
+			}
+		})
+	}
+}
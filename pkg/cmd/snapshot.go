@@ -0,0 +1,193 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snapmanager"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+)
+
+var (
+	snapshotLabels []string
+	snapshotNote   string
+	snapshotHold   bool
+)
+
+func NewSnapshotCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Manage the local snapshots of a subvolume",
+		Long: `Manage the local snapshots of a subvolume.
+
+Snapshots can be given labels and a note to find them later, and a hold that keeps
+them from being pruned locally and from mirrors until it is released. Labels and notes
+are copied to the mirrors on every sync, and restore can select snapshots by label.`,
+	}
+
+	create := &cobra.Command{
+		Use:   "create [flags] <volume:subvolume>",
+		Short: "Take a snapshot of a subvolume now",
+		Long: `Take a snapshot of a subvolume now.
+
+The pre_snapshot and post_snapshot hooks configured for the subvolume run before and
+after the snapshot is taken. The post_snapshot hooks also run when a pre_snapshot hook
+fails and the snapshot is skipped.`,
+		Args: cobra.ExactArgs(1),
+		RunE: snapshotCreate,
+	}
+	create.Flags().StringArrayVarP(&snapshotLabels, "label", "l", []string{}, "a label to give the snapshot, can be given more than once")
+	create.Flags().StringVar(&snapshotNote, "note", "", "a note to attach to the snapshot")
+	create.Flags().BoolVar(&snapshotHold, "hold", false, "hold the snapshot so it is never pruned")
+
+	hold := &cobra.Command{
+		Use:   "hold <volume:subvolume> <snapshot>",
+		Short: "Keep a snapshot from being pruned locally and from mirrors",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return snapshotSetHold(args, true)
+		},
+	}
+
+	release := &cobra.Command{
+		Use:   "release <volume:subvolume> <snapshot>",
+		Short: "Release the hold on a snapshot, letting it be pruned again",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return snapshotSetHold(args, false)
+		},
+	}
+
+	list := &cobra.Command{
+		Use:   "list <volume:subvolume>",
+		Short: "List the snapshots of a subvolume with their labels and holds",
+		Args:  cobra.ExactArgs(1),
+		RunE:  snapshotList,
+	}
+
+	root.AddCommand(create)
+	root.AddCommand(hold)
+	root.AddCommand(release)
+	root.AddCommand(list)
+	return root
+}
+
+// newSnapManager returns a snapshot manager for the subvolume given on the command line.
+func newSnapManager(arg string) (*snapmanager.SnapManager, *snapmanager.Config, error) {
+	vol, subvol, err := resolveSubvolumeArg(arg)
+	if err != nil {
+		return nil, nil, err
+	}
+	volumeName, subvolName := vol.GetName(), subvol.GetName()
+	cfg := &snapmanager.Config{
+		FullSubvolumePath: filepath.Join(vol.Path, subvol.Path),
+		SnapshotName:      subvol.GetSnapshotName(volumeName),
+		SnapshotDirectory: conf.ResolveSnapshotPath(volumeName, subvolName),
+		TimeFormat:        conf.ResolveTimeFormat(volumeName, subvolName),
+		Hooks:             newHookRunner(*vol, *subvol, nil),
+		Logger:            logger,
+		Verbosity:         conf.Verbosity,
+	}
+	manager, err := snapmanager.New(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return manager, cfg, nil
+}
+
+func snapshotCreate(cmd *cobra.Command, args []string) error {
+	manager, cfg, err := newSnapManager(args[0])
+	if err != nil {
+		return err
+	}
+	path, err := manager.CreateSnapshot()
+	if err != nil {
+		return err
+	}
+	m := &snaputil.SnapshotMetadata{Note: snapshotNote, Hold: snapshotHold}
+	m.AddLabels(snapshotLabels...)
+	if err := snaputil.SaveMetadata(cfg.SnapshotDirectory, filepath.Base(path), m); err != nil {
+		return err
+	}
+	logLevel(0, "Created snapshot %q", path)
+	return nil
+}
+
+func snapshotSetHold(args []string, hold bool) error {
+	manager, cfg, err := newSnapManager(args[0])
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(args[1])
+	if snaputil.GetSnapshotByName(manager.Snapshots(), name) == nil {
+		return fmt.Errorf("snapshot %q of %s not found", args[1], args[0])
+	}
+	m, err := snaputil.LoadMetadata(cfg.SnapshotDirectory, name)
+	if err != nil {
+		return err
+	}
+	m.Hold = hold
+	if err := snaputil.SaveMetadata(cfg.SnapshotDirectory, name, m); err != nil {
+		return err
+	}
+	if hold {
+		logLevel(0, "Snapshot %q is held", name)
+	} else {
+		logLevel(0, "Released the hold on snapshot %q", name)
+	}
+	return nil
+}
+
+func snapshotList(cmd *cobra.Command, args []string) error {
+	manager, cfg, err := newSnapManager(args[0])
+	if err != nil {
+		return err
+	}
+	snaps := manager.Snapshots()
+	snaputil.SortSnapshots(snaps, snaputil.SortAscending)
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "SNAPSHOT\tTAKEN\tHOLD\tLABELS\tNOTE")
+	for _, snap := range snaps {
+		m, err := snaputil.LoadMetadata(cfg.SnapshotDirectory, snap.Name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", snap.Name, formatFindTime(snap.CreationTime),
+			formatHold(m.Hold), formatLabels(m.Labels), m.Note)
+	}
+	return nil
+}
+
+func formatHold(hold bool) string {
+	if hold {
+		return "yes"
+	}
+	return "-"
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return "-"
+	}
+	return strings.Join(labels, ",")
+}
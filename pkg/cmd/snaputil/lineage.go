@@ -0,0 +1,86 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package snaputil
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// Lineage records the subvolumes that were replaced by rollbacks and restores, so the
+// snapshots taken of them are still found for the subvolume that replaced them.
+type Lineage struct {
+	// Replaced are the UUIDs of the replaced subvolumes
+	Replaced []uuid.UUID `json:"replaced"`
+}
+
+// LineagePath returns the path of the lineage of the snapshots with the given name in
+// the snapshot directory.
+func LineagePath(snapshotDirectory, snapshotName string) string {
+	return filepath.Join(snapshotDirectory, StateDirectory, snapshotName+".lineage.json")
+}
+
+// LoadLineage reads the lineage at path. An empty lineage is returned if it does not
+// exist yet.
+func LoadLineage(path string) (*Lineage, error) {
+	lineage := &Lineage{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return lineage, nil
+		}
+		return nil, fmt.Errorf("failed to read lineage: %w", err)
+	}
+	if err := json.Unmarshal(data, lineage); err != nil {
+		return nil, fmt.Errorf("lineage %q is unreadable: %w", path, err)
+	}
+	return lineage, nil
+}
+
+// RecordReplaced adds the UUID of a replaced subvolume to the lineage of the snapshots
+// with the given name in the snapshot directory.
+func RecordReplaced(snapshotDirectory, snapshotName string, id uuid.UUID) error {
+	path := LineagePath(snapshotDirectory, snapshotName)
+	lineage, err := LoadLineage(path)
+	if err != nil {
+		return err
+	}
+	for _, replaced := range lineage.Replaced {
+		if replaced == id {
+			return nil
+		}
+	}
+	lineage.Replaced = append(lineage.Replaced, id)
+	data, err := json.MarshalIndent(lineage, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write lineage: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write lineage: %w", err)
+	}
+	return nil
+}
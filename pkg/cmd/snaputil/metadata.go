@@ -0,0 +1,115 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package snaputil
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SnapshotMetadata is the metadata attached to a snapshot.
+type SnapshotMetadata struct {
+	// Labels are labels identifying the snapshot, such as pre-upgrade
+	Labels []string `json:"labels,omitempty"`
+	// Note is a free-text note about the snapshot
+	Note string `json:"note,omitempty"`
+	// Hold keeps the snapshot from being pruned locally and from mirrors
+	Hold bool `json:"hold,omitempty"`
+}
+
+// IsEmpty returns true if no metadata is set.
+func (m *SnapshotMetadata) IsEmpty() bool {
+	return m == nil || (len(m.Labels) == 0 && m.Note == "" && !m.Hold)
+}
+
+// HasLabel returns true if the snapshot has the given label.
+func (m *SnapshotMetadata) HasLabel(label string) bool {
+	if m == nil {
+		return false
+	}
+	for _, l := range m.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// AddLabels adds the given labels to the snapshot, keeping them sorted.
+func (m *SnapshotMetadata) AddLabels(labels ...string) {
+	for _, label := range labels {
+		if label != "" && !m.HasLabel(label) {
+			m.Labels = append(m.Labels, label)
+		}
+	}
+	sort.Strings(m.Labels)
+}
+
+// MetadataPath returns the path of the sidecar file holding the metadata of the
+// snapshot with the given name in the snapshot directory.
+func MetadataPath(snapshotDirectory, name string) string {
+	return filepath.Join(snapshotDirectory, StateDirectory, "metadata", name+".json")
+}
+
+// LoadMetadata reads the metadata of the snapshot with the given name in the snapshot
+// directory. Empty metadata is returned if it has none.
+func LoadMetadata(snapshotDirectory, name string) (*SnapshotMetadata, error) {
+	path := MetadataPath(snapshotDirectory, name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &SnapshotMetadata{}, nil
+		}
+		return nil, fmt.Errorf("failed to read snapshot metadata: %w", err)
+	}
+	var m SnapshotMetadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("snapshot metadata %q is unreadable: %w", path, err)
+	}
+	return &m, nil
+}
+
+// SaveMetadata writes the metadata of the snapshot with the given name in the snapshot
+// directory. The sidecar file is removed if the metadata is empty.
+func SaveMetadata(snapshotDirectory, name string, m *SnapshotMetadata) error {
+	path := MetadataPath(snapshotDirectory, name)
+	if m.IsEmpty() {
+		return RemoveMetadata(snapshotDirectory, name)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write snapshot metadata: %w", err)
+	}
+	return nil
+}
+
+// RemoveMetadata removes the metadata of the snapshot with the given name in the
+// snapshot directory, if it has any.
+func RemoveMetadata(snapshotDirectory, name string) error {
+	if err := os.Remove(MetadataPath(snapshotDirectory, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove snapshot metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package snaputil
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotMetadataLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   []string
+		add      []string
+		want     []string
+		hasLabel string
+	}{
+		{name: "sorted", add: []string{"weekly", "pre-upgrade"}, want: []string{"pre-upgrade", "weekly"}, hasLabel: "weekly"},
+		{name: "duplicates", labels: []string{"a"}, add: []string{"b", "a", "b"}, want: []string{"a", "b"}, hasLabel: "a"},
+		{name: "empty labels are ignored", add: []string{"", "a"}, want: []string{"a"}, hasLabel: "a"},
+		{name: "nothing added", labels: []string{"a"}, want: []string{"a"}, hasLabel: "a"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &SnapshotMetadata{Labels: tc.labels}
+			m.AddLabels(tc.add...)
+			if !reflect.DeepEqual(m.Labels, tc.want) {
+				t.Errorf("got labels %q, want %q", m.Labels, tc.want)
+			}
+			if !m.HasLabel(tc.hasLabel) {
+				t.Errorf("label %q not found", tc.hasLabel)
+			}
+			if m.HasLabel("missing") {
+				t.Error("found a label that was not added")
+			}
+		})
+	}
+
+	var m *SnapshotMetadata
+	if m.HasLabel("a") || !m.IsEmpty() {
+		t.Error("nil metadata has labels")
+	}
+}
+
+func TestSnapshotMetadataIsEmpty(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *SnapshotMetadata
+		want bool
+	}{
+		{"nil", nil, true},
+		{"zero", &SnapshotMetadata{}, true},
+		{"no labels", &SnapshotMetadata{Labels: []string{}}, true},
+		{"labels", &SnapshotMetadata{Labels: []string{"a"}}, false},
+		{"note", &SnapshotMetadata{Note: "before the upgrade"}, false},
+		{"hold", &SnapshotMetadata{Hold: true}, false},
+	}
+	for _, tc := range tests {
+		if got := tc.m.IsEmpty(); got != tc.want {
+			t.Errorf("%s: IsEmpty returned %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSnapshotMetadataStorage(t *testing.T) {
+	dir := t.TempDir()
+	m, err := LoadMetadata(dir, "root.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.IsEmpty() {
+		t.Errorf("snapshot without metadata has %+v", m)
+	}
+
+	want := &SnapshotMetadata{Labels: []string{"pre-upgrade"}, Note: "note", Hold: true}
+	if err := SaveMetadata(dir, "root.1", want); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = LoadMetadata(dir, "root.1"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("loaded %+v, want %+v", m, want)
+	}
+	if other, err := LoadMetadata(dir, "root.2"); err != nil || !other.IsEmpty() {
+		t.Errorf("metadata of another snapshot is %+v, %v", other, err)
+	}
+
+	// Saving empty metadata removes the sidecar
+	if err := SaveMetadata(dir, "root.1", &SnapshotMetadata{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(MetadataPath(dir, "root.1")); !os.IsNotExist(err) {
+		t.Errorf("sidecar of empty metadata exists: %v", err)
+	}
+	if err := RemoveMetadata(dir, "root.1"); err != nil {
+		t.Errorf("removing missing metadata failed: %s", err)
+	}
+
+	if err := SaveMetadata(dir, "root.1", want); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveMetadata(dir, "root.1"); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = LoadMetadata(dir, "root.1"); err != nil || !m.IsEmpty() {
+		t.Errorf("removed metadata is %+v, %v", m, err)
+	}
+
+	if err := os.WriteFile(MetadataPath(dir, "root.3"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadMetadata(dir, "root.3"); err == nil {
+		t.Error("expected an error loading unreadable metadata")
+	}
+}
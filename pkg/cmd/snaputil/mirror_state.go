@@ -0,0 +1,92 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package snaputil
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// StateDirectory is the directory in a snapshot directory where btrsync keeps the
+// state of the snapshots it manages.
+var StateDirectory = ".btrsync"
+
+// MirrorSnapshot is the newest snapshot a mirror has received.
+type MirrorSnapshot struct {
+	// Name is the name of the snapshot
+	Name string `json:"name"`
+	// UUID is the UUID of the snapshot
+	UUID uuid.UUID `json:"uuid"`
+	// SyncedAt is the last time the mirror synced successfully
+	SyncedAt time.Time `json:"synced_at"`
+}
+
+// MirrorState records the newest snapshot each mirror of a subvolume has received,
+// keyed by mirror path, so that local pruning can keep the parent of the next
+// incremental send of a mirror that has been offline.
+type MirrorState struct {
+	Mirrors map[string]*MirrorSnapshot `json:"mirrors"`
+}
+
+// MirrorStatePath returns the path of the mirror state of the snapshots with the given
+// name in the snapshot directory.
+func MirrorStatePath(snapshotDirectory, snapshotName string) string {
+	return filepath.Join(snapshotDirectory, StateDirectory, snapshotName+".mirrors.json")
+}
+
+// LoadMirrorState reads the mirror state at path. An empty state is returned if it
+// does not exist yet.
+func LoadMirrorState(path string) (*MirrorState, error) {
+	state := &MirrorState{Mirrors: make(map[string]*MirrorSnapshot)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("failed to read mirror state: %w", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("mirror state %q is unreadable: %w", path, err)
+	}
+	if state.Mirrors == nil {
+		state.Mirrors = make(map[string]*MirrorSnapshot)
+	}
+	return state, nil
+}
+
+// Save writes the mirror state to path, replacing it atomically.
+func (s *MirrorState) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write mirror state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write mirror state: %w", err)
+	}
+	return nil
+}
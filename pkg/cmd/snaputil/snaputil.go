@@ -52,6 +52,11 @@ func ResolveSubvolumeDetails(logger *log.Logger, verbosity int, subvolumePath, s
 	if err != nil {
 		return nil, err
 	}
+	// Subvolumes replaced by rollbacks and restores are searched for snapshots as well
+	lineage, err := LoadLineage(LineagePath(snapshotDirectory, snapshotName))
+	if err != nil {
+		return nil, err
+	}
 	// Lookup informatin and all snapshots associated with the volume
 	var info *btrfs.RootInfo
 	var retries int
@@ -61,7 +66,7 @@ func ResolveSubvolumeDetails(logger *log.Logger, verbosity int, subvolumePath, s
 		}
 		info, err = btrfs.SubvolumeSearch(
 			btrfs.SearchWithRootMount(mount.Path),
-			btrfs.SearchWithSnapshots(),
+			btrfs.SearchWithAncestorSnapshots(lineage.Replaced...),
 			btrfs.SearchWithPath(subvolumePath),
 		)
 		if err != nil {
@@ -101,6 +106,9 @@ func ResolveSubvolumeDetails(logger *log.Logger, verbosity int, subvolumePath, s
 type IncrementalSnapshot struct {
 	Snapshot *btrfs.RootInfo
 	Parent   *btrfs.RootInfo
+	// CloneSources are other snapshots the destination has that data can be cloned
+	// from, in addition to the parent.
+	CloneSources []*btrfs.RootInfo
 }
 
 // MapParents will map the given snapshots to their parent snapshots. This method assumes
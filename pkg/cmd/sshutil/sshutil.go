@@ -16,6 +16,7 @@ If not, see <https://www.gnu.org/licenses/>.
 package sshutil
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -152,3 +153,43 @@ func WriteFile(ctx context.Context, client *ssh.Client, path string, rdr io.Read
 	}
 	return <-errs
 }
+
+// OpenFile returns a reader of the contents of a remote file. Errors reading the file
+// are returned when the reader is closed.
+func OpenFile(ctx context.Context, client *ssh.Client, path string) (io.ReadCloser, error) {
+	sess, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	out, err := sess.StdoutPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	if err := sess.Start(fmt.Sprintf("cat %q", path)); err != nil {
+		sess.Close()
+		return nil, err
+	}
+	return &remoteFile{Reader: out, sess: sess, path: path, stderr: &stderr}, nil
+}
+
+type remoteFile struct {
+	io.Reader
+	sess   *ssh.Session
+	path   string
+	stderr *bytes.Buffer
+}
+
+func (f *remoteFile) Close() error {
+	defer f.sess.Close()
+	// Drain the output so the command can exit
+	if _, err := io.Copy(io.Discard, f.Reader); err != nil {
+		return err
+	}
+	if err := f.sess.Wait(); err != nil {
+		return fmt.Errorf("failed to read %s: %s: %w", f.path, f.stderr.String(), err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/syncmanager"
+	"github.com/tinyzimmer/btrsync/pkg/encryption"
+)
+
+// keyRefs are the encryption keys given on the command line.
+var keyRefs []string
+
+func addKeyFlag(flags *pflag.FlagSet) {
+	flags.StringArrayVar(&keyRefs, "key", nil,
+		"encryption key as file:<path>, env:<variable> or command:<command>, can be given multiple times")
+}
+
+// commandKeyring loads the keys given on the command line, or else the keys of every
+// configured mirror.
+func commandKeyring() (encryption.Keyring, error) {
+	if len(keyRefs) > 0 {
+		return encryption.LoadKeyring(keyRefs)
+	}
+	var refs []string
+	seen := make(map[string]struct{})
+	for _, mirror := range conf.Mirrors {
+		for _, ref := range mirror.EncryptionKeys {
+			if _, ok := seen[ref]; ok {
+				continue
+			}
+			seen[ref] = struct{}{}
+			refs = append(refs, ref)
+		}
+	}
+	return encryption.LoadKeyring(refs)
+}
+
+// decryptStream returns a reader of the plain contents of r. Keys are only loaded if r
+// is encrypted.
+func decryptStream(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	prefix, err := br.Peek(len(encryption.Magic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if !encryption.IsEncrypted(prefix) {
+		return br, nil
+	}
+	logLevel(1, "Stream is encrypted, loading keys")
+	keys, err := commandKeyring()
+	if err != nil {
+		return nil, err
+	}
+	dec, _, err := encryption.MaybeDecrypt(br, keys)
+	return dec, err
+}
+
+type streamFile struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (s *streamFile) Close() error {
+	var err error
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if cerr := s.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// openStreamFile opens a send stream stored in a file, such as a snapshot in a
+// compressed mirror. Encrypted files are decrypted, and files with the extension of a
+// compressed mirror format are decompressed.
+func openStreamFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stream := &streamFile{closers: []io.Closer{f}}
+	if stream.Reader, err = decryptStream(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error decrypting %s: %w", path, err)
+	}
+	format := config.MirrorFormat(strings.TrimPrefix(filepath.Ext(path), "."))
+	if format.IsCompressed() {
+		logLevel(1, "Decompressing %s stream", format)
+		dec, err := syncmanager.NewDecoder(format, stream.Reader)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("error decompressing %s: %w", path, err)
+		}
+		stream.Reader = dec
+		stream.closers = append(stream.closers, dec)
+	}
+	return stream, nil
+}
@@ -0,0 +1,150 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+	"github.com/tinyzimmer/btrsync/pkg/receive"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/catalog"
+)
+
+type catalogManager struct {
+	config     *Config
+	sourceInfo *btrfs.RootInfo
+	catalog    *catalog.Catalog
+}
+
+// NewCatalogManager returns a manager that records the snapshots of a subvolume in the
+// catalog of a mirror. It is meant to be replicated alongside the mirror itself, so the
+// catalog is built from the same sends. The returned manager's configuration uses the
+// path of the catalog database as its mirror path.
+func NewCatalogManager(cfg *Config) (Manager, error) {
+	dbPath, err := cfg.CatalogFile()
+	if err != nil {
+		return nil, err
+	}
+	subvolInfo, err := resolveSubvolume(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cfg.LogVerbose(0, "Initiating catalog manager for %q with catalog: %s\n", cfg.FullSubvolumePath, dbPath)
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create catalog directory: %w", err)
+	}
+	c, err := catalog.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	catalogCfg := *cfg
+	catalogCfg.MirrorPath = dbPath
+	return &catalogManager{
+		config:     &catalogCfg,
+		sourceInfo: subvolInfo,
+		catalog:    c,
+	}, nil
+}
+
+func (sm *catalogManager) Config() *Config { return sm.config }
+
+func (sm *catalogManager) Sync(ctx context.Context) error {
+	return syncStream(ctx, sm)
+}
+
+func (sm *catalogManager) Prepare(ctx context.Context) ([]*snaputil.IncrementalSnapshot, error) {
+	// Parents are chosen like the mirror of the catalog does, so both can share sends
+	sel := parentSelection{cloneSources: sm.config.MirrorFormat.IsSubvolume()}
+	return sm.config.incrementalSnapshots(sm.sourceInfo.Snapshots, sel, func(snap *btrfs.RootInfo) (bool, error) {
+		_, err := sm.catalog.Snapshot(snap.UUID)
+		if err == nil {
+			sm.config.LogVerbose(1, "Snapshot %s is already cataloged, skipping", snap.Name)
+			return true, nil
+		}
+		if errors.Is(err, catalog.ErrSnapshotNotFound) {
+			return false, nil
+		}
+		return false, err
+	})
+}
+
+func (sm *catalogManager) ReceiveStream(ctx context.Context, parent, snap *btrfs.RootInfo, stream io.Reader) error {
+	sm.config.LogVerbose(0, "Cataloging snapshot %q in %q\n", snap.Path, sm.config.MirrorPath)
+	opts := []catalog.Option{catalog.WithCreationTime(snap.CreationTime)}
+	if sm.config.CatalogHashes {
+		opts = append(opts, catalog.WithContentHashes())
+	}
+	rcvr := catalog.New(sm.catalog, opts...)
+	defer rcvr.Close()
+	err := receive.ProcessSendStream(stream,
+		receive.WithLogger(sm.config.Logger, sm.config.Verbosity),
+		receive.WithContext(ctx),
+		receive.HonorEndCommand(),
+		receive.To(rcvr),
+	)
+	if err != nil {
+		return err
+	}
+	// Errors finishing the subvolume are only logged by the stream processor
+	if _, err := sm.catalog.Snapshot(snap.UUID); err != nil {
+		return fmt.Errorf("snapshot %q was not cataloged: %w", snap.Path, err)
+	}
+	return nil
+}
+
+func (sm *catalogManager) Prune(ctx context.Context) error {
+	if !sm.config.sourceHasSnapshots() {
+		return nil
+	}
+	sm.config.LogVerbose(0, "Pruning expired snapshots from catalog %q\n", sm.config.MirrorPath)
+	snaps, err := sm.catalog.Snapshots()
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(snaps))
+	for i, snap := range snaps {
+		names[i] = snap.Name
+	}
+	retained := sm.config.retainedSnapshots(sm.sourceInfo.Snapshots, names)
+	for _, snap := range snaps {
+		keep := retained[snap.Name]
+		if sm.config.Retention == nil {
+			keep = snaputil.SnapshotUUIDExists(sm.sourceInfo.Snapshots, snap.UUID)
+		}
+		if keep {
+			continue
+		}
+		if sm.config.DryRun {
+			sm.config.Logger.Printf("Would remove snapshot %q from catalog %q: %s\n", snap.Name, sm.config.MirrorPath, sm.config.expiryReason(snap.Name))
+			continue
+		}
+		sm.config.LogVerbose(1, "Removing expired snapshot %q from catalog\n", snap.Name)
+		if err := sm.catalog.DeleteSnapshot(snap.UUID); err != nil {
+			return fmt.Errorf("failed to remove %q from catalog: %w", snap.Name, err)
+		}
+	}
+	return nil
+}
+
+func (sm *catalogManager) Close() error {
+	return sm.catalog.Close()
+}
@@ -0,0 +1,119 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/catalog"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/receivertest"
+	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+)
+
+func newTestCatalogManager(t *testing.T, snapshots ...*btrfs.RootInfo) *catalogManager {
+	t.Helper()
+	dbPath := filepath.Join(t.TempDir(), "root"+catalog.FileExtension)
+	c, err := catalog.Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := &catalogManager{
+		config: &Config{
+			Logger:              log.New(io.Discard, "", 0),
+			SubvolumeIdentifier: "root",
+			SnapshotName:        "root",
+			MirrorPath:          dbPath,
+			sourceSnapshots:     snapshots,
+		},
+		sourceInfo: &btrfs.RootInfo{Snapshots: snapshots},
+		catalog:    c,
+	}
+	t.Cleanup(func() { sm.Close() })
+	return sm
+}
+
+func catalogedNames(t *testing.T, sm *catalogManager) []string {
+	t.Helper()
+	snaps, err := sm.catalog.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, snap := range snaps {
+		names = append(names, snap.Name)
+	}
+	return names
+}
+
+func TestCatalogPrune(t *testing.T) {
+	ctx := context.Background()
+	snaps := []*btrfs.RootInfo{
+		testSnapshot("root.20221126"),
+		testSnapshot("root.20221127"),
+		testSnapshot("root.20221128"),
+	}
+	recreated := &btrfs.RootInfo{Name: snaps[1].Name, UUID: uuid.New(), CreationTime: snaps[1].CreationTime}
+	all := []string{"root.20221126", "root.20221127", "root.20221128"}
+	tc := []struct {
+		name   string
+		source []*btrfs.RootInfo
+		dryRun bool
+		want   []string
+	}{
+		{"source unchanged", snaps, false, all},
+		{"expired from the source", []*btrfs.RootInfo{snaps[2]}, false, []string{"root.20221128"}},
+		{"dry run", []*btrfs.RootInfo{snaps[2]}, true, all},
+		// Without snapshots in the source nothing can be told apart from expired
+		{"empty source", nil, false, all},
+		// A snapshot is matched by its UUID, not its name
+		{"recreated in the source", []*btrfs.RootInfo{snaps[0], recreated, snaps[2]}, false, []string{"root.20221126", "root.20221128"}},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newTestCatalogManager(t, snaps...)
+			for i, snap := range snaps {
+				stream := receivertest.NewStream(t).
+					Cmd(sendstream.NewSubvolCommand(snap.Name, snap.UUID, uint64(i+1))).
+					Cmd(sendstream.NewMkfileCommand("file", 257)).
+					End()
+				if err := sm.ReceiveStream(ctx, nil, snap, stream); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := catalogedNames(t, sm); !reflect.DeepEqual(got, all) {
+				t.Fatalf("expected %v to be cataloged, got %v", all, got)
+			}
+
+			sm.config.sourceSnapshots = tt.source
+			sm.sourceInfo.Snapshots = tt.source
+			sm.config.DryRun = tt.dryRun
+			if err := sm.Prune(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if got := catalogedNames(t, sm); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v to remain cataloged, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+)
+
+// streamChains reads the incremental chains of the streams of a subvolume in a
+// compressed mirror from their manifests.
+type streamChains struct {
+	cfg       *Config
+	files     mirrorFiles
+	manifests map[string]*Manifest
+}
+
+func newStreamChains(cfg *Config, files mirrorFiles) *streamChains {
+	return &streamChains{cfg: cfg, files: files, manifests: make(map[string]*Manifest)}
+}
+
+// streamFile returns the name of the stream file of a snapshot.
+func (c *Config) streamFile(snap *btrfs.RootInfo) string {
+	return snap.Name + "." + string(c.MirrorFormat)
+}
+
+// manifest returns the manifest of a stream file of the subvolume. Streams written
+// before manifests existed were always full streams, and are described by a manifest
+// holding the details of the snapshot if it is known.
+func (c *streamChains) manifest(ctx context.Context, file string, snap *btrfs.RootInfo) (*Manifest, error) {
+	if m, ok := c.manifests[file]; ok {
+		return m, nil
+	}
+	data, err := c.files.ReadFile(ctx, path.Join(c.cfg.SubvolumeIdentifier, ManifestName(file)))
+	var m *Manifest
+	switch {
+	case err == nil:
+		if m, err = ParseManifest(data); err != nil {
+			return nil, fmt.Errorf("manifest of %q is unreadable: %w", file, err)
+		}
+	case c.files.IsNotExist(err):
+		m = &Manifest{Version: ManifestVersion, File: file, Format: c.cfg.MirrorFormat}
+		if snap != nil {
+			m.UUID = snap.UUID
+			m.CreationTime = snap.CreationTime
+		}
+	default:
+		return nil, fmt.Errorf("failed to read manifest of %q: %w", file, err)
+	}
+	c.manifests[file] = m
+	return m, nil
+}
+
+// parentManifest returns the manifest of the stream an incremental stream of a snapshot
+// applies on top of, or nil for full streams.
+func parentManifest(ctx context.Context, cfg *Config, files mirrorFiles, parent *btrfs.RootInfo) (*Manifest, error) {
+	if parent == nil {
+		return nil, nil
+	}
+	return newStreamChains(cfg, files).manifest(ctx, cfg.streamFile(parent), parent)
+}
+
+// planChains returns the snapshots that still need to be sent to a compressed mirror.
+// Without a full send interval every snapshot is sent in full. Otherwise snapshots are
+// sent incrementally to the snapshot mirrored before them, and a full send starts a new
+// chain once the snapshot the current chain started with is older than the interval.
+func planChains(ctx context.Context, cfg *Config, files mirrorFiles, snapshots []*btrfs.RootInfo, isSynced func(*btrfs.RootInfo) (bool, error)) ([]*snaputil.IncrementalSnapshot, error) {
+	if cfg.FullSendInterval <= 0 {
+		return pendingSnapshots(fullSnapshots(snapshots), isSynced)
+	}
+	snaputil.SortSnapshots(snapshots, snaputil.SortAscending)
+	chains := newStreamChains(cfg, files)
+	var (
+		pending   []*snaputil.IncrementalSnapshot
+		last      *btrfs.RootInfo
+		lastSent  bool
+		baseStart time.Time
+	)
+	for _, snap := range snapshots {
+		synced, err := isSynced(snap)
+		if err != nil {
+			return nil, err
+		}
+		if synced {
+			last, lastSent = snap, false
+			continue
+		}
+		// The chain of a mirrored snapshot is only read when something follows it
+		if last != nil && !lastSent {
+			m, err := chains.manifest(ctx, cfg.streamFile(last), last)
+			if err != nil {
+				return nil, err
+			}
+			baseStart = m.ChainStart()
+		}
+		inc := &snaputil.IncrementalSnapshot{Snapshot: snap}
+		if last == nil || snap.CreationTime.Sub(baseStart) >= cfg.FullSendInterval {
+			cfg.LogVerbose(1, "Snapshot %q starts a new chain with a full send\n", snap.Name)
+			baseStart = snap.CreationTime
+		} else {
+			cfg.LogVerbose(1, "Snapshot %q will be sent incrementally to %q\n", snap.Name, last.Name)
+			inc.Parent = last
+		}
+		pending = append(pending, inc)
+		last, lastSent = snap, true
+	}
+	return pending, nil
+}
+
+// expiredStreams returns the files in the directory of the subvolume that belong to
+// snapshots that are not retained, except for the streams that incremental streams
+// of retained snapshots still apply on top of. The UUIDs of the retained snapshots
+// and the snapshots kept for this reason are returned as well, so that their
+// completion files are kept too.
+func expiredStreams(ctx context.Context, cfg *Config, files mirrorFiles, names []string, snapshots []*btrfs.RootInfo) (expired []string, kept map[uuid.UUID]struct{}, err error) {
+	ext := "." + string(cfg.MirrorFormat)
+	var mirrored []string
+	for _, name := range names {
+		if strings.HasSuffix(name, ext) {
+			mirrored = append(mirrored, compressedSnapshotName(cfg.MirrorFormat, name))
+		}
+	}
+	retained := cfg.retainedSnapshots(snapshots, mirrored)
+	chains := newStreamChains(cfg, files)
+	needed := make(map[string]struct{})
+	kept = make(map[uuid.UUID]struct{})
+	for _, name := range names {
+		if !strings.HasSuffix(name, ext) || !retained[compressedSnapshotName(cfg.MirrorFormat, name)] {
+			continue
+		}
+		// Walk the chain of the retained stream back to its full send
+		m, err := chains.manifest(ctx, name, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if m.UUID != uuid.Nil {
+			kept[m.UUID] = struct{}{}
+		}
+		for m.IsIncremental() {
+			if _, ok := needed[m.Parent]; ok {
+				break
+			}
+			needed[m.Parent] = struct{}{}
+			if m.ParentUUID != nil {
+				kept[*m.ParentUUID] = struct{}{}
+			}
+			if m, err = chains.manifest(ctx, m.Parent, nil); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	for _, name := range names {
+		snapshotName := compressedSnapshotName(cfg.MirrorFormat, name)
+		if retained[snapshotName] {
+			cfg.LogVerbose(3, "Mirrored snapshot %q has not expired\n", name)
+			continue
+		}
+		if _, ok := needed[strings.TrimSuffix(name, ManifestExtension)]; ok {
+			cfg.LogVerbose(1, "Keeping expired snapshot %q, retained incremental snapshots depend on it\n", name)
+			continue
+		}
+		cfg.LogVerbose(1, "Marking snapshot %q for expiry\n", name)
+		expired = append(expired, name)
+	}
+	return expired, kept, nil
+}
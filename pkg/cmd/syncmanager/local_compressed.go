@@ -16,21 +16,15 @@ If not, see <https://www.gnu.org/licenses/>.
 package syncmanager
 
 import (
-	"compress/gzip"
-	"compress/lzw"
 	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
-	"sync"
 
 	"github.com/google/uuid"
-	"github.com/klauspost/compress/zstd"
 
 	"github.com/tinyzimmer/btrsync/pkg/btrfs"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
 )
 
@@ -54,36 +48,43 @@ func NewLocalCompressedManager(cfg *Config, subvolInfo *btrfs.RootInfo) (Manager
 	}, nil
 }
 
+func (sm *localCompressedManager) Config() *Config { return sm.config }
+
 func (sm *localCompressedManager) Sync(ctx context.Context) error {
+	return syncStream(ctx, sm)
+}
+
+func (sm *localCompressedManager) Prepare(ctx context.Context) ([]*snaputil.IncrementalSnapshot, error) {
 	path := filepath.Join(sm.mirrorPath, sm.config.SubvolumeIdentifier)
 	sm.config.LogVerbose(0, "Syncing %s compressed mirror: %q\n", sm.config.MirrorFormat, path)
 	if err := os.MkdirAll(path, 0755); err != nil {
-		return fmt.Errorf("failed to create mirror directory: %s", err)
-	}
-	snaputil.SortSnapshots(sm.sourceInfo.Snapshots, snaputil.SortAscending)
-	for _, snap := range sm.sourceInfo.Snapshots {
-		if err := sm.syncSnapshot(ctx, path, nil, snap); err != nil {
-			return err
+		return nil, fmt.Errorf("failed to create mirror directory: %s", err)
+	}
+	return planChains(ctx, sm.config, localMirrorFiles(sm.mirrorPath), sm.sourceInfo.Snapshots, func(snap *btrfs.RootInfo) (bool, error) {
+		uuidfile := filepath.Join(path, OffsetDirectory, snap.UUID.String())
+		sm.config.LogVerbose(1, "Checking for snapshot completion file at %q\n", uuidfile)
+		_, err := os.Stat(uuidfile)
+		if err == nil {
+			sm.config.LogVerbose(1, "Snapshot %q already synced, skipping\n", snap.Name)
+			return true, nil
 		}
-	}
-	return nil
+		if !os.IsNotExist(err) {
+			return false, fmt.Errorf("failed to check for snapshot completion file: %s", err)
+		}
+		return false, nil
+	})
 }
 
-func (sm *localCompressedManager) syncSnapshot(ctx context.Context, destination string, _, snap *btrfs.RootInfo) error {
-	snapshotPath := filepath.Join(sm.config.SnapshotDirectory, snap.Name)
+func (sm *localCompressedManager) ReceiveStream(ctx context.Context, parent, snap *btrfs.RootInfo, stream io.Reader) error {
+	destination := filepath.Join(sm.mirrorPath, sm.config.SubvolumeIdentifier)
 	uuidfile := filepath.Join(destination, OffsetDirectory, snap.UUID.String())
-	destination = filepath.Join(destination, snap.Name+"."+string(sm.config.MirrorFormat))
-	sm.config.LogVerbose(1, "Checking for snapshot completion file at %q\n", uuidfile)
-	_, err := os.Stat(uuidfile)
-	if err == nil {
-		sm.config.LogVerbose(1, "Snapshot %q already synced, skipping\n", snap.Name)
-		return nil
-	}
-	if !os.IsNotExist(err) {
-		return fmt.Errorf("failed to check for snapshot completion file: %s", err)
-	}
+	destination = filepath.Join(destination, sm.config.streamFile(snap))
 
 	sm.config.LogVerbose(0, "Syncing snapshot %q to %q\n", snap.Path, destination)
+	parentStream, err := parentManifest(ctx, sm.config, localMirrorFiles(sm.mirrorPath), parent)
+	if err != nil {
+		return err
+	}
 
 	// Set up the destination
 	f, err := os.Create(destination)
@@ -93,62 +94,30 @@ func (sm *localCompressedManager) syncSnapshot(ctx context.Context, destination
 	defer f.Close()
 
 	// Set up the encoder
-	var enc io.WriteCloser
-	switch sm.config.MirrorFormat {
-	case config.MirrorFormatGzip:
-		enc = gzip.NewWriter(f)
-	case config.MirrorFormatLzw:
-		enc = lzw.NewWriter(f, lzw.LSB, 8)
-	case config.MirrorFormatZlib:
-		enc = gzip.NewWriter(f)
-	case config.MirrorFormatZstd:
-		enc, err = zstd.NewWriter(f)
-		if err != nil {
-			return fmt.Errorf("failed to create zstd writer: %s", err)
-		}
+	manifest := newManifestBuilder()
+	enc, err := newStreamEncoder(sm.config, manifest.Stored(f))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(enc, manifest.Stream(stream)); err != nil {
+		enc.Close()
+		return fmt.Errorf("error copying to encoder: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("error closing encoder: %w", err)
 	}
 
-	// Set up the pipe to the encoder
-	var wg sync.WaitGroup
-	pipeOpt, pipe, err := btrfs.SendToPipe()
+	// Write the manifest
+	m, err := manifest.Manifest(sm.config, filepath.Base(destination), snap, parentStream)
 	if err != nil {
-		return fmt.Errorf("error creating send pipe: %w", err)
-	}
-	defer pipe.Close()
-	errors := make(chan error, 2)
-
-	// Start the sendstream to the pipe
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		sendOpts := []btrfs.SendOption{
-			pipeOpt,
-			btrfs.SendWithLogger(sm.config.Logger, sm.config.Verbosity),
-			btrfs.SendCompressedData(),
-		}
-		if err := btrfs.Send(snapshotPath, sendOpts...); err != nil {
-			err = fmt.Errorf("error sending snapshot: %w", err)
-			errors <- err
-		}
-	}()
-
-	// Start the encoder to the destination
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		defer enc.Close()
-		_, err := io.Copy(enc, pipe)
-		if err != nil {
-			errors <- fmt.Errorf("error copying to encoder: %w", err)
-		}
-	}()
-
-	wg.Wait()
-	close(errors)
-	for err := range errors {
-		if err != nil {
-			return err
-		}
+		return err
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(ManifestName(destination), data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
 	}
 
 	// Create the completion file
@@ -162,6 +131,9 @@ func (sm *localCompressedManager) syncSnapshot(ctx context.Context, destination
 }
 
 func (sm *localCompressedManager) Prune(ctx context.Context) error {
+	if !sm.config.sourceHasSnapshots() {
+		return nil
+	}
 	destination := filepath.Join(sm.mirrorPath, sm.config.SubvolumeIdentifier)
 	uuiddir := filepath.Join(destination, OffsetDirectory)
 	sm.config.LogVerbose(2, "Listing compressed snapshots at %q\n", destination)
@@ -171,27 +143,29 @@ func (sm *localCompressedManager) Prune(ctx context.Context) error {
 		return fmt.Errorf("failed to read destination directory: %w", err)
 	}
 
-	var expired []string
+	names := make([]string, 0, len(files))
 	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-		snapshotName := strings.TrimSuffix(file.Name(), "."+string(sm.config.MirrorFormat))
-		if !snaputil.SnapshotSliceContains(sm.sourceInfo.Snapshots, snapshotName) {
-			sm.config.LogVerbose(1, "Marking snapshot %q for expiry\n", file.Name())
-			expired = append(expired, file.Name())
-		} else {
-			sm.config.LogVerbose(3, "Mirrored snapshot %q has not expired\n", file.Name())
+		if !file.IsDir() {
+			names = append(names, file.Name())
 		}
 	}
+	expired, kept, err := expiredStreams(ctx, sm.config, localMirrorFiles(sm.mirrorPath), names, sm.sourceInfo.Snapshots)
+	if err != nil {
+		return err
+	}
 
-	for _, path := range expired {
-		path = filepath.Join(destination, path)
-		sm.config.LogVerbose(0, "Expiring mirrored snapshot %q\n", path)
-		if err := os.Remove(path); err != nil {
+	for _, name := range expired {
+		path := filepath.Join(destination, name)
+		err := sm.config.expire(compressedSnapshotName(sm.config.MirrorFormat, name), path, func() error {
+			return os.Remove(path)
+		})
+		if err != nil {
 			return fmt.Errorf("error deleting snapshot file %q: %w", path, err)
 		}
 	}
+	if sm.config.DryRun {
+		return nil
+	}
 
 	uuids, err := os.ReadDir(uuiddir)
 	if err != nil {
@@ -199,7 +173,7 @@ func (sm *localCompressedManager) Prune(ctx context.Context) error {
 	}
 	var completedUUIDs []uuid.UUID
 	for _, uuStr := range uuids {
-		if uuStr.IsDir() {
+		if uuStr.IsDir() || uuStr.Name() == metadataFile {
 			continue
 		}
 		uu, err := uuid.Parse(uuStr.Name())
@@ -210,7 +184,7 @@ func (sm *localCompressedManager) Prune(ctx context.Context) error {
 	}
 
 	for _, uuid := range completedUUIDs {
-		if !snaputil.SnapshotUUIDExists(sm.sourceInfo.Snapshots, uuid) {
+		if _, ok := kept[uuid]; !ok && !snaputil.SnapshotUUIDExists(sm.sourceInfo.Snapshots, uuid) {
 			path := filepath.Join(uuiddir, uuid.String())
 			sm.config.LogVerbose(1, "Deleting expired completion file %q", path)
 			if err := os.Remove(path); err != nil {
@@ -18,13 +18,15 @@ package syncmanager
 import (
 	"context"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
-	"sync"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
 	"github.com/tinyzimmer/btrsync/pkg/receive"
 	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/directory"
@@ -50,96 +52,89 @@ func NewLocalDirectoryManager(cfg *Config, subvolInfo *btrfs.RootInfo) (Manager,
 	}, nil
 }
 
+func (sm *localDirectoryManager) Config() *Config { return sm.config }
+
 func (sm *localDirectoryManager) Sync(ctx context.Context) error {
+	return syncStream(ctx, sm)
+}
+
+func (sm *localDirectoryManager) Prepare(ctx context.Context) ([]*snaputil.IncrementalSnapshot, error) {
 	path := filepath.Join(sm.mirrorPath, sm.config.SubvolumeIdentifier)
 	sm.config.LogVerbose(0, "Syncing directory mirror: %s\n", path)
 	if err := os.MkdirAll(path, 0755); err != nil {
-		return fmt.Errorf("failed to create mirror directory: %s", err)
-	}
-	snapshots := snaputil.MapParents(sm.sourceInfo.Snapshots)
-	for _, snap := range snapshots {
-		if err := sm.syncSnapshot(ctx, path, snap.Parent, snap.Snapshot); err != nil {
-			return err
-		}
+		return nil, fmt.Errorf("failed to create mirror directory: %s", err)
 	}
-	return nil
+	// The directory only holds the state of the last snapshot received, so older
+	// snapshots cannot be applied on top of it
+	sel := parentSelection{forwardOnly: true}
+	return sm.config.incrementalSnapshots(sm.sourceInfo.Snapshots, sel, func(snap *btrfs.RootInfo) (bool, error) {
+		return sm.isSynced(path, snap)
+	})
 }
 
-func (sm *localDirectoryManager) syncSnapshot(ctx context.Context, destination string, parent, snap *btrfs.RootInfo) error {
+func (sm *localDirectoryManager) isSynced(destination string, snap *btrfs.RootInfo) (bool, error) {
 	// Check if the snapshot is already synced by verifying it's UUID file
 	uuidFile := filepath.Join(destination, OffsetDirectory, snap.UUID.String())
 	sm.config.LogVerbose(1, "Checking for snapshot progress file at %q\n", uuidFile)
 	f, err := os.Open(uuidFile)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			return fmt.Errorf("failed to open uuid file: %s", err)
+			return false, fmt.Errorf("failed to open uuid file: %s", err)
 		}
 		sm.config.LogVerbose(2, "Progress file %q does not exist\n", uuidFile)
-	} else {
-		var offset uint64
-		if _, err := fmt.Fscanf(f, "%d", &offset); err != nil {
-			return err
-		}
-		f.Close()
-		sm.config.LogVerbose(2, "Progress file %q found with offset %d\n", uuidFile, offset)
-		if offset == math.MaxUint64-1 {
-			sm.config.LogVerbose(1, "Snapshot %s is already synced, skipping", snap.Name)
-			return nil
-		}
+		return false, nil
+	}
+	defer f.Close()
+	var offset uint64
+	if _, err := fmt.Fscanf(f, "%d", &offset); err != nil {
+		return false, err
 	}
+	sm.config.LogVerbose(2, "Progress file %q found with offset %d\n", uuidFile, offset)
+	if offset == math.MaxUint64-1 {
+		sm.config.LogVerbose(1, "Snapshot %s is already synced, skipping", snap.Name)
+		return true, nil
+	}
+	return false, nil
+}
 
+func (sm *localDirectoryManager) ReceiveStream(ctx context.Context, parent, snap *btrfs.RootInfo, stream io.Reader) error {
+	destination := filepath.Join(sm.mirrorPath, sm.config.SubvolumeIdentifier)
 	sm.config.LogVerbose(0, "Syncing snapshot %q contents to %q\n", snap.Path, destination)
-	var wg sync.WaitGroup
-
-	pipeOpt, pipe, err := btrfs.SendToPipe()
-	if err != nil {
-		return fmt.Errorf("error creating send pipe: %w", err)
-	}
-	defer pipe.Close()
-	errors := make(chan error, 1)
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		sendOpts := []btrfs.SendOption{
-			pipeOpt,
-			btrfs.SendWithLogger(sm.config.Logger, sm.config.Verbosity),
-			btrfs.SendCompressedData(),
-		}
-		if parent != nil {
-			parentPath := filepath.Join(sm.config.SnapshotDirectory, parent.Name)
-			sendOpts = append(sendOpts, btrfs.SendWithParentRoot(parentPath))
-		}
-		snapshotPath := filepath.Join(sm.config.SnapshotDirectory, snap.Name)
-		if err := btrfs.Send(snapshotPath, sendOpts...); err != nil {
-			err = fmt.Errorf("error sending snapshot: %w", err)
-			errors <- err
-			return
-		}
-		errors <- nil
-	}()
-
 	receiveOpts := []receive.Option{
 		receive.WithLogger(sm.config.Logger, sm.config.Verbosity),
 		receive.WithContext(ctx),
 		receive.HonorEndCommand(),
-		receive.To(directory.New(destination, OffsetDirectory)),
 	}
-	err = receive.ProcessSendStream(pipe, receiveOpts...)
-	if err != nil {
-		return err
+	opts := []directory.Option{directory.WithFileCache(sm.config.fileCacheOptions()...)}
+	if sm.versioned() {
+		opts = append(opts, directory.WithVersions(sm.versionName))
 	}
-	wg.Wait()
-	close(errors)
-	for err := range errors {
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	receiveOpts = append(receiveOpts, receive.To(directory.New(destination, OffsetDirectory, opts...)))
+	return receive.ProcessSendStream(stream, receiveOpts...)
+}
+
+func (sm *localDirectoryManager) versioned() bool {
+	return sm.config.MirrorFormat == config.MirrorFormatVersionedDirectory
+}
+
+// versionName returns the name of the version directory for a snapshot, which is
+// the timestamp portion of the snapshot name.
+func (sm *localDirectoryManager) versionName(snapshotName string) string {
+	return strings.TrimPrefix(snapshotName, sm.config.SnapshotName+".")
 }
 
 func (sm *localDirectoryManager) Prune(ctx context.Context) error {
+	if !sm.config.sourceHasSnapshots() {
+		return nil
+	}
+	if sm.versioned() {
+		if err := sm.pruneVersions(ctx); err != nil {
+			return err
+		}
+	}
+	if sm.config.DryRun {
+		return nil
+	}
 	sm.config.LogVerbose(0, "Pruning expired offset files")
 	path := filepath.Join(sm.mirrorPath, sm.config.SubvolumeIdentifier)
 	files, err := os.ReadDir(filepath.Join(path, OffsetDirectory))
@@ -147,7 +142,7 @@ func (sm *localDirectoryManager) Prune(ctx context.Context) error {
 		return fmt.Errorf("failed to read offset directory: %s", err)
 	}
 	for _, file := range files {
-		if file.IsDir() {
+		if file.IsDir() || file.Name() == metadataFile {
 			continue
 		}
 		uuid, err := uuid.Parse(file.Name())
@@ -170,3 +165,58 @@ func (sm *localDirectoryManager) Prune(ctx context.Context) error {
 func (sm *localDirectoryManager) Close() error {
 	return nil
 }
+
+func (sm *localDirectoryManager) pruneVersions(ctx context.Context) error {
+	path := filepath.Join(sm.mirrorPath, sm.config.SubvolumeIdentifier)
+	sm.config.LogVerbose(2, "Listing snapshot versions at %q\n", path)
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("failed to read mirror directory: %w", err)
+	}
+	var versions []string
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == OffsetDirectory || strings.HasPrefix(entry.Name(), directory.PartialVersionPrefix) {
+			continue
+		}
+		versions = append(versions, sm.config.SnapshotName+"."+entry.Name())
+	}
+	retained := sm.config.retainedSnapshots(sm.sourceInfo.Snapshots, versions)
+	for _, snapshotName := range versions {
+		version := sm.versionName(snapshotName)
+		if retained[snapshotName] {
+			sm.config.LogVerbose(3, "Mirrored snapshot version %q has not expired\n", version)
+			continue
+		}
+		fullpath := filepath.Join(path, version)
+		err := sm.config.expire(snapshotName, fullpath, func() error {
+			return os.RemoveAll(fullpath)
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting snapshot version %q: %w", fullpath, err)
+		}
+	}
+	if sm.config.DryRun {
+		return nil
+	}
+	indexDir := filepath.Join(path, OffsetDirectory, "versions")
+	files, err := os.ReadDir(indexDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read version index: %w", err)
+	}
+	for _, file := range files {
+		uu, err := uuid.Parse(file.Name())
+		if err != nil {
+			continue
+		}
+		if !snaputil.SnapshotUUIDExists(sm.sourceInfo.Snapshots, uu) {
+			sm.config.LogVerbose(1, "Removing expired version index file %q", file.Name())
+			if err := os.Remove(filepath.Join(indexDir, file.Name())); err != nil {
+				return fmt.Errorf("failed to remove version index file: %s", err)
+			}
+		}
+	}
+	return nil
+}
@@ -19,12 +19,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/tinyzimmer/btrsync/pkg/btrfs"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
 	"github.com/tinyzimmer/btrsync/pkg/receive"
@@ -51,28 +52,48 @@ func NewLocalSubvolumeManager(cfg *Config, subvolInfo *btrfs.RootInfo) (Manager,
 	}, nil
 }
 
+func (sm *localSubvolumeManager) Config() *Config { return sm.config }
+
 func (sm *localSubvolumeManager) Sync(ctx context.Context) error {
-	sm.config.LogVerbose(1, "Ensuring mirror path is ready and accessible")
-	if err := sm.ensureLocalMirrorPath(ctx); err != nil {
-		return err
-	}
-	snapshots := snaputil.MapParents(sm.sourceInfo.Snapshots)
-	for _, snap := range snapshots {
-		if err := sm.syncSnapshot(ctx, snap.Parent, snap.Snapshot); err != nil {
-			return err
-		}
-	}
-	return nil
+	return syncStream(ctx, sm)
 }
 
 func (sm *localSubvolumeManager) Prune(ctx context.Context) error {
+	if !sm.config.sourceHasSnapshots() {
+		return nil
+	}
 	sm.config.LogVerbose(0, "Pruning expired snapshots from mirror: %s\n", sm.config.MirrorPath)
 	return sm.pruneLocalMirror(ctx)
 }
 
-func (sm *localSubvolumeManager) syncSnapshot(ctx context.Context, parent, snap *btrfs.RootInfo) error {
-	var wg sync.WaitGroup
+func (sm *localSubvolumeManager) Prepare(ctx context.Context) ([]*snaputil.IncrementalSnapshot, error) {
+	sm.config.LogVerbose(1, "Ensuring mirror path is ready and accessible")
+	if err := sm.ensureLocalMirrorPath(ctx); err != nil {
+		return nil, err
+	}
+	// Snapshots are matched by the received UUID of the mirrored subvolumes, so
+	// renamed snapshots are still found
+	mirrored, err := sm.mirroredSubvolumes()
+	if err != nil {
+		return nil, err
+	}
+	received := make(map[uuid.UUID]bool, len(mirrored))
+	for _, info := range mirrored {
+		if info.ReceivedUUID != uuid.Nil {
+			received[info.ReceivedUUID] = true
+		}
+	}
+	sel := parentSelection{cloneSources: true}
+	return sm.config.incrementalSnapshots(sm.sourceInfo.Snapshots, sel, func(snap *btrfs.RootInfo) (bool, error) {
+		synced := received[snap.UUID]
+		if synced {
+			sm.config.LogVerbose(1, "Snapshot %q already synced to %q\n", snap.Path, filepath.Join(sm.mirrorPath, sm.config.SubvolumeIdentifier))
+		}
+		return synced, nil
+	})
+}
 
+func (sm *localSubvolumeManager) ReceiveStream(ctx context.Context, parent, snap *btrfs.RootInfo, stream io.Reader) error {
 	destination := filepath.Join(sm.mirrorPath, sm.config.SubvolumeIdentifier)
 	snapshotPath := filepath.Join(sm.config.SnapshotDirectory, snap.Name)
 	destinationPath := filepath.Join(destination, snap.Path)
@@ -81,7 +102,7 @@ func (sm *localSubvolumeManager) syncSnapshot(ctx context.Context, parent, snap
 		receive.WithLogger(sm.config.Logger, sm.config.Verbosity),
 		receive.WithContext(ctx),
 		receive.HonorEndCommand(),
-		receive.To(local.New(destination)),
+		receive.To(local.New(destination, local.WithFileCache(sm.config.fileCacheOptions()...))),
 	}
 
 	// Check if the destination exists
@@ -91,7 +112,9 @@ func (sm *localSubvolumeManager) syncSnapshot(ctx context.Context, parent, snap
 	}
 	if synced {
 		sm.config.LogVerbose(1, "Snapshot %q already synced to %q\n", snap.Path, destination)
-		return nil
+		// Drain the stream so a shared send is not held up
+		_, err := io.Copy(io.Discard, stream)
+		return err
 	} else if found {
 		sm.config.LogVerbose(0, "Snapshot %q already exists at %q, but is not synced. Will try incremental send.\n", snap.Path, destination)
 		sm.config.LogVerbose(0, "Searching for command offset to resume from")
@@ -110,44 +133,7 @@ func (sm *localSubvolumeManager) syncSnapshot(ctx context.Context, parent, snap
 	}
 
 	sm.config.LogVerbose(0, "Syncing snapshot %q to %q\n", snap.Path, destination)
-
-	pipeOpt, pipe, err := btrfs.SendToPipe()
-	if err != nil {
-		return fmt.Errorf("error creating send pipe: %w", err)
-	}
-	defer pipe.Close()
-	errors := make(chan error, 1)
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		sendOpts := []btrfs.SendOption{
-			pipeOpt,
-			btrfs.SendWithLogger(sm.config.Logger, sm.config.Verbosity),
-			btrfs.SendCompressedData(),
-		}
-		if parent != nil {
-			parentPath := filepath.Join(sm.config.SnapshotDirectory, parent.Name)
-			sendOpts = append(sendOpts, btrfs.SendWithParentRoot(parentPath))
-		}
-		if err := btrfs.Send(snapshotPath, sendOpts...); err != nil {
-			err = fmt.Errorf("error sending snapshot: %w", err)
-			errors <- err
-		}
-	}()
-
-	err = receive.ProcessSendStream(pipe, receiveOpts...)
-	if err != nil {
-		return err
-	}
-	wg.Wait()
-	close(errors)
-	for err := range errors {
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return receive.ProcessSendStream(stream, receiveOpts...)
 }
 
 func (sm *localSubvolumeManager) checkDestinationSnapshotLocal(ctx context.Context, snap *btrfs.RootInfo) (found, synced bool, err error) {
@@ -225,11 +211,46 @@ func (sm *localSubvolumeManager) ensureLocalMirrorPath(ctx context.Context) erro
 
 func (sm *localSubvolumeManager) pruneLocalMirror(ctx context.Context) error {
 	destination := filepath.Join(sm.mirrorPath, sm.config.SubvolumeIdentifier)
+	infos, err := sm.mirroredSubvolumes()
+	if err != nil {
+		return err
+	}
+	mirrored := make([]string, len(infos))
+	for i, info := range infos {
+		mirrored[i] = info.Name
+	}
+
+	retained := sm.config.retainedSnapshots(sm.sourceInfo.Snapshots, mirrored)
+	var expired []string
+	for _, name := range mirrored {
+		fullpath := filepath.Join(destination, name)
+		if !retained[name] {
+			sm.config.LogVerbose(1, "Marking snapshot %q for expiry\n", fullpath)
+			expired = append(expired, fullpath)
+		} else {
+			sm.config.LogVerbose(3, "Mirrored snapshot %q has not expired\n", fullpath)
+		}
+	}
+
+	for _, path := range expired {
+		err := sm.config.expire(filepath.Base(path), path, func() error {
+			return btrfs.DeleteSubvolume(path, true)
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting subvolume %q: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// mirroredSubvolumes returns the snapshots of the subvolume in the mirror.
+func (sm *localSubvolumeManager) mirroredSubvolumes() ([]*btrfs.RootInfo, error) {
 	sm.config.LogVerbose(2, "Listing snapshots in tree at %q\n", sm.mirrorPath)
 
 	mirrorInfo, err := btrfs.SubvolumeSearch(btrfs.SearchWithPath(sm.mirrorPath))
 	if err != nil {
-		return fmt.Errorf("error looking up information on mirror path: %w", err)
+		return nil, fmt.Errorf("error looking up information on mirror path: %w", err)
 	}
 
 	var tree *btrfs.RBRoot
@@ -245,11 +266,11 @@ func (sm *localSubvolumeManager) pruneLocalMirror(ctx context.Context) error {
 		retries++
 	}
 	if err != nil {
-		return fmt.Errorf("error building tree at %q: %w", sm.mirrorPath, err)
+		return nil, fmt.Errorf("error building tree at %q: %w", sm.mirrorPath, err)
 	}
 	tree = tree.FilterFromRoot(mirrorInfo.RootID)
 
-	var expired []string
+	var mirrored []*btrfs.RootInfo
 	tree.PreOrderIterate(func(info *btrfs.RootInfo, _ error) error {
 		if info.Deleted || info.FullPath == "" || !strings.HasPrefix(info.FullPath, sm.config.SubvolumeIdentifier) {
 			return nil
@@ -257,25 +278,10 @@ func (sm *localSubvolumeManager) pruneLocalMirror(ctx context.Context) error {
 		if info.Name == sm.config.SubvolumeIdentifier {
 			return nil
 		}
-		fullpath := filepath.Join(destination, info.Name)
-		sm.config.LogVerbose(3, "Checking if mirrored snapshot %q is expired\n", fullpath)
-		if !snaputil.SnapshotSliceContains(sm.sourceInfo.Snapshots, info.Name) {
-			sm.config.LogVerbose(1, "Marking snapshot %q for expiry\n", fullpath)
-			expired = append(expired, fullpath)
-		} else {
-			sm.config.LogVerbose(3, "Mirrored snapshot %q has not expired\n", fullpath)
-		}
+		mirrored = append(mirrored, info)
 		return nil
 	})
-
-	for _, path := range expired {
-		sm.config.LogVerbose(0, "Expiring mirrored snapshot %q\n", path)
-		if err := btrfs.DeleteSubvolume(path, true); err != nil {
-			return fmt.Errorf("error deleting subvolume %q: %w", path, err)
-		}
-	}
-
-	return nil
+	return mirrored, nil
 }
 
 func (sm *localSubvolumeManager) Close() error {
@@ -0,0 +1,286 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/tinyzimmer/btrsync/pkg/encryption"
+)
+
+// ManifestExtension is appended to the name of a stream file to get the name of its
+// manifest.
+const ManifestExtension = ".manifest"
+
+// ManifestVersion is the version of the manifest format.
+const ManifestVersion = 1
+
+// ErrNoSignature is returned when verifying a manifest that is not signed.
+var ErrNoSignature = errors.New("manifest is not signed")
+
+// Manifest describes a stream file written to a compressed mirror. It is stored next to
+// the file and allows the file to be verified without receiving it.
+type Manifest struct {
+	// Version is the version of the manifest format
+	Version int `json:"version"`
+	// File is the name of the stream file
+	File string `json:"file"`
+	// Format is the compression format of the file
+	Format config.MirrorFormat `json:"format"`
+	// Encrypted is true if the file is encrypted
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Size is the size of the file
+	Size int64 `json:"size"`
+	// SHA256 is the hex encoded SHA-256 of the file
+	SHA256 string `json:"sha256"`
+	// StreamSize is the size of the send stream before compression
+	StreamSize int64 `json:"streamSize"`
+	// StreamSHA256 is the hex encoded SHA-256 of the send stream before compression
+	StreamSHA256 string `json:"streamSHA256"`
+	// UUID is the UUID of the snapshot
+	UUID uuid.UUID `json:"uuid"`
+	// SourceUUID is the UUID of the subvolume the snapshot was taken of
+	SourceUUID uuid.UUID `json:"sourceUUID"`
+	// ParentUUID is the UUID of the parent of an incremental stream
+	ParentUUID *uuid.UUID `json:"parentUUID,omitempty"`
+	// Parent is the name of the stream file an incremental stream applies on top of
+	Parent string `json:"parent,omitempty"`
+	// Base is the name of the full stream the incremental chain of the stream starts
+	// with, which is the file itself for full streams
+	Base string `json:"base,omitempty"`
+	// BaseCreationTime is the time the snapshot of the base stream was taken
+	BaseCreationTime *time.Time `json:"baseCreationTime,omitempty"`
+	// Ctransid is the transaction ID the snapshot was last changed in
+	Ctransid uint64 `json:"ctransid"`
+	// CreationTime is the time the snapshot was taken
+	CreationTime time.Time `json:"creationTime"`
+	// CreatedAt is the time the stream was written to the mirror
+	CreatedAt time.Time `json:"createdAt"`
+	// PublicKey is the base64 encoded ed25519 public key the manifest is signed with
+	PublicKey []byte `json:"publicKey,omitempty"`
+	// Signature is the ed25519 signature of the manifest without the signature
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// IsIncremental returns true if the stream applies on top of the stream of another
+// snapshot.
+func (m *Manifest) IsIncremental() bool { return m.Parent != "" }
+
+// ChainBase returns the name of the full stream the chain of the stream starts with.
+// Streams written before chains were recorded are always full streams.
+func (m *Manifest) ChainBase() string {
+	if m.Base != "" {
+		return m.Base
+	}
+	return m.File
+}
+
+// ChainStart returns the time the snapshot of the chain base was taken.
+func (m *Manifest) ChainStart() time.Time {
+	if m.BaseCreationTime != nil {
+		return *m.BaseCreationTime
+	}
+	return m.CreationTime
+}
+
+// ManifestName returns the name of the manifest of a stream file.
+func ManifestName(file string) string { return file + ManifestExtension }
+
+// ParseManifest parses the contents of a manifest file.
+func ParseManifest(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if m.Version != ManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	return &m, nil
+}
+
+// Marshal returns the contents of the manifest file.
+func (m *Manifest) Marshal() ([]byte, error) {
+	return json.MarshalIndent(m, "", "  ")
+}
+
+func (m *Manifest) signedData() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+// Sign signs the manifest with the given key.
+func (m *Manifest) Sign(key ed25519.PrivateKey) error {
+	m.PublicKey = key.Public().(ed25519.PublicKey)
+	data, err := m.signedData()
+	if err != nil {
+		return err
+	}
+	m.Signature = ed25519.Sign(key, data)
+	return nil
+}
+
+// VerifySignature verifies that the manifest is signed with the given key.
+func (m *Manifest) VerifySignature(key ed25519.PublicKey) error {
+	if len(m.Signature) == 0 {
+		return ErrNoSignature
+	}
+	data, err := m.signedData()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, data, m.Signature) {
+		return errors.New("manifest signature is invalid")
+	}
+	return nil
+}
+
+// LoadSigningKey loads the ed25519 private key a reference points to.
+func LoadSigningKey(ref string) (ed25519.PrivateKey, error) {
+	data, err := encryption.LoadSecret(ref)
+	if err != nil {
+		return nil, err
+	}
+	// Seeds are tried first, since a hex encoded seed has the length of a raw private key
+	if seed, err := encryption.DecodeSecret(data, ed25519.SeedSize); err == nil {
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	key, err := encryption.DecodeSecret(data, ed25519.PrivateKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("signing keys must be %w", err)
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// ParsePublicKey parses a hex or base64 encoded ed25519 public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := encryption.DecodeSecret([]byte(strings.TrimSpace(s)), ed25519.PublicKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("public keys must be %w", err)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Signer loads the key manifests are signed with. It is nil if the mirror does not sign
+// manifests.
+func (c *Config) Signer() (ed25519.PrivateKey, error) {
+	if c.SigningKey == "" {
+		return nil, nil
+	}
+	key, err := LoadSigningKey(c.SigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing key: %w", err)
+	}
+	return key, nil
+}
+
+// manifestBuilder computes the hashes of a stream while it is written to a mirror.
+type manifestBuilder struct {
+	stream, stored         hash.Hash
+	streamSize, storedSize int64
+}
+
+func newManifestBuilder() *manifestBuilder {
+	return &manifestBuilder{stream: sha256.New(), stored: sha256.New()}
+}
+
+// Stream returns a reader that hashes the send stream read from r.
+func (b *manifestBuilder) Stream(r io.Reader) io.Reader {
+	return io.TeeReader(r, &countingWriter{w: b.stream, n: &b.streamSize})
+}
+
+// Stored returns a writer that hashes the file written to w.
+func (b *manifestBuilder) Stored(w io.Writer) io.Writer {
+	return io.MultiWriter(w, &countingWriter{w: b.stored, n: &b.storedSize})
+}
+
+// Manifest returns the manifest of the stream file of a snapshot, signed with the key
+// of the configuration if it has one. The parent is the manifest of the stream an
+// incremental stream applies on top of, and nil for full streams.
+func (b *manifestBuilder) Manifest(cfg *Config, file string, snap *btrfs.RootInfo, parent *Manifest) (*Manifest, error) {
+	keys, err := cfg.Keyring()
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{
+		Version:      ManifestVersion,
+		File:         file,
+		Format:       cfg.MirrorFormat,
+		Encrypted:    len(keys) > 0,
+		Size:         b.storedSize,
+		SHA256:       hex.EncodeToString(b.stored.Sum(nil)),
+		StreamSize:   b.streamSize,
+		StreamSHA256: hex.EncodeToString(b.stream.Sum(nil)),
+		UUID:         snap.UUID,
+		SourceUUID:   snap.ParentUUID,
+		CreationTime: snap.CreationTime,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if parent != nil {
+		start := parent.ChainStart()
+		m.ParentUUID = &parent.UUID
+		m.Parent = parent.File
+		m.Base = parent.ChainBase()
+		m.BaseCreationTime = &start
+	} else {
+		m.Base = file
+		m.BaseCreationTime = &m.CreationTime
+	}
+	if snap.Item != nil {
+		m.Ctransid = snap.Item.Ctransid
+	}
+	key, err := cfg.Signer()
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		cfg.LogVerbose(2, "Signing manifest of %q\n", file)
+		if err := m.Sign(key); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// compressedSnapshotName returns the name of the snapshot a file in a compressed mirror
+// belongs to.
+func compressedSnapshotName(format config.MirrorFormat, file string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(file, ManifestExtension), "."+string(format))
+}
@@ -0,0 +1,343 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+)
+
+// testSecret sets an environment variable to a hex encoded secret derived from seed
+// and returns a reference to it.
+func testSecret(t *testing.T, name string, seed int64) string {
+	t.Helper()
+	secret := make([]byte, 32)
+	rand.New(rand.NewSource(seed)).Read(secret)
+	t.Setenv(name, hex.EncodeToString(secret))
+	return "env:" + name
+}
+
+// writeTestMirror writes a full stream and an incremental stream on top of it to a
+// local compressed mirror and returns the configuration of the mirror.
+func writeTestMirror(t *testing.T, configure func(*Config)) *Config {
+	t.Helper()
+	cfg := &Config{
+		Logger:              log.New(io.Discard, "", 0),
+		SubvolumeIdentifier: "root",
+		SnapshotName:        "root",
+		MirrorPath:          t.TempDir(),
+		MirrorFormat:        config.MirrorFormatGzip,
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	full, incremental := testSnapshot("root.1"), testSnapshot("root.2")
+	manager, err := NewLocalCompressedManager(cfg, &btrfs.RootInfo{Snapshots: []*btrfs.RootInfo{full, incremental}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := manager.(*localCompressedManager)
+	if _, err := sm.Prepare(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i, snap := range []*btrfs.RootInfo{full, incremental} {
+		var parent *btrfs.RootInfo
+		if i > 0 {
+			parent = full
+		}
+		data := make([]byte, 4096)
+		rand.New(rand.NewSource(int64(i))).Read(data)
+		if err := sm.ReceiveStream(context.Background(), parent, snap, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cfg
+}
+
+// verifyResults verifies the mirror and returns the error of each file, or "ok" if
+// the file was verified, with " (file only)" appended if the stream was not decoded.
+func verifyResults(t *testing.T, cfg *Config, publicKey ed25519.PublicKey) map[string]string {
+	t.Helper()
+	results := make(map[string]string)
+	err := VerifyCompressedMirror(context.Background(), cfg, publicKey, func(res *VerifyResult) {
+		result := "ok"
+		if res.Err != nil {
+			result = res.Err.Error()
+		}
+		if !res.StreamVerified {
+			result += " (file only)"
+		}
+		results[res.File] = result
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestVerifyCompressedMirror(t *testing.T) {
+	otherKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	tests := []struct {
+		name      string
+		configure func(t *testing.T, cfg *Config)
+		// modify changes the mirror and the configuration after it was written
+		modify    func(t *testing.T, dir string, cfg *Config)
+		publicKey ed25519.PublicKey
+		want      map[string]string
+	}{
+		{
+			name: "intact",
+			want: map[string]string{"root.1.gzip": "ok", "root.2.gzip": "ok"},
+		},
+		{
+			name: "signed",
+			configure: func(t *testing.T, cfg *Config) {
+				cfg.SigningKey = testSecret(t, "BTRSYNC_TEST_SIGNING_KEY", 1)
+			},
+			want: map[string]string{"root.1.gzip": "ok", "root.2.gzip": "ok"},
+		},
+		{
+			name: "signed with another key",
+			configure: func(t *testing.T, cfg *Config) {
+				cfg.SigningKey = testSecret(t, "BTRSYNC_TEST_SIGNING_KEY", 1)
+			},
+			publicKey: otherKey.Public().(ed25519.PublicKey),
+			want: map[string]string{
+				"root.1.gzip": "manifest signature is invalid (file only)",
+				"root.2.gzip": "manifest signature is invalid (file only)",
+			},
+		},
+		{
+			name:      "unsigned when a key is required",
+			publicKey: otherKey.Public().(ed25519.PublicKey),
+			want: map[string]string{
+				"root.1.gzip": ErrNoSignature.Error() + " (file only)",
+				"root.2.gzip": ErrNoSignature.Error() + " (file only)",
+			},
+		},
+		{
+			name: "signed manifest modified",
+			configure: func(t *testing.T, cfg *Config) {
+				cfg.SigningKey = testSecret(t, "BTRSYNC_TEST_SIGNING_KEY", 1)
+			},
+			modify: func(t *testing.T, dir string, cfg *Config) {
+				path := filepath.Join(dir, "root", ManifestName("root.1.gzip"))
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				m, err := ParseManifest(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				m.Ctransid++
+				if data, err = m.Marshal(); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{"root.1.gzip": "manifest signature is invalid (file only)", "root.2.gzip": "ok"},
+		},
+		{
+			name: "stream file modified",
+			modify: func(t *testing.T, dir string, cfg *Config) {
+				path := filepath.Join(dir, "root", "root.2.gzip")
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Flip a bit of the gzip trailer, which holds the size of the stream
+				data[len(data)-1] ^= 1
+				if err := os.WriteFile(path, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{"root.1.gzip": "ok", "root.2.gzip": "stream is corrupt: gzip: invalid checksum (file only)"},
+		},
+		{
+			name: "stream file replaced",
+			modify: func(t *testing.T, dir string, cfg *Config) {
+				if err := os.Rename(filepath.Join(dir, "root", "root.2.gzip"), filepath.Join(dir, "root", "root.1.gzip")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{
+				"root.1.gzip": "stream checksum does not match (file only)",
+				"root.2.gzip": "stream file is missing (file only)",
+			},
+		},
+		{
+			name: "manifest missing",
+			modify: func(t *testing.T, dir string, cfg *Config) {
+				if err := os.Remove(filepath.Join(dir, "root", ManifestName("root.1.gzip"))); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{"root.1.gzip": ErrNoManifest.Error() + " (file only)", "root.2.gzip": "ok"},
+		},
+		{
+			name: "parent missing",
+			modify: func(t *testing.T, dir string, cfg *Config) {
+				for _, name := range []string{"root.1.gzip", ManifestName("root.1.gzip")} {
+					if err := os.Remove(filepath.Join(dir, "root", name)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+			want: map[string]string{"root.2.gzip": `parent stream "root.1.gzip" is missing`},
+		},
+		{
+			name: "encrypted",
+			configure: func(t *testing.T, cfg *Config) {
+				cfg.EncryptionKeys = []string{testSecret(t, "BTRSYNC_TEST_ENCRYPTION_KEY", 2)}
+			},
+			want: map[string]string{"root.1.gzip": "ok", "root.2.gzip": "ok"},
+		},
+		{
+			name: "encrypted without the key",
+			configure: func(t *testing.T, cfg *Config) {
+				cfg.EncryptionKeys = []string{testSecret(t, "BTRSYNC_TEST_ENCRYPTION_KEY", 2)}
+			},
+			modify: func(t *testing.T, dir string, cfg *Config) {
+				cfg.EncryptionKeys = nil
+			},
+			want: map[string]string{"root.1.gzip": "ok (file only)", "root.2.gzip": "ok (file only)"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := writeTestMirror(t, func(cfg *Config) {
+				if tc.configure != nil {
+					tc.configure(t, cfg)
+				}
+			})
+			if tc.modify != nil {
+				tc.modify(t, cfg.MirrorPath, cfg)
+			}
+			got := verifyResults(t, cfg, tc.publicKey)
+			for file, want := range tc.want {
+				if got[file] != want {
+					t.Errorf("%s: got %q, want %q", file, got[file], want)
+				}
+			}
+			for file := range got {
+				if _, ok := tc.want[file]; !ok {
+					t.Errorf("unexpected result for %s: %s", file, got[file])
+				}
+			}
+		})
+	}
+}
+
+func TestManifestChain(t *testing.T) {
+	cfg := writeTestMirror(t, nil)
+	files := localMirrorFiles(cfg.MirrorPath)
+	manifests := make(map[string]*Manifest)
+	for _, name := range []string{"root.1.gzip", "root.2.gzip"} {
+		data, err := files.ReadFile(context.Background(), filepath.Join("root", ManifestName(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifests[name], err = ParseManifest(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	full, incremental := manifests["root.1.gzip"], manifests["root.2.gzip"]
+	if full.IsIncremental() || full.ParentUUID != nil || full.ChainBase() != "root.1.gzip" {
+		t.Errorf("full stream has parent %q and base %q", full.Parent, full.ChainBase())
+	}
+	if !incremental.IsIncremental() || incremental.Parent != "root.1.gzip" || incremental.ChainBase() != "root.1.gzip" {
+		t.Errorf("incremental stream has parent %q and base %q", incremental.Parent, incremental.ChainBase())
+	}
+	if incremental.ParentUUID == nil || *incremental.ParentUUID != full.UUID {
+		t.Errorf("incremental stream has parent UUID %v, want %s", incremental.ParentUUID, full.UUID)
+	}
+	if !incremental.ChainStart().Equal(full.CreationTime) {
+		t.Errorf("incremental chain starts at %s, want %s", incremental.ChainStart(), full.CreationTime)
+	}
+	if full.StreamSize != 4096 || full.Size == 0 || full.Encrypted {
+		t.Errorf("full stream has size %d, stream size %d and encrypted %v", full.Size, full.StreamSize, full.Encrypted)
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	seed := bytes.Repeat([]byte{7}, ed25519.SeedSize)
+	key := ed25519.NewKeyFromSeed(seed)
+	tests := []struct {
+		name    string
+		secret  string
+		wantErr bool
+	}{
+		{name: "hex seed", secret: hex.EncodeToString(seed)},
+		{name: "base64 seed", secret: base64.StdEncoding.EncodeToString(seed)},
+		{name: "hex private key", secret: hex.EncodeToString(key)},
+		{name: "base64 private key", secret: base64.StdEncoding.EncodeToString(key)},
+		{name: "wrong size", secret: hex.EncodeToString(seed[:20]), wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("BTRSYNC_TEST_SIGNING_KEY", tc.secret)
+			got, err := LoadSigningKey("env:BTRSYNC_TEST_SIGNING_KEY")
+			if tc.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(key) {
+				t.Error("loaded the wrong key")
+			}
+		})
+	}
+
+	pub, err := ParsePublicKey(" " + hex.EncodeToString(key.Public().(ed25519.PublicKey)) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Version: ManifestVersion, File: "root.1.gzip"}
+	if err := m.VerifySignature(pub); !errors.Is(err, ErrNoSignature) {
+		t.Errorf("unsigned manifest verified with %v", err)
+	}
+	if err := m.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.VerifySignature(pub); err != nil {
+		t.Errorf("signed manifest failed verification: %s", err)
+	}
+	m.File = "root.2.gzip"
+	if err := m.VerifySignature(pub); err == nil || !strings.Contains(err.Error(), "invalid") {
+		t.Errorf("modified manifest verified with %v", err)
+	}
+}
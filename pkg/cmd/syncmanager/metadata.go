@@ -0,0 +1,110 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+)
+
+// metadataFile is the file in the offset directory of a subvolume in a mirror that
+// holds the metadata of its snapshots, keyed by snapshot name.
+const metadataFile = "metadata.json"
+
+func (c *Config) metadataPath() string {
+	return path.Join(c.SubvolumeIdentifier, OffsetDirectory, metadataFile)
+}
+
+// MirrorMetadata returns the metadata of the snapshots in the mirror of the
+// configuration, keyed by snapshot name.
+func MirrorMetadata(ctx context.Context, cfg *Config) (map[string]*snaputil.SnapshotMetadata, error) {
+	files, err := openMirrorFiles(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer files.Close()
+	return readMirrorMetadata(ctx, cfg, files)
+}
+
+func readMirrorMetadata(ctx context.Context, cfg *Config, files mirrorFiles) (map[string]*snaputil.SnapshotMetadata, error) {
+	metadata := make(map[string]*snaputil.SnapshotMetadata)
+	data, err := files.ReadFile(ctx, cfg.metadataPath())
+	if err != nil {
+		if files.IsNotExist(err) {
+			return metadata, nil
+		}
+		return nil, fmt.Errorf("failed to read snapshot metadata of mirror: %w", err)
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("snapshot metadata of mirror is unreadable: %w", err)
+	}
+	return metadata, nil
+}
+
+// PropagateMetadata copies the metadata of the source snapshots to the mirror of the
+// configuration, so labels and notes can be used to find restore points there. The
+// metadata of snapshots only the mirror still has is kept until they are pruned from
+// it, so it should be called after the mirror is pruned.
+func PropagateMetadata(ctx context.Context, cfg *Config) error {
+	if cfg.DryRun {
+		return nil
+	}
+	files, err := openMirrorFiles(cfg)
+	if err != nil {
+		return err
+	}
+	defer files.Close()
+	metadata, err := readMirrorMetadata(ctx, cfg, files)
+	if err != nil {
+		return err
+	}
+	previous, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	for _, name := range cfg.expiredSnapshots {
+		delete(metadata, name)
+	}
+	for _, snap := range cfg.sourceSnapshots {
+		m, err := snaputil.LoadMetadata(cfg.SnapshotDirectory, snap.Name)
+		if err != nil {
+			return err
+		}
+		if m.IsEmpty() {
+			delete(metadata, snap.Name)
+		} else {
+			metadata[snap.Name] = m
+		}
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, previous) {
+		cfg.LogVerbose(2, "Snapshot metadata of mirror %s is up to date\n", cfg.MirrorPath)
+		return nil
+	}
+	cfg.LogVerbose(1, "Updating snapshot metadata of mirror %s\n", cfg.MirrorPath)
+	if err := files.WriteFile(ctx, cfg.metadataPath(), data); err != nil {
+		return fmt.Errorf("failed to write snapshot metadata to mirror: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+)
+
+func TestPropagateMetadata(t *testing.T) {
+	labeled := func(labels ...string) *snaputil.SnapshotMetadata {
+		return &snaputil.SnapshotMetadata{Labels: labels}
+	}
+	tests := []struct {
+		name string
+		// mirror is the metadata already in the mirror, nil if it has none
+		mirror map[string]*snaputil.SnapshotMetadata
+		// source is the metadata of the source snapshots, which are all in the source
+		source  map[string]*snaputil.SnapshotMetadata
+		expired []string
+		dryRun  bool
+		// want is the metadata in the mirror afterwards, nil if it has none
+		want map[string]*snaputil.SnapshotMetadata
+	}{
+		{
+			name:   "nothing to propagate",
+			source: map[string]*snaputil.SnapshotMetadata{"root.1": nil},
+		},
+		{
+			name:   "copied to the mirror",
+			source: map[string]*snaputil.SnapshotMetadata{"root.1": labeled("a"), "root.2": {Hold: true, Note: "note"}},
+			want:   map[string]*snaputil.SnapshotMetadata{"root.1": labeled("a"), "root.2": {Hold: true, Note: "note"}},
+		},
+		{
+			name:   "updated in the mirror",
+			mirror: map[string]*snaputil.SnapshotMetadata{"root.1": labeled("a"), "root.2": labeled("b")},
+			source: map[string]*snaputil.SnapshotMetadata{"root.1": labeled("a", "c"), "root.2": nil},
+			want:   map[string]*snaputil.SnapshotMetadata{"root.1": labeled("a", "c")},
+		},
+		{
+			name:    "kept for snapshots only the mirror has until they expire",
+			mirror:  map[string]*snaputil.SnapshotMetadata{"root.old": labeled("a"), "root.expired": labeled("b")},
+			source:  map[string]*snaputil.SnapshotMetadata{"root.1": labeled("c")},
+			expired: []string{"root.expired"},
+			want:    map[string]*snaputil.SnapshotMetadata{"root.old": labeled("a"), "root.1": labeled("c")},
+		},
+		{
+			name:   "dry run",
+			mirror: map[string]*snaputil.SnapshotMetadata{"root.1": labeled("a")},
+			source: map[string]*snaputil.SnapshotMetadata{"root.1": labeled("b")},
+			dryRun: true,
+			want:   map[string]*snaputil.SnapshotMetadata{"root.1": labeled("a")},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := &Config{
+				Logger:              log.New(io.Discard, "", 0),
+				SubvolumeIdentifier: "root",
+				SnapshotDirectory:   t.TempDir(),
+				MirrorPath:          t.TempDir(),
+				DryRun:              tc.dryRun,
+				expiredSnapshots:    tc.expired,
+			}
+			files := localMirrorFiles(cfg.MirrorPath)
+			if tc.mirror != nil {
+				data, err := json.Marshal(tc.mirror)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := files.WriteFile(ctx, cfg.metadataPath(), data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, m := range tc.source {
+				if m != nil {
+					if err := snaputil.SaveMetadata(cfg.SnapshotDirectory, name, m); err != nil {
+						t.Fatal(err)
+					}
+				}
+				cfg.sourceSnapshots = append(cfg.sourceSnapshots, &btrfs.RootInfo{Name: name})
+			}
+
+			if err := PropagateMetadata(ctx, cfg); err != nil {
+				t.Fatal(err)
+			}
+			if tc.want == nil {
+				if _, err := os.Stat(filepath.Join(cfg.MirrorPath, cfg.metadataPath())); !os.IsNotExist(err) {
+					t.Errorf("metadata written to the mirror: %v", err)
+				}
+				return
+			}
+			got, err := readMirrorMetadata(ctx, cfg, files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("mirror has metadata %v, want %v", got, tc.want)
+			}
+			metadata, err := MirrorMetadata(ctx, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(metadata, got) {
+				t.Errorf("MirrorMetadata returned %v, want %v", metadata, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tinyzimmer/btrsync/pkg/cmd/sshutil"
+	"github.com/tinyzimmer/btrsync/pkg/s3"
+)
+
+// mirrorFiles reads the files of a compressed mirror, and writes the files btrsync keeps
+// next to the snapshots of any mirror.
+type mirrorFiles interface {
+	// Subvolumes lists the directories of the subvolumes in the mirror
+	Subvolumes(ctx context.Context) ([]string, error)
+	// Files lists the files in the directory of a subvolume
+	Files(ctx context.Context, subvolume string) ([]string, error)
+	ReadFile(ctx context.Context, path string) ([]byte, error)
+	Open(ctx context.Context, path string) (io.ReadCloser, error)
+	// WriteFile writes a file, creating its directory if needed
+	WriteFile(ctx context.Context, path string, data []byte) error
+	// IsNotExist returns true if an error is returned for a file that does not exist
+	IsNotExist(err error) bool
+	Close() error
+}
+
+func openMirrorFiles(cfg *Config) (mirrorFiles, error) {
+	mirrorURL, err := cfg.MirrorURL()
+	if err != nil {
+		return nil, err
+	}
+	switch mirrorURL.Scheme {
+	case "file":
+		return localMirrorFiles(mirrorURL.Path), nil
+	case "ssh":
+		sshcfg, err := cfg.SSHConfig()
+		if err != nil {
+			return nil, err
+		}
+		cfg.LogVerbose(1, "Connecting to remote host using tcp: %s\n", mirrorURL.String())
+		client, err := sshutil.Dial(context.Background(), mirrorURL, sshcfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial ssh server: %s", err)
+		}
+		return &sshMirrorFiles{client: client, root: mirrorURL.Path}, nil
+	case "s3":
+		client, bucket, prefix, err := cfg.S3Client()
+		if err != nil {
+			return nil, err
+		}
+		return &s3MirrorFiles{client: client, bucket: bucket, prefix: prefix}, nil
+	}
+	return nil, fmt.Errorf("unsupported mirror scheme: %s", mirrorURL.Scheme)
+}
+
+type localMirrorFiles string
+
+func (l localMirrorFiles) list(dir string, dirs bool) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(string(l), dir))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() == dirs && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (l localMirrorFiles) Subvolumes(ctx context.Context) ([]string, error) {
+	return l.list("", true)
+}
+
+func (l localMirrorFiles) Files(ctx context.Context, subvolume string) ([]string, error) {
+	return l.list(subvolume, false)
+}
+
+func (l localMirrorFiles) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(string(l), path))
+}
+
+func (l localMirrorFiles) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(l), path))
+}
+
+func (l localMirrorFiles) WriteFile(ctx context.Context, path string, data []byte) error {
+	path = filepath.Join(string(l), path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func (l localMirrorFiles) IsNotExist(err error) bool { return os.IsNotExist(err) }
+
+func (l localMirrorFiles) Close() error { return nil }
+
+type sshMirrorFiles struct {
+	client *ssh.Client
+	root   string
+}
+
+func (s *sshMirrorFiles) Subvolumes(ctx context.Context) ([]string, error) {
+	return sshutil.ReadDir(ctx, s.client, s.root)
+}
+
+func (s *sshMirrorFiles) Files(ctx context.Context, subvolume string) ([]string, error) {
+	return sshutil.ReadDir(ctx, s.client, filepath.Join(s.root, subvolume))
+}
+
+func (s *sshMirrorFiles) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	return sshutil.ReadFile(ctx, s.client, filepath.Join(s.root, path))
+}
+
+func (s *sshMirrorFiles) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	return sshutil.OpenFile(ctx, s.client, filepath.Join(s.root, path))
+}
+
+func (s *sshMirrorFiles) WriteFile(ctx context.Context, path string, data []byte) error {
+	path = filepath.Join(s.root, path)
+	if err := sshutil.MkdirAll(ctx, s.client, filepath.Dir(path)); err != nil {
+		return err
+	}
+	return sshutil.WriteFile(ctx, s.client, path, bytes.NewReader(data))
+}
+
+func (s *sshMirrorFiles) IsNotExist(err error) bool { return sshutil.IsFileNotExist(err) }
+
+func (s *sshMirrorFiles) Close() error { return s.client.Close() }
+
+type s3MirrorFiles struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func (s *s3MirrorFiles) dir(name string) string {
+	if dir := path.Join(s.prefix, name); dir != "." {
+		return dir + "/"
+	}
+	return ""
+}
+
+func (s *s3MirrorFiles) Subvolumes(ctx context.Context) ([]string, error) {
+	dir := s.dir("")
+	res, err := s.client.ListObjects(ctx, s.bucket, dir, "/")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, prefix := range res.Prefixes {
+		names = append(names, strings.TrimSuffix(strings.TrimPrefix(prefix, dir), "/"))
+	}
+	return names, nil
+}
+
+func (s *s3MirrorFiles) Files(ctx context.Context, subvolume string) ([]string, error) {
+	dir := s.dir(subvolume)
+	res, err := s.client.ListObjects(ctx, s.bucket, dir, "/")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, obj := range res.Objects {
+		names = append(names, strings.TrimPrefix(obj.Key, dir))
+	}
+	return names, nil
+}
+
+func (s *s3MirrorFiles) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	rdr, err := s.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	return io.ReadAll(rdr)
+}
+
+func (s *s3MirrorFiles) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.client.GetObject(ctx, s.bucket, path.Join(s.prefix, name))
+}
+
+func (s *s3MirrorFiles) WriteFile(ctx context.Context, name string, data []byte) error {
+	return s.client.PutObject(ctx, s.bucket, path.Join(s.prefix, name), data, nil)
+}
+
+func (s *s3MirrorFiles) IsNotExist(err error) bool { return s3.IsNotFound(err) }
+
+func (s *s3MirrorFiles) Close() error { return nil }
@@ -0,0 +1,424 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+)
+
+// ReplicationBufferChunks is the number of stream chunks buffered for each mirror
+// while replicating a single send to multiple mirrors. A mirror only slows down
+// the send once its buffer is full.
+var ReplicationBufferChunks = 64
+
+const replicationChunkSize = 128 * 1024
+
+// MaxCloneSources is the maximum number of snapshots, besides the parent, that an
+// incremental send to a subvolume mirror may clone data from. The newest snapshots the
+// mirror has are used.
+var MaxCloneSources = 16
+
+// ReplicationError is returned by Replicate when one or more mirrors failed.
+// Errors are keyed by mirror path.
+type ReplicationError struct {
+	Errors map[string]error
+}
+
+func (e *ReplicationError) Error() string {
+	paths := make([]string, 0, len(e.Errors))
+	for path := range e.Errors {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	msgs := make([]string, len(paths))
+	for i, path := range paths {
+		msgs[i] = fmt.Sprintf("%s: %s", path, e.Errors[path])
+	}
+	return fmt.Sprintf("replication failed for %d mirror(s): %s", len(paths), strings.Join(msgs, "; "))
+}
+
+// Failed returns true if the mirror at the given path failed to replicate.
+func (e *ReplicationError) Failed(mirrorPath string) bool {
+	_, ok := e.Errors[mirrorPath]
+	return ok
+}
+
+type replicationKey struct {
+	parent uuid.UUID
+	snap   uuid.UUID
+	clones string
+}
+
+type replicationGroup struct {
+	inc      *snaputil.IncrementalSnapshot
+	managers []StreamManager
+}
+
+// Replicate syncs the given managers, which must all mirror the same subvolume. Mirrors
+// that need the same snapshot sent against the same parent and clone sources share a
+// single btrfs send, whose stream is copied to each of them. Every mirror is given its
+// own buffer, and a mirror that fails stops receiving the remaining snapshots without
+// affecting the others.
+// Managers that do not implement StreamManager are synced on their own.
+func Replicate(ctx context.Context, managers ...Manager) error {
+	failed := make(map[string]error)
+	var streamManagers []StreamManager
+	for _, m := range managers {
+		sm, ok := m.(StreamManager)
+		if !ok {
+			if err := m.Sync(ctx); err != nil {
+				failed[m.Config().MirrorPath] = err
+			}
+			continue
+		}
+		streamManagers = append(streamManagers, sm)
+	}
+
+	// Collect the snapshots every mirror is missing and group them by what
+	// needs to be sent.
+	var groups []*replicationGroup
+	keys := make(map[replicationKey]*replicationGroup)
+	for _, sm := range streamManagers {
+		pending, err := sm.Prepare(ctx)
+		if err != nil {
+			failed[sm.Config().MirrorPath] = err
+			continue
+		}
+		for _, inc := range pending {
+			key := replicationKey{snap: inc.Snapshot.UUID}
+			if inc.Parent != nil {
+				key.parent = inc.Parent.UUID
+			}
+			clones := make([]string, len(inc.CloneSources))
+			for i, clone := range inc.CloneSources {
+				clones[i] = clone.UUID.String()
+			}
+			key.clones = strings.Join(clones, ",")
+			group, ok := keys[key]
+			if !ok {
+				group = &replicationGroup{inc: inc}
+				keys[key] = group
+				groups = append(groups, group)
+			}
+			group.managers = append(group.managers, sm)
+		}
+	}
+	// Each mirror returned its snapshots oldest first, so sending the groups in
+	// order of snapshot creation preserves the order for every mirror.
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].inc.Snapshot.CreationTime.Before(groups[j].inc.Snapshot.CreationTime)
+	})
+
+	for _, group := range groups {
+		var targets []StreamManager
+		for _, sm := range group.managers {
+			if _, ok := failed[sm.Config().MirrorPath]; !ok {
+				targets = append(targets, sm)
+			}
+		}
+		if len(targets) == 0 {
+			continue
+		}
+		errs := replicateSnapshot(ctx, group.inc, targets)
+		for i, err := range errs {
+			if err := resendInFull(ctx, group.inc, targets[i], err); err != nil {
+				failed[targets[i].Config().MirrorPath] = err
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return &ReplicationError{Errors: failed}
+	}
+	return nil
+}
+
+type replicationTarget struct {
+	manager StreamManager
+	chunks  chan []byte
+	reader  *io.PipeReader
+	writer  *io.PipeWriter
+	done    chan struct{}
+	err     error
+}
+
+// replicateSnapshot sends the snapshot once and copies the stream to every target. The
+// returned errors correspond to the given targets.
+func replicateSnapshot(ctx context.Context, inc *snaputil.IncrementalSnapshot, targets []StreamManager) []error {
+	parent, snap := inc.Parent, inc.Snapshot
+	cfg := targets[0].Config()
+	if len(targets) > 1 {
+		cfg.LogVerbose(0, "Replicating snapshot %q to %d mirrors with a single send\n", snap.Path, len(targets))
+	}
+	errs := make([]error, len(targets))
+	if len(targets) == 1 {
+		errs[0] = sendSnapshot(cfg, inc, func(r io.Reader) error {
+			return targets[0].ReceiveStream(ctx, parent, snap, r)
+		})
+		return errs
+	}
+
+	var wg sync.WaitGroup
+	rts := make([]*replicationTarget, len(targets))
+	for i, sm := range targets {
+		rt := &replicationTarget{
+			manager: sm,
+			chunks:  make(chan []byte, ReplicationBufferChunks),
+			done:    make(chan struct{}),
+		}
+		rt.reader, rt.writer = io.Pipe()
+		rts[i] = rt
+		wg.Add(2)
+		// Feed buffered chunks to the receiver. Once the receiver has returned,
+		// writes fail immediately and the remaining chunks are discarded.
+		go func() {
+			defer wg.Done()
+			defer rt.writer.Close()
+			for chunk := range rt.chunks {
+				rt.writer.Write(chunk)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			defer close(rt.done)
+			rt.err = rt.manager.ReceiveStream(ctx, parent, snap, rt.reader)
+			if rt.err != nil {
+				rt.manager.Config().LogVerbose(0, "Mirror %s failed to receive snapshot %q: %s\n",
+					rt.manager.Config().MirrorPath, snap.Path, rt.err)
+			}
+			rt.reader.CloseWithError(io.ErrClosedPipe)
+		}()
+	}
+
+	sendErr := sendSnapshot(cfg, inc, func(r io.Reader) error {
+		for {
+			buf := make([]byte, replicationChunkSize)
+			n, err := r.Read(buf)
+			if n > 0 {
+				var active int
+				for _, rt := range rts {
+					select {
+					case <-rt.done:
+						continue
+					default:
+					}
+					active++
+					select {
+					case rt.chunks <- buf[:n]:
+					case <-rt.done:
+					}
+				}
+				if active == 0 {
+					return fmt.Errorf("all mirrors failed to receive snapshot %q", snap.Path)
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
+	})
+	for _, rt := range rts {
+		close(rt.chunks)
+	}
+	wg.Wait()
+
+	for i, rt := range rts {
+		errs[i] = rt.err
+		if errs[i] == nil && sendErr != nil {
+			errs[i] = sendErr
+		}
+	}
+	return errs
+}
+
+// resendInFull sends a snapshot in full to a mirror that failed to receive it
+// incrementally because it could not clone data from a previous snapshot, such as a
+// directory mirror that only holds the contents of the last snapshot it received. Any
+// other error is returned as is.
+func resendInFull(ctx context.Context, inc *snaputil.IncrementalSnapshot, sm StreamManager, err error) error {
+	if err == nil || inc.Parent == nil || !errors.Is(err, receivers.ErrCloneSourceUnavailable) {
+		return err
+	}
+	cfg := sm.Config()
+	cfg.LogVerbose(0, "Mirror %s cannot receive snapshot %q incrementally, sending it in full: %s\n", cfg.MirrorPath, inc.Snapshot.Path, err)
+	full := &snaputil.IncrementalSnapshot{Snapshot: inc.Snapshot}
+	return sendSnapshot(cfg, full, func(r io.Reader) error {
+		return sm.ReceiveStream(ctx, nil, inc.Snapshot, r)
+	})
+}
+
+// sendSnapshot sends the snapshot, incrementally from its parent if it has one, and
+// hands the stream to the given receive function.
+func sendSnapshot(cfg *Config, inc *snaputil.IncrementalSnapshot, receive func(io.Reader) error) error {
+	var parentPath string
+	if inc.Parent != nil {
+		parentPath = filepath.Join(cfg.SnapshotDirectory, inc.Parent.Name)
+	}
+	clonePaths := make([]string, len(inc.CloneSources))
+	for i, clone := range inc.CloneSources {
+		clonePaths[i] = filepath.Join(cfg.SnapshotDirectory, clone.Name)
+	}
+	return sendSubvolume(cfg, filepath.Join(cfg.SnapshotDirectory, inc.Snapshot.Name), parentPath, clonePaths, receive)
+}
+
+// sendSubvolume sends the subvolume at path to the receive function, incrementally to
+// the subvolume at parentPath if it is set, cloning data from the subvolumes at
+// clonePaths as well.
+func sendSubvolume(cfg *Config, path, parentPath string, clonePaths []string, receive func(io.Reader) error) error {
+	pipeOpt, pipe, err := btrfs.SendToPipe()
+	if err != nil {
+		return fmt.Errorf("error creating send pipe: %w", err)
+	}
+	var wg sync.WaitGroup
+	errors := make(chan error, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sendOpts := []btrfs.SendOption{
+			pipeOpt,
+			btrfs.SendWithLogger(cfg.Logger, cfg.Verbosity),
+			btrfs.SendCompressedData(),
+		}
+		if parentPath != "" {
+			sendOpts = append(sendOpts, btrfs.SendWithParentRoot(parentPath))
+		}
+		if len(clonePaths) > 0 {
+			sendOpts = append(sendOpts, btrfs.SendWithCloneSources(clonePaths...))
+		}
+		if err := btrfs.Send(path, sendOpts...); err != nil {
+			errors <- fmt.Errorf("error sending snapshot: %w", err)
+		}
+	}()
+	err = receive(pipe)
+	// Closing the read end unblocks the send if the receiver stopped early
+	pipe.Close()
+	wg.Wait()
+	close(errors)
+	if err != nil {
+		return err
+	}
+	for err := range errors {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingSnapshots filters the incremental chain of snapshots down to the ones that
+// the given check reports as not yet synced.
+func pendingSnapshots(snapshots []*snaputil.IncrementalSnapshot, isSynced func(*btrfs.RootInfo) (bool, error)) ([]*snaputil.IncrementalSnapshot, error) {
+	pending := make([]*snaputil.IncrementalSnapshot, 0, len(snapshots))
+	for _, inc := range snapshots {
+		synced, err := isSynced(inc.Snapshot)
+		if err != nil {
+			return nil, err
+		}
+		if !synced {
+			pending = append(pending, inc)
+		}
+	}
+	return pending, nil
+}
+
+// parentSelection describes how snapshots can be sent incrementally to a destination.
+type parentSelection struct {
+	// cloneSources adds the other snapshots the destination has as clone sources
+	cloneSources bool
+	// forwardOnly only sends the snapshots newer than the newest one the destination
+	// has, for destinations that only hold the state of the last snapshot received
+	forwardOnly bool
+}
+
+// incrementalSnapshots returns the snapshots the destination is missing, oldest first.
+// Each is sent against the newest older snapshot the destination has, or will have by
+// the time it is sent, so snapshots missing from the destination do not break the chain.
+// Source snapshots that are not to be sent, such as the ones a mirror retention policy
+// does not keep, are still used as parents when the destination has them.
+func (c *Config) incrementalSnapshots(snapshots []*btrfs.RootInfo, sel parentSelection, isSynced func(*btrfs.RootInfo) (bool, error)) ([]*snaputil.IncrementalSnapshot, error) {
+	send := make(map[uuid.UUID]bool, len(snapshots))
+	for _, snap := range snapshots {
+		send[snap.UUID] = true
+	}
+	candidates := c.sourceSnapshots
+	if candidates == nil {
+		candidates = snapshots
+	}
+	candidates = append([]*btrfs.RootInfo(nil), candidates...)
+	snaputil.SortSnapshots(candidates, snaputil.SortAscending)
+
+	synced := make([]bool, len(candidates))
+	start := 0
+	for i, snap := range candidates {
+		ok, err := isSynced(snap)
+		if err != nil {
+			return nil, err
+		}
+		synced[i] = ok
+		if ok && sel.forwardOnly {
+			start = i
+		}
+	}
+
+	var (
+		have    []*btrfs.RootInfo
+		pending []*snaputil.IncrementalSnapshot
+	)
+	for i, snap := range candidates {
+		if synced[i] {
+			have = append(have, snap)
+			continue
+		}
+		if !send[snap.UUID] {
+			continue
+		}
+		if i < start {
+			c.LogVerbose(1, "Skipping snapshot %q, the destination already has the newer %q\n", snap.Name, candidates[start].Name)
+			continue
+		}
+		inc := &snaputil.IncrementalSnapshot{Snapshot: snap}
+		if len(have) > 0 {
+			inc.Parent = have[len(have)-1]
+			if sel.cloneSources {
+				clones := have[:len(have)-1]
+				if len(clones) > MaxCloneSources {
+					clones = clones[len(clones)-MaxCloneSources:]
+				}
+				inc.CloneSources = append([]*btrfs.RootInfo(nil), clones...)
+			}
+			c.LogVerbose(2, "Snapshot %q will be sent incrementally to %q\n", snap.Name, inc.Parent.Name)
+		}
+		pending = append(pending, inc)
+		have = append(have, snap)
+	}
+	return pending, nil
+}
@@ -0,0 +1,175 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+)
+
+func TestIncrementalSnapshots(t *testing.T) {
+	now := time.Now()
+	snapshots := make([]*btrfs.RootInfo, 5)
+	for i := range snapshots {
+		snapshots[i] = &btrfs.RootInfo{
+			Name:         fmt.Sprintf("snap%d", i+1),
+			UUID:         uuid.New(),
+			CreationTime: now.Add(time.Duration(i-len(snapshots)) * time.Hour),
+		}
+	}
+	// pick returns the snapshots with the given numbers
+	pick := func(numbers ...int) []*btrfs.RootInfo {
+		picked := make([]*btrfs.RootInfo, len(numbers))
+		for i, n := range numbers {
+			picked[i] = snapshots[n-1]
+		}
+		return picked
+	}
+	tests := []struct {
+		name string
+		sel  parentSelection
+		// send are the snapshots to send, and source every snapshot of the source if
+		// it differs
+		send, source []int
+		synced       []int
+		maxClones    int
+		want         []string
+	}{
+		{
+			name: "nothing synced",
+			send: []int{1, 2, 3},
+			want: []string{"snap1", "snap2 from snap1", "snap3 from snap2"},
+		},
+		{
+			name:   "everything synced",
+			send:   []int{1, 2, 3},
+			synced: []int{1, 2, 3},
+			want:   []string{},
+		},
+		{
+			name:   "unsorted snapshots",
+			send:   []int{3, 1, 2},
+			synced: []int{1},
+			want:   []string{"snap2 from snap1", "snap3 from snap2"},
+		},
+		{
+			name:   "missing snapshots are sent from the newest older one",
+			send:   []int{1, 2, 3, 4, 5},
+			synced: []int{1, 3},
+			want:   []string{"snap2 from snap1", "snap4 from snap3", "snap5 from snap4"},
+		},
+		{
+			name:   "clone sources",
+			sel:    parentSelection{cloneSources: true},
+			send:   []int{1, 2, 3, 4, 5},
+			synced: []int{1, 3},
+			want: []string{
+				"snap2 from snap1",
+				"snap4 from snap3 cloning snap1,snap2",
+				"snap5 from snap4 cloning snap1,snap2,snap3",
+			},
+		},
+		{
+			name:      "newest clone sources are used",
+			sel:       parentSelection{cloneSources: true},
+			send:      []int{1, 2, 3, 4, 5},
+			synced:    []int{1, 2, 3, 4},
+			maxClones: 2,
+			want:      []string{"snap5 from snap4 cloning snap2,snap3"},
+		},
+		{
+			name:   "forward only",
+			sel:    parentSelection{forwardOnly: true},
+			send:   []int{1, 2, 3, 4, 5},
+			synced: []int{3},
+			want:   []string{"snap4 from snap3", "snap5 from snap4"},
+		},
+		{
+			name:   "snapshots that are not sent are still parents",
+			send:   []int{1, 3, 5},
+			source: []int{1, 2, 3, 4, 5},
+			synced: []int{2},
+			want:   []string{"snap1", "snap3 from snap2", "snap5 from snap3"},
+		},
+		{
+			name:   "snapshots that are not sent and not synced are not parents",
+			send:   []int{1, 3, 5},
+			source: []int{1, 2, 3, 4, 5},
+			want:   []string{"snap1", "snap3 from snap1", "snap5 from snap3"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.maxClones > 0 {
+				defer func(max int) { MaxCloneSources = max }(MaxCloneSources)
+				MaxCloneSources = tc.maxClones
+			}
+			cfg := &Config{Logger: log.New(io.Discard, "", 0)}
+			if tc.source != nil {
+				cfg.sourceSnapshots = pick(tc.source...)
+			}
+			synced := make(map[uuid.UUID]bool)
+			for _, snap := range pick(tc.synced...) {
+				synced[snap.UUID] = true
+			}
+			pending, err := cfg.incrementalSnapshots(pick(tc.send...), tc.sel, func(snap *btrfs.RootInfo) (bool, error) {
+				return synced[snap.UUID], nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, inc := range pending {
+				s := inc.Snapshot.Name
+				if inc.Parent != nil {
+					s += " from " + inc.Parent.Name
+				}
+				if len(inc.CloneSources) > 0 {
+					names := make([]string, len(inc.CloneSources))
+					for i, clone := range inc.CloneSources {
+						names[i] = clone.Name
+					}
+					s += " cloning " + strings.Join(names, ",")
+				}
+				got = append(got, s)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("error checking the destination", func(t *testing.T) {
+		errCheck := errors.New("check failed")
+		cfg := &Config{Logger: log.New(io.Discard, "", 0)}
+		_, err := cfg.incrementalSnapshots(snapshots, parentSelection{}, func(*btrfs.RootInfo) (bool, error) {
+			return false, errCheck
+		})
+		if !errors.Is(err, errCheck) {
+			t.Errorf("got error %v, want %v", err, errCheck)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/sshutil"
+	"github.com/tinyzimmer/btrsync/pkg/repository"
+)
+
+type repositoryManager struct {
+	config     *Config
+	sourceInfo *btrfs.RootInfo
+	repo       *repository.Repository
+}
+
+// OpenRepository opens the deduplicating repository at the mirror path of the
+// configuration, connecting over SFTP for ssh mirrors.
+func OpenRepository(cfg *Config) (*repository.Repository, error) {
+	mirrorURL, err := cfg.MirrorURL()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := cfg.Keyring()
+	if err != nil {
+		return nil, err
+	}
+	var backend repository.Backend
+	switch mirrorURL.Scheme {
+	case "file":
+		backend = repository.NewLocalBackend(mirrorURL.Path)
+	case "ssh":
+		sshcfg, err := cfg.SSHConfig()
+		if err != nil {
+			return nil, err
+		}
+		cfg.LogVerbose(1, "Connecting to remote host using tcp: %s\n", mirrorURL.String())
+		sshClient, err := sshutil.Dial(context.Background(), mirrorURL, sshcfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial ssh server: %s", err)
+		}
+		backend, err = repository.NewSFTPBackend(sshClient, mirrorURL.Path)
+		if err != nil {
+			sshClient.Close()
+			return nil, fmt.Errorf("failed to start sftp session: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported mirror scheme: %s", mirrorURL.Scheme)
+	}
+	repo, err := repository.Open(backend,
+		repository.WithLogger(cfg.Logger, cfg.Verbosity),
+		repository.WithKeys(keys),
+	)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+	return repo, nil
+}
+
+func NewRepositoryManager(cfg *Config, subvolInfo *btrfs.RootInfo) (Manager, error) {
+	cfg.LogVerbose(0, "Initiating repository sync manager for %q with mirror URL: %s\n", cfg.FullSubvolumePath, cfg.MirrorPath)
+	repo, err := OpenRepository(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &repositoryManager{
+		config:     cfg,
+		sourceInfo: subvolInfo,
+		repo:       repo,
+	}, nil
+}
+
+func (sm *repositoryManager) Config() *Config { return sm.config }
+
+func (sm *repositoryManager) Sync(ctx context.Context) error {
+	return syncStream(ctx, sm)
+}
+
+func (sm *repositoryManager) Prepare(ctx context.Context) ([]*snaputil.IncrementalSnapshot, error) {
+	sm.config.LogVerbose(0, "Syncing repository mirror: %q\n", sm.config.MirrorPath)
+	stored, err := sm.repo.Snapshots(sm.config.SubvolumeIdentifier)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repository snapshots: %w", err)
+	}
+	return pendingSnapshots(fullSnapshots(sm.sourceInfo.Snapshots), func(snap *btrfs.RootInfo) (bool, error) {
+		for _, idx := range stored {
+			if idx.UUID == snap.UUID {
+				sm.config.LogVerbose(1, "Snapshot %q already synced, skipping\n", snap.Name)
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
+
+func (sm *repositoryManager) ReceiveStream(ctx context.Context, _, snap *btrfs.RootInfo, stream io.Reader) error {
+	sm.config.LogVerbose(0, "Syncing snapshot %q to repository %q\n", snap.Path, sm.config.MirrorPath)
+	idx := &repository.Index{
+		Subvolume:    sm.config.SubvolumeIdentifier,
+		Name:         snap.Name,
+		UUID:         snap.UUID,
+		Generation:   snap.Generation,
+		CreationTime: snap.CreationTime,
+	}
+	if err := sm.repo.Save(ctx, idx, stream); err != nil {
+		return fmt.Errorf("error storing snapshot in repository: %w", err)
+	}
+	return nil
+}
+
+func (sm *repositoryManager) Prune(ctx context.Context) error {
+	if !sm.config.sourceHasSnapshots() {
+		return nil
+	}
+	stored, err := sm.repo.Snapshots(sm.config.SubvolumeIdentifier)
+	if err != nil {
+		return fmt.Errorf("failed to list repository snapshots: %w", err)
+	}
+	names := make([]string, len(stored))
+	for i, idx := range stored {
+		names[i] = idx.Name
+	}
+	retained := sm.config.retainedSnapshots(sm.sourceInfo.Snapshots, names)
+	for _, idx := range stored {
+		if retained[idx.Name] {
+			sm.config.LogVerbose(3, "Mirrored snapshot %q has not expired\n", idx.Name)
+			continue
+		}
+		err := sm.config.expire(idx.Name, idx.Subvolume+"/"+idx.Name, func() error {
+			return sm.repo.DeleteSnapshot(idx.Subvolume, idx.Name)
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting snapshot %q: %w", idx.Name, err)
+		}
+	}
+	if sm.config.DryRun {
+		return nil
+	}
+	_, err = sm.repo.Prune(ctx)
+	if errors.Is(err, repository.ErrLocked) {
+		// Another subvolume is using the repository, its chunks are collected by
+		// the next prune
+		sm.config.LogVerbose(0, "Skipping removal of unreferenced chunks: %s\n", err)
+		return nil
+	}
+	return err
+}
+
+func (sm *repositoryManager) Close() error {
+	return sm.repo.Close()
+}
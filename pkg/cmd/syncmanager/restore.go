@@ -0,0 +1,647 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/sshutil"
+	"github.com/tinyzimmer/btrsync/pkg/encryption"
+	"github.com/tinyzimmer/btrsync/pkg/receive"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/directory"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/local"
+	"github.com/tinyzimmer/btrsync/pkg/repository"
+)
+
+// RestorePoint is a snapshot of a subvolume stored in a mirror.
+type RestorePoint struct {
+	// Name is the name of the snapshot
+	Name string
+	// UUID is the UUID of the snapshot, if the mirror records it
+	UUID uuid.UUID
+	// CreationTime is the time the snapshot was taken, if it is known
+	CreationTime time.Time
+}
+
+// Restorer lists the snapshots of a subvolume stored in a mirror and restores them.
+type Restorer interface {
+	// Snapshots returns the snapshots in the mirror, oldest first
+	Snapshots(ctx context.Context) ([]*RestorePoint, error)
+	// Restore restores a snapshot as a new read-only subvolume in the dest directory
+	// and returns its path
+	Restore(ctx context.Context, snap *RestorePoint, dest string) (string, error)
+	Close() error
+}
+
+// NewRestorer returns a restorer for the snapshots of the subvolume of the
+// configuration in its mirror.
+func NewRestorer(cfg *Config) (Restorer, error) {
+	mirrorURL, err := cfg.MirrorURL()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cfg.MirrorFormat == config.MirrorFormatRepository:
+		repo, err := OpenRepository(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &repositoryRestorer{config: cfg, repo: repo}, nil
+	case cfg.MirrorFormat.IsCompressed():
+		files, err := openMirrorFiles(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &compressedRestorer{config: cfg, files: files}, nil
+	}
+	switch mirrorURL.Scheme {
+	case "file":
+		root := filepath.Join(mirrorURL.Path, cfg.SubvolumeIdentifier)
+		switch cfg.MirrorFormat {
+		case config.MirrorFormatSubvolume, "":
+			return &localSubvolumeRestorer{config: cfg, root: root}, nil
+		case config.MirrorFormatDirectory, config.MirrorFormatVersionedDirectory:
+			return &directoryRestorer{config: cfg, tree: localTree{}, root: root}, nil
+		}
+	case "ssh":
+		sshcfg, err := cfg.SSHConfig()
+		if err != nil {
+			return nil, err
+		}
+		cfg.LogVerbose(1, "Connecting to remote host using tcp: %s\n", mirrorURL.String())
+		client, err := sshutil.Dial(context.Background(), mirrorURL, sshcfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial ssh server: %s", err)
+		}
+		root := filepath.Join(mirrorURL.Path, cfg.SubvolumeIdentifier)
+		switch cfg.MirrorFormat {
+		case config.MirrorFormatSubvolume, "":
+			return &sshSubvolumeRestorer{config: cfg, client: client, root: root}, nil
+		case config.MirrorFormatDirectory, config.MirrorFormatVersionedDirectory:
+			sftpClient, err := sftp.NewClient(client)
+			if err != nil {
+				client.Close()
+				return nil, fmt.Errorf("failed to start sftp session: %s", err)
+			}
+			return &directoryRestorer{config: cfg, tree: &sftpTree{client: sftpClient, conn: client}, root: root}, nil
+		}
+		client.Close()
+	default:
+		return nil, fmt.Errorf("unsupported mirror scheme: %s", mirrorURL.Scheme)
+	}
+	return nil, fmt.Errorf("unsupported mirror format: %s", cfg.MirrorFormat)
+}
+
+// snapshotTime returns the time in the name of a snapshot, or the zero time if the name
+// does not contain one.
+func (c *Config) snapshotTime(name string) time.Time {
+	if c.TimeFormat == "" {
+		return time.Time{}
+	}
+	t, err := time.ParseInLocation(c.TimeFormat, strings.TrimPrefix(name, c.SnapshotName+"."), time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// receiveSnapshot receives a send stream into the dest directory.
+func receiveSnapshot(ctx context.Context, cfg *Config, stream io.Reader, dest string) error {
+	return receive.ProcessSendStream(stream,
+		receive.WithLogger(cfg.Logger, cfg.Verbosity),
+		receive.WithContext(ctx),
+		receive.HonorEndCommand(),
+		receive.To(local.New(dest)),
+	)
+}
+
+// checkRestoreDestination returns the path a snapshot is restored to in dest, failing
+// if something is already there.
+func checkRestoreDestination(dest, name string) (string, error) {
+	target := filepath.Join(dest, name)
+	if _, err := os.Lstat(target); err == nil {
+		return "", fmt.Errorf("%q already exists", target)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	return target, nil
+}
+
+// pointsByTime sorts restore points oldest first. Points without a time are sorted by
+// name, which sorts by time for the default time format.
+func pointsByTime(points []*RestorePoint) []*RestorePoint {
+	sort.SliceStable(points, func(i, j int) bool {
+		if points[i].CreationTime.Equal(points[j].CreationTime) {
+			return points[i].Name < points[j].Name
+		}
+		return points[i].CreationTime.Before(points[j].CreationTime)
+	})
+	return points
+}
+
+// localSubvolumeRestorer sends snapshots back from a local subvolume mirror.
+type localSubvolumeRestorer struct {
+	config *Config
+	root   string
+}
+
+func (r *localSubvolumeRestorer) Snapshots(ctx context.Context) ([]*RestorePoint, error) {
+	entries, err := os.ReadDir(r.root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mirror directory: %w", err)
+	}
+	var points []*RestorePoint
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		point := &RestorePoint{Name: entry.Name(), CreationTime: r.config.snapshotTime(entry.Name())}
+		if info, err := btrfs.SubvolumeSearch(btrfs.SearchWithPath(filepath.Join(r.root, entry.Name()))); err == nil {
+			point.UUID = info.ReceivedUUID
+		}
+		points = append(points, point)
+	}
+	return pointsByTime(points), nil
+}
+
+func (r *localSubvolumeRestorer) Restore(ctx context.Context, snap *RestorePoint, dest string) (string, error) {
+	target, err := checkRestoreDestination(dest, snap.Name)
+	if err != nil {
+		return "", err
+	}
+	source := filepath.Join(r.root, snap.Name)
+	r.config.LogVerbose(0, "Sending %q back to %q\n", source, dest)
+	err = sendSubvolume(r.config, source, "", nil, func(stream io.Reader) error {
+		return receiveSnapshot(ctx, r.config, stream, dest)
+	})
+	return target, err
+}
+
+func (r *localSubvolumeRestorer) Close() error { return nil }
+
+// sshSubvolumeRestorer sends snapshots back from a subvolume mirror on a remote host
+// with btrfs send.
+type sshSubvolumeRestorer struct {
+	config *Config
+	client *ssh.Client
+	root   string
+}
+
+func (r *sshSubvolumeRestorer) Snapshots(ctx context.Context) ([]*RestorePoint, error) {
+	names, err := sshutil.ReadDir(ctx, r.client, r.root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mirror directory: %w", err)
+	}
+	var points []*RestorePoint
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		points = append(points, &RestorePoint{Name: name, CreationTime: r.config.snapshotTime(name)})
+	}
+	return pointsByTime(points), nil
+}
+
+func (r *sshSubvolumeRestorer) Restore(ctx context.Context, snap *RestorePoint, dest string) (string, error) {
+	target, err := checkRestoreDestination(dest, snap.Name)
+	if err != nil {
+		return "", err
+	}
+	source := filepath.Join(r.root, snap.Name)
+	r.config.LogVerbose(0, "Sending %q back from the remote host to %q\n", source, dest)
+	sess, err := r.client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("failed to create ssh session: %w", err)
+	}
+	defer sess.Close()
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if r.config.Verbosity >= 3 {
+		stderr, err := sess.StderrPipe()
+		if err != nil {
+			return "", err
+		}
+		go func() {
+			scanner := bufio.NewScanner(stderr)
+			for scanner.Scan() {
+				r.config.LogVerbose(3, "SSH REMOTE: %s\n", scanner.Text())
+			}
+		}()
+	}
+	if err := sess.Start(fmt.Sprintf("btrfs send %q", source)); err != nil {
+		return "", fmt.Errorf("error running btrfs send: %w", err)
+	}
+	if err := receiveSnapshot(ctx, r.config, stdout, dest); err != nil {
+		return "", err
+	}
+	if err := sess.Wait(); err != nil {
+		return "", fmt.Errorf("error running btrfs send: %w", err)
+	}
+	return target, nil
+}
+
+func (r *sshSubvolumeRestorer) Close() error { return r.client.Close() }
+
+// compressedRestorer restores snapshots from compressed mirrors, receiving the chain of
+// streams from the last full send up to the snapshot.
+type compressedRestorer struct {
+	config *Config
+	files  mirrorFiles
+}
+
+func (r *compressedRestorer) Snapshots(ctx context.Context) ([]*RestorePoint, error) {
+	names, err := r.files.Files(ctx, r.config.SubvolumeIdentifier)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	chains := newStreamChains(r.config, r.files)
+	ext := "." + string(r.config.MirrorFormat)
+	var points []*RestorePoint
+	for _, name := range names {
+		if !strings.HasSuffix(name, ext) {
+			continue
+		}
+		point := &RestorePoint{Name: compressedSnapshotName(r.config.MirrorFormat, name)}
+		if point.CreationTime = r.config.snapshotTime(point.Name); point.CreationTime.IsZero() {
+			m, err := chains.manifest(ctx, name, nil)
+			if err != nil {
+				return nil, err
+			}
+			point.UUID, point.CreationTime = m.UUID, m.CreationTime
+		}
+		points = append(points, point)
+	}
+	return pointsByTime(points), nil
+}
+
+func (r *compressedRestorer) Restore(ctx context.Context, snap *RestorePoint, dest string) (string, error) {
+	target, err := checkRestoreDestination(dest, snap.Name)
+	if err != nil {
+		return "", err
+	}
+	keys, err := r.config.Keyring()
+	if err != nil {
+		return "", err
+	}
+
+	// Walk the chain back to its full send
+	chains := newStreamChains(r.config, r.files)
+	m, err := chains.manifest(ctx, snap.Name+"."+string(r.config.MirrorFormat), nil)
+	if err != nil {
+		return "", err
+	}
+	chain := []*Manifest{m}
+	for m.IsIncremental() {
+		if m, err = chains.manifest(ctx, m.Parent, nil); err != nil {
+			return "", err
+		}
+		chain = append([]*Manifest{m}, chain...)
+	}
+	var intermediates []string
+	for _, m := range chain[:len(chain)-1] {
+		path, err := checkRestoreDestination(dest, compressedSnapshotName(r.config.MirrorFormat, m.File))
+		if err != nil {
+			return "", err
+		}
+		intermediates = append(intermediates, path)
+	}
+	if len(chain) > 1 {
+		r.config.LogVerbose(0, "Restoring %q from a chain of %d streams starting at %q\n", snap.Name, len(chain), chain[0].File)
+	}
+
+	for _, m := range chain {
+		if err := r.receive(ctx, m.File, keys, dest); err != nil {
+			return "", err
+		}
+	}
+	for i := len(intermediates) - 1; i >= 0; i-- {
+		r.config.LogVerbose(1, "Deleting intermediate snapshot %q\n", intermediates[i])
+		if err := btrfs.DeleteSubvolume(intermediates[i], true); err != nil {
+			return "", fmt.Errorf("failed to delete intermediate snapshot %q: %w", intermediates[i], err)
+		}
+	}
+	return target, nil
+}
+
+func (r *compressedRestorer) receive(ctx context.Context, file string, keys encryption.Keyring, dest string) error {
+	r.config.LogVerbose(0, "Receiving %q to %q\n", file, dest)
+	f, err := r.files.Open(ctx, path.Join(r.config.SubvolumeIdentifier, file))
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", file, err)
+	}
+	defer f.Close()
+	plain, _, err := encryption.MaybeDecrypt(f, keys)
+	if err != nil {
+		return fmt.Errorf("error decrypting %q: %w", file, err)
+	}
+	dec, err := NewDecoder(r.config.MirrorFormat, plain)
+	if err != nil {
+		return fmt.Errorf("error decompressing %q: %w", file, err)
+	}
+	defer dec.Close()
+	if err := receiveSnapshot(ctx, r.config, dec, dest); err != nil {
+		return fmt.Errorf("error receiving %q: %w", file, err)
+	}
+	return nil
+}
+
+func (r *compressedRestorer) Close() error { return r.files.Close() }
+
+// repositoryRestorer restores snapshots from deduplicating repositories.
+type repositoryRestorer struct {
+	config *Config
+	repo   *repository.Repository
+}
+
+func (r *repositoryRestorer) Snapshots(ctx context.Context) ([]*RestorePoint, error) {
+	indexes, err := r.repo.Snapshots(r.config.SubvolumeIdentifier)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repository snapshots: %w", err)
+	}
+	points := make([]*RestorePoint, len(indexes))
+	for i, idx := range indexes {
+		points[i] = &RestorePoint{Name: idx.Name, UUID: idx.UUID, CreationTime: idx.CreationTime}
+	}
+	return points, nil
+}
+
+func (r *repositoryRestorer) Restore(ctx context.Context, snap *RestorePoint, dest string) (string, error) {
+	target, err := checkRestoreDestination(dest, snap.Name)
+	if err != nil {
+		return "", err
+	}
+	idx, err := r.repo.Snapshot(r.config.SubvolumeIdentifier, snap.Name)
+	if err != nil {
+		return "", err
+	}
+	r.config.LogVerbose(0, "Receiving %q from the repository to %q\n", snap.Name, dest)
+	stream := r.repo.OpenSnapshot(idx)
+	defer stream.Close()
+	return target, receiveSnapshot(ctx, r.config, stream, dest)
+}
+
+func (r *repositoryRestorer) Close() error { return r.repo.Close() }
+
+// directoryRestorer restores snapshots from directory mirrors by copying their files
+// into a new subvolume. Plain directory mirrors only hold the latest snapshot.
+type directoryRestorer struct {
+	config *Config
+	tree   fileTree
+	root   string
+}
+
+func (r *directoryRestorer) versioned() bool {
+	return r.config.MirrorFormat == config.MirrorFormatVersionedDirectory
+}
+
+func (r *directoryRestorer) Snapshots(ctx context.Context) ([]*RestorePoint, error) {
+	if !r.versioned() {
+		if _, err := r.tree.Lstat(r.root); err != nil {
+			return nil, fmt.Errorf("failed to read mirror directory: %w", err)
+		}
+		return []*RestorePoint{{Name: r.config.SnapshotName}}, nil
+	}
+	entries, err := r.tree.ReadDir(r.root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mirror directory: %w", err)
+	}
+	var points []*RestorePoint
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == OffsetDirectory || strings.HasPrefix(entry.Name(), directory.PartialVersionPrefix) {
+			continue
+		}
+		name := r.config.SnapshotName + "." + entry.Name()
+		points = append(points, &RestorePoint{Name: name, CreationTime: r.config.snapshotTime(name)})
+	}
+	return pointsByTime(points), nil
+}
+
+func (r *directoryRestorer) Restore(ctx context.Context, snap *RestorePoint, dest string) (string, error) {
+	target, err := checkRestoreDestination(dest, snap.Name)
+	if err != nil {
+		return "", err
+	}
+	source := r.root
+	if r.versioned() {
+		source = filepath.Join(r.root, strings.TrimPrefix(snap.Name, r.config.SnapshotName+"."))
+	}
+	r.config.LogVerbose(0, "Copying %q to a new subvolume at %q\n", source, target)
+	if err := btrfs.CreateSubvolume(target); err != nil {
+		return "", fmt.Errorf("failed to create subvolume %q: %w", target, err)
+	}
+	if err := r.copyTree(ctx, source, target); err != nil {
+		return "", err
+	}
+	if err := btrfs.SetSubvolumeReadOnly(target, true); err != nil {
+		return "", fmt.Errorf("failed to make %q read-only: %w", target, err)
+	}
+	return target, nil
+}
+
+// copyTree copies the contents of a directory in the mirror to a local directory,
+// keeping ownership, permissions and modification times.
+func (r *directoryRestorer) copyTree(ctx context.Context, source, target string) error {
+	var dirs []string
+	var times []time.Time
+	err := r.tree.Walk(source, func(name string, info os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, source), "/")
+		if rel == OffsetDirectory || strings.HasPrefix(rel, OffsetDirectory+"/") {
+			return nil
+		}
+		dst := filepath.Join(target, rel)
+		r.config.LogVerbose(3, "Copying %q\n", rel)
+		switch {
+		case info.IsDir():
+			if rel != "" {
+				if err := os.Mkdir(dst, info.Mode().Perm()); err != nil {
+					return err
+				}
+			}
+			// Directory times are set last, after their contents are written
+			dirs = append(dirs, dst)
+			times = append(times, info.ModTime())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := r.tree.ReadLink(name)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, dst); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if err := r.copyFile(name, dst, info); err != nil {
+				return err
+			}
+		default:
+			r.config.LogVerbose(1, "Skipping special file %q\n", rel)
+			return nil
+		}
+		if uid, gid, ok := r.tree.Owner(info); ok {
+			if err := os.Lchown(dst, uid, gid); err != nil {
+				return err
+			}
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return os.Chmod(dst, info.Mode().Perm()|info.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error copying %q: %w", source, err)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(dirs[i], times[i], times[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *directoryRestorer) copyFile(name, dst string, info os.FileInfo) error {
+	src, err := r.tree.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+func (r *directoryRestorer) Close() error { return r.tree.Close() }
+
+// fileTree reads the files of a directory mirror.
+type fileTree interface {
+	// Walk calls fn for every file under root, parents before their contents
+	Walk(root string, fn func(name string, info os.FileInfo) error) error
+	ReadDir(name string) ([]os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadLink(name string) (string, error)
+	Open(name string) (io.ReadCloser, error)
+	// Owner returns the owner of a file, if it is known
+	Owner(info os.FileInfo) (uid, gid int, ok bool)
+	Close() error
+}
+
+type localTree struct{}
+
+func (localTree) Walk(root string, fn func(string, os.FileInfo) error) error {
+	return filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return fn(name, info)
+	})
+}
+
+func (localTree) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (localTree) Lstat(name string) (os.FileInfo, error)  { return os.Lstat(name) }
+func (localTree) ReadLink(name string) (string, error)    { return os.Readlink(name) }
+func (localTree) Open(name string) (io.ReadCloser, error) { return os.Open(name) }
+func (localTree) Owner(info os.FileInfo) (int, int, bool) { return fileOwner(info) }
+func (localTree) Close() error                            { return nil }
+
+// fileOwner returns the owner of a local file.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(stat.Uid), int(stat.Gid), true
+	}
+	return 0, 0, false
+}
+
+type sftpTree struct {
+	client *sftp.Client
+	conn   *ssh.Client
+}
+
+func (t *sftpTree) Walk(root string, fn func(string, os.FileInfo) error) error {
+	walker := t.client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		if err := fn(walker.Path(), walker.Stat()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *sftpTree) ReadDir(name string) ([]os.FileInfo, error) { return t.client.ReadDir(name) }
+func (t *sftpTree) Lstat(name string) (os.FileInfo, error)     { return t.client.Lstat(name) }
+func (t *sftpTree) ReadLink(name string) (string, error)       { return t.client.ReadLink(name) }
+func (t *sftpTree) Open(name string) (io.ReadCloser, error)    { return t.client.Open(name) }
+
+func (t *sftpTree) Owner(info os.FileInfo) (int, int, bool) {
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		return int(stat.UID), int(stat.GID), true
+	}
+	return 0, 0, false
+}
+
+func (t *sftpTree) Close() error {
+	err := t.client.Close()
+	if cerr := t.conn.Close(); err == nil && !errors.Is(cerr, io.EOF) {
+		err = cerr
+	}
+	return err
+}
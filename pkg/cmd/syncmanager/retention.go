@@ -0,0 +1,188 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/retention"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+)
+
+// resolveSubvolume resolves the details of the source subvolume and its snapshots.
+// Snapshots a dry run expired from the source are left out, and if the mirror has a
+// retention policy, only the snapshots it keeps and the ones with a hold are included
+// so the others are not sent to the mirror.
+func resolveSubvolume(cfg *Config) (*btrfs.RootInfo, error) {
+	subvolInfo, err := snaputil.ResolveSubvolumeDetails(
+		cfg.Logger,
+		cfg.Verbosity,
+		cfg.FullSubvolumePath,
+		cfg.SnapshotDirectory,
+		cfg.SnapshotName,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving subvolume details: %w", err)
+	}
+	cfg.expiryReasons = make(map[string]string)
+	if len(cfg.SourceExpired) > 0 {
+		for _, d := range cfg.SourceExpired {
+			cfg.expiryReasons[d.Name] = "expired from the source: " + d.Reason()
+		}
+		remaining := make([]*btrfs.RootInfo, 0, len(subvolInfo.Snapshots))
+		for _, snap := range subvolInfo.Snapshots {
+			if _, ok := cfg.expiryReasons[snap.Name]; !ok {
+				remaining = append(remaining, snap)
+			}
+		}
+		subvolInfo.Snapshots = remaining
+	}
+	cfg.sourceSnapshots = subvolInfo.Snapshots
+	if cfg.Retention != nil {
+		cfg.LogVerbose(1, "Applying mirror retention policy %s\n", cfg.Retention)
+		keep, expire := retention.Partition(*cfg.Retention, time.Now(), subvolInfo.Snapshots)
+		for _, d := range expire {
+			if cfg.isHeld(d.Name) {
+				keep = append(keep, snaputil.GetSnapshotByName(subvolInfo.Snapshots, d.Name))
+				continue
+			}
+			cfg.LogVerbose(2, "Snapshot %q is not sent to the mirror: %s\n", d.Name, d.Reason())
+		}
+		subvolInfo.Snapshots = keep
+	}
+	cfg.latestSnapshot = nil
+	for _, snap := range subvolInfo.Snapshots {
+		if cfg.latestSnapshot == nil || snap.CreationTime.After(cfg.latestSnapshot.CreationTime) {
+			cfg.latestSnapshot = snap
+		}
+	}
+	return subvolInfo, nil
+}
+
+// RecordSynced records the newest snapshot of the source as received by the mirror of
+// the configuration, after it synced successfully. Local pruning holds the snapshot
+// back until the mirror syncs again, so the next send to it can be incremental.
+func RecordSynced(cfg *Config) error {
+	if cfg.latestSnapshot == nil || cfg.DryRun {
+		return nil
+	}
+	path := snaputil.MirrorStatePath(cfg.SnapshotDirectory, cfg.SnapshotName)
+	state, err := snaputil.LoadMirrorState(path)
+	if err != nil {
+		return err
+	}
+	cfg.LogVerbose(2, "Recording snapshot %q as the newest received by mirror %s\n", cfg.latestSnapshot.Name, cfg.MirrorPath)
+	state.Mirrors[cfg.MirrorPath] = &snaputil.MirrorSnapshot{
+		Name:     cfg.latestSnapshot.Name,
+		UUID:     cfg.latestSnapshot.UUID,
+		SyncedAt: time.Now(),
+	}
+	return state.Save(path)
+}
+
+// retainedSnapshots returns the names of the mirrored snapshots that are kept, given
+// the snapshots of the source. Without a mirror retention policy a mirrored snapshot
+// is kept for as long as it exists in the source. With one, the policy is applied to
+// the mirrored snapshots themselves, so the mirror can keep more history than the
+// source. The newest mirrored snapshot that still exists in the source is always kept
+// as the parent of the next incremental send, as are snapshots with a hold.
+func (c *Config) retainedSnapshots(source []*btrfs.RootInfo, mirrored []string) map[string]bool {
+	retained := make(map[string]bool, len(mirrored))
+	if c.Retention == nil {
+		for _, name := range mirrored {
+			if snaputil.SnapshotSliceContains(source, name) {
+				retained[name] = true
+			}
+		}
+		return retained
+	}
+	if c.expiryReasons == nil {
+		c.expiryReasons = make(map[string]string)
+	}
+	snaps := make([]retention.Snapshot, len(mirrored))
+	for i, name := range mirrored {
+		snaps[i] = retention.Snapshot{Name: name, Time: c.snapshotTime(name)}
+	}
+	var parentKept bool
+	for _, d := range retention.Apply(*c.Retention, time.Now(), snaps) {
+		if !parentKept && snaputil.SnapshotSliceContains(source, d.Name) {
+			// Decisions are sorted newest first
+			parentKept = true
+			if !d.Keep {
+				c.LogVerbose(1, "Keeping mirrored snapshot %q as the parent of the next incremental send\n", d.Name)
+				d.Keep = true
+			}
+		}
+		if !d.Keep && c.isHeld(d.Name) {
+			c.LogVerbose(1, "Keeping mirrored snapshot %q, it has a hold\n", d.Name)
+			d.Keep = true
+		}
+		if d.Keep {
+			retained[d.Name] = true
+		} else {
+			c.expiryReasons[d.Name] = "not kept by the mirror retention policy: " + d.Reason()
+		}
+	}
+	return retained
+}
+
+// isHeld returns true if the local snapshot with the given name has a hold. Snapshots
+// whose metadata cannot be read are treated as held.
+func (c *Config) isHeld(name string) bool {
+	m, err := snaputil.LoadMetadata(c.SnapshotDirectory, name)
+	if err != nil {
+		c.LogVerbose(0, "Keeping snapshot %q: %s\n", name, err)
+		return true
+	}
+	return m.Hold
+}
+
+// sourceHasSnapshots returns true if snapshots of the source were found. Mirrors are
+// not pruned without them, as every mirrored snapshot would look expired when the
+// source lost track of its snapshots.
+func (c *Config) sourceHasSnapshots() bool {
+	if len(c.sourceSnapshots) > 0 {
+		return true
+	}
+	c.Logger.Printf("WARNING: No snapshots of %q were found, not pruning mirror %s\n", c.FullSubvolumePath, c.MirrorPath)
+	return false
+}
+
+// expire removes the expired snapshot with the given name from the mirror by calling
+// remove, path being where it is stored. In a dry run the snapshot is only reported
+// along with the reason it expired.
+func (c *Config) expire(name, path string, remove func() error) error {
+	if c.DryRun {
+		c.Logger.Printf("Would expire mirrored snapshot %q: %s\n", path, c.expiryReason(name))
+		return nil
+	}
+	c.LogVerbose(0, "Expiring mirrored snapshot %q\n", path)
+	c.LogVerbose(1, "Snapshot %q expired: %s\n", name, c.expiryReason(name))
+	if err := remove(); err != nil {
+		return err
+	}
+	c.expiredSnapshots = append(c.expiredSnapshots, name)
+	return nil
+}
+
+func (c *Config) expiryReason(name string) string {
+	if reason, ok := c.expiryReasons[name]; ok {
+		return reason
+	}
+	return "no longer exists in the source"
+}
@@ -0,0 +1,192 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+)
+
+func TestRetainedSnapshots(t *testing.T) {
+	const timeFormat = "2006-01-02_15-04-05"
+	day := 24 * time.Hour
+	now := time.Now()
+	// name returns the name of the snapshot taken the given number of days ago
+	name := func(days int) string {
+		return "root." + now.Add(-time.Duration(days)*day).Format(timeFormat)
+	}
+	mirrored := []string{name(1), name(2), name(4), name(8), name(16)}
+	tests := []struct {
+		name      string
+		retention *config.RetentionPolicy
+		// source and held are the ages in days of the source snapshots and the held ones
+		source []int
+		held   []int
+		// unreadable are the ages of snapshots whose metadata cannot be read
+		unreadable []int
+		want       []int
+	}{
+		{
+			name:   "without a policy the source decides",
+			source: []int{1, 2, 4},
+			want:   []int{1, 2, 4},
+		},
+		{
+			name:      "mirror keeps more history than the source",
+			retention: &config.RetentionPolicy{KeepWithin: config.Duration(30 * day)},
+			source:    []int{1},
+			want:      []int{1, 2, 4, 8, 16},
+		},
+		{
+			name:      "mirror keeps less history than the source",
+			retention: &config.RetentionPolicy{KeepWithin: config.Duration(3 * day)},
+			source:    []int{1, 2, 4, 8, 16},
+			want:      []int{1, 2},
+		},
+		{
+			name:      "calendar policy",
+			retention: &config.RetentionPolicy{Daily: 3},
+			source:    []int{1, 2, 4, 8, 16},
+			want:      []int{1, 2, 4},
+		},
+		{
+			name:      "newest snapshot in the source is kept as the parent",
+			retention: &config.RetentionPolicy{KeepWithin: config.Duration(3 * day)},
+			source:    []int{8, 16},
+			want:      []int{1, 2, 8},
+		},
+		{
+			name:      "held snapshots are kept",
+			retention: &config.RetentionPolicy{KeepWithin: config.Duration(3 * day)},
+			source:    []int{1},
+			held:      []int{16},
+			want:      []int{1, 2, 16},
+		},
+		{
+			name:       "unreadable metadata is treated as a hold",
+			retention:  &config.RetentionPolicy{KeepWithin: config.Duration(3 * day)},
+			source:     []int{1},
+			unreadable: []int{4},
+			want:       []int{1, 2, 4},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{
+				Logger:            log.New(io.Discard, "", 0),
+				SnapshotName:      "root",
+				SnapshotDirectory: t.TempDir(),
+				TimeFormat:        timeFormat,
+				Retention:         tc.retention,
+			}
+			var source []*btrfs.RootInfo
+			for _, days := range tc.source {
+				source = append(source, testSnapshot(name(days)))
+			}
+			for _, days := range tc.held {
+				if err := snaputil.SaveMetadata(cfg.SnapshotDirectory, name(days), &snaputil.SnapshotMetadata{Hold: true}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, days := range tc.unreadable {
+				path := snaputil.MetadataPath(cfg.SnapshotDirectory, name(days))
+				if err := snaputil.SaveMetadata(cfg.SnapshotDirectory, name(days), &snaputil.SnapshotMetadata{Note: "note"}); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			retained := cfg.retainedSnapshots(source, mirrored)
+			var got []string
+			for name := range retained {
+				got = append(got, name)
+			}
+			sort.Sort(sort.Reverse(sort.StringSlice(got)))
+			var want []string
+			for _, days := range tc.want {
+				want = append(want, name(days))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("retained %v, want %v", got, want)
+			}
+			for _, name := range mirrored {
+				reason := cfg.expiryReason(name)
+				switch {
+				case retained[name]:
+				case tc.retention == nil && reason != "no longer exists in the source":
+					t.Errorf("%s expired with reason %q", name, reason)
+				case tc.retention != nil && !strings.HasPrefix(reason, "not kept by the mirror retention policy: "):
+					t.Errorf("%s expired with reason %q", name, reason)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordSynced(t *testing.T) {
+	snap := testSnapshot("root.1")
+	tests := []struct {
+		name   string
+		latest *btrfs.RootInfo
+		dryRun bool
+		want   string
+	}{
+		{name: "records the newest snapshot", latest: snap, want: snap.Name},
+		{name: "nothing to record", latest: nil},
+		{name: "dry run", latest: snap, dryRun: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{
+				Logger:            log.New(io.Discard, "", 0),
+				SnapshotName:      "root",
+				SnapshotDirectory: t.TempDir(),
+				MirrorPath:        "/mirror",
+				DryRun:            tc.dryRun,
+				latestSnapshot:    tc.latest,
+			}
+			if err := RecordSynced(cfg); err != nil {
+				t.Fatal(err)
+			}
+			state, err := snaputil.LoadMirrorState(snaputil.MirrorStatePath(cfg.SnapshotDirectory, cfg.SnapshotName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := state.Mirrors["/mirror"]
+			if tc.want == "" {
+				if ok {
+					t.Errorf("recorded %q", got.Name)
+				}
+				return
+			}
+			if !ok || got.Name != tc.want || got.UUID != snap.UUID || time.Since(got.SyncedAt) > time.Minute {
+				t.Errorf("recorded %+v, want %q synced now", got, tc.want)
+			}
+		})
+	}
+}
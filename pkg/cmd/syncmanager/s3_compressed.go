@@ -0,0 +1,317 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+	"github.com/tinyzimmer/btrsync/pkg/s3"
+)
+
+// uploadsDirectory holds the state of uploads in progress, next to the completion
+// files of a subvolume.
+const uploadsDirectory = "uploads"
+
+type s3CompressedManager struct {
+	config     *Config
+	sourceInfo *btrfs.RootInfo
+	client     *s3.Client
+	bucket     string
+	prefix     string
+}
+
+// S3Client returns a client for the s3:// mirror of the configuration, along with the
+// bucket and the key prefix of the mirror.
+func (c *Config) S3Client() (client *s3.Client, bucket, prefix string, err error) {
+	mirrorURL, err := c.MirrorURL()
+	if err != nil {
+		return nil, "", "", err
+	}
+	if mirrorURL.Scheme != "s3" || mirrorURL.Host == "" {
+		return nil, "", "", fmt.Errorf("invalid s3 mirror %q, expected s3://bucket/prefix", c.MirrorPath)
+	}
+	opts := []s3.Option{
+		s3.WithRegion(c.S3Region),
+		s3.WithCredentials(c.S3AccessKeyID, c.S3SecretAccessKey, ""),
+	}
+	if c.S3Endpoint != "" {
+		opts = append(opts, s3.WithEndpoint(c.S3Endpoint))
+	}
+	client, err = s3.New(opts...)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return client, mirrorURL.Host, strings.Trim(mirrorURL.Path, "/"), nil
+}
+
+func NewS3CompressedManager(cfg *Config, subvolInfo *btrfs.RootInfo) (Manager, error) {
+	client, bucket, prefix, err := cfg.S3Client()
+	if err != nil {
+		return nil, err
+	}
+	cfg.LogVerbose(0, "Initiating S3 compressed sync manager for %q with mirror URL: %s\n", cfg.FullSubvolumePath, cfg.MirrorPath)
+	return &s3CompressedManager{
+		config:     cfg,
+		sourceInfo: subvolInfo,
+		client:     client,
+		bucket:     bucket,
+		prefix:     prefix,
+	}, nil
+}
+
+func (sm *s3CompressedManager) Config() *Config { return sm.config }
+
+func (sm *s3CompressedManager) Sync(ctx context.Context) error {
+	return syncStream(ctx, sm)
+}
+
+// key returns the key of an object in the directory of the subvolume.
+func (sm *s3CompressedManager) key(elem ...string) string {
+	return path.Join(append([]string{sm.prefix, sm.config.SubvolumeIdentifier}, elem...)...)
+}
+
+// list returns the names of the objects in a directory of the subvolume.
+func (sm *s3CompressedManager) list(ctx context.Context, elem ...string) ([]string, error) {
+	dir := sm.key(elem...) + "/"
+	res, err := sm.client.ListObjects(ctx, sm.bucket, dir, "/")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(res.Objects))
+	for _, obj := range res.Objects {
+		names = append(names, strings.TrimPrefix(obj.Key, dir))
+	}
+	return names, nil
+}
+
+// files returns the files of the mirror, read with the client of the manager.
+func (sm *s3CompressedManager) files() mirrorFiles {
+	return &s3MirrorFiles{client: sm.client, bucket: sm.bucket, prefix: sm.prefix}
+}
+
+func (sm *s3CompressedManager) Prepare(ctx context.Context) ([]*snaputil.IncrementalSnapshot, error) {
+	sm.config.LogVerbose(0, "Syncing %s compressed mirror: s3://%s/%s\n", sm.config.MirrorFormat, sm.bucket, sm.key())
+	completed, err := sm.list(ctx, OffsetDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshot completion files: %w", err)
+	}
+	done := make(map[string]struct{}, len(completed))
+	for _, name := range completed {
+		done[name] = struct{}{}
+	}
+	return planChains(ctx, sm.config, sm.files(), sm.sourceInfo.Snapshots, func(snap *btrfs.RootInfo) (bool, error) {
+		if _, ok := done[snap.UUID.String()]; ok {
+			sm.config.LogVerbose(1, "Snapshot %q already synced, skipping\n", snap.Name)
+			return true, nil
+		}
+		return false, nil
+	})
+}
+
+func (sm *s3CompressedManager) uploadStateKey(id uuid.UUID) string {
+	return sm.key(OffsetDirectory, uploadsDirectory, id.String()+".json")
+}
+
+func (sm *s3CompressedManager) loadUploadState(ctx context.Context, id uuid.UUID) (*s3.UploadState, error) {
+	rdr, err := sm.client.GetObject(ctx, sm.bucket, sm.uploadStateKey(id))
+	if err != nil {
+		if s3.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rdr.Close()
+	var state s3.UploadState
+	if err := json.NewDecoder(rdr).Decode(&state); err != nil {
+		sm.config.LogVerbose(0, "Ignoring unreadable upload state of %s: %s\n", id, err)
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func (sm *s3CompressedManager) ReceiveStream(ctx context.Context, parent, snap *btrfs.RootInfo, stream io.Reader) error {
+	file := sm.config.streamFile(snap)
+	key := sm.key(file)
+	sm.config.LogVerbose(0, "Syncing %s compressed snapshot %q to s3://%s/%s\n", sm.config.MirrorFormat, snap.Path, sm.bucket, key)
+	parentStream, err := parentManifest(ctx, sm.config, sm.files(), parent)
+	if err != nil {
+		return err
+	}
+
+	// Resume the upload of the snapshot if it was interrupted
+	resume, err := sm.loadUploadState(ctx, snap.UUID)
+	if err != nil {
+		return fmt.Errorf("failed to load upload state: %w", err)
+	}
+	stateKey := sm.uploadStateKey(snap.UUID)
+	upload, err := sm.client.NewUploader(ctx, sm.bucket, key, int64(sm.config.S3PartSize)*1024*1024,
+		&s3.PutOptions{StorageClass: sm.config.S3StorageClass},
+		resume,
+		func(state *s3.UploadState) error {
+			data, err := json.Marshal(state)
+			if err != nil {
+				return err
+			}
+			if err := sm.client.PutObject(ctx, sm.bucket, stateKey, data, nil); err != nil {
+				return fmt.Errorf("failed to save upload state: %w", err)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if resume != nil && upload.State().UploadID == resume.UploadID {
+		sm.config.LogVerbose(0, "Resuming upload %s with %d uploaded parts\n", resume.UploadID, len(upload.State().Parts))
+	}
+
+	// Run the encoder on the stream to the upload. The upload is left in place on
+	// failure, so that the next sync can resume it.
+	manifest := newManifestBuilder()
+	enc, err := newStreamEncoder(sm.config, manifest.Stored(upload))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(enc, manifest.Stream(stream)); err != nil {
+		enc.Close()
+		return fmt.Errorf("error copying to encoder: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("error closing encoder: %w", err)
+	}
+	if err := upload.Close(); err != nil {
+		return err
+	}
+	if n := upload.Resumed(); n > 0 {
+		sm.config.LogVerbose(1, "Skipped %d parts uploaded by a previous sync\n", n)
+	}
+
+	// Write the manifest
+	m, err := manifest.Manifest(sm.config, file, snap, parentStream)
+	if err != nil {
+		return err
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := sm.client.PutObject(ctx, sm.bucket, ManifestName(key), data, &s3.PutOptions{ContentType: "application/json"}); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	// Create the completion file and remove the upload state
+	completion := sm.key(OffsetDirectory, snap.UUID.String())
+	sm.config.LogVerbose(1, "Creating snapshot completion file at %q\n", completion)
+	if err := sm.client.PutObject(ctx, sm.bucket, completion, nil, nil); err != nil {
+		return fmt.Errorf("failed to create completion file: %w", err)
+	}
+	if err := sm.client.DeleteObject(ctx, sm.bucket, stateKey); err != nil {
+		return fmt.Errorf("failed to delete upload state: %w", err)
+	}
+	return nil
+}
+
+func (sm *s3CompressedManager) Prune(ctx context.Context) error {
+	if !sm.config.sourceHasSnapshots() {
+		return nil
+	}
+	sm.config.LogVerbose(2, "Listing compressed snapshots at s3://%s/%s\n", sm.bucket, sm.key())
+
+	files, err := sm.list(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	expired, kept, err := expiredStreams(ctx, sm.config, sm.files(), files, sm.sourceInfo.Snapshots)
+	if err != nil {
+		return err
+	}
+	for _, file := range expired {
+		err := sm.config.expire(compressedSnapshotName(sm.config.MirrorFormat, file), "s3://"+sm.bucket+"/"+sm.key(file), func() error {
+			return sm.client.DeleteObject(ctx, sm.bucket, sm.key(file))
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting snapshot object %q: %w", file, err)
+		}
+	}
+	if sm.config.DryRun {
+		return nil
+	}
+
+	completed, err := sm.list(ctx, OffsetDirectory)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshot completion files: %w", err)
+	}
+	for _, name := range completed {
+		if name == metadataFile {
+			continue
+		}
+		uu, err := uuid.Parse(name)
+		if err != nil {
+			return fmt.Errorf("failed to parse uuid %q: %w", name, err)
+		}
+		if _, ok := kept[uu]; ok || snaputil.SnapshotUUIDExists(sm.sourceInfo.Snapshots, uu) {
+			sm.config.LogVerbose(3, "Mirrored snapshot uuid %q has not expired\n", uu)
+			continue
+		}
+		sm.config.LogVerbose(1, "Deleting expired completion file %q\n", name)
+		if err := sm.client.DeleteObject(ctx, sm.bucket, sm.key(OffsetDirectory, name)); err != nil {
+			return fmt.Errorf("failed to delete completion file %q: %w", name, err)
+		}
+	}
+
+	// Abort the uploads of snapshots that no longer exist
+	uploads, err := sm.list(ctx, OffsetDirectory, uploadsDirectory)
+	if err != nil {
+		return fmt.Errorf("failed to list uploads: %w", err)
+	}
+	for _, name := range uploads {
+		uu, err := uuid.Parse(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return fmt.Errorf("failed to parse uuid %q: %w", name, err)
+		}
+		if snaputil.SnapshotUUIDExists(sm.sourceInfo.Snapshots, uu) {
+			continue
+		}
+		state, err := sm.loadUploadState(ctx, uu)
+		if err != nil {
+			return err
+		}
+		if state != nil {
+			sm.config.LogVerbose(1, "Aborting upload %s of expired snapshot %s\n", state.UploadID, uu)
+			if err := sm.client.AbortMultipartUpload(ctx, sm.bucket, state.Key, state.UploadID); err != nil && !s3.IsNotFound(err) {
+				return fmt.Errorf("failed to abort upload %s: %w", state.UploadID, err)
+			}
+		}
+		if err := sm.client.DeleteObject(ctx, sm.bucket, sm.uploadStateKey(uu)); err != nil {
+			return fmt.Errorf("failed to delete upload state: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (sm *s3CompressedManager) Close() error {
+	return nil
+}
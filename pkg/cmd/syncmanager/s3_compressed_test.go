@@ -0,0 +1,197 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/tinyzimmer/btrsync/pkg/s3"
+	"github.com/tinyzimmer/btrsync/pkg/s3/s3test"
+)
+
+func newTestS3Manager(t *testing.T, snapshots ...*btrfs.RootInfo) (*s3CompressedManager, *s3test.Server) {
+	t.Helper()
+	srv := s3test.NewServer("bucket")
+	t.Cleanup(srv.Close)
+	cfg := &Config{
+		Logger:              log.New(io.Discard, "", 0),
+		SubvolumeIdentifier: "root",
+		SnapshotName:        "root",
+		MirrorPath:          "s3://bucket/mirror",
+		MirrorFormat:        config.MirrorFormatGzip,
+		S3Endpoint:          srv.URL,
+		S3AccessKeyID:       "access",
+		S3SecretAccessKey:   "secret",
+		S3PartSize:          s3.MinPartSize / 1024 / 1024,
+		sourceSnapshots:     snapshots,
+	}
+	manager, err := NewS3CompressedManager(cfg, &btrfs.RootInfo{Snapshots: snapshots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager.(*s3CompressedManager), srv
+}
+
+func testSnapshot(name string) *btrfs.RootInfo {
+	return &btrfs.RootInfo{Name: name, UUID: uuid.New(), CreationTime: time.Now()}
+}
+
+func TestS3ReceiveStream(t *testing.T) {
+	ctx := context.Background()
+	snap := testSnapshot("root.20221128")
+	sm, srv := newTestS3Manager(t, snap)
+	// Random data does not compress, so the stored stream spans three parts
+	data := make([]byte, 2*s3.MinPartSize+1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// Interrupt the upload at the second part
+	var uploaded []string
+	fail := true
+	srv.Fail = func(r *http.Request) bool {
+		if r.Method != http.MethodPut || r.URL.Query().Get("partNumber") == "" {
+			return false
+		}
+		number := r.URL.Query().Get("partNumber")
+		if fail && number == "2" {
+			return true
+		}
+		uploaded = append(uploaded, number)
+		return false
+	}
+	if err := sm.ReceiveStream(ctx, nil, snap, bytes.NewReader(data)); err == nil {
+		t.Fatal("expected the interrupted upload to fail")
+	}
+	stateKey := sm.uploadStateKey(snap.UUID)
+	if _, ok := srv.Object("bucket", stateKey); !ok {
+		t.Fatal("upload state was not saved")
+	}
+	if _, ok := srv.Object("bucket", "mirror/root/root.20221128.gzip"); ok {
+		t.Fatal("interrupted upload created the stream object")
+	}
+
+	// The next sync resumes the upload after the part that was uploaded
+	fail = false
+	uploaded = nil
+	if err := sm.ReceiveStream(ctx, nil, snap, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"2", "3"}; !reflect.DeepEqual(uploaded, want) {
+		t.Errorf("uploaded parts %v, want %v", uploaded, want)
+	}
+	stored, ok := srv.Object("bucket", "mirror/root/root.20221128.gzip")
+	if !ok {
+		t.Fatal("stream object was not created")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("stored stream does not match the sent stream")
+	}
+	for _, key := range []string{
+		ManifestName("mirror/root/root.20221128.gzip"),
+		"mirror/root/" + OffsetDirectory + "/" + snap.UUID.String(),
+	} {
+		if _, ok := srv.Object("bucket", key); !ok {
+			t.Errorf("%s was not created", key)
+		}
+	}
+	if _, ok := srv.Object("bucket", stateKey); ok {
+		t.Error("upload state was not deleted")
+	}
+	if uploads := srv.Uploads("bucket"); len(uploads) != 0 {
+		t.Errorf("uploads %v still in progress", uploads)
+	}
+}
+
+func TestS3Prune(t *testing.T) {
+	ctx := context.Background()
+	kept := testSnapshot("root.20221128")
+	expired := testSnapshot("root.20221127")
+	sm, srv := newTestS3Manager(t, kept)
+
+	// Both snapshots were mirrored and have an upload in progress
+	var uploadIDs []string
+	for _, snap := range []*btrfs.RootInfo{kept, expired} {
+		srv.PutObject("bucket", sm.key(sm.config.streamFile(snap)), []byte("stream"))
+		srv.PutObject("bucket", sm.key(OffsetDirectory, snap.UUID.String()), nil)
+		key := sm.key(sm.config.streamFile(snap) + ".next")
+		id, err := sm.client.CreateMultipartUpload(ctx, "bucket", key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sm.client.UploadPart(ctx, "bucket", key, id, 1, []byte("part")); err != nil {
+			t.Fatal(err)
+		}
+		state, err := json.Marshal(&s3.UploadState{Key: key, UploadID: id, PartSize: s3.MinPartSize})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.PutObject("bucket", sm.uploadStateKey(snap.UUID), state)
+		uploadIDs = append(uploadIDs, id)
+	}
+	before := srv.Keys("bucket")
+
+	// Nothing is pruned while the source has no snapshots
+	sm.config.sourceSnapshots = nil
+	if err := sm.Prune(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Keys("bucket"); !reflect.DeepEqual(got, before) {
+		t.Fatalf("pruned against an empty source: %v, want %v", got, before)
+	}
+	if got := srv.Uploads("bucket"); len(got) != 2 {
+		t.Fatalf("aborted uploads against an empty source: %v", got)
+	}
+
+	sm.config.sourceSnapshots = []*btrfs.RootInfo{kept}
+	if err := sm.Prune(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		sm.key(OffsetDirectory, kept.UUID.String()),
+		sm.uploadStateKey(kept.UUID),
+		sm.key(sm.config.streamFile(kept)),
+	}
+	if got := srv.Keys("bucket"); !reflect.DeepEqual(got, want) {
+		t.Errorf("objects after prune %v, want %v", got, want)
+	}
+	if got, want := srv.Uploads("bucket"), []string{sm.key(sm.config.streamFile(kept) + ".next")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("uploads after prune %v, want %v", got, want)
+	}
+	if parts := srv.Parts(uploadIDs[1]); len(parts) != 0 {
+		t.Errorf("parts %v of the expired upload were not deleted", parts)
+	}
+}
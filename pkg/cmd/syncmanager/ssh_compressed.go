@@ -17,20 +17,15 @@ package syncmanager
 
 import (
 	"bytes"
-	"compress/gzip"
-	"compress/lzw"
 	"context"
 	"fmt"
 	"io"
 	"net/url"
 	"path/filepath"
-	"strings"
 	"sync"
 
 	"github.com/google/uuid"
-	"github.com/klauspost/compress/zstd"
 	"github.com/tinyzimmer/btrsync/pkg/btrfs"
-	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/sshutil"
 	"golang.org/x/crypto/ssh"
@@ -74,90 +69,59 @@ func NewSSHCompressedManager(cfg *Config, subvolInfo *btrfs.RootInfo) (Manager,
 	}, nil
 }
 
+func (sm *sshCompressedManager) Config() *Config { return sm.config }
+
 func (sm *sshCompressedManager) Sync(ctx context.Context) error {
+	return syncStream(ctx, sm)
+}
+
+// files returns the files of the mirror, read over the connection of the manager.
+func (sm *sshCompressedManager) files() mirrorFiles {
+	return &sshMirrorFiles{client: sm.sshClient, root: sm.mirrorURL.Path}
+}
+
+func (sm *sshCompressedManager) Prepare(ctx context.Context) ([]*snaputil.IncrementalSnapshot, error) {
 	path := filepath.Join(sm.mirrorURL.Path, sm.config.SubvolumeIdentifier)
 	sm.config.LogVerbose(0, "Syncing %s compressed mirror: %q\n", sm.config.MirrorFormat, path)
 	if err := sshutil.MkdirAll(ctx, sm.sshClient, path); err != nil {
-		return fmt.Errorf("failed to create mirror directory: %s", err)
-	}
-	snaputil.SortSnapshots(sm.sourceInfo.Snapshots, snaputil.SortAscending)
-	for _, snap := range sm.sourceInfo.Snapshots {
-		if err := sm.syncSnapshot(ctx, path, nil, snap); err != nil {
-			return err
+		return nil, fmt.Errorf("failed to create mirror directory: %s", err)
+	}
+	return planChains(ctx, sm.config, sm.files(), sm.sourceInfo.Snapshots, func(snap *btrfs.RootInfo) (bool, error) {
+		uuidfile := filepath.Join(path, OffsetDirectory, snap.UUID.String())
+		sm.config.LogVerbose(1, "Checking for snapshot completion file at %q\n", uuidfile)
+		_, err := sshutil.ReadFile(ctx, sm.sshClient, uuidfile)
+		if err == nil {
+			sm.config.LogVerbose(1, "Snapshot %q already synced, skipping\n", snap.Name)
+			return true, nil
 		}
-	}
-	return nil
+		if !sshutil.IsFileNotExist(err) {
+			return false, fmt.Errorf("failed to check for snapshot completion file: %s", err)
+		}
+		return false, nil
+	})
 }
 
-func (sm *sshCompressedManager) syncSnapshot(ctx context.Context, destination string, _, snap *btrfs.RootInfo) error {
-	snapshotPath := filepath.Join(sm.config.SnapshotDirectory, snap.Name)
+func (sm *sshCompressedManager) ReceiveStream(ctx context.Context, parent, snap *btrfs.RootInfo, stream io.Reader) error {
+	destination := filepath.Join(sm.mirrorURL.Path, sm.config.SubvolumeIdentifier)
 	uuidfile := filepath.Join(destination, OffsetDirectory, snap.UUID.String())
-	destination = filepath.Join(destination, snap.Name+"."+string(sm.config.MirrorFormat))
-
-	sm.config.LogVerbose(1, "Checking for snapshot completion file at %q\n", uuidfile)
-	_, err := sshutil.ReadFile(ctx, sm.sshClient, uuidfile)
-	if err == nil {
-		sm.config.LogVerbose(1, "Snapshot %q already synced, skipping\n", snap.Name)
-		return nil
-	}
-	if !sshutil.IsFileNotExist(err) {
-		return fmt.Errorf("failed to check for snapshot completion file: %s", err)
-	}
+	destination = filepath.Join(destination, sm.config.streamFile(snap))
 
 	sm.config.LogVerbose(0, "Syncing %s compressed snapshot %q to %q on remote %s\n",
 		sm.config.MirrorFormat, snap.Path, destination, sm.mirrorURL.Hostname())
-
-	r, w := io.Pipe()
-	var enc io.WriteCloser
-	switch sm.config.MirrorFormat {
-	case config.MirrorFormatGzip:
-		enc = gzip.NewWriter(w)
-	case config.MirrorFormatLzw:
-		enc = lzw.NewWriter(w, lzw.LSB, 8)
-	case config.MirrorFormatZlib:
-		enc = gzip.NewWriter(w)
-	case config.MirrorFormatZstd:
-		enc, err = zstd.NewWriter(w)
-		if err != nil {
-			return fmt.Errorf("failed to create zstd writer: %s", err)
-		}
+	parentStream, err := parentManifest(ctx, sm.config, sm.files(), parent)
+	if err != nil {
+		return err
 	}
 
-	// Set up the pipe to the encoder
-	var wg sync.WaitGroup
-	pipeOpt, pipe, err := btrfs.SendToPipe()
+	r, w := io.Pipe()
+	manifest := newManifestBuilder()
+	enc, err := newStreamEncoder(sm.config, manifest.Stored(w))
 	if err != nil {
-		return fmt.Errorf("error creating send pipe: %w", err)
+		return err
 	}
-	defer pipe.Close()
-	errors := make(chan error, 3)
-
-	// Start the sendstream to the pipe
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		sendOpts := []btrfs.SendOption{
-			pipeOpt,
-			btrfs.SendWithLogger(sm.config.Logger, sm.config.Verbosity),
-			btrfs.SendCompressedData(),
-		}
-		if err := btrfs.Send(snapshotPath, sendOpts...); err != nil {
-			err = fmt.Errorf("error sending snapshot: %w", err)
-			errors <- err
-		}
-	}()
 
-	// Start the encoder on the read end of the pipe to the writer
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		defer w.Close()
-		defer enc.Close()
-		_, err := io.Copy(enc, pipe)
-		if err != nil {
-			errors <- fmt.Errorf("error copying to encoder: %w", err)
-		}
-	}()
+	var wg sync.WaitGroup
+	errors := make(chan error, 1)
 
 	// Start the write to the remote destination
 	wg.Add(1)
@@ -166,8 +130,16 @@ func (sm *sshCompressedManager) syncSnapshot(ctx context.Context, destination st
 		if err := sshutil.WriteFile(ctx, sm.sshClient, destination, r); err != nil {
 			errors <- fmt.Errorf("error writing to remote destination: %w", err)
 		}
+		// Unblock the encoder if the remote write stopped early
+		r.Close()
 	}()
 
+	// Run the encoder on the stream to the write end of the pipe
+	_, err = io.Copy(enc, manifest.Stream(stream))
+	if cerr := enc.Close(); err == nil {
+		err = cerr
+	}
+	w.Close()
 	wg.Wait()
 	close(errors)
 	for err := range errors {
@@ -175,6 +147,23 @@ func (sm *sshCompressedManager) syncSnapshot(ctx context.Context, destination st
 			return err
 		}
 	}
+	if err != nil {
+		return fmt.Errorf("error copying to encoder: %w", err)
+	}
+
+	// Write the manifest
+	m, err := manifest.Manifest(sm.config, filepath.Base(destination), snap, parentStream)
+	if err != nil {
+		return err
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	sm.config.LogVerbose(1, "Writing manifest to %q\n", ManifestName(destination))
+	if err := sshutil.WriteFile(ctx, sm.sshClient, ManifestName(destination), bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
 
 	// Create the completion file
 	sm.config.LogVerbose(1, "Creating snapshot completion file at %q\n", uuidfile)
@@ -188,6 +177,9 @@ func (sm *sshCompressedManager) syncSnapshot(ctx context.Context, destination st
 }
 
 func (sm *sshCompressedManager) Prune(ctx context.Context) error {
+	if !sm.config.sourceHasSnapshots() {
+		return nil
+	}
 	destination := filepath.Join(sm.mirrorURL.Path, sm.config.SubvolumeIdentifier)
 	uuiddir := filepath.Join(destination, OffsetDirectory)
 	sm.config.LogVerbose(2, "Listing compressed snapshots on remote at %q\n", destination)
@@ -197,24 +189,23 @@ func (sm *sshCompressedManager) Prune(ctx context.Context) error {
 		return fmt.Errorf("failed to read destination directory: %w", err)
 	}
 
-	var expired []string
-	for _, file := range files {
-		snapshotName := strings.TrimSuffix(file, "."+string(sm.config.MirrorFormat))
-		if !snaputil.SnapshotSliceContains(sm.sourceInfo.Snapshots, snapshotName) {
-			sm.config.LogVerbose(1, "Marking snapshot %q for expiry\n", file)
-			expired = append(expired, file)
-		} else {
-			sm.config.LogVerbose(3, "Mirrored snapshot %q has not expired\n", file)
-		}
+	expired, kept, err := expiredStreams(ctx, sm.config, sm.files(), files, sm.sourceInfo.Snapshots)
+	if err != nil {
+		return err
 	}
 
-	for _, path := range expired {
-		path = filepath.Join(destination, path)
-		sm.config.LogVerbose(0, "Expiring mirrored snapshot %q\n", path)
-		if err := sshutil.RemoveFile(ctx, sm.sshClient, path); err != nil {
+	for _, name := range expired {
+		path := filepath.Join(destination, name)
+		err := sm.config.expire(compressedSnapshotName(sm.config.MirrorFormat, name), path, func() error {
+			return sshutil.RemoveFile(ctx, sm.sshClient, path)
+		})
+		if err != nil {
 			return fmt.Errorf("error deleting snapshot file %q: %w", path, err)
 		}
 	}
+	if sm.config.DryRun {
+		return nil
+	}
 
 	uuids, err := sshutil.ReadDir(ctx, sm.sshClient, uuiddir)
 	if err != nil {
@@ -222,6 +213,9 @@ func (sm *sshCompressedManager) Prune(ctx context.Context) error {
 	}
 	var completedUUIDs []uuid.UUID
 	for _, uuStr := range uuids {
+		if uuStr == metadataFile {
+			continue
+		}
 		uu, err := uuid.Parse(uuStr)
 		if err != nil {
 			return fmt.Errorf("failed to parse uuid %q: %w", uuStr, err)
@@ -230,7 +224,7 @@ func (sm *sshCompressedManager) Prune(ctx context.Context) error {
 	}
 
 	for _, uuid := range completedUUIDs {
-		if !snaputil.SnapshotUUIDExists(sm.sourceInfo.Snapshots, uuid) {
+		if _, ok := kept[uuid]; !ok && !snaputil.SnapshotUUIDExists(sm.sourceInfo.Snapshots, uuid) {
 			path := filepath.Join(uuiddir, uuid.String())
 			sm.config.LogVerbose(1, "Deleting expired completion file %q", path)
 			if err := sshutil.RemoveFile(ctx, sm.sshClient, path); err != nil {
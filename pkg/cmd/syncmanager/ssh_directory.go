@@ -19,16 +19,18 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"math"
 	"net/url"
 	"path/filepath"
-	"sync"
 
 	"github.com/google/uuid"
+	"github.com/pkg/sftp"
 	"github.com/tinyzimmer/btrsync/pkg/btrfs"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/sshutil"
 	"github.com/tinyzimmer/btrsync/pkg/receive"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/sftpdir"
 	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/sshdir"
 	"golang.org/x/crypto/ssh"
 )
@@ -38,6 +40,7 @@ type sshDirectoryManager struct {
 	sourceInfo *btrfs.RootInfo
 	mirrorURL  *url.URL
 	sshClient  *ssh.Client
+	sftpClient *sftp.Client
 }
 
 func NewSSHDirectoryManager(cfg *Config, subvolInfo *btrfs.RootInfo) (Manager, error) {
@@ -57,101 +60,91 @@ func NewSSHDirectoryManager(cfg *Config, subvolInfo *btrfs.RootInfo) (Manager, e
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial ssh server: %s", err)
 	}
+	var sftpClient *sftp.Client
+	if cfg.UseSFTP {
+		cfg.LogVerbose(1, "Starting sftp session with remote host: %s\n", mirrorURL.Hostname())
+		sftpClient, err = sftpdir.NewClient(sshClient)
+		if err != nil {
+			sshClient.Close()
+			return nil, fmt.Errorf("failed to start sftp session: %s", err)
+		}
+	}
 	return &sshDirectoryManager{
 		config:     cfg,
 		sourceInfo: subvolInfo,
 		mirrorURL:  mirrorURL,
 		sshClient:  sshClient,
+		sftpClient: sftpClient,
 	}, nil
 }
 
+func (sm *sshDirectoryManager) Config() *Config { return sm.config }
+
 func (sm *sshDirectoryManager) Sync(ctx context.Context) error {
+	return syncStream(ctx, sm)
+}
+
+func (sm *sshDirectoryManager) Prepare(ctx context.Context) ([]*snaputil.IncrementalSnapshot, error) {
 	path := filepath.Join(sm.mirrorURL.Path, sm.config.SubvolumeIdentifier)
 	sm.config.LogVerbose(0, "Syncing ssh directory mirror: %s\n", path)
 	if err := sshutil.MkdirAll(ctx, sm.sshClient, path); err != nil {
-		return fmt.Errorf("failed to create mirror directory: %s", err)
-	}
-	snapshots := snaputil.MapParents(sm.sourceInfo.Snapshots)
-	for _, snap := range snapshots {
-		if err := sm.syncSnapshot(ctx, path, snap.Parent, snap.Snapshot); err != nil {
-			return err
-		}
+		return nil, fmt.Errorf("failed to create mirror directory: %s", err)
 	}
-	return nil
+	// The directory only holds the state of the last snapshot received, so older
+	// snapshots cannot be applied on top of it
+	sel := parentSelection{forwardOnly: true}
+	return sm.config.incrementalSnapshots(sm.sourceInfo.Snapshots, sel, func(snap *btrfs.RootInfo) (bool, error) {
+		return sm.isSynced(ctx, path, snap)
+	})
 }
 
-func (sm *sshDirectoryManager) syncSnapshot(ctx context.Context, destination string, parent, snap *btrfs.RootInfo) error {
+func (sm *sshDirectoryManager) isSynced(ctx context.Context, destination string, snap *btrfs.RootInfo) (bool, error) {
 	// Check if the snapshot is already synced by verifying it's UUID file
 	uuidFile := filepath.Join(destination, OffsetDirectory, snap.UUID.String())
 	sm.config.LogVerbose(1, "Checking for snapshot progress file on remote at %q\n", uuidFile)
 	data, err := sshutil.ReadFile(ctx, sm.sshClient, uuidFile)
 	if err != nil {
 		if !sshutil.IsFileNotExist(err) {
-			return fmt.Errorf("failed to read snapshot progress file: %s", err)
+			return false, fmt.Errorf("failed to read snapshot progress file: %s", err)
 		}
 		sm.config.LogVerbose(2, "Progress file %q does not exist\n", uuidFile)
-	} else {
-		var offset uint64
-		if _, err := fmt.Fscanf(bytes.NewReader(data), "%d", &offset); err != nil {
-			return err
-		}
-		sm.config.LogVerbose(2, "Progress file %q found with offset %d\n", uuidFile, offset)
-		if offset == math.MaxUint64-1 {
-			sm.config.LogVerbose(1, "Snapshot %s is already synced, skipping", snap.Name)
-			return nil
-		}
+		return false, nil
 	}
-
-	sm.config.LogVerbose(0, "Syncing snapshot %q contents to remote %q\n", snap.Path, destination)
-	var wg sync.WaitGroup
-
-	pipeOpt, pipe, err := btrfs.SendToPipe()
-	if err != nil {
-		return fmt.Errorf("error creating send pipe: %w", err)
+	var offset uint64
+	if _, err := fmt.Fscanf(bytes.NewReader(data), "%d", &offset); err != nil {
+		return false, err
 	}
-	defer pipe.Close()
-
-	wg.Add(1)
-	errors := make(chan error, 1)
-	go func() {
-		defer wg.Done()
-		sendOpts := []btrfs.SendOption{
-			pipeOpt,
-			btrfs.SendWithLogger(sm.config.Logger, sm.config.Verbosity),
-			btrfs.SendCompressedData(),
-		}
-		if parent != nil {
-			parentPath := filepath.Join(sm.config.SnapshotDirectory, parent.Name)
-			sendOpts = append(sendOpts, btrfs.SendWithParentRoot(parentPath))
-		}
-		snapshotPath := filepath.Join(sm.config.SnapshotDirectory, snap.Name)
-		if err := btrfs.Send(snapshotPath, sendOpts...); err != nil {
-			err = fmt.Errorf("error sending snapshot: %w", err)
-			errors <- err
-		}
-	}()
+	sm.config.LogVerbose(2, "Progress file %q found with offset %d\n", uuidFile, offset)
+	if offset == math.MaxUint64-1 {
+		sm.config.LogVerbose(1, "Snapshot %s is already synced, skipping", snap.Name)
+		return true, nil
+	}
+	return false, nil
+}
 
+func (sm *sshDirectoryManager) ReceiveStream(ctx context.Context, parent, snap *btrfs.RootInfo, stream io.Reader) error {
+	destination := filepath.Join(sm.mirrorURL.Path, sm.config.SubvolumeIdentifier)
+	sm.config.LogVerbose(0, "Syncing snapshot %q contents to remote %q\n", snap.Path, destination)
 	receiveOpts := []receive.Option{
 		receive.WithLogger(sm.config.Logger, sm.config.Verbosity),
 		receive.WithContext(ctx),
 		receive.HonorEndCommand(),
-		receive.To(sshdir.New(sm.sshClient, destination, OffsetDirectory)),
-	}
-	err = receive.ProcessSendStream(pipe, receiveOpts...)
-	if err != nil {
-		return err
 	}
-	wg.Wait()
-	close(errors)
-	for err := range errors {
-		if err != nil {
-			return err
-		}
+	if sm.sftpClient != nil {
+		receiveOpts = append(receiveOpts, receive.To(sftpdir.New(sm.sshClient, sm.sftpClient, destination, OffsetDirectory)))
+	} else {
+		receiveOpts = append(receiveOpts, receive.To(sshdir.New(sm.sshClient, destination, OffsetDirectory)))
 	}
-	return nil
+	return receive.ProcessSendStream(stream, receiveOpts...)
 }
 
 func (sm *sshDirectoryManager) Prune(ctx context.Context) error {
+	if !sm.config.sourceHasSnapshots() {
+		return nil
+	}
+	if sm.config.DryRun {
+		return nil
+	}
 	sm.config.LogVerbose(0, "Pruning expired offset files on the remote host")
 	path := filepath.Join(sm.mirrorURL.Path, sm.config.SubvolumeIdentifier)
 	files, err := sshutil.ReadDir(ctx, sm.sshClient, filepath.Join(path, OffsetDirectory))
@@ -159,6 +152,9 @@ func (sm *sshDirectoryManager) Prune(ctx context.Context) error {
 		return fmt.Errorf("failed to list offset files: %s", err)
 	}
 	for _, file := range files {
+		if file == metadataFile {
+			continue
+		}
 		uuid, err := uuid.Parse(file)
 		if err != nil {
 			sm.config.LogVerbose(1, "Failed to parse uuid from file %q: %s", file, err)
@@ -177,5 +173,8 @@ func (sm *sshDirectoryManager) Prune(ctx context.Context) error {
 }
 
 func (sm *sshDirectoryManager) Close() error {
+	if sm.sftpClient != nil {
+		sm.sftpClient.Close()
+	}
 	return sm.sshClient.Close()
 }
@@ -71,34 +71,51 @@ func NewSSHSubvolumeManager(cfg *Config, subvolInfo *btrfs.RootInfo) (Manager, e
 	}, nil
 }
 
+func (sm *sshSubvolumeManager) Config() *Config { return sm.config }
+
 func (sm *sshSubvolumeManager) Sync(ctx context.Context) error {
+	return syncStream(ctx, sm)
+}
+
+func (sm *sshSubvolumeManager) Prepare(ctx context.Context) ([]*snaputil.IncrementalSnapshot, error) {
 	exists, err := sshutil.CommandExists(ctx, sm.sshClient, "btrsync")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var syncFunc func(context.Context, *btrfs.RootInfo, *btrfs.RootInfo) error
 	if exists {
-		sm.config.LogVerbose(0, "Remote host has btrsync installed, using btrfsync for sync\n")
-		syncFunc = sm.syncBtrsync
+		sm.config.LogVerbose(0, "Remote host has btrsync installed, but btrsync is not yet supported for SSH subvolume manager, using btrfs send/receive for sync\n")
 	} else {
 		sm.config.LogVerbose(0, "Remote host does not have btrsync installed, using btrfs send/receive for sync\n")
-		syncFunc = sm.syncBtrfs
 	}
 	// Make sure the top directory exists on the path
 	parentdir := filepath.Dir(sm.getRemoteSnapshotPath(sm.sourceInfo))
 	if err := sshutil.MkdirAll(ctx, sm.sshClient, parentdir); err != nil {
-		return err
+		return nil, err
 	}
-	snapshots := snaputil.MapParents(sm.sourceInfo.Snapshots)
-	for _, snap := range snapshots {
-		if err := syncFunc(ctx, snap.Parent, snap.Snapshot); err != nil {
-			return err
-		}
+	// Snapshots are matched by the received UUID of the remote subvolumes, so
+	// renamed snapshots are still found
+	remoteSnapshots, err := sm.listRemoteSnapshots(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote snapshots: %w", err)
 	}
-	return nil
+	received := make(map[uuid.UUID]bool, len(remoteSnapshots))
+	for _, receivedUUID := range remoteSnapshots {
+		received[receivedUUID] = true
+	}
+	sel := parentSelection{cloneSources: true}
+	return sm.config.incrementalSnapshots(sm.sourceInfo.Snapshots, sel, func(snap *btrfs.RootInfo) (bool, error) {
+		synced := received[snap.UUID]
+		if synced {
+			sm.config.LogVerbose(1, "Remote snapshot %q is already synced, skipping\n", snap.Path)
+		}
+		return synced, nil
+	})
 }
 
 func (sm *sshSubvolumeManager) Prune(ctx context.Context) error {
+	if !sm.config.sourceHasSnapshots() {
+		return nil
+	}
 	sm.config.LogVerbose(0, "Pruning expired snapshots from mirror: %s\n", sm.config.MirrorPath)
 	remoteSnapshots, err := sm.listRemoteSnapshots(ctx)
 	if err != nil {
@@ -107,20 +124,35 @@ func (sm *sshSubvolumeManager) Prune(ctx context.Context) error {
 	sm.config.LogVerbose(3, "Found %d remote snapshots\n", len(remoteSnapshots))
 	sm.config.LogVerbose(4, "Remote snapshots: %v\n", remoteSnapshots)
 	// Check remote against what we have locally
+	names := make([]string, 0, len(remoteSnapshots))
+	for snapshotName := range remoteSnapshots {
+		names = append(names, snapshotName)
+	}
+	retained := sm.config.retainedSnapshots(sm.sourceInfo.Snapshots, names)
 	for snapshotName, uuid := range remoteSnapshots {
-		if !snaputil.SnapshotUUIDExists(sm.sourceInfo.Snapshots, uuid) {
-			sess, err := sm.sshClient.NewSession()
-			if err != nil {
-				return err
-			}
-			defer sess.Close()
-			sm.config.LogVerbose(0, "Pruning remote snapshot %q\n", snapshotName)
+		keep := retained[snapshotName]
+		if sm.config.Retention == nil {
+			// Without a retention policy snapshots are matched by their received UUID
+			keep = snaputil.SnapshotUUIDExists(sm.sourceInfo.Snapshots, uuid)
+		}
+		if !keep {
 			fullpath := filepath.Join(sm.mirrorURL.Path, sm.config.SubvolumeIdentifier, snapshotName)
-			cmd := fmt.Sprintf("btrfs subvolume delete %s", fullpath)
-			sm.config.LogVerbose(1, "Running command: %s\n", cmd)
-			out, err := sess.CombinedOutput(cmd)
+			err := sm.config.expire(snapshotName, fullpath, func() error {
+				sess, err := sm.sshClient.NewSession()
+				if err != nil {
+					return err
+				}
+				defer sess.Close()
+				cmd := fmt.Sprintf("btrfs subvolume delete %s", fullpath)
+				sm.config.LogVerbose(1, "Running command: %s\n", cmd)
+				out, err := sess.CombinedOutput(cmd)
+				if err != nil {
+					return fmt.Errorf("failed to delete remote snapshot: %s: %w", string(out), err)
+				}
+				return nil
+			})
 			if err != nil {
-				return fmt.Errorf("failed to delete remote snapshot: %s: %w", string(out), err)
+				return err
 			}
 		}
 	}
@@ -131,16 +163,7 @@ func (sm *sshSubvolumeManager) Close() error {
 	return sm.sshClient.Close()
 }
 
-func (sm *sshSubvolumeManager) syncBtrfs(ctx context.Context, parent, snap *btrfs.RootInfo) error {
-	synced, err := sm.isRemoteSnapshotSynced(ctx, snap)
-	if err != nil {
-		return fmt.Errorf("failed to check if remote snapshot is synced: %s", err)
-	}
-	if synced {
-		sm.config.LogVerbose(1, "Remote snapshot %q is already synced, skipping\n", snap.Path)
-		return nil
-	}
-
+func (sm *sshSubvolumeManager) ReceiveStream(ctx context.Context, parent, snap *btrfs.RootInfo, stream io.Reader) error {
 	// Double check if the directory exists and remove if so (this should be cleaned up)
 	exists, err := sshutil.FileOrDirectoryExists(ctx, sm.sshClient, sm.getRemoteSnapshotPath(snap))
 	if err != nil {
@@ -181,40 +204,17 @@ func (sm *sshSubvolumeManager) syncBtrfs(ctx context.Context, parent, snap *btrf
 		}()
 	}
 
-	// Start the send operation
-
-	pipeOpt, pipe, err := btrfs.SendToPipe()
-	if err != nil {
-		return fmt.Errorf("error creating send pipe: %w", err)
-	}
+	// Copy the send data to the stdin pipe
 
 	var wg sync.WaitGroup
-	errors := make(chan error, 2)
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		sendOpts := []btrfs.SendOption{
-			pipeOpt,
-			btrfs.SendWithLogger(sm.config.Logger, sm.config.Verbosity),
-			btrfs.SendCompressedData(),
-		}
-		if parent != nil {
-			sendOpts = append(sendOpts, btrfs.SendWithParentRoot(sm.getLocalSnapshotPath(parent)))
-		}
-		if err := btrfs.Send(sm.getLocalSnapshotPath(snap), sendOpts...); err != nil {
-			err = fmt.Errorf("error sending snapshot: %w", err)
-			errors <- err
-		}
-	}()
-
-	// Copy the send data to the stdin pipe
+	errors := make(chan error, 1)
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		defer sessStdin.Close()
 		sm.config.LogVerbose(4, "Copying send data to remote host\n")
-		_, err := io.Copy(sessStdin, pipe)
+		_, err := io.Copy(sessStdin, stream)
 		if err != nil {
 			err = fmt.Errorf("error copying send data to remote: %w", err)
 			errors <- err
@@ -244,56 +244,10 @@ func (sm *sshSubvolumeManager) syncBtrfs(ctx context.Context, parent, snap *btrf
 	return nil
 }
 
-func (sm *sshSubvolumeManager) syncBtrsync(ctx context.Context, parent, snap *btrfs.RootInfo) error {
-	sm.config.LogVerbose(0, "Btrsync is not yet supported for SSH subvolume manager, falling back to btrfs\n")
-	return sm.syncBtrfs(ctx, parent, snap)
-}
-
-func (sm *sshSubvolumeManager) getLocalSnapshotPath(snap *btrfs.RootInfo) string {
-	return filepath.Join(sm.config.SnapshotDirectory, snap.Path)
-}
-
 func (sm *sshSubvolumeManager) getRemoteSnapshotPath(snap *btrfs.RootInfo) string {
 	return filepath.Join(sm.mirrorURL.Path, sm.config.SubvolumeIdentifier, snap.Path)
 }
 
-func (sm *sshSubvolumeManager) isRemoteSnapshotSynced(ctx context.Context, snap *btrfs.RootInfo) (bool, error) {
-	sm.config.LogVerbose(2, "Checking if remote snapshot %q is synced\n", snap.Path)
-	exists, err := sshutil.FileOrDirectoryExists(ctx, sm.sshClient, sm.getRemoteSnapshotPath(snap))
-	if err != nil {
-		return false, err
-	}
-	if !exists {
-		return false, nil
-	}
-	sm.config.LogVerbose(3, "Remote snapshot %q exists, checking if received UUID matches local\n", snap.Path)
-	receivedUUID, err := sm.getRemoteReceivedUUID(ctx, snap)
-	if err != nil {
-		return false, err
-	}
-	sm.config.LogVerbose(3, "Remote snapshot %q has received UUID %q\n", snap.Path, receivedUUID)
-	return receivedUUID == snap.UUID, nil
-}
-
-func (sm *sshSubvolumeManager) getRemoteReceivedUUID(ctx context.Context, snap *btrfs.RootInfo) (uuid.UUID, error) {
-	sess, err := sm.sshClient.NewSession()
-	if err != nil {
-		return uuid.Nil, err
-	}
-	defer sess.Close()
-	cmd := fmt.Sprintf("btrfs subvolume show %s | grep 'Received UUID' | awk '{print $3}'", sm.getRemoteSnapshotPath(snap))
-	sm.config.LogVerbose(4, "Running command %q on remote host\n", cmd)
-	out, err := sess.CombinedOutput(cmd)
-	if err != nil {
-		return uuid.Nil, fmt.Errorf("error running command on remote host: %s: %w", string(out), err)
-	}
-	data := strings.TrimSpace(string(out))
-	if string(data) == "-" {
-		return uuid.Nil, nil
-	}
-	return uuid.Parse(string(data))
-}
-
 func (sm *sshSubvolumeManager) listRemoteSnapshots(ctx context.Context) (map[string]uuid.UUID, error) {
 	parentdir := filepath.Dir(sm.getRemoteSnapshotPath(sm.sourceInfo))
 	sess, err := sm.sshClient.NewSession()
@@ -319,6 +273,11 @@ func (sm *sshSubvolumeManager) listRemoteSnapshots(ctx context.Context) (map[str
 		}
 		name := filepath.Base(parts[10])
 		uustr := parts[8]
+		if uustr == "-" {
+			// Snapshots that were not fully received have no received UUID
+			snapshots[name] = uuid.Nil
+			continue
+		}
 		uuid, err := uuid.Parse(uustr)
 		if err != nil {
 			return nil, fmt.Errorf("error parsing UUID %q: %w", uustr, err)
@@ -18,36 +18,59 @@ If not, see <https://www.gnu.org/licenses/>.
 package syncmanager
 
 import (
+	"compress/gzip"
+	"compress/lzw"
 	"context"
 	"fmt"
+	"io"
 
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/snaputil"
+	"github.com/tinyzimmer/btrsync/pkg/encryption"
 )
 
 var OffsetDirectory = ".btrsync"
 
 type Manager interface {
+	Config() *Config
 	Sync(ctx context.Context) error
 	Prune(ctx context.Context) error
 	Close() error
 }
 
+// StreamManager is a Manager that can receive a send stream produced elsewhere. It allows
+// a single send to be replicated to multiple mirrors.
+type StreamManager interface {
+	Manager
+	// Prepare readies the mirror and returns the snapshots it is missing, oldest first,
+	// along with the parent each should be sent against.
+	Prepare(ctx context.Context) ([]*snaputil.IncrementalSnapshot, error)
+	// ReceiveStream receives the send stream for snap, sent against parent if it is
+	// not nil.
+	ReceiveStream(ctx context.Context, parent, snap *btrfs.RootInfo, stream io.Reader) error
+}
+
 func New(cfg *Config) (Manager, error) {
-	subvolInfo, err := snaputil.ResolveSubvolumeDetails(
-		cfg.Logger,
-		cfg.Verbosity,
-		cfg.FullSubvolumePath,
-		cfg.SnapshotDirectory,
-		cfg.SnapshotName,
-	)
+	subvolInfo, err := resolveSubvolume(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("error resolving subvolume details: %w", err)
+		return nil, err
 	}
 	mirrorURL, err := cfg.MirrorURL()
 	if err != nil {
 		return nil, err
 	}
+	if len(cfg.EncryptionKeys) > 0 && !cfg.MirrorFormat.SupportsEncryption() {
+		return nil, fmt.Errorf("encryption is not supported for %q mirrors", cfg.MirrorFormat)
+	}
+	if cfg.SigningKey != "" && !cfg.MirrorFormat.IsCompressed() {
+		return nil, fmt.Errorf("signing is not supported for %q mirrors", cfg.MirrorFormat)
+	}
+	if cfg.FullSendInterval > 0 && !cfg.MirrorFormat.IsCompressed() {
+		return nil, fmt.Errorf("full send intervals are not supported for %q mirrors", cfg.MirrorFormat)
+	}
 	var manager Manager
 	switch mirrorURL.Scheme {
 	case "file":
@@ -57,8 +80,10 @@ func New(cfg *Config) (Manager, error) {
 			switch cfg.MirrorFormat {
 			case config.MirrorFormatSubvolume, "":
 				manager, err = NewLocalSubvolumeManager(cfg, subvolInfo)
-			case config.MirrorFormatDirectory:
+			case config.MirrorFormatDirectory, config.MirrorFormatVersionedDirectory:
 				manager, err = NewLocalDirectoryManager(cfg, subvolInfo)
+			case config.MirrorFormatRepository:
+				manager, err = NewRepositoryManager(cfg, subvolInfo)
 			default:
 				return nil, fmt.Errorf("unsupported local mirror format: %s", cfg.MirrorFormat)
 			}
@@ -72,10 +97,17 @@ func New(cfg *Config) (Manager, error) {
 				manager, err = NewSSHSubvolumeManager(cfg, subvolInfo)
 			case config.MirrorFormatDirectory:
 				manager, err = NewSSHDirectoryManager(cfg, subvolInfo)
+			case config.MirrorFormatRepository:
+				manager, err = NewRepositoryManager(cfg, subvolInfo)
 			default:
 				return nil, fmt.Errorf("unsupported ssh mirror format: %s", cfg.MirrorFormat)
 			}
 		}
+	case "s3":
+		if !cfg.MirrorFormat.IsCompressed() {
+			return nil, fmt.Errorf("s3 mirrors require a compressed format, got %q", cfg.MirrorFormat)
+		}
+		manager, err = NewS3CompressedManager(cfg, subvolInfo)
 	default:
 		err = fmt.Errorf("unsupported mirror scheme: %s", mirrorURL.Scheme)
 	}
@@ -84,3 +116,105 @@ func New(cfg *Config) (Manager, error) {
 	}
 	return manager, nil
 }
+
+// syncStream syncs a StreamManager on its own by sending each missing snapshot to it.
+func syncStream(ctx context.Context, sm StreamManager) error {
+	pending, err := sm.Prepare(ctx)
+	if err != nil {
+		return err
+	}
+	for _, snap := range pending {
+		err := sendSnapshot(sm.Config(), snap, func(r io.Reader) error {
+			return sm.ReceiveStream(ctx, snap.Parent, snap.Snapshot, r)
+		})
+		if err := resendInFull(ctx, snap, sm, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fullSnapshots returns the snapshots sorted oldest first without any parents, for
+// mirror formats that store every snapshot as a full send.
+func fullSnapshots(snapshots []*btrfs.RootInfo) []*snaputil.IncrementalSnapshot {
+	snaputil.SortSnapshots(snapshots, snaputil.SortAscending)
+	out := make([]*snaputil.IncrementalSnapshot, len(snapshots))
+	for i, snap := range snapshots {
+		out[i] = &snaputil.IncrementalSnapshot{Snapshot: snap}
+	}
+	return out
+}
+
+// newStreamEncoder returns a writer that compresses to w using the mirror format of the
+// configuration, and encrypts the compressed stream if the mirror has encryption keys.
+// Closing the writer does not close w.
+func newStreamEncoder(cfg *Config, w io.Writer) (io.WriteCloser, error) {
+	keys, err := cfg.Keyring()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return newEncoder(cfg.MirrorFormat, w)
+	}
+	cfg.LogVerbose(1, "Encrypting stream with key %s\n", keys.Primary().ID())
+	encrypter, err := encryption.NewWriter(w, keys.Primary())
+	if err != nil {
+		return nil, err
+	}
+	enc, err := newEncoder(cfg.MirrorFormat, encrypter)
+	if err != nil {
+		return nil, err
+	}
+	return &chainedWriteCloser{WriteCloser: enc, next: encrypter}, nil
+}
+
+// chainedWriteCloser closes the writer it writes to after itself.
+type chainedWriteCloser struct {
+	io.WriteCloser
+	next io.Closer
+}
+
+func (c *chainedWriteCloser) Close() error {
+	err := c.WriteCloser.Close()
+	if cerr := c.next.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// NewDecoder returns a reader that decompresses r using the given mirror format.
+func NewDecoder(format config.MirrorFormat, r io.Reader) (io.ReadCloser, error) {
+	switch format {
+	// zlib mirrors have always been written with gzip
+	case config.MirrorFormatGzip, config.MirrorFormatZlib:
+		return gzip.NewReader(r)
+	case config.MirrorFormatLzw:
+		return lzw.NewReader(r, lzw.LSB, 8), nil
+	case config.MirrorFormatZstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd reader: %s", err)
+		}
+		return dec.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported compressed mirror format: %s", format)
+}
+
+// newEncoder returns a writer that compresses to w using the given mirror format.
+func newEncoder(format config.MirrorFormat, w io.Writer) (io.WriteCloser, error) {
+	switch format {
+	case config.MirrorFormatGzip:
+		return gzip.NewWriter(w), nil
+	case config.MirrorFormatLzw:
+		return lzw.NewWriter(w, lzw.LSB, 8), nil
+	case config.MirrorFormatZlib:
+		return gzip.NewWriter(w), nil
+	case config.MirrorFormatZstd:
+		enc, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd writer: %s", err)
+		}
+		return enc, nil
+	}
+	return nil, fmt.Errorf("unsupported compressed mirror format: %s", format)
+}
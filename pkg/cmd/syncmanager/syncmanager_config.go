@@ -21,8 +21,15 @@ import (
 	"net/url"
 	"os"
 	"os/user"
+	"path/filepath"
+	"time"
 
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
 	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/retention"
+	"github.com/tinyzimmer/btrsync/pkg/encryption"
+	"github.com/tinyzimmer/btrsync/pkg/receive/filecache"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/catalog"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -33,12 +40,42 @@ type Config struct {
 	FullSubvolumePath   string
 	SnapshotDirectory   string
 	SnapshotName        string
+	TimeFormat          string
 	MirrorPath          string
 	MirrorFormat        config.MirrorFormat
 	SSHUser             string
 	SSHPassword         string
 	SSHKeyFile          string
 	SSHHostKey          string
+	UseSFTP             bool
+	CatalogPath         string
+	CatalogHashes       bool
+	EncryptionKeys      []string
+	SigningKey          string
+	FullSendInterval    time.Duration
+	Retention           *config.RetentionPolicy
+	S3Endpoint          string
+	S3Region            string
+	S3AccessKeyID       string
+	S3SecretAccessKey   string
+	S3StorageClass      string
+	S3PartSize          int
+	WriteCoalescing     int
+	SyncOnClose         bool
+	DryRun              bool
+	// SourceExpired are the snapshots a dry run expired from the source. They are
+	// treated as if they were already deleted.
+	SourceExpired []*retention.Decision
+
+	// expiryReasons are why snapshots still in the source are not kept by the mirror
+	expiryReasons map[string]string
+	// sourceSnapshots are all the snapshots of the source, including the ones that are
+	// not sent to the mirror
+	sourceSnapshots []*btrfs.RootInfo
+	// latestSnapshot is the newest snapshot sent to the mirror
+	latestSnapshot *btrfs.RootInfo
+	// expiredSnapshots are the snapshots pruned from the mirror
+	expiredSnapshots []string
 }
 
 func (c *Config) LogVerbose(level int, format string, args ...interface{}) {
@@ -47,6 +84,15 @@ func (c *Config) LogVerbose(level int, format string, args ...interface{}) {
 	}
 }
 
+// LatestSnapshotPath returns the path of the newest snapshot of the source that is sent
+// to the mirror, or an empty string if there is none.
+func (c *Config) LatestSnapshotPath() string {
+	if c.latestSnapshot == nil {
+		return ""
+	}
+	return filepath.Join(c.SnapshotDirectory, c.latestSnapshot.Name)
+}
+
 func (c *Config) MirrorURL() (*url.URL, error) {
 	u, err := url.Parse(c.MirrorPath)
 	if err != nil {
@@ -58,6 +104,45 @@ func (c *Config) MirrorURL() (*url.URL, error) {
 	return u, nil
 }
 
+// fileCacheOptions returns the options of the cache of open files used by receivers
+// writing to local mirrors.
+func (c *Config) fileCacheOptions() []filecache.Option {
+	var opts []filecache.Option
+	if c.WriteCoalescing > 0 {
+		opts = append(opts, filecache.WithWriteCoalescing(c.WriteCoalescing*1024))
+	}
+	if c.SyncOnClose {
+		opts = append(opts, filecache.WithSyncOnClose())
+	}
+	return opts
+}
+
+// CatalogFile returns the path to the catalog database of the subvolume.
+func (c *Config) CatalogFile() (string, error) {
+	dir := c.CatalogPath
+	if dir == "" {
+		mirrorURL, err := c.MirrorURL()
+		if err != nil {
+			return "", err
+		}
+		if mirrorURL.Scheme != "file" {
+			return "", fmt.Errorf("a catalog path is required for %s mirrors", mirrorURL.Scheme)
+		}
+		dir = mirrorURL.Path
+	}
+	return filepath.Join(dir, c.SubvolumeIdentifier+catalog.FileExtension), nil
+}
+
+// Keyring loads the encryption keys of the mirror. It is empty if the mirror is not
+// encrypted.
+func (c *Config) Keyring() (encryption.Keyring, error) {
+	keys, err := encryption.LoadKeyring(c.EncryptionKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load encryption keys: %w", err)
+	}
+	return keys, nil
+}
+
 func (c *Config) SSHConfig() (*ssh.ClientConfig, error) {
 	mirrorURL, err := c.MirrorURL()
 	if err != nil {
@@ -0,0 +1,208 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package syncmanager
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tinyzimmer/btrsync/pkg/encryption"
+)
+
+// ErrNoManifest is the error of stream files written before manifests were introduced.
+var ErrNoManifest = errors.New("stream file has no manifest")
+
+// VerifyResult is the result of verifying a stream file in a compressed mirror.
+type VerifyResult struct {
+	// Subvolume is the identifier the snapshot is stored under
+	Subvolume string
+	// File is the name of the stream file
+	File string
+	// Manifest is the manifest of the file, nil if it is missing or unreadable
+	Manifest *Manifest
+	// StreamVerified is true if the file was decoded and the send stream verified.
+	// Encrypted files can only be decoded with their key.
+	StreamVerified bool
+	// Err is the reason the file failed verification
+	Err error
+}
+
+// VerifyCompressedMirror verifies every stream file in the compressed mirror of the
+// configuration against its manifest, calling fn with the result of each file.
+// Manifests must be signed with publicKey if it is set, which defaults to the public
+// key of the signing key of the mirror.
+func VerifyCompressedMirror(ctx context.Context, cfg *Config, publicKey ed25519.PublicKey, fn func(*VerifyResult)) error {
+	if !cfg.MirrorFormat.IsCompressed() {
+		return fmt.Errorf("%q mirrors have no manifests to verify", cfg.MirrorFormat)
+	}
+	keys, err := cfg.Keyring()
+	if err != nil {
+		return err
+	}
+	if publicKey == nil {
+		signer, err := cfg.Signer()
+		if err != nil {
+			return err
+		}
+		if signer != nil {
+			publicKey = signer.Public().(ed25519.PublicKey)
+		}
+	}
+	files, err := openMirrorFiles(cfg)
+	if err != nil {
+		return err
+	}
+	defer files.Close()
+	v := &verifier{cfg: cfg, files: files, keys: keys, publicKey: publicKey}
+
+	subvolumes, err := files.Subvolumes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list mirror: %w", err)
+	}
+	ext := "." + string(cfg.MirrorFormat)
+	for _, subvolume := range subvolumes {
+		names, err := files.Files(ctx, subvolume)
+		if err != nil {
+			return fmt.Errorf("failed to list snapshots of %s: %w", subvolume, err)
+		}
+		streams := make(map[string]bool)
+		manifests := make(map[string]bool)
+		for _, name := range names {
+			switch {
+			case strings.HasSuffix(name, ext):
+				streams[name] = true
+			case strings.HasSuffix(name, ext+ManifestExtension):
+				manifests[strings.TrimSuffix(name, ManifestExtension)] = true
+			}
+		}
+		for name := range manifests {
+			if !streams[name] {
+				fn(&VerifyResult{Subvolume: subvolume, File: name, Err: errors.New("stream file is missing")})
+			}
+		}
+		sorted := make([]string, 0, len(streams))
+		for name := range streams {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		for _, name := range sorted {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			res := &VerifyResult{Subvolume: subvolume, File: name}
+			if !manifests[name] {
+				res.Err = ErrNoManifest
+			} else if res.Err = v.verify(ctx, res); res.Err == nil && res.Manifest.IsIncremental() && !streams[res.Manifest.Parent] {
+				res.Err = fmt.Errorf("parent stream %q is missing", res.Manifest.Parent)
+			}
+			fn(res)
+		}
+	}
+	return nil
+}
+
+type verifier struct {
+	cfg       *Config
+	files     mirrorFiles
+	keys      encryption.Keyring
+	publicKey ed25519.PublicKey
+}
+
+func (v *verifier) verify(ctx context.Context, res *VerifyResult) error {
+	path := filepath.Join(res.Subvolume, res.File)
+	v.cfg.LogVerbose(1, "Verifying %q\n", path)
+	data, err := v.files.ReadFile(ctx, ManifestName(path))
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	m, err := ParseManifest(data)
+	if err != nil {
+		return fmt.Errorf("manifest is unreadable: %w", err)
+	}
+	res.Manifest = m
+	if v.publicKey != nil {
+		if err := m.VerifySignature(v.publicKey); err != nil {
+			return err
+		}
+	}
+	if m.File != res.File {
+		return fmt.Errorf("manifest describes file %q", m.File)
+	}
+
+	f, err := v.files.Open(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	storedHash := sha256.New()
+	var storedSize int64
+	rdr := io.TeeReader(f, &countingWriter{w: storedHash, n: &storedSize})
+
+	// Decode the stream when possible, the stored file is hashed along the way
+	if !m.Encrypted || len(v.keys) > 0 {
+		streamSum, streamSize, err := v.decode(rdr, m)
+		if err != nil {
+			return fmt.Errorf("stream is corrupt: %w", err)
+		}
+		if streamSize != m.StreamSize {
+			return fmt.Errorf("stream is %d bytes, expected %d", streamSize, m.StreamSize)
+		}
+		if streamSum != m.StreamSHA256 {
+			return errors.New("stream checksum does not match")
+		}
+		res.StreamVerified = true
+	}
+	if _, err := io.Copy(io.Discard, rdr); err != nil {
+		return fmt.Errorf("failed to read stream file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if storedSize != m.Size {
+		return fmt.Errorf("file is %d bytes, expected %d", storedSize, m.Size)
+	}
+	if hex.EncodeToString(storedHash.Sum(nil)) != m.SHA256 {
+		return errors.New("file checksum does not match")
+	}
+	return nil
+}
+
+func (v *verifier) decode(r io.Reader, m *Manifest) (sum string, size int64, err error) {
+	if m.Encrypted {
+		if r, err = encryption.NewReader(r, v.keys); err != nil {
+			return "", 0, err
+		}
+	}
+	dec, err := NewDecoder(m.Format, r)
+	if err != nil {
+		return "", 0, err
+	}
+	defer dec.Close()
+	h := sha256.New()
+	size, err = io.Copy(h, dec)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
@@ -0,0 +1,106 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/btrsync/pkg/cmd/config"
+	"github.com/tinyzimmer/btrsync/pkg/cmd/syncmanager"
+)
+
+var (
+	verifyPublicKey string
+	verifyStrict    bool
+)
+
+func NewVerifyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify [flags] <mirror>",
+		Short: "Verify the snapshots stored in a mirror",
+		Long: `Verify the snapshots stored in a mirror.
+
+Every stream file in a compressed mirror is checked against the manifest written next
+to it: the stored file is hashed, and the stream is decompressed and hashed as well
+unless it is encrypted and no key is available. Manifests must be signed if the mirror
+has a signing key or --public-key is given.
+
+Repository mirrors are checked by reading every chunk, like "btrsync repository check
+--read-data".`,
+		Args: cobra.ExactArgs(1),
+		RunE: verify,
+	}
+	cmd.Flags().StringVar(&verifyPublicKey, "public-key", "", "hex or base64 encoded ed25519 public key manifests must be signed with")
+	cmd.Flags().BoolVar(&verifyStrict, "strict", false, "fail on stream files without a manifest")
+	addKeyFlag(cmd.Flags())
+	return cmd
+}
+
+func verify(cmd *cobra.Command, args []string) error {
+	mirror := conf.GetMirror(args[0])
+	if mirror == nil {
+		return fmt.Errorf("mirror %q is not configured", args[0])
+	}
+	if mirror.Format == config.MirrorFormatRepository {
+		repoReadData = true
+		return repositoryCheck(cmd, args)
+	}
+	var publicKey ed25519.PublicKey
+	if verifyPublicKey != "" {
+		var err error
+		if publicKey, err = syncmanager.ParsePublicKey(verifyPublicKey); err != nil {
+			return err
+		}
+	}
+	cfg := newMirrorConfig(mirror)
+	if len(keyRefs) > 0 {
+		cfg.EncryptionKeys = keyRefs
+	}
+
+	out := cmd.OutOrStdout()
+	var verified, unverified, failed int
+	err := syncmanager.VerifyCompressedMirror(context.Background(), cfg, publicKey, func(res *syncmanager.VerifyResult) {
+		name := path.Join(res.Subvolume, res.File)
+		switch {
+		case errors.Is(res.Err, syncmanager.ErrNoManifest) && !verifyStrict:
+			unverified++
+			fmt.Fprintf(out, "SKIP  %s: %s\n", name, res.Err)
+		case res.Err != nil:
+			failed++
+			fmt.Fprintf(out, "FAIL  %s: %s\n", name, res.Err)
+		case !res.StreamVerified:
+			verified++
+			fmt.Fprintf(out, "OK    %s (encrypted, stream not decoded)\n", name)
+		default:
+			verified++
+			fmt.Fprintf(out, "OK    %s\n", name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Verified %d files, %d failed, %d without a manifest\n", verified, failed, unverified)
+	if failed > 0 {
+		return fmt.Errorf("%d files failed verification", failed)
+	}
+	return nil
+}
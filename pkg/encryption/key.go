@@ -0,0 +1,188 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// KeySize is the size of encryption keys in bytes.
+const KeySize = 32
+
+// KeyIDSize is the size of key IDs in bytes.
+const KeyIDSize = 8
+
+// ErrNoKey is returned when data is encrypted with a key that is not in the keyring.
+var ErrNoKey = errors.New("no matching decryption key")
+
+// KeyID identifies a key without revealing it.
+type KeyID [KeyIDSize]byte
+
+// String returns the hex encoded key ID.
+func (id KeyID) String() string { return hex.EncodeToString(id[:]) }
+
+// Key is a symmetric encryption key.
+type Key struct {
+	id     KeyID
+	secret [KeySize]byte
+}
+
+// NewKey returns a key from its raw bytes.
+func NewKey(secret []byte) (*Key, error) {
+	if len(secret) != KeySize {
+		return nil, fmt.Errorf("encryption keys must be %d bytes, got %d", KeySize, len(secret))
+	}
+	k := &Key{}
+	copy(k.secret[:], secret)
+	sum := sha256.Sum256(append([]byte("btrsync key id\x00"), secret...))
+	copy(k.id[:], sum[:KeyIDSize])
+	return k, nil
+}
+
+// GenerateKey returns a new random key.
+func GenerateKey() (*Key, error) {
+	secret := make([]byte, KeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return NewKey(secret)
+}
+
+// ParseKey parses a key that is either raw, or hex or base64 encoded. Surrounding
+// whitespace is ignored for encoded keys.
+func ParseKey(data []byte) (*Key, error) {
+	secret, err := DecodeSecret(data, KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("encryption keys must be %w", err)
+	}
+	return NewKey(secret)
+}
+
+// DecodeSecret decodes a secret of the given size that is either raw, or hex or base64
+// encoded. Surrounding whitespace is ignored for encoded secrets.
+func DecodeSecret(data []byte, size int) ([]byte, error) {
+	if len(data) == size {
+		return data, nil
+	}
+	text := strings.TrimSpace(string(data))
+	if secret, err := hex.DecodeString(text); err == nil && len(secret) == size {
+		return secret, nil
+	}
+	if secret, err := base64.StdEncoding.DecodeString(text); err == nil && len(secret) == size {
+		return secret, nil
+	}
+	return nil, fmt.Errorf("%d bytes, raw or hex or base64 encoded", size)
+}
+
+// LoadKey loads the key a reference points to. See LoadSecret for the form of
+// references.
+func LoadKey(ref string) (*Key, error) {
+	data, err := LoadSecret(ref)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseKey(data)
+	if err != nil {
+		kind, _, _ := strings.Cut(ref, ":")
+		return nil, fmt.Errorf("error loading key from %s: %w", kind, err)
+	}
+	return key, nil
+}
+
+// LoadSecret loads the secret a reference points to. References take the form
+// file:<path>, env:<variable> or command:<shell command>, where the command prints the
+// secret on its standard output.
+func LoadSecret(ref string) ([]byte, error) {
+	kind, value, ok := strings.Cut(ref, ":")
+	if !ok || value == "" {
+		return nil, fmt.Errorf("invalid key reference %q, expected file:, env: or command:", ref)
+	}
+	switch kind {
+	case "file":
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("error reading key file: %w", err)
+		}
+		return data, nil
+	case "env":
+		env, ok := os.LookupEnv(value)
+		if !ok {
+			return nil, fmt.Errorf("key environment variable %s is not set", value)
+		}
+		return []byte(env), nil
+	case "command":
+		var stderr bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", value)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("key command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("invalid key reference %q, expected file:, env: or command:", ref)
+}
+
+// ID returns the ID of the key.
+func (k *Key) ID() KeyID { return k.id }
+
+// String returns the base64 encoding of the key.
+func (k *Key) String() string { return base64.StdEncoding.EncodeToString(k.secret[:]) }
+
+// Keyring is a list of keys. The first key is the primary key used to encrypt new data,
+// and every key can decrypt existing data. Keys are rotated by adding a new primary key
+// in front of the old ones.
+type Keyring []*Key
+
+// LoadKeyring loads the keys of every reference in order.
+func LoadKeyring(refs []string) (Keyring, error) {
+	keys := make(Keyring, 0, len(refs))
+	for _, ref := range refs {
+		key, err := LoadKey(ref)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Primary returns the key used to encrypt new data, or nil if the keyring is empty.
+func (k Keyring) Primary() *Key {
+	if len(k) == 0 {
+		return nil
+	}
+	return k[0]
+}
+
+// Find returns the key with the given ID, or nil.
+func (k Keyring) Find(id KeyID) *Key {
+	for _, key := range k {
+		if key.id == id {
+			return key
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecodeSecret(t *testing.T) {
+	secret := testData(KeySize)
+	tc := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"raw", secret, false},
+		{"hex", []byte(hex.EncodeToString(secret)), false},
+		{"hex with whitespace", []byte(" " + hex.EncodeToString(secret) + "\n"), false},
+		{"base64", []byte(base64.StdEncoding.EncodeToString(secret)), false},
+		{"base64 with newline", []byte(base64.StdEncoding.EncodeToString(secret) + "\n"), false},
+		{"too short", secret[:KeySize-1], true},
+		{"hex too short", []byte(hex.EncodeToString(secret[:KeySize-1])), true},
+		{"base64 too long", []byte(base64.StdEncoding.EncodeToString(append(secret, 0))), true},
+		{"not encoded", bytes.Repeat([]byte("z"), 2*KeySize), true},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeSecret(tt.data, KeySize)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %x", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, secret) {
+				t.Errorf("expected %x, got %x", secret, got)
+			}
+		})
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	key := testKey(t)
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(key.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BTRSYNC_TEST_KEY", hex.EncodeToString(key.secret[:]))
+	tc := []struct {
+		ref     string
+		wantErr bool
+	}{
+		{"file:" + path, false},
+		{"env:BTRSYNC_TEST_KEY", false},
+		{"command:cat " + path, false},
+		{"file:" + path + ".missing", true},
+		{"env:BTRSYNC_TEST_KEY_UNSET", true},
+		{"command:exit 1", true},
+		{"command:echo short", true},
+		{path, true},
+		{"file:", true},
+	}
+	for _, tt := range tc {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := LoadKey(tt.ref)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID() != key.ID() || got.String() != key.String() {
+				t.Errorf("expected key %s, got %s", key.ID(), got.ID())
+			}
+		})
+	}
+}
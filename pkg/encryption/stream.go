@@ -0,0 +1,276 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package encryption implements authenticated encryption of streams and blobs with
+// symmetric keys.
+//
+// Encrypted data starts with a header holding a magic value, the ID of the key it was
+// encrypted with and a random salt. A key unique to the stream is derived from the key
+// and the salt with HKDF-SHA256, and the data is split into segments of 64 KiB that are
+// each sealed with AES-256-GCM. Segment nonces are a counter with a flag marking the
+// final segment, so segments cannot be reordered, dropped or truncated without
+// detection. The header is authenticated with every segment.
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Magic is the value encrypted data starts with.
+var Magic = []byte("BTRSENC\x01")
+
+const (
+	saltSize    = 16
+	headerSize  = 8 + KeyIDSize + saltSize
+	segmentSize = 64 * 1024
+	tagSize     = 16
+)
+
+// ErrCorrupt is returned when encrypted data fails authentication.
+var ErrCorrupt = errors.New("encrypted data is corrupt or was tampered with")
+
+// IsEncrypted returns true if data starts with the encryption header magic.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, Magic)
+}
+
+func streamCipher(key *Key, salt []byte) (cipher.AEAD, error) {
+	streamKey := make([]byte, KeySize)
+	kdf := hkdf.New(sha256.New, key.secret[:], salt, []byte("btrsync stream v1"))
+	if _, err := io.ReadFull(kdf, streamKey); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(streamKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+// NewWriter returns a writer that encrypts to w with the given key. Close must be called
+// to write the final segment. It does not close w.
+func NewWriter(w io.Writer, key *Key) (io.WriteCloser, error) {
+	header := make([]byte, headerSize)
+	copy(header, Magic)
+	id := key.ID()
+	copy(header[len(Magic):], id[:])
+	salt := header[len(Magic)+KeyIDSize:]
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := streamCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &writer{
+		w:      w,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, 0, segmentSize+tagSize),
+	}, nil
+}
+
+func (e *writer) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encryption writer")
+	}
+	var n int
+	for len(p) > 0 {
+		// A full segment is only flushed once more data arrives, since the last
+		// segment must be marked as final
+		if len(e.buf) == segmentSize {
+			if err := e.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(e.buf[len(e.buf):segmentSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (e *writer) flush(final bool) error {
+	out := e.aead.Seal(e.buf[:0], segmentNonce(e.counter, final), e.buf, e.header)
+	e.counter++
+	_, err := e.w.Write(out)
+	e.buf = e.buf[:0]
+	return err
+}
+
+func (e *writer) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.flush(true)
+}
+
+type reader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	seg     []byte
+	plain   []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+// NewReader returns a reader that decrypts r with the matching key from the keyring.
+// ErrNoKey is returned if the data was encrypted with a key that is not in the keyring.
+func NewReader(r io.Reader, keys Keyring) (io.Reader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("error reading encryption header: %w", err)
+	}
+	if !IsEncrypted(header) {
+		return nil, errors.New("data is not encrypted")
+	}
+	var id KeyID
+	copy(id[:], header[len(Magic):])
+	key := keys.Find(id)
+	if key == nil {
+		return nil, fmt.Errorf("%w: data is encrypted with key %s", ErrNoKey, id)
+	}
+	aead, err := streamCipher(key, header[len(Magic)+KeyIDSize:])
+	if err != nil {
+		return nil, err
+	}
+	return &reader{
+		r:      bufio.NewReaderSize(r, segmentSize+tagSize+1),
+		aead:   aead,
+		header: header,
+		seg:    make([]byte, segmentSize+tagSize),
+	}, nil
+}
+
+func (d *reader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.next()
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *reader) next() error {
+	n, err := io.ReadFull(d.r, d.seg)
+	final := false
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF):
+		final = true
+	case err != nil:
+		return err
+	default:
+		if _, err := d.r.Peek(1); errors.Is(err, io.EOF) {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	plain, err := d.aead.Open(d.seg[:0], segmentNonce(d.counter, final), d.seg[:n], d.header)
+	if err != nil {
+		return ErrCorrupt
+	}
+	d.counter++
+	d.plain = plain
+	d.done = final
+	return nil
+}
+
+// MaybeDecrypt returns a reader of the plain contents of r, decrypting it with the
+// keyring if it starts with an encryption header. The returned bool is true if r was
+// encrypted.
+func MaybeDecrypt(r io.Reader, keys Keyring) (io.Reader, bool, error) {
+	br := bufio.NewReader(r)
+	prefix, err := br.Peek(len(Magic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, false, err
+	}
+	if !IsEncrypted(prefix) {
+		return br, false, nil
+	}
+	if len(keys) == 0 {
+		return nil, true, fmt.Errorf("%w: data is encrypted and no keys were given", ErrNoKey)
+	}
+	dec, err := NewReader(br, keys)
+	return dec, true, err
+}
+
+// Seal encrypts data with the key.
+func Seal(key *Key, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(headerSize + len(data) + (len(data)/segmentSize+1)*tagSize)
+	w, err := NewWriter(&buf, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Open decrypts data sealed with a key in the keyring.
+func Open(keys Keyring, data []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(data), keys)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
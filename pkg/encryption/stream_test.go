@@ -0,0 +1,244 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func testKey(t *testing.T) *Key {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// sealSegments encrypts data and returns the header and every sealed segment.
+func sealSegments(t *testing.T, key *Key, data []byte) (header []byte, segments [][]byte) {
+	t.Helper()
+	sealed, err := Seal(key, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, sealed = sealed[:headerSize], sealed[headerSize:]
+	for len(sealed) > segmentSize+tagSize {
+		segments = append(segments, sealed[:segmentSize+tagSize])
+		sealed = sealed[segmentSize+tagSize:]
+	}
+	return header, append(segments, sealed)
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := testKey(t)
+	sizes := []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 2 * segmentSize, 3*segmentSize + 100}
+	for _, size := range sizes {
+		t.Run(fmt.Sprintf("%d bytes", size), func(t *testing.T) {
+			data := testData(size)
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Write in uneven pieces to cross segment boundaries mid write
+			for rest := data; len(rest) > 0; {
+				n := 1000
+				if n > len(rest) {
+					n = len(rest)
+				}
+				if _, err := w.Write(rest[:n]); err != nil {
+					t.Fatal(err)
+				}
+				rest = rest[n:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			segments := size/segmentSize + 1
+			if size > 0 && size%segmentSize == 0 {
+				segments--
+			}
+			if want := headerSize + size + segments*tagSize; buf.Len() != want {
+				t.Errorf("expected %d encrypted bytes, got %d", want, buf.Len())
+			}
+			if !IsEncrypted(buf.Bytes()) {
+				t.Error("expected the output to start with the header")
+			}
+
+			r, err := NewReader(&buf, Keyring{testKey(t), key})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("decrypted %d bytes that do not match the %d encrypted", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestTampering(t *testing.T) {
+	key := testKey(t)
+	data := testData(3*segmentSize + 100)
+	tc := []struct {
+		name    string
+		tamper  func(header []byte, segments [][]byte) [][]byte
+		wantErr error
+	}{
+		{
+			name: "truncated at a segment boundary",
+			tamper: func(header []byte, segments [][]byte) [][]byte {
+				return append([][]byte{header}, segments[:3]...)
+			},
+			wantErr: ErrCorrupt,
+		},
+		{
+			name: "final segment truncated",
+			tamper: func(header []byte, segments [][]byte) [][]byte {
+				last := segments[len(segments)-1]
+				return append(append([][]byte{header}, segments[:len(segments)-1]...), last[:len(last)-1])
+			},
+			wantErr: ErrCorrupt,
+		},
+		{
+			name: "reordered segments",
+			tamper: func(header []byte, segments [][]byte) [][]byte {
+				return [][]byte{header, segments[1], segments[0], segments[2], segments[3]}
+			},
+			wantErr: ErrCorrupt,
+		},
+		{
+			name: "data appended",
+			tamper: func(header []byte, segments [][]byte) [][]byte {
+				return append(append([][]byte{header}, segments...), segments[0])
+			},
+			wantErr: ErrCorrupt,
+		},
+		{
+			name: "modified segment",
+			tamper: func(header []byte, segments [][]byte) [][]byte {
+				segments[1][100] ^= 1
+				return append([][]byte{header}, segments...)
+			},
+			wantErr: ErrCorrupt,
+		},
+		{
+			name: "modified salt",
+			tamper: func(header []byte, segments [][]byte) [][]byte {
+				header[headerSize-1] ^= 1
+				return append([][]byte{header}, segments...)
+			},
+			wantErr: ErrCorrupt,
+		},
+		{
+			name: "modified key ID",
+			tamper: func(header []byte, segments [][]byte) [][]byte {
+				header[len(Magic)] ^= 1
+				return append([][]byte{header}, segments...)
+			},
+			wantErr: ErrNoKey,
+		},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			header, segments := sealSegments(t, key, data)
+			if len(segments) != 4 {
+				t.Fatalf("expected 4 segments, got %d", len(segments))
+			}
+			sealed := bytes.Join(tt.tamper(header, segments), nil)
+			got, err := Open(Keyring{key}, sealed)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			// Only data that was authenticated is ever returned
+			if !bytes.HasPrefix(data, got) {
+				t.Error("returned data that was not encrypted")
+			}
+		})
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	sealed, err := Seal(testKey(t), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, keys := range map[string]Keyring{
+		"no keys":    nil,
+		"other keys": {testKey(t), testKey(t)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Open(keys, sealed); !errors.Is(err, ErrNoKey) {
+				t.Errorf("expected ErrNoKey from Open, got %v", err)
+			}
+			if _, _, err := MaybeDecrypt(bytes.NewReader(sealed), keys); !errors.Is(err, ErrNoKey) {
+				t.Errorf("expected ErrNoKey from MaybeDecrypt, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMaybeDecrypt(t *testing.T) {
+	key := testKey(t)
+	sealed, err := Seal(key, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := []struct {
+		name          string
+		data          []byte
+		want          string
+		wantEncrypted bool
+	}{
+		{"encrypted", sealed, "secret", true},
+		{"plain", []byte("plain data"), "plain data", false},
+		{"shorter than the magic", []byte("BTR"), "BTR", false},
+		{"empty", nil, "", false},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			r, encrypted, err := MaybeDecrypt(bytes.NewReader(tt.data), Keyring{key})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encrypted != tt.wantEncrypted {
+				t.Errorf("expected encrypted to be %t", tt.wantEncrypted)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package filecache provides a cache of open file descriptors for receivers that write
+// to a local filesystem. A send stream usually writes a file in many small chunks, and
+// keeping the file open between them avoids an open and close for every write. Adjacent
+// writes can optionally be coalesced into larger ones, and the files that were written
+// can be synced to disk in one batch when the cache is closed.
+//
+// The cache is keyed by path, so receivers must tell it about renames and removals. It
+// is not safe for concurrent use.
+package filecache
+
+import (
+	"container/list"
+	"os"
+	"strings"
+)
+
+// DefaultMaxOpen is the default number of file descriptors kept open by a cache.
+const DefaultMaxOpen = 64
+
+// Option is a function that configures a Cache.
+type Option func(*Cache)
+
+// WithMaxOpen sets the maximum number of file descriptors kept open. The least recently
+// used file is closed when the limit is reached.
+func WithMaxOpen(n int) Option {
+	return func(c *Cache) {
+		if n > 0 {
+			c.maxOpen = n
+		}
+	}
+}
+
+// WithWriteCoalescing buffers adjacent writes to the same file until they reach the
+// given size, a write is not adjacent to the previous one, or the cache is flushed.
+func WithWriteCoalescing(maxBytes int) Option {
+	return func(c *Cache) {
+		c.coalesce = maxBytes
+	}
+}
+
+// WithSyncOnClose calls fsync on every file written through the cache when the cache
+// is closed.
+func WithSyncOnClose() Option {
+	return func(c *Cache) {
+		c.syncOnClose = true
+	}
+}
+
+// Cache is an LRU cache of files open for writing.
+type Cache struct {
+	maxOpen     int
+	coalesce    int
+	syncOnClose bool
+
+	files map[string]*list.Element
+	lru   *list.List
+	// dirty holds the paths written since the cache was last closed
+	dirty map[string]struct{}
+}
+
+type entry struct {
+	path      string
+	f         *os.File
+	buf       []byte
+	bufOffset int64
+}
+
+// New returns a new file cache.
+func New(opts ...Option) *Cache {
+	c := &Cache{
+		maxOpen: DefaultMaxOpen,
+		files:   make(map[string]*list.Element),
+		lru:     list.New(),
+		dirty:   make(map[string]struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// File returns an open handle for writing to the file at path. Any data buffered for
+// the file is written first. The handle must not be closed by the caller.
+func (c *Cache) File(path string) (*os.File, error) {
+	e, err := c.get(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.flush(); err != nil {
+		return nil, err
+	}
+	c.dirty[path] = struct{}{}
+	return e.f, nil
+}
+
+// WriteAt writes data to the file at path at the given offset.
+func (c *Cache) WriteAt(path string, data []byte, offset int64) error {
+	e, err := c.get(path)
+	if err != nil {
+		return err
+	}
+	c.dirty[path] = struct{}{}
+	if c.coalesce <= 0 {
+		_, err := e.f.WriteAt(data, offset)
+		return err
+	}
+	if len(e.buf) > 0 && e.bufOffset+int64(len(e.buf)) != offset {
+		if err := e.flush(); err != nil {
+			return err
+		}
+	}
+	if len(e.buf) == 0 {
+		e.bufOffset = offset
+	}
+	e.buf = append(e.buf, data...)
+	if len(e.buf) >= c.coalesce {
+		return e.flush()
+	}
+	return nil
+}
+
+// Pending returns true if any writes are buffered.
+func (c *Cache) Pending() bool {
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		if len(el.Value.(*entry).buf) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush writes all buffered data to the open files.
+func (c *Cache) Flush() error {
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		if err := el.Value.(*entry).flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Invalidate flushes and closes any open handles for path and the files beneath it.
+func (c *Cache) Invalidate(path string) error {
+	var firstErr error
+	for p, el := range c.files {
+		if isUnder(p, path) {
+			if err := c.evict(el); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Rename must be called before path is renamed to newPath. Handles for both paths are
+// closed and files pending a sync are tracked under their new path.
+func (c *Cache) Rename(path, newPath string) error {
+	if err := c.Invalidate(path); err != nil {
+		return err
+	}
+	if err := c.Invalidate(newPath); err != nil {
+		return err
+	}
+	c.forget(newPath)
+	var moved []string
+	for p := range c.dirty {
+		if isUnder(p, path) {
+			moved = append(moved, p)
+		}
+	}
+	for _, p := range moved {
+		delete(c.dirty, p)
+		c.dirty[newPath+strings.TrimPrefix(p, path)] = struct{}{}
+	}
+	return nil
+}
+
+// Remove must be called before path is removed. Handles for the path and the files
+// beneath it are closed and they no longer need to be synced.
+func (c *Cache) Remove(path string) error {
+	if err := c.Invalidate(path); err != nil {
+		return err
+	}
+	c.forget(path)
+	return nil
+}
+
+// Close flushes and closes every open file. If the cache was created with WithSyncOnClose,
+// every file written since the last Close is synced to disk first. The cache can be used
+// again after it is closed.
+func (c *Cache) Close() error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	if c.syncOnClose {
+		for path := range c.dirty {
+			if err := c.sync(path); err != nil {
+				return err
+			}
+		}
+	}
+	for el := c.lru.Front(); el != nil; el = c.lru.Front() {
+		if err := c.evict(el); err != nil {
+			return err
+		}
+	}
+	c.dirty = make(map[string]struct{})
+	return nil
+}
+
+func (c *Cache) sync(path string) error {
+	if el, ok := c.files[path]; ok {
+		return el.Value.(*entry).f.Sync()
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func (c *Cache) get(path string) (*entry, error) {
+	if el, ok := c.files[path]; ok {
+		c.lru.MoveToFront(el)
+		return el.Value.(*entry), nil
+	}
+	for c.lru.Len() >= c.maxOpen {
+		if err := c.evict(c.lru.Back()); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	e := &entry{path: path, f: f}
+	c.files[path] = c.lru.PushFront(e)
+	return e, nil
+}
+
+func (c *Cache) evict(el *list.Element) error {
+	e := el.Value.(*entry)
+	c.lru.Remove(el)
+	delete(c.files, e.path)
+	err := e.flush()
+	if cerr := e.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *Cache) forget(path string) {
+	for p := range c.dirty {
+		if isUnder(p, path) {
+			delete(c.dirty, p)
+		}
+	}
+}
+
+func (e *entry) flush() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+	_, err := e.f.WriteAt(e.buf, e.bufOffset)
+	e.buf = e.buf[:0]
+	return err
+}
+
+// isUnder returns true if p is path or a file beneath it.
+func isUnder(p, path string) bool {
+	return p == path || strings.HasPrefix(p, strings.TrimSuffix(path, "/")+"/")
+}
@@ -0,0 +1,459 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package filecache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// createFiles creates empty files with the given names in dir and returns their paths.
+func createFiles(t *testing.T, dir string, names ...string) []string {
+	t.Helper()
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(paths[i]), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(paths[i], nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths
+}
+
+// checkContents fails the test if the file at path does not contain want.
+func checkContents(t *testing.T, path string, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte(want)) {
+		t.Errorf("%s contains %q, want %q", filepath.Base(path), got, want)
+	}
+}
+
+// openFiles returns the base names of the files open in the cache.
+func openFiles(c *Cache) []string {
+	var names []string
+	for p := range c.files {
+		names = append(names, filepath.Base(p))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestEviction(t *testing.T) {
+	tc := []struct {
+		name     string
+		writes   []string
+		wantOpen []string
+	}{
+		{"under the limit", []string{"a", "b"}, []string{"a", "b"}},
+		{"least recently written is closed", []string{"a", "b", "c"}, []string{"b", "c"}},
+		{"writes refresh a file", []string{"a", "b", "a", "c"}, []string{"a", "c"}},
+		{"reopened after eviction", []string{"a", "b", "c", "a"}, []string{"a", "c"}},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			createFiles(t, dir, "a", "b", "c")
+			c := New(WithMaxOpen(2))
+			offsets := make(map[string]int64)
+			for _, name := range tt.writes {
+				if err := c.WriteAt(filepath.Join(dir, name), []byte(name), offsets[name]); err != nil {
+					t.Fatal(err)
+				}
+				offsets[name]++
+			}
+			if got := openFiles(c); fmt.Sprint(got) != fmt.Sprint(tt.wantOpen) {
+				t.Errorf("open files are %v, want %v", got, tt.wantOpen)
+			}
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := openFiles(c); len(got) != 0 {
+				t.Errorf("files still open after close: %v", got)
+			}
+			for name, n := range offsets {
+				checkContents(t, filepath.Join(dir, name), string(bytes.Repeat([]byte(name), int(n))))
+			}
+		})
+	}
+}
+
+func TestEvictionFlushesPendingWrites(t *testing.T) {
+	paths := createFiles(t, t.TempDir(), "a", "b")
+	c := New(WithMaxOpen(1), WithWriteCoalescing(1024))
+	if err := c.WriteAt(paths[0], []byte("hello "), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteAt(paths[0], []byte("world"), 6); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, paths[0], "")
+	if !c.Pending() {
+		t.Fatal("expected coalesced writes to be pending")
+	}
+	// Opening the second file evicts the first, which must write its buffer
+	if err := c.WriteAt(paths[1], []byte("b"), 0); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, paths[0], "hello world")
+	checkContents(t, paths[1], "")
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, paths[1], "b")
+	if c.Pending() {
+		t.Error("writes still pending after close")
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	type write struct {
+		offset int64
+		data   string
+	}
+	tc := []struct {
+		name        string
+		writes      []write
+		wantPending string
+		want        string
+	}{
+		{"adjacent writes are buffered", []write{{0, "ab"}, {2, "cd"}}, "", "abcd"},
+		{"a gap flushes the buffer", []write{{0, "ab"}, {4, "ef"}}, "ab", "ab\x00\x00ef"},
+		{"an overlap flushes the buffer", []write{{0, "abcd"}, {1, "x"}}, "abcd", "axcd"},
+		{"the size limit flushes the buffer", []write{{0, "abcd"}, {4, "efgh"}}, "abcdefgh", "abcdefgh"},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			path := createFiles(t, t.TempDir(), "f")[0]
+			c := New(WithWriteCoalescing(8))
+			for _, w := range tt.writes {
+				if err := c.WriteAt(path, []byte(w.data), w.offset); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkContents(t, path, tt.wantPending)
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+			checkContents(t, path, tt.want)
+		})
+	}
+}
+
+func TestFileFlushesPendingWrites(t *testing.T) {
+	path := createFiles(t, t.TempDir(), "f")[0]
+	c := New(WithWriteCoalescing(1024))
+	if err := c.WriteAt(path, []byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.File(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, path, "data")
+	if err := f.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, path, "da")
+}
+
+func TestRename(t *testing.T) {
+	tc := []struct {
+		name string
+		// from and to are renamed after writing "old" to every file
+		from, to string
+		// write is written to after the rename
+		write    string
+		want     map[string]string
+		wantGone []string
+	}{
+		{
+			name: "file", from: "a", to: "moved", write: "moved",
+			want:     map[string]string{"moved": "new", "b": "old", "dir/c": "old"},
+			wantGone: []string{"a"},
+		},
+		{
+			name: "over a cached file", from: "a", to: "b", write: "b",
+			want:     map[string]string{"b": "new", "dir/c": "old"},
+			wantGone: []string{"a"},
+		},
+		{
+			name: "directory", from: "dir", to: "moved", write: "moved/c",
+			want:     map[string]string{"a": "old", "b": "old", "moved/c": "new"},
+			wantGone: []string{"dir/c"},
+		},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			paths := createFiles(t, dir, "a", "b", "dir/c")
+			c := New(WithWriteCoalescing(1024))
+			for _, path := range paths {
+				if err := c.WriteAt(path, []byte("old"), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			from, to := filepath.Join(dir, tt.from), filepath.Join(dir, tt.to)
+			if err := c.Rename(from, to); err != nil {
+				t.Fatal(err)
+			}
+			for p := range c.files {
+				if isUnder(p, from) || isUnder(p, to) {
+					t.Errorf("%s still open after rename", p)
+				}
+			}
+			if err := os.Rename(from, to); err != nil {
+				t.Fatal(err)
+			}
+			// A stale handle would write the renamed file through its old name
+			if err := c.WriteAt(filepath.Join(dir, tt.write), []byte("new"), 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				checkContents(t, filepath.Join(dir, name), want)
+			}
+			for _, name := range tt.wantGone {
+				if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+					t.Errorf("%s still exists after rename", name)
+				}
+			}
+		})
+	}
+}
+
+func TestRenameTracksDirtyFiles(t *testing.T) {
+	dir := t.TempDir()
+	paths := createFiles(t, dir, "dir/a", "b")
+	c := New(WithSyncOnClose())
+	for _, path := range paths {
+		if err := c.WriteAt(path, []byte("x"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	moved := filepath.Join(dir, "moved")
+	if err := c.Rename(filepath.Join(dir, "dir"), moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "dir"), moved); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{paths[1], filepath.Join(moved, "a")}
+	var got []string
+	for p := range c.dirty {
+		got = append(got, p)
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("dirty files are %v, want %v", got, want)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	tc := []struct {
+		name      string
+		remove    string
+		wantOpen  []string
+		wantDirty int
+	}{
+		{"file", "a", []string{"b", "c"}, 2},
+		{"directory", "dir", []string{"a"}, 1},
+		{"unknown path", "missing", []string{"a", "b", "c"}, 3},
+		{"path sharing a prefix", "di", []string{"a", "b", "c"}, 3},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			paths := createFiles(t, dir, "a", "dir/b", "dir/c")
+			c := New(WithWriteCoalescing(1024), WithSyncOnClose())
+			for _, path := range paths {
+				if err := c.WriteAt(path, []byte("x"), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.Remove(filepath.Join(dir, tt.remove)); err != nil {
+				t.Fatal(err)
+			}
+			if got := openFiles(c); fmt.Sprint(got) != fmt.Sprint(tt.wantOpen) {
+				t.Errorf("open files are %v, want %v", got, tt.wantOpen)
+			}
+			if len(c.dirty) != tt.wantDirty {
+				t.Errorf("%d dirty files, want %d", len(c.dirty), tt.wantDirty)
+			}
+			if err := os.RemoveAll(filepath.Join(dir, tt.remove)); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCloseErrors(t *testing.T) {
+	t.Run("pending write", func(t *testing.T) {
+		path := createFiles(t, t.TempDir(), "f")[0]
+		c := New(WithWriteCoalescing(1024))
+		// The invalid offset is only seen when the buffer is written
+		if err := c.WriteAt(path, []byte("x"), -1); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Close(); err == nil {
+			t.Error("expected an error writing the pending data")
+		}
+	})
+
+	t.Run("sync of a closed file", func(t *testing.T) {
+		dir := t.TempDir()
+		paths := createFiles(t, dir, "dir/a", "b")
+		c := New(WithMaxOpen(1), WithSyncOnClose())
+		for _, path := range paths {
+			if err := c.WriteAt(path, []byte("x"), 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Replace the directory behind the cache's back, so the evicted file can not be
+		// reopened for the sync
+		if err := os.RemoveAll(filepath.Join(dir, "dir")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "dir"), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Close(); err == nil {
+			t.Error("expected an error syncing the file")
+		}
+	})
+
+	t.Run("sync of a removed file", func(t *testing.T) {
+		dir := t.TempDir()
+		paths := createFiles(t, dir, "a", "b")
+		c := New(WithMaxOpen(1), WithSyncOnClose())
+		for _, path := range paths {
+			if err := c.WriteAt(path, []byte("x"), 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Files that no longer exist have nothing to sync
+		if err := os.Remove(paths[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Close(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+}
+
+const (
+	// benchChunk is the size of each write, a typical size of send stream writes
+	benchChunk = 4 * 1024
+	// benchFileSize is the size of each file written
+	benchFileSize = 1024 * 1024
+)
+
+// benchFiles creates n empty files in a temporary directory.
+func benchFiles(b *testing.B, n int) []string {
+	b.Helper()
+	dir := b.TempDir()
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("file%d", i))
+		if err := os.WriteFile(paths[i], nil, 0600); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return paths
+}
+
+// benchWrites writes every file in chunks, interleaving the files like a stream with
+// several files in flight, and calls done once all files are written.
+func benchWrites(b *testing.B, files int, write func(path string, data []byte, offset int64) error, done func() error) {
+	paths := benchFiles(b, files)
+	data := make([]byte, benchChunk)
+	b.SetBytes(int64(files * benchFileSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for offset := int64(0); offset < benchFileSize; offset += benchChunk {
+			for _, path := range paths {
+				if err := write(path, data, offset); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		if err := done(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// openWriteClose is how receivers wrote files before the cache: every write opens and
+// closes the file.
+func openWriteClose(path string, data []byte, offset int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, offset); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func BenchmarkWrite(b *testing.B) {
+	for _, files := range []int{1, 16} {
+		b.Run(fmt.Sprintf("files=%d/open-write-close", files), func(b *testing.B) {
+			benchWrites(b, files, openWriteClose, func() error { return nil })
+		})
+		b.Run(fmt.Sprintf("files=%d/cache", files), func(b *testing.B) {
+			c := New()
+			benchWrites(b, files, c.WriteAt, c.Close)
+		})
+		b.Run(fmt.Sprintf("files=%d/cache-coalescing", files), func(b *testing.B) {
+			c := New(WithWriteCoalescing(256 * 1024))
+			benchWrites(b, files, c.WriteAt, c.Close)
+		})
+		b.Run(fmt.Sprintf("files=%d/cache-sync-on-close", files), func(b *testing.B) {
+			c := New(WithWriteCoalescing(256*1024), WithSyncOnClose())
+			benchWrites(b, files, c.WriteAt, c.Close)
+		})
+		if files > 1 {
+			b.Run(fmt.Sprintf("files=%d/cache-evicting", files), func(b *testing.B) {
+				// Fewer descriptors than files, so files are reopened
+				c := New(WithMaxOpen(files / 2))
+				benchWrites(b, files, c.WriteAt, c.Close)
+			})
+		}
+	}
+}
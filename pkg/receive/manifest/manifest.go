@@ -0,0 +1,462 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package manifest builds a description of the expected result of a send stream and
+// verifies a received subvolume against it.
+//
+// A Recorder is a receiver that does not write anything. It tracks the type, mode,
+// ownership, size, extended attributes, symlink target and content hash of every file
+// touched by the stream. Properties that cannot be known from the stream alone, such as
+// the contents of a file that is partially rewritten by an incremental stream, or data
+// cloned from another file, are left out of the manifest instead of guessed. For full
+// streams the manifest describes the whole subvolume, so unexpected files are reported
+// as well.
+package manifest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+)
+
+// FileType is the type of a file in the manifest.
+type FileType uint32
+
+// File types tracked by the manifest.
+const (
+	TypeUnknown FileType = 0
+	TypeRegular FileType = syscall.S_IFREG
+	TypeDir     FileType = syscall.S_IFDIR
+	TypeSymlink FileType = syscall.S_IFLNK
+	TypeFifo    FileType = syscall.S_IFIFO
+	TypeSocket  FileType = syscall.S_IFSOCK
+	TypeChar    FileType = syscall.S_IFCHR
+	TypeBlock   FileType = syscall.S_IFBLK
+)
+
+func (t FileType) String() string {
+	switch t {
+	case TypeRegular:
+		return "file"
+	case TypeDir:
+		return "directory"
+	case TypeSymlink:
+		return "symlink"
+	case TypeFifo:
+		return "fifo"
+	case TypeSocket:
+		return "socket"
+	case TypeChar:
+		return "character device"
+	case TypeBlock:
+		return "block device"
+	default:
+		return "unknown"
+	}
+}
+
+// Entry is the expected state of a single inode. Hardlinks share the same entry.
+type Entry struct {
+	Type FileType
+	// Mode holds the permission bits if HasMode is true
+	Mode    uint32
+	HasMode bool
+	// UID and GID are the expected owner if HasOwner is true
+	UID, GID uint64
+	HasOwner bool
+	// Size is the expected size of a regular file if HasSize is true
+	Size    uint64
+	HasSize bool
+	// Rdev is the expected device number of a device node
+	Rdev uint64
+	// LinkTarget is the target of a symlink
+	LinkTarget string
+	// Xattrs holds the expected extended attributes. A nil value means the
+	// attribute was removed.
+	Xattrs map[string][]byte
+
+	// hash covers the first hashed bytes of the file while the contents are known
+	hash   hash.Hash
+	hashed uint64
+}
+
+// HasContent returns true if the full contents of the file are known.
+func (e *Entry) HasContent() bool {
+	return e.hash != nil && e.HasSize && e.hashed <= e.Size
+}
+
+// Sum returns the SHA-256 of the file contents, or nil if they are not known.
+func (e *Entry) Sum() []byte {
+	if !e.HasContent() {
+		return nil
+	}
+	if e.hashed == e.Size {
+		return e.hash.Sum(nil)
+	}
+	// The file was extended past the last write, hash the trailing zeroes on a copy
+	state, err := e.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil
+	}
+	io.CopyN(h, zeroReader{}, int64(e.Size-e.hashed))
+	return h.Sum(nil)
+}
+
+// Manifest is the expected state of a received subvolume.
+type Manifest struct {
+	// Complete is true if the manifest was built from a full stream and
+	// describes every file in the subvolume.
+	Complete bool
+	// Entries maps paths relative to the subvolume to their expected state.
+	// The root of the subvolume has an empty path.
+	Entries map[string]*Entry
+	// Removed holds paths that must not exist after the receive.
+	Removed map[string]struct{}
+}
+
+// New returns an empty manifest.
+func New(complete bool) *Manifest {
+	m := &Manifest{
+		Complete: complete,
+		Entries:  make(map[string]*Entry),
+		Removed:  make(map[string]struct{}),
+	}
+	if complete {
+		m.Entries[""] = &Entry{Type: TypeDir}
+	}
+	return m
+}
+
+// entry returns the entry for path, creating one with unknown properties if the
+// path was not created by the stream.
+func (m *Manifest) entry(path string) *Entry {
+	if e, ok := m.Entries[path]; ok {
+		return e
+	}
+	e := &Entry{}
+	m.Entries[path] = e
+	delete(m.Removed, path)
+	return e
+}
+
+func (m *Manifest) create(path string, e *Entry) {
+	if e.Type == TypeRegular {
+		e.hash = sha256.New()
+		e.HasSize = true
+	}
+	m.Entries[path] = e
+	delete(m.Removed, path)
+}
+
+// link adds path as another name for e.
+func (m *Manifest) link(path string, e *Entry) {
+	m.Entries[path] = e
+	delete(m.Removed, path)
+}
+
+func (m *Manifest) rename(oldPath, newPath string) {
+	m.remove(newPath)
+	if _, ok := m.Entries[oldPath]; !ok {
+		// Renaming a file from the parent, only its existence is known
+		m.Entries[oldPath] = &Entry{}
+	}
+	moved := make(map[string]*Entry)
+	for p, e := range m.Entries {
+		if isUnder(p, oldPath) {
+			delete(m.Entries, p)
+			moved[newPath+strings.TrimPrefix(p, oldPath)] = e
+		}
+	}
+	for p, e := range moved {
+		m.Entries[p] = e
+	}
+	for p := range m.Removed {
+		if isUnder(p, newPath) {
+			delete(m.Removed, p)
+		}
+	}
+	if !m.Complete {
+		m.Removed[oldPath] = struct{}{}
+	}
+}
+
+func (m *Manifest) remove(path string) {
+	for p := range m.Entries {
+		if isUnder(p, path) {
+			delete(m.Entries, p)
+		}
+	}
+	if !m.Complete {
+		m.Removed[path] = struct{}{}
+	}
+}
+
+// write records data written to the file at path at the given offset.
+func (e *Entry) write(offset uint64, data []byte) {
+	end := offset + uint64(len(data))
+	if e.HasSize && end > e.Size {
+		e.Size = end
+	}
+	if e.hash == nil {
+		return
+	}
+	if offset > e.hashed {
+		// A hole, which reads back as zeroes
+		e.zeroFill(offset)
+	}
+	if offset != e.hashed {
+		// Rewriting data that was already hashed
+		e.hash = nil
+		return
+	}
+	e.hash.Write(data)
+	e.hashed = end
+}
+
+// truncate records a change in the size of the file.
+func (e *Entry) truncate(size uint64) {
+	if e.hash != nil && size < e.hashed {
+		e.hash = nil
+	}
+	e.Size = size
+	e.HasSize = true
+}
+
+// forgetContent marks the contents of the file as unknown.
+func (e *Entry) forgetContent() {
+	e.hash = nil
+}
+
+// forgetSize marks the size and contents of the file as unknown.
+func (e *Entry) forgetSize() {
+	e.hash = nil
+	e.HasSize = false
+}
+
+func (e *Entry) zeroFill(offset uint64) {
+	io.CopyN(e.hash, zeroReader{}, int64(offset-e.hashed))
+	e.hashed = offset
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// MismatchError is returned when a received subvolume does not match its manifest.
+type MismatchError struct {
+	Path       string
+	Mismatches []string
+}
+
+func (e *MismatchError) Error() string {
+	const maxShown = 10
+	shown := e.Mismatches
+	var more string
+	if len(shown) > maxShown {
+		more = fmt.Sprintf(" (and %d more)", len(shown)-maxShown)
+		shown = shown[:maxShown]
+	}
+	return fmt.Sprintf("%q does not match the received stream: %s%s", e.Path, strings.Join(shown, "; "), more)
+}
+
+// Unwrap allows the error to match receivers.ErrVerificationFailed.
+func (e *MismatchError) Unwrap() error { return receivers.ErrVerificationFailed }
+
+// Verify compares the subvolume at root against the manifest. A *MismatchError is
+// returned describing every difference found.
+func (m *Manifest) Verify(root string) error {
+	var mismatches []string
+	report := func(path, format string, args ...any) {
+		if path == "" {
+			path = "/"
+		}
+		mismatches = append(mismatches, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	paths := make([]string, 0, len(m.Entries))
+	for p := range m.Entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if err := verifyEntry(filepath.Join(root, p), m.Entries[p], func(format string, args ...any) {
+			report(p, format, args...)
+		}); err != nil {
+			return err
+		}
+	}
+
+	for p := range m.Removed {
+		if _, err := os.Lstat(filepath.Join(root, p)); err == nil {
+			report(p, "should have been removed")
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if m.Complete {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			if rel == "." {
+				rel = ""
+			}
+			if _, ok := m.Entries[rel]; !ok {
+				report(rel, "not present in the stream")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return &MismatchError{Path: root, Mismatches: mismatches}
+	}
+	return nil
+}
+
+func verifyEntry(path string, e *Entry, report func(format string, args ...any)) error {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		if err == syscall.ENOENT {
+			report("missing")
+			return nil
+		}
+		return &fs.PathError{Op: "lstat", Path: path, Err: err}
+	}
+	typ := FileType(st.Mode & syscall.S_IFMT)
+	if e.Type != TypeUnknown && typ != e.Type {
+		report("expected a %s, found a %s", e.Type, typ)
+		return nil
+	}
+	if e.HasMode && st.Mode&07777 != e.Mode&07777 {
+		report("expected mode %o, found %o", e.Mode&07777, st.Mode&07777)
+	}
+	if e.HasOwner && (uint64(st.Uid) != e.UID || uint64(st.Gid) != e.GID) {
+		report("expected owner %d:%d, found %d:%d", e.UID, e.GID, st.Uid, st.Gid)
+	}
+	switch typ {
+	case TypeRegular:
+		if e.HasSize && uint64(st.Size) != e.Size {
+			report("expected size %d, found %d", e.Size, st.Size)
+		} else if sum := e.Sum(); sum != nil {
+			actual, err := hashFile(path)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(actual, sum) {
+				report("expected sha256 %x, found %x", sum, actual)
+			}
+		}
+	case TypeSymlink:
+		if e.Type == TypeSymlink {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if target != e.LinkTarget {
+				report("expected link to %q, found %q", e.LinkTarget, target)
+			}
+		}
+	case TypeChar, TypeBlock:
+		if e.Type != TypeUnknown && uint64(st.Rdev) != e.Rdev {
+			report("expected device %d, found %d", e.Rdev, st.Rdev)
+		}
+	}
+	for name, expected := range e.Xattrs {
+		actual, err := getXattr(path, name)
+		if err != nil {
+			return err
+		}
+		switch {
+		case expected == nil && actual != nil:
+			report("xattr %q should have been removed", name)
+		case expected != nil && actual == nil:
+			report("missing xattr %q", name)
+		case !bytes.Equal(expected, actual):
+			report("xattr %q does not match", name)
+		}
+	}
+	return nil
+}
+
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// getXattr returns the value of the attribute, or nil if it is not set.
+func getXattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		if err == unix.ENODATA {
+			return nil, nil
+		}
+		return nil, &fs.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	value := make([]byte, size)
+	if size > 0 {
+		if size, err = unix.Lgetxattr(path, name, value); err != nil {
+			return nil, &fs.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+	}
+	return value[:size], nil
+}
+
+// isUnder returns true if p is path or a file beneath it.
+func isUnder(p, path string) bool {
+	if path == "" {
+		return true
+	}
+	return p == path || strings.HasPrefix(p, path+"/")
+}
@@ -0,0 +1,254 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package manifest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
+
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/receivertest"
+	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+)
+
+const testXattr = "user.btrsync.test"
+
+// supportsXattrs returns true if the filesystem of dir supports user xattrs.
+func supportsXattrs(t *testing.T, dir string) bool {
+	t.Helper()
+	path := filepath.Join(dir, "probe")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	return unix.Lsetxattr(path, testXattr, []byte("probe"), 0) == nil
+}
+
+// recordManifest records the manifest of a full stream creating a small tree, and
+// creates the same tree under root.
+func recordManifest(t *testing.T, root string, xattrs bool) *Manifest {
+	t.Helper()
+	stream := receivertest.NewStream(t).
+		Cmd(sendstream.NewSubvolCommand("root", uuid.New(), 1)).
+		Cmd(sendstream.NewMkdirCommand("o257-1-0", 257)).
+		Cmd(sendstream.NewRenameCommand("o257-1-0", "dir")).
+		Cmd(sendstream.NewChmodCommand("dir", 0755)).
+		Cmd(sendstream.NewMkfileCommand("dir/file", 258)).
+		Cmd(sendstream.NewWriteCommand("dir/file", 0, []byte("hello "))).
+		Cmd(sendstream.NewWriteCommand("dir/file", 6, []byte("world"))).
+		Cmd(sendstream.NewChmodCommand("dir/file", 0640)).
+		Cmd(sendstream.NewMkfileCommand("sparse", 259)).
+		Cmd(sendstream.NewWriteCommand("sparse", 4, []byte("data"))).
+		Cmd(sendstream.NewTruncateCommand("sparse", 16)).
+		Cmd(sendstream.NewSymlinkCommand("link", "dir/file", 260)).
+		Cmd(sendstream.NewMkfileCommand("removed", 261)).
+		Cmd(sendstream.NewUnlinkCommand("removed"))
+	if xattrs {
+		stream.Cmd(sendstream.NewSetXattrCommand("dir/file", testXattr, []byte("value")))
+	}
+	recorder := NewRecorder()
+	if err := receivertest.Receive(stream.End(), recorder); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(root, "dir", "file")
+	if err := os.WriteFile(file, []byte("hello world"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	sparse := append(append(make([]byte, 4), "data"...), make([]byte, 8)...)
+	if err := os.WriteFile(filepath.Join(root, "sparse"), sparse, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	// The umask may have dropped bits
+	for path, mode := range map[string]os.FileMode{"dir": 0755, "dir/file": 0640} {
+		if err := os.Chmod(filepath.Join(root, path), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if xattrs {
+		if err := unix.Lsetxattr(file, testXattr, []byte("value"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return recorder.Manifest()
+}
+
+func TestVerify(t *testing.T) {
+	tc := []struct {
+		name   string
+		xattrs bool
+		// damage changes the received tree under root
+		damage func(t *testing.T, root string) error
+		// want are the expected mismatches, or nil if the tree matches
+		want []string
+	}{
+		{
+			name:   "matching",
+			damage: func(t *testing.T, root string) error { return nil },
+		},
+		{
+			name: "tampered file",
+			damage: func(t *testing.T, root string) error {
+				return os.WriteFile(filepath.Join(root, "dir/file"), []byte("HELLO WORLD"), 0640)
+			},
+			want: []string{"dir/file: expected sha256"},
+		},
+		{
+			name: "truncated file",
+			damage: func(t *testing.T, root string) error {
+				return os.Truncate(filepath.Join(root, "sparse"), 8)
+			},
+			want: []string{"sparse: expected size 16, found 8"},
+		},
+		{
+			name: "missing file",
+			damage: func(t *testing.T, root string) error {
+				return os.Remove(filepath.Join(root, "dir/file"))
+			},
+			want: []string{"dir/file: missing"},
+		},
+		{
+			name: "unexpected file",
+			damage: func(t *testing.T, root string) error {
+				return os.WriteFile(filepath.Join(root, "removed"), nil, 0644)
+			},
+			want: []string{"removed: not present in the stream"},
+		},
+		{
+			name: "wrong mode",
+			damage: func(t *testing.T, root string) error {
+				return os.Chmod(filepath.Join(root, "dir"), 0700)
+			},
+			want: []string{"dir: expected mode 755, found 700"},
+		},
+		{
+			name: "wrong type",
+			damage: func(t *testing.T, root string) error {
+				if err := os.Remove(filepath.Join(root, "link")); err != nil {
+					return err
+				}
+				return os.WriteFile(filepath.Join(root, "link"), []byte("dir/file"), 0644)
+			},
+			want: []string{"link: expected a symlink, found a file"},
+		},
+		{
+			name: "wrong symlink target",
+			damage: func(t *testing.T, root string) error {
+				if err := os.Remove(filepath.Join(root, "link")); err != nil {
+					return err
+				}
+				return os.Symlink("dir", filepath.Join(root, "link"))
+			},
+			want: []string{`link: expected link to "dir/file", found "dir"`},
+		},
+		{
+			name:   "wrong xattr",
+			xattrs: true,
+			damage: func(t *testing.T, root string) error {
+				return unix.Lsetxattr(filepath.Join(root, "dir/file"), testXattr, []byte("other"), 0)
+			},
+			want: []string{`dir/file: xattr "user.btrsync.test" does not match`},
+		},
+		{
+			name:   "missing xattr",
+			xattrs: true,
+			damage: func(t *testing.T, root string) error {
+				return unix.Lremovexattr(filepath.Join(root, "dir/file"), testXattr)
+			},
+			want: []string{`dir/file: missing xattr "user.btrsync.test"`},
+		},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if tt.xattrs && !supportsXattrs(t, root) {
+				t.Skip("user xattrs are not supported by the filesystem")
+			}
+			m := recordManifest(t, root, tt.xattrs)
+			if err := tt.damage(t, root); err != nil {
+				t.Fatal(err)
+			}
+			err := m.Verify(root)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("expected the tree to match, got %v", err)
+				}
+				return
+			}
+			var mismatch *MismatchError
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("expected a MismatchError, got %v", err)
+			}
+			if !errors.Is(err, receivers.ErrVerificationFailed) {
+				t.Error("expected the error to match ErrVerificationFailed")
+			}
+			if len(mismatch.Mismatches) != len(tt.want) {
+				t.Errorf("expected %d mismatches, got %q", len(tt.want), mismatch.Mismatches)
+			}
+			for _, want := range tt.want {
+				var found bool
+				for _, got := range mismatch.Mismatches {
+					found = found || strings.HasPrefix(got, want)
+				}
+				if !found {
+					t.Errorf("expected a mismatch starting with %q, got %q", want, mismatch.Mismatches)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyIncremental(t *testing.T) {
+	// An incremental manifest only describes what the stream changed
+	root := t.TempDir()
+	stream := receivertest.NewStream(t).
+		Cmd(sendstream.NewSnapshotCommand("root", uuid.New(), 2, uuid.New(), 1)).
+		Cmd(sendstream.NewWriteCommand("existing", 0, []byte("new"))).
+		Cmd(sendstream.NewUnlinkCommand("removed"))
+	recorder := NewRecorder()
+	if err := receivertest.Receive(stream.End(), recorder); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{"existing": "new and old", "untouched": "data"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recorder.Verify(root); err != nil {
+		t.Fatalf("expected files unknown to the stream to be ignored, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "removed"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var mismatch *MismatchError
+	if err := recorder.Verify(root); !errors.As(err, &mismatch) || len(mismatch.Mismatches) != 1 ||
+		mismatch.Mismatches[0] != "removed: should have been removed" {
+		t.Errorf("expected the unlinked file to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package manifest
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+)
+
+// Recorder is a receiver that builds a manifest of the subvolume being received.
+// It is meant to be placed in front of the receiver doing the actual work, for example
+// with a dispatcher, so that the manifest is complete by the time that receiver
+// finishes the subvolume.
+type Recorder struct {
+	manifest *Manifest
+}
+
+// NewRecorder returns a new manifest recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{manifest: New(false)}
+}
+
+// Manifest returns the manifest of the current subvolume.
+func (r *Recorder) Manifest() *Manifest { return r.manifest }
+
+// Verify compares the subvolume at root against the manifest of the current subvolume.
+func (r *Recorder) Verify(root string) error { return r.manifest.Verify(root) }
+
+func (r *Recorder) Subvol(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64) error {
+	r.manifest = New(true)
+	return nil
+}
+
+func (r *Recorder) Snapshot(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64, cloneUUID uuid.UUID, cloneCtransid uint64) error {
+	r.manifest = New(false)
+	return nil
+}
+
+func (r *Recorder) Mkfile(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	r.manifest.create(path, &Entry{Type: TypeRegular})
+	return nil
+}
+
+func (r *Recorder) Mkdir(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	r.manifest.create(path, &Entry{Type: TypeDir})
+	return nil
+}
+
+func (r *Recorder) Mknod(ctx receivers.ReceiveContext, path string, ino uint64, mode uint32, rdev uint64) error {
+	r.manifest.create(path, &Entry{Type: FileType(mode & unix.S_IFMT), Rdev: rdev})
+	return nil
+}
+
+func (r *Recorder) Mkfifo(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	r.manifest.create(path, &Entry{Type: TypeFifo})
+	return nil
+}
+
+func (r *Recorder) Mksock(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	r.manifest.create(path, &Entry{Type: TypeSocket})
+	return nil
+}
+
+func (r *Recorder) Symlink(ctx receivers.ReceiveContext, path string, ino uint64, linkTo string) error {
+	r.manifest.create(path, &Entry{Type: TypeSymlink, LinkTarget: linkTo})
+	return nil
+}
+
+func (r *Recorder) Rename(ctx receivers.ReceiveContext, oldPath string, newPath string) error {
+	r.manifest.rename(oldPath, newPath)
+	return nil
+}
+
+func (r *Recorder) Link(ctx receivers.ReceiveContext, path string, linkTo string) error {
+	r.manifest.link(path, r.manifest.entry(linkTo))
+	return nil
+}
+
+func (r *Recorder) Unlink(ctx receivers.ReceiveContext, path string) error {
+	r.manifest.remove(path)
+	return nil
+}
+
+func (r *Recorder) Rmdir(ctx receivers.ReceiveContext, path string) error {
+	r.manifest.remove(path)
+	return nil
+}
+
+func (r *Recorder) Write(ctx receivers.ReceiveContext, path string, offset uint64, data []byte) error {
+	r.manifest.entry(path).write(offset, data)
+	return nil
+}
+
+func (r *Recorder) EncodedWrite(ctx receivers.ReceiveContext, path string, op *btrfs.EncodedWriteOp) error {
+	e := r.manifest.entry(path)
+	data, err := op.Decompress()
+	if err != nil || op.UnencodedOffset+op.UnencodedFileLength > uint64(len(data)) {
+		// The receiver doing the work will report the error, only the
+		// manifest needs to stop trusting the contents.
+		e.forgetSize()
+		return nil
+	}
+	e.write(op.Offset, data[op.UnencodedOffset:op.UnencodedOffset+op.UnencodedFileLength])
+	return nil
+}
+
+func (r *Recorder) Clone(ctx receivers.ReceiveContext, path string, offset uint64, len uint64, cloneUUID uuid.UUID, cloneCtransid uint64, clonePath string, cloneOffset uint64) error {
+	e := r.manifest.entry(path)
+	e.forgetContent()
+	if e.HasSize && offset+len > e.Size {
+		e.Size = offset + len
+	}
+	return nil
+}
+
+func (r *Recorder) SetXattr(ctx receivers.ReceiveContext, path string, name string, data []byte) error {
+	e := r.manifest.entry(path)
+	if e.Xattrs == nil {
+		e.Xattrs = make(map[string][]byte)
+	}
+	e.Xattrs[name] = append([]byte{}, data...)
+	return nil
+}
+
+func (r *Recorder) RemoveXattr(ctx receivers.ReceiveContext, path string, name string) error {
+	e := r.manifest.entry(path)
+	if e.Xattrs == nil {
+		e.Xattrs = make(map[string][]byte)
+	}
+	e.Xattrs[name] = nil
+	return nil
+}
+
+func (r *Recorder) Truncate(ctx receivers.ReceiveContext, path string, size uint64) error {
+	r.manifest.entry(path).truncate(size)
+	return nil
+}
+
+func (r *Recorder) Chmod(ctx receivers.ReceiveContext, path string, mode uint64) error {
+	e := r.manifest.entry(path)
+	e.Mode = uint32(mode)
+	e.HasMode = true
+	return nil
+}
+
+func (r *Recorder) Chown(ctx receivers.ReceiveContext, path string, uid uint64, gid uint64) error {
+	e := r.manifest.entry(path)
+	e.UID, e.GID = uid, gid
+	e.HasOwner = true
+	return nil
+}
+
+func (r *Recorder) Utimes(ctx receivers.ReceiveContext, path string, atime, mtime, ctime time.Time) error {
+	return nil
+}
+
+func (r *Recorder) UpdateExtent(ctx receivers.ReceiveContext, path string, fileOffset uint64, tmpSize uint64) error {
+	r.manifest.entry(path).forgetContent()
+	return nil
+}
+
+func (r *Recorder) EnableVerity(ctx receivers.ReceiveContext, path string, algorithm uint8, blockSize uint32, salt []byte, sig []byte) error {
+	return nil
+}
+
+func (r *Recorder) Fallocate(ctx receivers.ReceiveContext, path string, mode uint32, offset uint64, len uint64) error {
+	e := r.manifest.entry(path)
+	switch {
+	case mode == 0:
+		// Plain allocations read back as zeroes and may only extend the file
+		if e.HasSize && offset+len > e.Size {
+			e.Size = offset + len
+		}
+	case mode&unix.FALLOC_FL_KEEP_SIZE != 0:
+		e.forgetContent()
+	default:
+		e.forgetSize()
+	}
+	return nil
+}
+
+func (r *Recorder) Fileattr(ctx receivers.ReceiveContext, path string, attr uint32) error {
+	return nil
+}
+
+func (r *Recorder) FinishSubvolume(ctx receivers.ReceiveContext) error {
+	return nil
+}
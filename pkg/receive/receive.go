@@ -114,8 +114,8 @@ func ProcessSendStream(r io.Reader, opts ...Option) error {
 			if cmd.Cmd == sendstream.BTRFS_SEND_C_END {
 				if ctx.honorEndCmd {
 					if ctx.currentSubvolInfo != nil {
-						if err := ctx.receiver.FinishSubvolume(ctx); err != nil {
-							ctx.log.Printf("Error finishing subvolume: %s", err)
+						if err := finishSubvolume(ctx); err != nil {
+							errCh <- err
 						}
 					}
 					return
@@ -160,8 +160,8 @@ func ProcessSendStream(r io.Reader, opts ...Option) error {
 		}
 
 		if ctx.currentSubvolInfo != nil {
-			if err := ctx.receiver.FinishSubvolume(ctx); err != nil {
-				ctx.log.Printf("Error finishing subvolume: %s", err)
+			if err := finishSubvolume(ctx); err != nil {
+				errCh <- err
 			}
 		}
 	}()
@@ -178,3 +178,17 @@ func ProcessSendStream(r io.Reader, opts ...Option) error {
 	}
 	return nil
 }
+
+// finishSubvolume finishes the subvolume received when the stream ends. A subvolume
+// that failed verification fails the receive, since it must not be mistaken for a
+// complete copy. Other errors are only logged.
+func finishSubvolume(ctx *receiveCtx) error {
+	err := ctx.receiver.FinishSubvolume(ctx)
+	if errors.Is(err, receivers.ErrVerificationFailed) {
+		return fmt.Errorf("error finishing subvolume: %w", err)
+	}
+	if err != nil {
+		ctx.log.Printf("Error finishing subvolume: %s", err)
+	}
+	return nil
+}
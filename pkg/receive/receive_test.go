@@ -0,0 +1,87 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package receive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/nop"
+	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+)
+
+// finishReceiver fails to finish subvolumes with err.
+type finishReceiver struct {
+	receivers.Receiver
+	err      error
+	finished int
+}
+
+func (r *finishReceiver) FinishSubvolume(ctx receivers.ReceiveContext) error {
+	r.finished++
+	return r.err
+}
+
+func TestFinishSubvolumeErrors(t *testing.T) {
+	errFinish := errors.New("finish failed")
+	errMismatch := fmt.Errorf("mismatch: %w", receivers.ErrVerificationFailed)
+	tc := []struct {
+		name      string
+		finishErr error
+		opts      []Option
+		wantErr   error
+	}{
+		{"finished", nil, []Option{HonorEndCommand()}, nil},
+		{"failed verification", errMismatch, []Option{HonorEndCommand()}, receivers.ErrVerificationFailed},
+		// Only verification failures fail the stream once it ended
+		{"other error", errFinish, []Option{HonorEndCommand()}, nil},
+		// Without honoring the end command, it is handled like any other command
+		{"failed verification without end", errMismatch, nil, receivers.ErrVerificationFailed},
+		{"other error without end", errFinish, nil, errFinish},
+		{"other error within max errors", errFinish, []Option{WithMaxErrors(2)}, nil},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			w := sendstream.NewWriter(&stream)
+			if err := w.WriteCommand(sendstream.NewSubvolCommand("root", uuid.New(), 1)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.WriteCommand(sendstream.NewMkfileCommand("file", 257)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.End(); err != nil {
+				t.Fatal(err)
+			}
+			rcvr := &finishReceiver{Receiver: nop.New(), err: tt.finishErr}
+			err := ProcessSendStream(&stream, append(tt.opts, To(rcvr))...)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if rcvr.finished != 1 {
+				t.Errorf("expected the subvolume to be finished once, got %d", rcvr.finished)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package catalog implements a receiver that indexes the files of every received
+// snapshot in an embedded database, without storing any of their data. The catalog
+// can then answer which snapshots contain a path and when it changed without
+// mounting or receiving anything.
+//
+// Full streams catalog a snapshot from scratch, and incremental streams start from a
+// copy of the catalog of their parent, which must have been received first. Streams
+// sent without file data are supported, in which case content hashes of changed files
+// are left empty.
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// FileExtension is the extension given to catalog databases.
+const FileExtension = ".catalog"
+
+// ErrSnapshotNotFound is returned when a snapshot is not in the catalog.
+var ErrSnapshotNotFound = errors.New("snapshot not found in catalog")
+
+var (
+	snapshotsBucket = []byte("snapshots")
+	filesBucket     = []byte("files")
+)
+
+// SnapshotInfo describes a snapshot in the catalog.
+type SnapshotInfo struct {
+	UUID        uuid.UUID `json:"uuid"`
+	ParentUUID  uuid.UUID `json:"parentUUID,omitempty"`
+	Name        string    `json:"name"`
+	Ctransid    uint64    `json:"ctransid"`
+	CatalogedAt time.Time `json:"catalogedAt"`
+	// CreationTime is the time the snapshot was taken, if it was known when it
+	// was cataloged
+	CreationTime time.Time `json:"creationTime,omitempty"`
+	// Files is the number of paths in the snapshot
+	Files int `json:"files"`
+}
+
+// FileInfo describes a path in a snapshot.
+type FileInfo struct {
+	// Path is the absolute path of the file inside the snapshot
+	Path       string      `json:"path"`
+	Mode       fs.FileMode `json:"mode"`
+	Size       uint64      `json:"size"`
+	UID        uint64      `json:"uid"`
+	GID        uint64      `json:"gid"`
+	ModTime    time.Time   `json:"mtime"`
+	LinkTarget string      `json:"linkTarget,omitempty"`
+	Rdev       uint64      `json:"rdev,omitempty"`
+	// Hash is the hex encoded SHA-256 of the contents, if it was computed
+	Hash string `json:"sha256,omitempty"`
+}
+
+// IsDir returns true if the file is a directory.
+func (f *FileInfo) IsDir() bool { return f.Mode.IsDir() }
+
+// Equal returns true if both describe the same file metadata and contents. Content
+// is only compared when both sides have a hash.
+func (f *FileInfo) Equal(o *FileInfo) bool {
+	if f.Mode != o.Mode || f.Size != o.Size || f.UID != o.UID || f.GID != o.GID ||
+		!f.ModTime.Equal(o.ModTime) || f.LinkTarget != o.LinkTarget || f.Rdev != o.Rdev {
+		return false
+	}
+	if f.Hash != "" && o.Hash != "" {
+		return f.Hash == o.Hash
+	}
+	return true
+}
+
+// Catalog is an embedded database of snapshots and the files they contain.
+type Catalog struct {
+	db *bolt.DB
+}
+
+// Open opens the catalog database at the given path, creating it if it does not exist.
+// Only one process may have a catalog open at a time.
+func Open(dbPath string) (*Catalog, error) {
+	db, err := bolt.Open(dbPath, 0644, &bolt.Options{Timeout: time.Minute})
+	if err != nil {
+		return nil, fmt.Errorf("error opening catalog %q: %w", dbPath, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{snapshotsBucket, filesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Catalog{db: db}, nil
+}
+
+// Close closes the catalog database.
+func (c *Catalog) Close() error { return c.db.Close() }
+
+// Snapshots returns every snapshot in the catalog, oldest first.
+func (c *Catalog) Snapshots() ([]*SnapshotInfo, error) {
+	var snaps []*SnapshotInfo
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(snapshotsBucket).ForEach(func(k, v []byte) error {
+			var info SnapshotInfo
+			if err := json.Unmarshal(v, &info); err != nil {
+				return err
+			}
+			snaps = append(snaps, &info)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Ctransid < snaps[j].Ctransid
+	})
+	return snaps, nil
+}
+
+// Snapshot returns the snapshot with the given UUID, or ErrSnapshotNotFound.
+func (c *Catalog) Snapshot(snapUUID uuid.UUID) (*SnapshotInfo, error) {
+	var info *SnapshotInfo
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		info, err = getSnapshot(tx, snapUUID)
+		return err
+	})
+	return info, err
+}
+
+// Lookup returns the file at the given path in a snapshot, or nil if the snapshot
+// does not contain it.
+func (c *Catalog) Lookup(snapUUID uuid.UUID, filePath string) (*FileInfo, error) {
+	var info *FileInfo
+	err := c.db.View(func(tx *bolt.Tx) error {
+		files, err := snapshotFiles(tx, snapUUID)
+		if err != nil {
+			return err
+		}
+		info, err = getFile(files, CleanPath(filePath))
+		return err
+	})
+	return info, err
+}
+
+// Walk calls fn for every file in a snapshot in lexical order.
+func (c *Catalog) Walk(snapUUID uuid.UUID, fn func(*FileInfo) error) error {
+	return c.db.View(func(tx *bolt.Tx) error {
+		files, err := snapshotFiles(tx, snapUUID)
+		if err != nil {
+			return err
+		}
+		return files.ForEach(func(k, v []byte) error {
+			info, err := decodeFile(v)
+			if err != nil {
+				return err
+			}
+			return fn(info)
+		})
+	})
+}
+
+// DeleteSnapshot removes a snapshot and its files from the catalog.
+func (c *Catalog) DeleteSnapshot(snapUUID uuid.UUID) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return deleteSnapshot(tx, snapUUID)
+	})
+}
+
+// ChangeKind describes how a file changed from one snapshot to the next.
+type ChangeKind string
+
+const (
+	// ChangeAdded means the file appeared in the snapshot.
+	ChangeAdded ChangeKind = "added"
+	// ChangeModified means the metadata or contents of the file changed.
+	ChangeModified ChangeKind = "modified"
+	// ChangeRemoved means the file no longer exists in the snapshot.
+	ChangeRemoved ChangeKind = "removed"
+	// ChangeNone means the file is unchanged from the previous snapshot.
+	ChangeNone ChangeKind = "unchanged"
+)
+
+// Version is the state of a path in a single snapshot.
+type Version struct {
+	Snapshot *SnapshotInfo `json:"snapshot"`
+	// File is nil when the change is ChangeRemoved
+	File   *FileInfo  `json:"file,omitempty"`
+	Change ChangeKind `json:"change"`
+}
+
+// History returns the state of a path in every snapshot that contains it, oldest
+// first. A version with ChangeRemoved is included for each snapshot where the path
+// disappeared.
+func (c *Catalog) History(filePath string) ([]*Version, error) {
+	snaps, err := c.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	filePath = CleanPath(filePath)
+	var versions []*Version
+	var last *FileInfo
+	err = c.db.View(func(tx *bolt.Tx) error {
+		for _, snap := range snaps {
+			files, err := snapshotFiles(tx, snap.UUID)
+			if err != nil {
+				return err
+			}
+			info, err := getFile(files, filePath)
+			if err != nil {
+				return err
+			}
+			switch {
+			case info == nil && last != nil:
+				versions = append(versions, &Version{Snapshot: snap, Change: ChangeRemoved})
+			case info != nil && last == nil:
+				versions = append(versions, &Version{Snapshot: snap, File: info, Change: ChangeAdded})
+			case info != nil && !info.Equal(last):
+				versions = append(versions, &Version{Snapshot: snap, File: info, Change: ChangeModified})
+			case info != nil:
+				versions = append(versions, &Version{Snapshot: snap, File: info, Change: ChangeNone})
+			}
+			last = info
+		}
+		return nil
+	})
+	return versions, err
+}
+
+// CleanPath returns the absolute, cleaned form of a path inside a snapshot, which is
+// how paths are keyed in the catalog.
+func CleanPath(p string) string {
+	return path.Clean("/" + strings.TrimPrefix(p, "/"))
+}
+
+func getSnapshot(tx *bolt.Tx, snapUUID uuid.UUID) (*SnapshotInfo, error) {
+	data := tx.Bucket(snapshotsBucket).Get([]byte(snapUUID.String()))
+	if data == nil {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, snapUUID)
+	}
+	var info SnapshotInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func putSnapshot(tx *bolt.Tx, info *SnapshotInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(snapshotsBucket).Put([]byte(info.UUID.String()), data)
+}
+
+func deleteSnapshot(tx *bolt.Tx, snapUUID uuid.UUID) error {
+	key := []byte(snapUUID.String())
+	if tx.Bucket(filesBucket).Bucket(key) != nil {
+		if err := tx.Bucket(filesBucket).DeleteBucket(key); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(snapshotsBucket).Delete(key)
+}
+
+func snapshotFiles(tx *bolt.Tx, snapUUID uuid.UUID) (*bolt.Bucket, error) {
+	files := tx.Bucket(filesBucket).Bucket([]byte(snapUUID.String()))
+	if files == nil || tx.Bucket(snapshotsBucket).Get([]byte(snapUUID.String())) == nil {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, snapUUID)
+	}
+	return files, nil
+}
+
+func getFile(files *bolt.Bucket, filePath string) (*FileInfo, error) {
+	data := files.Get([]byte(filePath))
+	if data == nil {
+		return nil, nil
+	}
+	return decodeFile(data)
+}
+
+func decodeFile(data []byte) (*FileInfo, error) {
+	var info FileInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func putFile(files *bolt.Bucket, info *FileInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return files.Put([]byte(info.Path), data)
+}
@@ -0,0 +1,309 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package catalog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/receivertest"
+	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+)
+
+func openTestCatalog(t *testing.T) (*Catalog, string) {
+	t.Helper()
+	dbPath := filepath.Join(t.TempDir(), "mirror"+FileExtension)
+	c, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, dbPath
+}
+
+// receiveCatalog catalogs the stream and discards anything left unfinished.
+func receiveCatalog(t *testing.T, c *Catalog, stream *bytes.Buffer, opts ...Option) error {
+	t.Helper()
+	rcvr := New(c, opts...)
+	err := receivertest.Receive(stream, rcvr)
+	if cerr := rcvr.Close(); cerr != nil {
+		t.Fatal(cerr)
+	}
+	return err
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+var mtime = time.Date(2022, 11, 28, 12, 0, 0, 0, time.UTC)
+
+// fullStream creates a subvolume with a directory, files, a symlink and a fifo.
+func fullStream(t *testing.T, snapUUID uuid.UUID) *bytes.Buffer {
+	return receivertest.NewStream(t).
+		Cmd(sendstream.NewSubvolCommand("root.1", snapUUID, 1)).
+		Cmd(sendstream.NewMkdirCommand("o257-1-0", 257)).
+		Cmd(sendstream.NewRenameCommand("o257-1-0", "dir")).
+		Cmd(sendstream.NewMkfileCommand("dir/file", 258)).
+		Cmd(sendstream.NewWriteCommand("dir/file", 0, []byte("hello"))).
+		Cmd(sendstream.NewChmodCommand("dir/file", 0600)).
+		Cmd(sendstream.NewChownCommand("dir/file", 1000, 100)).
+		Cmd(sendstream.NewUtimesCommand("dir/file", mtime, mtime, mtime)).
+		Cmd(sendstream.NewMkfileCommand("sparse", 259)).
+		Cmd(sendstream.NewWriteCommand("sparse", 4, []byte("data"))).
+		Cmd(sendstream.NewTruncateCommand("sparse", 16)).
+		Cmd(sendstream.NewSymlinkCommand("link", "dir/file", 260)).
+		Cmd(sendstream.NewMkfifoCommand("fifo", 261)).
+		End()
+}
+
+// incrementalStream changes the subvolume of fullStream.
+func incrementalStream(t *testing.T, snapUUID, parentUUID uuid.UUID) *bytes.Buffer {
+	return receivertest.NewStream(t).
+		Cmd(sendstream.NewSnapshotCommand("root.2", snapUUID, 2, parentUUID, 1)).
+		Cmd(sendstream.NewRenameCommand("dir", "moved")).
+		Cmd(sendstream.NewWriteCommand("moved/file", 0, []byte("HELLO"))).
+		Cmd(sendstream.NewUnlinkCommand("link")).
+		Cmd(sendstream.NewTruncateCommand("sparse", 8)).
+		Cmd(sendstream.NewMkfileCommand("new", 262)).
+		Cmd(sendstream.NewWriteCommand("new", 0, []byte("new"))).
+		End()
+}
+
+func walkCatalog(t *testing.T, c *Catalog, snapUUID uuid.UUID) map[string]*FileInfo {
+	t.Helper()
+	files := make(map[string]*FileInfo)
+	if err := c.Walk(snapUUID, func(info *FileInfo) error {
+		files[info.Path] = info
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestCatalogFullStream(t *testing.T) {
+	c, _ := openTestCatalog(t)
+	snapUUID := uuid.New()
+	created := time.Now().Add(-time.Hour).UTC()
+	if err := receiveCatalog(t, c, fullStream(t, snapUUID), WithContentHashes(), WithCreationTime(created)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]*FileInfo{
+		"/":         {Path: "/", Mode: fs.ModeDir},
+		"/dir":      {Path: "/dir", Mode: fs.ModeDir},
+		"/dir/file": {Path: "/dir/file", Mode: 0600, Size: 5, UID: 1000, GID: 100, ModTime: mtime, Hash: sha256Hex([]byte("hello"))},
+		"/sparse":   {Path: "/sparse", Size: 16, Hash: sha256Hex(append(append(make([]byte, 4), "data"...), make([]byte, 8)...))},
+		"/link":     {Path: "/link", Mode: fs.ModeSymlink | 0777, Size: 8, LinkTarget: "dir/file"},
+		"/fifo":     {Path: "/fifo", Mode: fs.ModeNamedPipe},
+	}
+	got := walkCatalog(t, c, snapUUID)
+	if !reflect.DeepEqual(got, want) {
+		for path, info := range want {
+			if !reflect.DeepEqual(got[path], info) {
+				t.Errorf("%s: expected %+v, got %+v", path, info, got[path])
+			}
+		}
+		for path := range got {
+			if want[path] == nil {
+				t.Errorf("%s: unexpected", path)
+			}
+		}
+	}
+
+	snap, err := c.Snapshot(snapUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Name != "root.1" || snap.Ctransid != 1 || snap.ParentUUID != uuid.Nil || snap.Files != len(want) || !snap.CreationTime.Equal(created) {
+		t.Errorf("unexpected snapshot info %+v", snap)
+	}
+	info, err := c.Lookup(snapUUID, "dir/file/")
+	if err != nil || info == nil || info.Path != "/dir/file" {
+		t.Errorf("expected lookups to clean the path, got %+v, %v", info, err)
+	}
+	if info, err := c.Lookup(snapUUID, "missing"); err != nil || info != nil {
+		t.Errorf("expected no file for a missing path, got %+v, %v", info, err)
+	}
+	if _, err := c.Lookup(uuid.New(), "/"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("expected ErrSnapshotNotFound for an unknown snapshot, got %v", err)
+	}
+}
+
+func TestCatalogWithoutHashes(t *testing.T) {
+	c, _ := openTestCatalog(t)
+	snapUUID := uuid.New()
+	if err := receiveCatalog(t, c, fullStream(t, snapUUID)); err != nil {
+		t.Fatal(err)
+	}
+	for path, info := range walkCatalog(t, c, snapUUID) {
+		if info.Hash != "" {
+			t.Errorf("%s: expected no hash without content hashes, got %s", path, info.Hash)
+		}
+	}
+}
+
+func TestCatalogIncrementalStream(t *testing.T) {
+	c, dbPath := openTestCatalog(t)
+	parentUUID, snapUUID := uuid.New(), uuid.New()
+	if err := receiveCatalog(t, c, fullStream(t, parentUUID), WithContentHashes()); err != nil {
+		t.Fatal(err)
+	}
+	parentFiles := walkCatalog(t, c, parentUUID)
+	if err := receiveCatalog(t, c, incrementalStream(t, snapUUID, parentUUID), WithContentHashes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The catalog persists once closed
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if got := walkCatalog(t, c, parentUUID); !reflect.DeepEqual(got, parentFiles) {
+		t.Error("the parent changed when its child was cataloged")
+	}
+	files := walkCatalog(t, c, snapUUID)
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	wantPaths := []string{"/", "/fifo", "/moved", "/moved/file", "/new", "/sparse"}
+	if len(paths) != len(wantPaths) {
+		t.Errorf("expected paths %v, got %v", wantPaths, paths)
+	}
+	for _, path := range wantPaths {
+		if files[path] == nil {
+			t.Errorf("expected %s in the snapshot, got %v", path, paths)
+		}
+	}
+	if file := files["/moved/file"]; file != nil {
+		// Only part of the file was rewritten, so its contents are unknown
+		if file.Size != 5 || file.Hash != "" || file.UID != 1000 || file.Mode != 0600 {
+			t.Errorf("expected the moved file to keep its metadata without a hash, got %+v", file)
+		}
+	}
+	if file := files["/new"]; file != nil && file.Hash != sha256Hex([]byte("new")) {
+		t.Errorf("expected the hash of the new file, got %+v", file)
+	}
+
+	snaps, err := c.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 2 || snaps[0].UUID != parentUUID || snaps[1].UUID != snapUUID || snaps[1].ParentUUID != parentUUID {
+		t.Errorf("expected the parent and its child oldest first, got %+v %+v", snaps[0], snaps[1])
+	}
+
+	tc := []struct {
+		path string
+		want []ChangeKind
+	}{
+		{"/dir/file", []ChangeKind{ChangeAdded, ChangeRemoved}},
+		{"/moved/file", []ChangeKind{ChangeAdded}},
+		{"/sparse", []ChangeKind{ChangeAdded, ChangeModified}},
+		{"fifo", []ChangeKind{ChangeAdded, ChangeNone}},
+		{"/missing", nil},
+	}
+	for _, tt := range tc {
+		versions, err := c.History(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []ChangeKind
+		for _, v := range versions {
+			got = append(got, v.Change)
+			if (v.File == nil) != (v.Change == ChangeRemoved) {
+				t.Errorf("%s: expected only removals to have no file, got %+v", tt.path, v)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected history %v, got %v", tt.path, tt.want, got)
+		}
+	}
+
+	if err := c.DeleteSnapshot(parentUUID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Snapshot(parentUUID); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("expected the deleted snapshot to be gone, got %v", err)
+	}
+	if err := c.Walk(parentUUID, func(*FileInfo) error { return nil }); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("expected the files of the deleted snapshot to be gone, got %v", err)
+	}
+	if got := walkCatalog(t, c, snapUUID); len(got) != len(wantPaths) {
+		t.Errorf("expected the child to be unaffected by deleting its parent, got %d files", len(got))
+	}
+}
+
+func TestCatalogMissingParent(t *testing.T) {
+	c, _ := openTestCatalog(t)
+	snapUUID := uuid.New()
+	err := receiveCatalog(t, c, incrementalStream(t, snapUUID, uuid.New()))
+	if err == nil || !strings.Contains(err.Error(), "must be cataloged first") {
+		t.Fatalf("expected an error for the missing parent, got %v", err)
+	}
+	if _, err := c.Snapshot(snapUUID); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("expected nothing to be cataloged, got %v", err)
+	}
+}
+
+func TestCatalogUnfinishedStream(t *testing.T) {
+	c, _ := openTestCatalog(t)
+	snapUUID := uuid.New()
+	if err := receiveCatalog(t, c, fullStream(t, snapUUID)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cataloging the snapshot again replaces it, unless the stream is cut short
+	stream := fullStream(t, snapUUID)
+	stream.Truncate(stream.Len() - 10)
+	if err := receiveCatalog(t, c, stream); err == nil {
+		t.Fatal("expected the truncated stream to fail")
+	}
+	snap, err := c.Snapshot(snapUUID)
+	if err != nil {
+		t.Fatalf("expected the catalog to keep the finished snapshot, got %v", err)
+	}
+	if got := walkCatalog(t, c, snapUUID); len(got) != snap.Files {
+		t.Errorf("expected %d files, got %d", snap.Files, len(got))
+	}
+
+	// The rolled back transaction does not block later ones
+	other := uuid.New()
+	if err := receiveCatalog(t, c, fullStream(t, other)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Snapshot(other); err != nil {
+		t.Error(err)
+	}
+}
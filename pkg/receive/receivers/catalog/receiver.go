@@ -0,0 +1,482 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package catalog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+)
+
+// Receiver catalogs the subvolumes in a send stream. Each subvolume is written in a
+// single transaction that is committed when the subvolume is finished. Close must be
+// called once the stream is processed to discard a subvolume that was not finished.
+type Receiver struct {
+	catalog      *Catalog
+	hashes       bool
+	creationTime time.Time
+
+	tx    *bolt.Tx
+	files *bolt.Bucket
+	snap  *SnapshotInfo
+	// content holds the running hash of files whose data was written sequentially
+	// by the stream
+	content map[string]*contentHash
+}
+
+type contentHash struct {
+	hash   hash.Hash
+	hashed uint64
+}
+
+// Option is a function that configures the catalog receiver.
+type Option func(*Receiver)
+
+// WithContentHashes computes the SHA-256 of every file written by the stream. Files
+// whose contents cannot be determined from the stream alone are left without a hash.
+func WithContentHashes() Option {
+	return func(r *Receiver) {
+		r.hashes = true
+	}
+}
+
+// WithCreationTime records the time the received snapshot was taken, which is not part
+// of the send stream.
+func WithCreationTime(t time.Time) Option {
+	return func(r *Receiver) {
+		r.creationTime = t
+	}
+}
+
+// New returns a receiver that records the received subvolumes in the given catalog.
+func New(c *Catalog, opts ...Option) *Receiver {
+	r := &Receiver{catalog: c}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Close discards any subvolume that was not finished.
+func (r *Receiver) Close() error {
+	if r.tx == nil {
+		return nil
+	}
+	err := r.tx.Rollback()
+	r.reset()
+	return err
+}
+
+func (r *Receiver) reset() {
+	r.tx, r.files, r.snap, r.content = nil, nil, nil, nil
+}
+
+func (r *Receiver) begin(ctx receivers.ReceiveContext, path string, snapUUID uuid.UUID, ctransid uint64, parent uuid.UUID) error {
+	if err := r.Close(); err != nil {
+		return err
+	}
+	tx, err := r.catalog.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	r.tx = tx
+	r.snap = &SnapshotInfo{
+		UUID:         snapUUID,
+		ParentUUID:   parent,
+		Name:         path,
+		Ctransid:     ctransid,
+		CreationTime: r.creationTime,
+	}
+	r.content = make(map[string]*contentHash)
+	if err := deleteSnapshot(tx, snapUUID); err != nil {
+		return err
+	}
+	r.files, err = tx.Bucket(filesBucket).CreateBucket([]byte(snapUUID.String()))
+	return err
+}
+
+func (r *Receiver) Subvol(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64) error {
+	ctx.LogVerbose(2, "cataloging subvolume %q\n", path)
+	if err := r.begin(ctx, path, uuid, ctransid, [16]byte{}); err != nil {
+		return err
+	}
+	return putFile(r.files, &FileInfo{Path: "/", Mode: fs.ModeDir})
+}
+
+func (r *Receiver) Snapshot(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64, cloneUUID uuid.UUID, cloneCtransid uint64) error {
+	ctx.LogVerbose(2, "cataloging snapshot %q from parent %s\n", path, cloneUUID)
+	if err := r.begin(ctx, path, uuid, ctransid, cloneUUID); err != nil {
+		return err
+	}
+	parent, err := snapshotFiles(r.tx, cloneUUID)
+	if err != nil {
+		return fmt.Errorf("parent of %q must be cataloged first: %w", path, err)
+	}
+	return parent.ForEach(func(k, v []byte) error {
+		return r.files.Put(k, v)
+	})
+}
+
+// get returns the catalog entry for path. Paths that are not in the catalog yet get
+// an empty entry.
+func (r *Receiver) get(path string) (*FileInfo, error) {
+	if r.files == nil {
+		return nil, errors.New("no subvolume is being cataloged")
+	}
+	path = CleanPath(path)
+	info, err := getFile(r.files, path)
+	if err != nil || info != nil {
+		return info, err
+	}
+	return &FileInfo{Path: path}, nil
+}
+
+// update applies fn to the entry for path and stores the result.
+func (r *Receiver) update(path string, fn func(*FileInfo)) error {
+	info, err := r.get(path)
+	if err != nil {
+		return err
+	}
+	fn(info)
+	return putFile(r.files, info)
+}
+
+func (r *Receiver) create(ctx receivers.ReceiveContext, path string, info *FileInfo) error {
+	if r.files == nil {
+		return errors.New("no subvolume is being cataloged")
+	}
+	info.Path = CleanPath(path)
+	if r.hashes && info.Mode.IsRegular() {
+		r.content[info.Path] = &contentHash{hash: sha256.New()}
+	}
+	return putFile(r.files, info)
+}
+
+func (r *Receiver) Mkfile(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	return r.create(ctx, path, &FileInfo{})
+}
+
+func (r *Receiver) Mkdir(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	return r.create(ctx, path, &FileInfo{Mode: fs.ModeDir})
+}
+
+func (r *Receiver) Mknod(ctx receivers.ReceiveContext, path string, ino uint64, mode uint32, rdev uint64) error {
+	return r.create(ctx, path, &FileInfo{Mode: toFileMode(mode), Rdev: rdev})
+}
+
+func (r *Receiver) Mkfifo(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	return r.create(ctx, path, &FileInfo{Mode: fs.ModeNamedPipe})
+}
+
+func (r *Receiver) Mksock(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	return r.create(ctx, path, &FileInfo{Mode: fs.ModeSocket})
+}
+
+func (r *Receiver) Symlink(ctx receivers.ReceiveContext, path string, ino uint64, linkTo string) error {
+	return r.create(ctx, path, &FileInfo{Mode: fs.ModeSymlink | 0777, LinkTarget: linkTo, Size: uint64(len(linkTo))})
+}
+
+func (r *Receiver) Rename(ctx receivers.ReceiveContext, oldPath string, newPath string) error {
+	oldPath, newPath = CleanPath(oldPath), CleanPath(newPath)
+	if err := r.remove(newPath); err != nil {
+		return err
+	}
+	moved := make(map[string][]byte)
+	if data := r.files.Get([]byte(oldPath)); data != nil {
+		moved[oldPath] = append([]byte{}, data...)
+	}
+	prefix := []byte(oldPath + "/")
+	c := r.files.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		moved[string(k)] = append([]byte{}, v...)
+	}
+	for p, data := range moved {
+		if err := r.files.Delete([]byte(p)); err != nil {
+			return err
+		}
+		info, err := decodeFile(data)
+		if err != nil {
+			return err
+		}
+		info.Path = newPath + strings.TrimPrefix(p, oldPath)
+		if err := putFile(r.files, info); err != nil {
+			return err
+		}
+		if h, ok := r.content[p]; ok {
+			delete(r.content, p)
+			r.content[info.Path] = h
+		}
+	}
+	return nil
+}
+
+func (r *Receiver) Link(ctx receivers.ReceiveContext, path string, linkTo string) error {
+	info, err := r.get(linkTo)
+	if err != nil {
+		return err
+	}
+	if h, ok := r.content[info.Path]; ok {
+		// Data written so far is all the link will see from the stream
+		info.Hash = h.sum(info.Size)
+	}
+	info.Path = CleanPath(path)
+	return putFile(r.files, info)
+}
+
+func (r *Receiver) Unlink(ctx receivers.ReceiveContext, path string) error {
+	return r.remove(CleanPath(path))
+}
+
+func (r *Receiver) Rmdir(ctx receivers.ReceiveContext, path string) error {
+	return r.remove(CleanPath(path))
+}
+
+// remove deletes path and everything beneath it.
+func (r *Receiver) remove(path string) error {
+	if r.files == nil {
+		return errors.New("no subvolume is being cataloged")
+	}
+	keys := [][]byte{[]byte(path)}
+	prefix := []byte(path + "/")
+	c := r.files.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	for _, k := range keys {
+		if err := r.files.Delete(k); err != nil {
+			return err
+		}
+		delete(r.content, string(k))
+	}
+	return nil
+}
+
+func (r *Receiver) Write(ctx receivers.ReceiveContext, path string, offset uint64, data []byte) error {
+	return r.update(path, func(info *FileInfo) {
+		end := offset + uint64(len(data))
+		if end > info.Size {
+			info.Size = end
+		}
+		info.Hash = ""
+		h, ok := r.content[info.Path]
+		if !ok {
+			return
+		}
+		if offset < h.hashed {
+			delete(r.content, info.Path)
+			return
+		}
+		h.zeroFill(offset)
+		h.hash.Write(data)
+		h.hashed = end
+	})
+}
+
+func (r *Receiver) EncodedWrite(ctx receivers.ReceiveContext, path string, op *btrfs.EncodedWriteOp) error {
+	if r.hashes {
+		data, err := op.Decompress()
+		if err == nil && op.UnencodedOffset+op.UnencodedFileLength <= uint64(len(data)) {
+			return r.Write(ctx, path, op.Offset, data[op.UnencodedOffset:op.UnencodedOffset+op.UnencodedFileLength])
+		}
+	}
+	return r.changed(path, op.Offset+op.UnencodedFileLength)
+}
+
+// changed records that the contents of path changed in a way the catalog cannot
+// follow, and that the file is at least size bytes long.
+func (r *Receiver) changed(path string, size uint64) error {
+	return r.update(path, func(info *FileInfo) {
+		if size > info.Size {
+			info.Size = size
+		}
+		info.Hash = ""
+		delete(r.content, info.Path)
+	})
+}
+
+func (r *Receiver) Clone(ctx receivers.ReceiveContext, path string, offset uint64, len uint64, cloneUUID uuid.UUID, cloneCtransid uint64, clonePath string, cloneOffset uint64) error {
+	return r.changed(path, offset+len)
+}
+
+func (r *Receiver) SetXattr(ctx receivers.ReceiveContext, path string, name string, data []byte) error {
+	return nil
+}
+
+func (r *Receiver) RemoveXattr(ctx receivers.ReceiveContext, path string, name string) error {
+	return nil
+}
+
+func (r *Receiver) Truncate(ctx receivers.ReceiveContext, path string, size uint64) error {
+	return r.update(path, func(info *FileInfo) {
+		info.Size = size
+		info.Hash = ""
+		if h, ok := r.content[info.Path]; ok && size < h.hashed {
+			delete(r.content, info.Path)
+		}
+	})
+}
+
+func (r *Receiver) Chmod(ctx receivers.ReceiveContext, path string, mode uint64) error {
+	return r.update(path, func(info *FileInfo) {
+		info.Mode = info.Mode.Type() | toFileMode(uint32(mode))&^fs.ModeType
+	})
+}
+
+func (r *Receiver) Chown(ctx receivers.ReceiveContext, path string, uid uint64, gid uint64) error {
+	return r.update(path, func(info *FileInfo) {
+		info.UID, info.GID = uid, gid
+	})
+}
+
+func (r *Receiver) Utimes(ctx receivers.ReceiveContext, path string, atime, mtime, ctime time.Time) error {
+	return r.update(path, func(info *FileInfo) {
+		info.ModTime = mtime
+	})
+}
+
+func (r *Receiver) UpdateExtent(ctx receivers.ReceiveContext, path string, fileOffset uint64, tmpSize uint64) error {
+	// Sent instead of data with BTRFS_SEND_FLAG_NO_FILE_DATA
+	return r.changed(path, fileOffset+tmpSize)
+}
+
+func (r *Receiver) EnableVerity(ctx receivers.ReceiveContext, path string, algorithm uint8, blockSize uint32, salt []byte, sig []byte) error {
+	return nil
+}
+
+func (r *Receiver) Fallocate(ctx receivers.ReceiveContext, path string, mode uint32, offset uint64, len uint64) error {
+	if mode != 0 {
+		return r.changed(path, 0)
+	}
+	// Plain allocations read back as zeroes and may only extend the file
+	return r.update(path, func(info *FileInfo) {
+		if offset+len > info.Size {
+			info.Size = offset + len
+		}
+	})
+}
+
+func (r *Receiver) Fileattr(ctx receivers.ReceiveContext, path string, attr uint32) error {
+	return nil
+}
+
+func (r *Receiver) FinishSubvolume(ctx receivers.ReceiveContext) error {
+	if r.tx == nil {
+		return errors.New("no subvolume is being cataloged")
+	}
+	for path, h := range r.content {
+		err := r.update(path, func(info *FileInfo) {
+			info.Hash = h.sum(info.Size)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// Bucket stats do not count the changes of the open transaction
+	r.snap.Files = 0
+	err := r.files.ForEach(func(k, v []byte) error {
+		r.snap.Files++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.snap.CatalogedAt = time.Now().UTC()
+	if err := putSnapshot(r.tx, r.snap); err != nil {
+		return err
+	}
+	ctx.LogVerbose(2, "cataloged %d paths for %q\n", r.snap.Files, r.snap.Name)
+	err = r.tx.Commit()
+	r.reset()
+	return err
+}
+
+// sum returns the hash of a file of the given size whose leading data was hashed.
+func (h *contentHash) sum(size uint64) string {
+	if size < h.hashed {
+		return ""
+	}
+	state, err := h.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return ""
+	}
+	c := &contentHash{hash: sha256.New(), hashed: h.hashed}
+	if err := c.hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return ""
+	}
+	c.zeroFill(size)
+	return hex.EncodeToString(c.hash.Sum(nil))
+}
+
+// zeroFill hashes the hole between the data hashed so far and offset.
+func (h *contentHash) zeroFill(offset uint64) {
+	if offset > h.hashed {
+		io.CopyN(h.hash, zeroReader{}, int64(offset-h.hashed))
+		h.hashed = offset
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// toFileMode converts a unix mode to an fs.FileMode.
+func toFileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		m |= fs.ModeDir
+	case syscall.S_IFLNK:
+		m |= fs.ModeSymlink
+	case syscall.S_IFIFO:
+		m |= fs.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		m |= fs.ModeSocket
+	case syscall.S_IFCHR:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case syscall.S_IFBLK:
+		m |= fs.ModeDevice
+	}
+	if mode&syscall.S_ISUID != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
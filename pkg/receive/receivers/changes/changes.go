@@ -0,0 +1,329 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package changes implements a receiver that reports the paths changed by an
+// incremental send stream instead of applying them. It is meant to be used with streams
+// sent without file data, where writes are replaced by extent updates.
+//
+// Incremental streams create new inodes under temporary names and move them into
+// place, and move deleted directories out of the way before removing them. The
+// receiver follows these renames so that changes are reported against the paths in
+// the parent and the received snapshot.
+package changes
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+)
+
+// Kind is the kind of change made to a path.
+type Kind string
+
+const (
+	// Added means the path does not exist in the parent snapshot.
+	Added Kind = "added"
+	// Modified means the contents of the path changed.
+	Modified Kind = "modified"
+	// Deleted means the path does not exist in the received snapshot.
+	Deleted Kind = "deleted"
+	// Renamed means the path was moved, and possibly changed as well.
+	Renamed Kind = "renamed"
+	// Metadata means only the metadata of the path changed.
+	Metadata Kind = "metadata"
+)
+
+// Metadata that can change on a path.
+const (
+	MetadataMode   = "mode"
+	MetadataOwner  = "owner"
+	MetadataTimes  = "times"
+	MetadataXattrs = "xattrs"
+	MetadataAttrs  = "attrs"
+	MetadataVerity = "verity"
+)
+
+// Change is a change to a single path.
+type Change struct {
+	Kind Kind `json:"kind"`
+	// Path is the path in the received snapshot, or in the parent for deletions
+	Path string `json:"path"`
+	// OldPath is the path in the parent snapshot for renames
+	OldPath string `json:"oldPath,omitempty"`
+	// Content is true if the contents of a modified or renamed path changed
+	Content bool `json:"content,omitempty"`
+	// Metadata lists the metadata that changed on the path
+	Metadata []string `json:"metadata,omitempty"`
+	// LinkTo is the existing path a hard link was added to
+	LinkTo string `json:"linkTo,omitempty"`
+}
+
+// OnlyTimes returns true if the only change is to timestamps. Directories have their
+// timestamps updated whenever their entries change.
+func (c *Change) OnlyTimes() bool {
+	return c.Kind == Metadata && len(c.Metadata) == 1 && c.Metadata[0] == MetadataTimes
+}
+
+// state tracks a path by its current name in the stream.
+type state struct {
+	// origin is the path in the parent snapshot, empty if created by the stream
+	origin   string
+	content  bool
+	metadata map[string]struct{}
+	linkTo   string
+}
+
+// Receiver collects the changes in a send stream. Streams containing multiple
+// subvolumes report the changes of the last one.
+type Receiver struct {
+	paths   map[string]*state
+	deleted map[string]struct{}
+}
+
+// New returns a new change receiver.
+func New() *Receiver {
+	return &Receiver{
+		paths:   make(map[string]*state),
+		deleted: make(map[string]struct{}),
+	}
+}
+
+// Changes returns the changes sorted by path.
+func (r *Receiver) Changes() []*Change {
+	var changes []*Change
+	for p, st := range r.paths {
+		c := &Change{Path: p, Content: st.content, LinkTo: st.linkTo}
+		for m := range st.metadata {
+			c.Metadata = append(c.Metadata, m)
+		}
+		sort.Strings(c.Metadata)
+		switch {
+		case st.origin == "":
+			c.Kind, c.Content, c.Metadata = Added, false, nil
+		case st.origin != p:
+			c.Kind, c.OldPath = Renamed, st.origin
+		case st.content:
+			c.Kind = Modified
+		case len(c.Metadata) > 0:
+			c.Kind = Metadata
+		default:
+			// Moved away and back again
+			continue
+		}
+		changes = append(changes, c)
+	}
+	for p := range r.deleted {
+		changes = append(changes, &Change{Kind: Deleted, Path: p})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Path == changes[j].Path {
+			// A deleted path that was replaced sorts first
+			return changes[i].Kind == Deleted
+		}
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + strings.TrimPrefix(p, "/"))
+}
+
+func isUnder(p, dir string) bool {
+	return dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// get returns the state of a path, creating it from the renames of its parents if it
+// has not been seen yet.
+func (r *Receiver) get(p string) *state {
+	if st, ok := r.paths[p]; ok {
+		return st
+	}
+	st := &state{origin: p}
+	for dir := path.Dir(p); ; dir = path.Dir(dir) {
+		if parent, ok := r.paths[dir]; ok {
+			if parent.origin == "" {
+				st.origin = ""
+			} else {
+				st.origin = path.Join(parent.origin, strings.TrimPrefix(p, dir))
+			}
+			break
+		}
+		if dir == "/" {
+			break
+		}
+	}
+	r.paths[p] = st
+	return st
+}
+
+func (r *Receiver) create(p string) error {
+	r.paths[cleanPath(p)] = &state{}
+	return nil
+}
+
+func (r *Receiver) modified(p string) error {
+	r.get(cleanPath(p)).content = true
+	return nil
+}
+
+func (r *Receiver) changedMetadata(p, name string) error {
+	st := r.get(cleanPath(p))
+	if st.metadata == nil {
+		st.metadata = make(map[string]struct{})
+	}
+	st.metadata[name] = struct{}{}
+	return nil
+}
+
+func (r *Receiver) remove(p string) error {
+	p = cleanPath(p)
+	st := r.get(p)
+	delete(r.paths, p)
+	if st.origin != "" {
+		r.deleted[st.origin] = struct{}{}
+	}
+	return nil
+}
+
+func (r *Receiver) Subvol(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64) error {
+	*r = *New()
+	// Everything in a full stream is new
+	r.paths["/"] = &state{}
+	return nil
+}
+
+func (r *Receiver) Snapshot(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64, cloneUUID uuid.UUID, cloneCtransid uint64) error {
+	*r = *New()
+	return nil
+}
+
+func (r *Receiver) Mkfile(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	return r.create(path)
+}
+
+func (r *Receiver) Mkdir(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	return r.create(path)
+}
+
+func (r *Receiver) Mknod(ctx receivers.ReceiveContext, path string, ino uint64, mode uint32, rdev uint64) error {
+	return r.create(path)
+}
+
+func (r *Receiver) Mkfifo(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	return r.create(path)
+}
+
+func (r *Receiver) Mksock(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	return r.create(path)
+}
+
+func (r *Receiver) Symlink(ctx receivers.ReceiveContext, path string, ino uint64, linkTo string) error {
+	return r.create(path)
+}
+
+func (r *Receiver) Rename(ctx receivers.ReceiveContext, oldPath string, newPath string) error {
+	oldPath, newPath = cleanPath(oldPath), cleanPath(newPath)
+	st := r.get(oldPath)
+	delete(r.paths, oldPath)
+	// Move anything already tracked beneath a renamed directory
+	var children []string
+	for p := range r.paths {
+		if isUnder(p, oldPath) {
+			children = append(children, p)
+		}
+	}
+	for _, p := range children {
+		r.paths[newPath+strings.TrimPrefix(p, oldPath)] = r.paths[p]
+		delete(r.paths, p)
+	}
+	r.paths[newPath] = st
+	return nil
+}
+
+func (r *Receiver) Link(ctx receivers.ReceiveContext, path string, linkTo string) error {
+	r.paths[cleanPath(path)] = &state{linkTo: cleanPath(linkTo)}
+	return nil
+}
+
+func (r *Receiver) Unlink(ctx receivers.ReceiveContext, path string) error {
+	return r.remove(path)
+}
+
+func (r *Receiver) Rmdir(ctx receivers.ReceiveContext, path string) error {
+	return r.remove(path)
+}
+
+func (r *Receiver) Write(ctx receivers.ReceiveContext, path string, offset uint64, data []byte) error {
+	return r.modified(path)
+}
+
+func (r *Receiver) EncodedWrite(ctx receivers.ReceiveContext, path string, op *btrfs.EncodedWriteOp) error {
+	return r.modified(path)
+}
+
+func (r *Receiver) Clone(ctx receivers.ReceiveContext, path string, offset uint64, len uint64, cloneUUID uuid.UUID, cloneCtransid uint64, clonePath string, cloneOffset uint64) error {
+	return r.modified(path)
+}
+
+func (r *Receiver) SetXattr(ctx receivers.ReceiveContext, path string, name string, data []byte) error {
+	return r.changedMetadata(path, MetadataXattrs)
+}
+
+func (r *Receiver) RemoveXattr(ctx receivers.ReceiveContext, path string, name string) error {
+	return r.changedMetadata(path, MetadataXattrs)
+}
+
+func (r *Receiver) Truncate(ctx receivers.ReceiveContext, path string, size uint64) error {
+	return r.modified(path)
+}
+
+func (r *Receiver) Chmod(ctx receivers.ReceiveContext, path string, mode uint64) error {
+	return r.changedMetadata(path, MetadataMode)
+}
+
+func (r *Receiver) Chown(ctx receivers.ReceiveContext, path string, uid uint64, gid uint64) error {
+	return r.changedMetadata(path, MetadataOwner)
+}
+
+func (r *Receiver) Utimes(ctx receivers.ReceiveContext, path string, atime, mtime, ctime time.Time) error {
+	return r.changedMetadata(path, MetadataTimes)
+}
+
+func (r *Receiver) UpdateExtent(ctx receivers.ReceiveContext, path string, fileOffset uint64, tmpSize uint64) error {
+	return r.modified(path)
+}
+
+func (r *Receiver) EnableVerity(ctx receivers.ReceiveContext, path string, algorithm uint8, blockSize uint32, salt []byte, sig []byte) error {
+	return r.changedMetadata(path, MetadataVerity)
+}
+
+func (r *Receiver) Fallocate(ctx receivers.ReceiveContext, path string, mode uint32, offset uint64, len uint64) error {
+	return r.modified(path)
+}
+
+func (r *Receiver) Fileattr(ctx receivers.ReceiveContext, path string, attr uint32) error {
+	return r.changedMetadata(path, MetadataAttrs)
+}
+
+func (r *Receiver) FinishSubvolume(ctx receivers.ReceiveContext) error {
+	return nil
+}
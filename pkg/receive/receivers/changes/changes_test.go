@@ -0,0 +1,239 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package changes
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/receivertest"
+	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+)
+
+// command is a send stream command and its attributes.
+type command struct {
+	cmd   sendstream.SendCommand
+	attrs sendstream.CmdAttrs
+}
+
+func cmd(c sendstream.SendCommand, attrs sendstream.CmdAttrs) command {
+	return command{c, attrs}
+}
+
+// formatChange returns a change as a string that is easy to compare.
+func formatChange(c *Change) string {
+	s := fmt.Sprintf("%s %s", c.Kind, c.Path)
+	if c.OldPath != "" {
+		s += " from " + c.OldPath
+	}
+	if c.LinkTo != "" {
+		s += " linked to " + c.LinkTo
+	}
+	if c.Content {
+		s += " content"
+	}
+	if len(c.Metadata) > 0 {
+		s += " " + strings.Join(c.Metadata, ",")
+	}
+	return s
+}
+
+// receiveChanges applies the commands to a new receiver, after a snapshot command for
+// an incremental stream or a subvol command for a full one.
+func receiveChanges(t *testing.T, full bool, cmds []command) []string {
+	t.Helper()
+	stream := receivertest.NewStream(t)
+	if full {
+		stream.Cmd(sendstream.NewSubvolCommand("snap", uuid.New(), 1))
+	} else {
+		stream.Cmd(sendstream.NewSnapshotCommand("snap", uuid.New(), 2, uuid.New(), 1))
+	}
+	for _, c := range cmds {
+		stream.Cmd(c.cmd, c.attrs)
+	}
+	rcvr := New()
+	if err := receivertest.Receive(stream.End(), rcvr); err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, c := range rcvr.Changes() {
+		got = append(got, formatChange(c))
+	}
+	return got
+}
+
+func TestChanges(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		full bool
+		cmds []command
+		want []string
+	}{
+		{
+			name: "full stream",
+			full: true,
+			cmds: []command{
+				cmd(sendstream.NewMkdirCommand("o257-1-0", 257)),
+				cmd(sendstream.NewRenameCommand("o257-1-0", "dir")),
+				cmd(sendstream.NewMkfileCommand("dir/file", 258)),
+				cmd(sendstream.NewUpdateExtentCommand("dir/file", 0, 5)),
+			},
+			want: []string{"added /", "added /dir", "added /dir/file"},
+		},
+		{
+			name: "no changes",
+			want: []string{},
+		},
+		{
+			name: "new file under a temporary name",
+			cmds: []command{
+				cmd(sendstream.NewMkfileCommand("o258-5-0", 258)),
+				cmd(sendstream.NewRenameCommand("o258-5-0", "new")),
+				cmd(sendstream.NewUpdateExtentCommand("new", 0, 5)),
+				cmd(sendstream.NewChmodCommand("new", 0600)),
+				cmd(sendstream.NewUtimesCommand("new", now, now, now)),
+			},
+			want: []string{"added /new"},
+		},
+		{
+			name: "modified contents and metadata",
+			cmds: []command{
+				cmd(sendstream.NewUpdateExtentCommand("file", 0, 5)),
+				cmd(sendstream.NewChownCommand("file", 1000, 100)),
+			},
+			want: []string{"modified /file content owner"},
+		},
+		{
+			name: "truncated",
+			cmds: []command{cmd(sendstream.NewTruncateCommand("file", 0))},
+			want: []string{"modified /file content"},
+		},
+		{
+			name: "metadata only",
+			cmds: []command{
+				cmd(sendstream.NewChmodCommand("file", 0600)),
+				cmd(sendstream.NewSetXattrCommand("file", "user.key", []byte("value"))),
+				cmd(sendstream.NewUtimesCommand("file", now, now, now)),
+			},
+			want: []string{"metadata /file mode,times,xattrs"},
+		},
+		{
+			name: "renamed",
+			cmds: []command{cmd(sendstream.NewRenameCommand("a", "b"))},
+			want: []string{"renamed /b from /a"},
+		},
+		{
+			name: "renamed and modified",
+			cmds: []command{
+				cmd(sendstream.NewRenameCommand("a", "b")),
+				cmd(sendstream.NewUpdateExtentCommand("b", 0, 5)),
+			},
+			want: []string{"renamed /b from /a content"},
+		},
+		{
+			name: "file modified in a renamed directory",
+			cmds: []command{
+				cmd(sendstream.NewRenameCommand("dir", "moved")),
+				cmd(sendstream.NewUpdateExtentCommand("moved/file", 0, 5)),
+			},
+			want: []string{"renamed /moved from /dir", "renamed /moved/file from /dir/file content"},
+		},
+		{
+			name: "file renamed before its directory",
+			cmds: []command{
+				cmd(sendstream.NewRenameCommand("dir/a", "dir/b")),
+				cmd(sendstream.NewRenameCommand("dir", "moved")),
+			},
+			want: []string{"renamed /moved from /dir", "renamed /moved/b from /dir/a"},
+		},
+		{
+			name: "moved away and back",
+			cmds: []command{
+				cmd(sendstream.NewRenameCommand("a", "o259-7-0")),
+				cmd(sendstream.NewRenameCommand("o259-7-0", "a")),
+			},
+			want: []string{},
+		},
+		{
+			name: "deleted",
+			cmds: []command{cmd(sendstream.NewUnlinkCommand("file"))},
+			want: []string{"deleted /file"},
+		},
+		{
+			name: "directory moved out of the way and deleted",
+			cmds: []command{
+				cmd(sendstream.NewRenameCommand("dir", "o259-7-0")),
+				cmd(sendstream.NewUnlinkCommand("o259-7-0/file")),
+				cmd(sendstream.NewRmdirCommand("o259-7-0")),
+			},
+			want: []string{"deleted /dir", "deleted /dir/file"},
+		},
+		{
+			name: "replaced by a new file",
+			cmds: []command{
+				cmd(sendstream.NewUnlinkCommand("file")),
+				cmd(sendstream.NewMkfileCommand("o260-9-0", 260)),
+				cmd(sendstream.NewRenameCommand("o260-9-0", "file")),
+			},
+			want: []string{"deleted /file", "added /file"},
+		},
+		{
+			name: "created and deleted by the stream",
+			cmds: []command{
+				cmd(sendstream.NewMkfileCommand("o261-9-0", 261)),
+				cmd(sendstream.NewUnlinkCommand("o261-9-0")),
+			},
+			want: []string{},
+		},
+		{
+			name: "hard link",
+			cmds: []command{cmd(sendstream.NewLinkCommand("b", "a"))},
+			want: []string{"added /b linked to /a"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := receiveChanges(t, tc.full, tc.cmds)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOnlyTimes(t *testing.T) {
+	tests := []struct {
+		change *Change
+		want   bool
+	}{
+		{&Change{Kind: Metadata, Metadata: []string{MetadataTimes}}, true},
+		{&Change{Kind: Metadata, Metadata: []string{MetadataMode, MetadataTimes}}, false},
+		{&Change{Kind: Metadata, Metadata: []string{MetadataMode}}, false},
+		{&Change{Kind: Modified, Content: true, Metadata: []string{MetadataTimes}}, false},
+		{&Change{Kind: Renamed, Metadata: []string{MetadataTimes}}, false},
+	}
+	for _, tc := range tests {
+		if got := tc.change.OnlyTimes(); got != tc.want {
+			t.Errorf("OnlyTimes of %q returned %v, want %v", formatChange(tc.change), got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package directory
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
+
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+)
+
+// cloneSourceRoot returns the directory holding the contents of the subvolume with the
+// given UUID. Clones may reference the subvolume currently being received, or in a
+// versioned directory a version that was previously received in full. Snapshots are
+// received in place otherwise, so the contents of previous snapshots are no longer
+// there to clone from.
+func (n *directoryReceiver) cloneSourceRoot(ctx receivers.ReceiveContext, cloneUUID uuid.UUID) (string, error) {
+	if cloneUUID == ctx.CurrentSubvolume().UUID {
+		return n.root(), nil
+	}
+	if !n.versioned() {
+		return "", fmt.Errorf("%w: %s is a previous snapshot received in place", receivers.ErrCloneSourceUnavailable, cloneUUID)
+	}
+	version, err := VersionDirectory(n.destPath, n.offsetDirectory, cloneUUID)
+	if err != nil {
+		return "", fmt.Errorf("clone source %s has not been received: %w", cloneUUID, err)
+	}
+	return filepath.Join(n.destPath, version), nil
+}
+
+// cloneRange clones size bytes from src at srcOffset to dest at destOffset. A reflink is
+// attempted first, and the data is copied if the filesystem does not support them.
+func cloneRange(src, dest string, srcOffset, destOffset, size uint64) (reflinked bool, err error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer srcFile.Close()
+	destFile, err := os.OpenFile(dest, os.O_WRONLY, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer destFile.Close()
+
+	err = unix.IoctlFileCloneRange(int(destFile.Fd()), &unix.FileCloneRange{
+		Src_fd:      int64(srcFile.Fd()),
+		Src_offset:  srcOffset,
+		Src_length:  size,
+		Dest_offset: destOffset,
+	})
+	if err == nil {
+		return true, nil
+	}
+	if !reflinkUnsupported(err) {
+		return false, err
+	}
+
+	r := io.NewSectionReader(srcFile, int64(srcOffset), int64(size))
+	buf := make([]byte, 128*1024)
+	off := int64(destOffset)
+	for {
+		nr, rerr := r.Read(buf)
+		if nr > 0 {
+			if _, err := destFile.WriteAt(buf[:nr], off); err != nil {
+				return false, err
+			}
+			off += int64(nr)
+		}
+		if rerr == io.EOF {
+			return false, nil
+		}
+		if rerr != nil {
+			return false, rerr
+		}
+	}
+}
+
+// reflinkUnsupported returns true if the error from FICLONERANGE means the range
+// cannot be reflinked on this filesystem, as opposed to a real failure.
+func reflinkUnsupported(err error) bool {
+	// EINVAL is also returned for ranges that are not block aligned.
+	return errors.Is(err, unix.EOPNOTSUPP) ||
+		errors.Is(err, unix.ENOTTY) ||
+		errors.Is(err, unix.EXDEV) ||
+		errors.Is(err, unix.EINVAL) ||
+		errors.Is(err, unix.ENOSYS)
+}
@@ -18,9 +18,22 @@ If not, see <https://www.gnu.org/licenses/>.
 // resume from the last known offset. For each subvolume, a file named after the
 // UUID is used to track the offset. Upon completion of a subvolume math.MaxUint64 is
 // written to the file. This can be used to determine if a transfer was completed.
+// Clone operations are performed with reflinks when the filesystem supports them
+// and fall back to copying the data otherwise.
+//
+// Incremental streams are applied to the destination in place. Full streams are
+// received into a staging directory next to it, which replaces the destination once
+// the stream is complete.
+//
+// When created with WithVersions, each subvolume is instead received into its own
+// version directory, with unchanged files hardlinked to the previous version.
+//
+// Files are kept open between writes in a cache of file descriptors. When the cache
+// coalesces writes, progress is only recorded once the buffered data is written.
 package directory
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"math"
@@ -30,8 +43,10 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
 
 	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/receive/filecache"
 	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
 	"github.com/tinyzimmer/btrsync/pkg/sendstream"
 )
@@ -40,14 +55,48 @@ type directoryReceiver struct {
 	destPath        string
 	currentOffset   uint64
 	offsetDirectory string
+	files           *filecache.Cache
+	// staging is set while a full stream is received into the staging directory
+	staging bool
+
+	// versionName is set when receiving into version directories
+	versionName func(string) string
+	version     string
+	// fresh holds the inodes of files written by the current receive
+	fresh map[uint64]struct{}
+	// links holds the paths of files in the version that are hardlinked to each
+	// other, by inode
+	links map[uint64][]string
+}
+
+func New(path string, offsetDirectory string, opts ...Option) receivers.Receiver {
+	n := &directoryReceiver{destPath: path, offsetDirectory: offsetDirectory, files: filecache.New()}
+	for _, opt := range opts {
+		opt(n)
+	}
+	return n
 }
 
-func New(path string, offsetDirectory string) receivers.Receiver {
-	return &directoryReceiver{path, 0, offsetDirectory}
+// WithFileCache configures the cache of open files used for writes.
+func WithFileCache(opts ...filecache.Option) Option {
+	return func(n *directoryReceiver) {
+		n.files = filecache.New(opts...)
+	}
 }
 
 func (n *directoryReceiver) resolvePath(ctx receivers.ReceiveContext, path string) string {
-	return filepath.Join(n.destPath, path)
+	return filepath.Join(n.root(), path)
+}
+
+// root returns the directory the current subvolume is received into.
+func (n *directoryReceiver) root() string {
+	switch {
+	case n.versioned():
+		return n.partialPath()
+	case n.staging:
+		return n.stagingPath()
+	}
+	return n.destPath
 }
 
 func (n *directoryReceiver) currentOffsetPath(ctx receivers.ReceiveContext) string {
@@ -59,13 +108,21 @@ func (n *directoryReceiver) PreOp(ctx receivers.ReceiveContext, hdr sendstream.C
 		ctx.LogVerbose(4, "skipping preop for %q, already at offset %d", attrs.GetPath(), n.currentOffset)
 		return receivers.ErrSkipCommand
 	}
-	return nil
+	if hdr.Cmd == sendstream.BTRFS_SEND_C_WRITE {
+		return nil
+	}
+	// Any other command may depend on buffered writes having been made
+	return n.files.Flush()
 }
 
 func (n *directoryReceiver) PostOp(ctx receivers.ReceiveContext, hdr sendstream.CmdHeader, attrs sendstream.CmdAttrs) error {
 	if ctx.CurrentOffset() < n.currentOffset {
 		return nil
 	}
+	if n.files.Pending() {
+		// The offset is written once the buffered data is on disk
+		return nil
+	}
 	f, err := os.OpenFile(n.currentOffsetPath(ctx), os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		return err
@@ -76,28 +133,48 @@ func (n *directoryReceiver) PostOp(ctx receivers.ReceiveContext, hdr sendstream.
 	return err
 }
 
-func (n *directoryReceiver) Subvol(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64) error {
+func (n *directoryReceiver) Subvol(ctx receivers.ReceiveContext, path string, _ uuid.UUID, ctransid uint64) error {
 	ctx.LogVerbose(2, "creating directory at %q\n", n.destPath)
+	if err := n.recoverStaging(ctx); err != nil {
+		return err
+	}
 	if err := os.MkdirAll(filepath.Dir(n.currentOffsetPath(ctx)), 0755); err != nil {
 		return err
 	}
-	f, err := os.Open(n.currentOffsetPath(ctx))
-	if err != nil {
-		if !os.IsNotExist(err) {
+	if err := n.loadOffset(ctx); err != nil {
+		return err
+	}
+	if n.versioned() {
+		return n.startVersion(ctx, path, uuid.Nil)
+	}
+	return n.startStaging(ctx)
+}
+
+func (n *directoryReceiver) Snapshot(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64, cloneUUID uuid.UUID, cloneCtransid uint64) error {
+	n.staging = false
+	if err := n.recoverStaging(ctx); err != nil {
+		return err
+	}
+	if !n.versioned() {
+		if err := n.checkStaging(); err != nil {
 			return err
 		}
-		return nil
 	}
-	defer f.Close()
-	var offset uint64
-	if _, err := fmt.Fscanf(f, "%d", &offset); err != nil {
+	if n.versioned() {
+		if err := os.MkdirAll(filepath.Dir(n.currentOffsetPath(ctx)), 0755); err != nil {
+			return err
+		}
+	}
+	if err := n.loadOffset(ctx); err != nil {
 		return err
 	}
-	n.currentOffset = offset
+	if n.versioned() {
+		return n.startVersion(ctx, path, cloneUUID)
+	}
 	return nil
 }
 
-func (n *directoryReceiver) Snapshot(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64, cloneUUID uuid.UUID, cloneCtransid uint64) error {
+func (n *directoryReceiver) loadOffset(ctx receivers.ReceiveContext) error {
 	f, err := os.Open(n.currentOffsetPath(ctx))
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -121,6 +198,7 @@ func (n *directoryReceiver) Mkfile(ctx receivers.ReceiveContext, path string, in
 	if err != nil {
 		return err
 	}
+	n.markFresh(path)
 	return f.Close()
 }
 
@@ -155,7 +233,12 @@ func (n *directoryReceiver) Mksock(ctx receivers.ReceiveContext, path string, in
 
 func (n *directoryReceiver) Symlink(ctx receivers.ReceiveContext, path string, ino uint64, linkTo string) error {
 	path = n.resolvePath(ctx, path)
-	linkTo = n.resolvePath(ctx, linkTo)
+	if !n.versioned() {
+		linkTo = filepath.Join(n.destPath, linkTo)
+	}
+	// Version directories are renamed once complete, so symlinks are kept
+	// exactly as they were sent. Staged subvolumes are linked to where they
+	// are moved to.
 	ctx.LogVerbose(3, "creating symlink %q -> %q\n", path, linkTo)
 	return os.Symlink(linkTo, path)
 }
@@ -164,40 +247,52 @@ func (n *directoryReceiver) Rename(ctx receivers.ReceiveContext, oldPath string,
 	oldPath = n.resolvePath(ctx, oldPath)
 	newPath = n.resolvePath(ctx, newPath)
 	ctx.LogVerbose(3, "rename %q to %q\n", oldPath, newPath)
-	return os.Rename(oldPath, newPath)
+	if err := n.files.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	n.renameLinks(oldPath, newPath)
+	return nil
 }
 
 func (n *directoryReceiver) Link(ctx receivers.ReceiveContext, path string, linkTo string) error {
 	path = n.resolvePath(ctx, path)
 	linkTo = n.resolvePath(ctx, linkTo)
 	ctx.LogVerbose(3, "link %q -> %q\n", path, linkTo)
-	return os.Link(linkTo, path)
+	if err := os.Link(linkTo, path); err != nil {
+		return err
+	}
+	n.addLink(path, linkTo)
+	return nil
 }
 
 func (n *directoryReceiver) Unlink(ctx receivers.ReceiveContext, path string) error {
 	path = n.resolvePath(ctx, path)
 	ctx.LogVerbose(3, "unlinking %q\n", path)
+	if err := n.files.Remove(path); err != nil {
+		return err
+	}
 	return os.Remove(path)
 }
 
 func (n *directoryReceiver) Rmdir(ctx receivers.ReceiveContext, path string) error {
 	path = n.resolvePath(ctx, path)
 	ctx.LogVerbose(3, "removing directory %q\n", path)
+	if err := n.files.Remove(path); err != nil {
+		return err
+	}
 	return os.RemoveAll(path)
 }
 
 func (n *directoryReceiver) Write(ctx receivers.ReceiveContext, path string, offset uint64, data []byte) error {
-	path = n.resolvePath(ctx, path)
-	ctx.LogVerbose(3, "write %d bytes to %q at offset %d\n", len(data), path, offset)
-	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	path, err := n.writablePath(ctx, path)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	if _, err := f.WriteAt(data, int64(offset)); err != nil {
-		return err
-	}
-	return nil
+	ctx.LogVerbose(3, "write %d bytes to %q at offset %d\n", len(data), path, offset)
+	return n.files.WriteAt(path, data, int64(offset))
 }
 
 func (n *directoryReceiver) EncodedWrite(ctx receivers.ReceiveContext, path string, op *btrfs.EncodedWriteOp) error {
@@ -209,43 +304,87 @@ func (n *directoryReceiver) EncodedWrite(ctx receivers.ReceiveContext, path stri
 }
 
 func (n *directoryReceiver) Clone(ctx receivers.ReceiveContext, path string, offset uint64, len uint64, cloneUUID uuid.UUID, cloneCtransid uint64, clonePath string, cloneOffset uint64) error {
-	return receivers.ErrNotSupported
+	root, err := n.cloneSourceRoot(ctx, cloneUUID)
+	if err != nil {
+		if errors.Is(err, receivers.ErrCloneSourceUnavailable) {
+			// The stream has already changed the destination, the snapshot has to
+			// be received again in full
+			if stErr := n.requireFullSend(ctx); stErr != nil {
+				ctx.LogVerbose(0, "failed to prepare %q for a full send: %s\n", n.destPath, stErr)
+			}
+		}
+		return fmt.Errorf("cannot find source subvolume for clone: %w", err)
+	}
+	clonePath = filepath.Join(root, clonePath)
+	destPath, err := n.writablePath(ctx, path)
+	if err != nil {
+		return err
+	}
+	ctx.LogVerbose(3, "clone %d bytes from %q at offset %d to %q at offset %d\n", len, clonePath, cloneOffset, destPath, offset)
+	reflinked, err := cloneRange(clonePath, destPath, cloneOffset, offset, len)
+	if err != nil {
+		return err
+	}
+	if !reflinked {
+		ctx.LogVerbose(4, "reflinks not supported for %q, copied data instead\n", destPath)
+	}
+	return nil
 }
 
 func (n *directoryReceiver) SetXattr(ctx receivers.ReceiveContext, path string, name string, data []byte) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.writablePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "setting xattr %q on %q\n", name, path)
-	return syscall.Setxattr(path, name, data, 0)
+	return unix.Lsetxattr(path, name, data, 0)
 }
 
 func (n *directoryReceiver) RemoveXattr(ctx receivers.ReceiveContext, path string, name string) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.writablePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "removing xattr %q on %q\n", name, path)
-	return syscall.Removexattr(path, name)
+	return unix.Lremovexattr(path, name)
 }
 
 func (n *directoryReceiver) Truncate(ctx receivers.ReceiveContext, path string, size uint64) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.writablePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "truncating %q to %d bytes\n", path, size)
 	return os.Truncate(path, int64(size))
 }
 
 func (n *directoryReceiver) Chmod(ctx receivers.ReceiveContext, path string, mode uint64) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.writablePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "chmod %q to %o\n", path, mode)
 	return os.Chmod(path, fs.FileMode(mode))
 }
 
 func (n *directoryReceiver) Chown(ctx receivers.ReceiveContext, path string, uid uint64, gid uint64) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.writablePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "chown %q to %d:%d\n", path, uid, gid)
-	return os.Chown(path, int(uid), int(gid))
+	return os.Lchown(path, int(uid), int(gid))
 }
 
 func (n *directoryReceiver) Utimes(ctx receivers.ReceiveContext, path string, atime, mtime, ctime time.Time) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.writablePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "utimes %q to %v:%v", path, atime, mtime)
-	return os.Chtimes(path, atime, mtime)
+	// Symlinks are not followed, like the other metadata commands
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
 }
 
 func (n *directoryReceiver) UpdateExtent(ctx receivers.ReceiveContext, path string, fileOffset uint64, tmpSize uint64) error {
@@ -261,19 +400,24 @@ func (n *directoryReceiver) EnableVerity(ctx receivers.ReceiveContext, path stri
 }
 
 func (n *directoryReceiver) Fallocate(ctx receivers.ReceiveContext, path string, mode uint32, offset uint64, len uint64) error {
-	path = n.resolvePath(ctx, path)
+	path, err := n.writablePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "fallocate %q to %d bytes at offset %d\n", path, len, offset)
-	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	f, err := n.files.File(path)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 	return syscall.Fallocate(int(f.Fd()), mode, int64(offset), int64(len))
 }
 
 func (n *directoryReceiver) Fileattr(ctx receivers.ReceiveContext, path string, attr uint32) error {
 	// From source it looks like this just makes sure it can open the file for writing
-	path = n.resolvePath(ctx, path)
+	path, err := n.writablePath(ctx, path)
+	if err != nil {
+		return err
+	}
 	ctx.LogVerbose(3, "fileattr %q to %d\n", path, attr)
 	f, err := os.OpenFile(path, os.O_RDWR, 0600)
 	if err != nil {
@@ -283,6 +427,20 @@ func (n *directoryReceiver) Fileattr(ctx receivers.ReceiveContext, path string,
 }
 
 func (n *directoryReceiver) FinishSubvolume(ctx receivers.ReceiveContext) error {
+	if err := n.files.Close(); err != nil {
+		return err
+	}
+	switch {
+	case n.versioned():
+		if err := n.finishVersion(ctx); err != nil {
+			return err
+		}
+	case n.staging:
+		if err := n.finishStaging(ctx); err != nil {
+			return err
+		}
+		n.staging = false
+	}
 	f, err := os.OpenFile(n.currentOffsetPath(ctx), os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		return err
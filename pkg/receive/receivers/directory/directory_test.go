@@ -0,0 +1,253 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package directory
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/receivertest"
+	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+)
+
+const testOffsetDirectory = ".btrsync"
+
+func checkTree(t *testing.T, root string, want map[string]string) {
+	t.Helper()
+	receivertest.CheckTree(t, root, want, testOffsetDirectory)
+}
+
+func readOffset(t *testing.T, dest string, subvol uuid.UUID) (uint64, bool) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dest, testOffsetDirectory, subvol.String()))
+	if os.IsNotExist(err) {
+		return 0, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return offset, true
+}
+
+func checkComplete(t *testing.T, dest string, subvol uuid.UUID) {
+	t.Helper()
+	if offset, ok := readOffset(t, dest, subvol); !ok || offset != math.MaxUint64-1 {
+		t.Errorf("subvolume %s is not recorded as complete", subvol)
+	}
+}
+
+func checkNotExist(t *testing.T, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %q to not exist: %v", path, err)
+		}
+	}
+}
+
+func TestCloneSourceUnavailable(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "root")
+	first, second := uuid.New(), uuid.New()
+
+	full := receivertest.NewStream(t).
+		Cmd(sendstream.NewSubvolCommand("root.1", first, 1)).
+		Cmd(sendstream.NewMkdirCommand("dir", 257)).
+		Cmd(sendstream.NewMkfileCommand("dir/a", 258)).
+		Cmd(sendstream.NewWriteCommand("dir/a", 0, []byte("one"))).
+		Cmd(sendstream.NewMkfileCommand("dir/b", 259)).
+		Cmd(sendstream.NewMkfileCommand("kept", 260)).
+		Cmd(sendstream.NewWriteCommand("kept", 0, []byte("kept"))).
+		Cmd(sendstream.NewSymlinkCommand("link", "kept", 261)).
+		End()
+	if err := receivertest.Receive(full, New(dest, testOffsetDirectory)); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dest, map[string]string{
+		"dir/": "", "dir/a": "one", "dir/b": "", "kept": "kept", "link": "-> " + filepath.Join(dest, "kept"),
+	})
+	checkComplete(t, dest, first)
+
+	// The incremental stream changes the destination before it clones from the
+	// previous snapshot, which is no longer there.
+	incremental := func() *bytes.Buffer {
+		return receivertest.NewStream(t).
+			Cmd(sendstream.NewSnapshotCommand("root.2", second, 2, first, 1)).
+			Cmd(sendstream.NewUnlinkCommand("dir/b")).
+			Cmd(sendstream.NewWriteCommand("kept", 0, []byte("KEPT"))).
+			Cmd(sendstream.NewMkfileCommand("cloned", 262)).
+			Cmd(sendstream.NewCloneCommand("cloned", 0, 4, first, 1, "kept", 0)).
+			Cmd(sendstream.NewUnlinkCommand("link")).
+			End()
+	}
+	err := receivertest.Receive(incremental(), New(dest, testOffsetDirectory))
+	if !errors.Is(err, receivers.ErrCloneSourceUnavailable) {
+		t.Fatalf("expected clone source to be unavailable, got %v", err)
+	}
+	if _, ok := readOffset(t, dest, second); ok {
+		t.Error("expected the progress of the incremental stream to be forgotten")
+	}
+
+	// The destination is not touched by the incremental stream again
+	before := receivertest.ReadTree(t, dest, testOffsetDirectory)
+	err = receivertest.Receive(incremental(), New(dest, testOffsetDirectory))
+	if !errors.Is(err, receivers.ErrCloneSourceUnavailable) {
+		t.Fatalf("expected the incremental stream to be refused, got %v", err)
+	}
+	checkTree(t, dest, before)
+
+	// The full stream replaces the destination, even though the directory it renames
+	// into place already exists and is not empty.
+	resend := receivertest.NewStream(t).
+		Cmd(sendstream.NewSubvolCommand("root.2", second, 2)).
+		Cmd(sendstream.NewMkdirCommand("o257-2-0", 257)).
+		Cmd(sendstream.NewMkfileCommand("o257-2-0/a", 258)).
+		Cmd(sendstream.NewWriteCommand("o257-2-0/a", 0, []byte("one"))).
+		Cmd(sendstream.NewRenameCommand("o257-2-0", "dir")).
+		Cmd(sendstream.NewMkfileCommand("kept", 260)).
+		Cmd(sendstream.NewWriteCommand("kept", 0, []byte("KEPT"))).
+		Cmd(sendstream.NewMkfileCommand("cloned", 262)).
+		Cmd(sendstream.NewCloneCommand("cloned", 0, 4, second, 2, "kept", 0)).
+		End()
+	if err := receivertest.Receive(resend, New(dest, testOffsetDirectory)); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dest, map[string]string{
+		"dir/": "", "dir/a": "one", "kept": "KEPT", "cloned": "KEPT",
+	})
+	checkComplete(t, dest, first)
+	checkComplete(t, dest, second)
+	checkNotExist(t, dest+StagingSuffix, dest+replacedSuffix)
+}
+
+func TestResumeStaging(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "root")
+	subvol := uuid.New()
+	stream := func() *bytes.Buffer {
+		return receivertest.NewStream(t).
+			Cmd(sendstream.NewSubvolCommand("root.1", subvol, 1)).
+			Cmd(sendstream.NewMkfileCommand("a", 257)).
+			Cmd(sendstream.NewWriteCommand("a", 0, []byte("a"))).
+			Cmd(sendstream.NewMkfileCommand("b", 258)).
+			Cmd(sendstream.NewWriteCommand("b", 0, []byte("b"))).
+			End()
+	}
+	if err := os.MkdirAll(filepath.Join(dest, testOffsetDirectory), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dest, "stale"), []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop before the second file is written
+	stopped := errors.New("stopped")
+	rcvr := &failingReceiver{Receiver: New(dest, testOffsetDirectory), failAt: 4, err: stopped}
+	if err := receivertest.Receive(stream(), rcvr); !errors.Is(err, stopped) {
+		t.Fatalf("expected the receive to stop, got %v", err)
+	}
+	checkTree(t, dest, map[string]string{"stale": "stale"})
+	checkTree(t, dest+StagingSuffix, map[string]string{"a": "a", "b": ""})
+	if offset, _ := readOffset(t, dest, subvol); offset != 3 {
+		t.Fatalf("expected progress to be recorded at offset 3, got %d", offset)
+	}
+
+	// Change the first file to make sure it is not written again
+	if err := os.WriteFile(filepath.Join(dest+StagingSuffix, "a"), []byte("resumed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := receivertest.Receive(stream(), New(dest, testOffsetDirectory)); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dest, map[string]string{"a": "resumed", "b": "b"})
+	checkComplete(t, dest, subvol)
+	checkNotExist(t, dest+StagingSuffix, dest+replacedSuffix)
+}
+
+func TestRecoverStaging(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// moved is set if the staged subvolume was moved into place before the
+		// receive was interrupted
+		moved bool
+	}{
+		{name: "before staged subvolume is moved"},
+		{name: "after staged subvolume is moved", moved: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "root")
+			subvol := uuid.New()
+			// The whole stream was received, but the receive stopped while moving the
+			// staged subvolume into place
+			for path, data := range map[string]string{
+				filepath.Join(dest+replacedSuffix, "stale"):                              "stale",
+				filepath.Join(dest+replacedSuffix, testOffsetDirectory, subvol.String()): "2",
+				filepath.Join(dest+StagingSuffix, "a"):                                   "a",
+			} {
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.moved {
+				if err := os.Rename(dest+StagingSuffix, dest); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stream := receivertest.NewStream(t).
+				Cmd(sendstream.NewSubvolCommand("root.1", subvol, 1)).
+				Cmd(sendstream.NewMkfileCommand("a", 257)).
+				Cmd(sendstream.NewWriteCommand("a", 0, []byte("a"))).
+				End()
+			if err := receivertest.Receive(stream, New(dest, testOffsetDirectory)); err != nil {
+				t.Fatal(err)
+			}
+			checkTree(t, dest, map[string]string{"a": "a"})
+			checkComplete(t, dest, subvol)
+			checkNotExist(t, dest+StagingSuffix, dest+replacedSuffix)
+		})
+	}
+}
+
+// failingReceiver fails the command at the given offset of the stream.
+type failingReceiver struct {
+	receivers.Receiver
+	failAt uint64
+	err    error
+}
+
+func (f *failingReceiver) PreOp(ctx receivers.ReceiveContext, hdr sendstream.CmdHeader, attrs sendstream.CmdAttrs) error {
+	if ctx.CurrentOffset() == f.failAt {
+		return f.err
+	}
+	return f.Receiver.(receivers.PreOpReceiver).PreOp(ctx, hdr, attrs)
+}
+
+func (f *failingReceiver) PostOp(ctx receivers.ReceiveContext, hdr sendstream.CmdHeader, attrs sendstream.CmdAttrs) error {
+	return f.Receiver.(receivers.PostOpReceiver).PostOp(ctx, hdr, attrs)
+}
@@ -0,0 +1,145 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package directory
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+)
+
+// StagingSuffix is appended to the destination to name the directory that full streams
+// are received into when not receiving into version directories. The staged subvolume
+// replaces the destination once it is complete, so nothing left behind by a previous
+// snapshot, or by an incremental stream that failed part way, survives a full send.
+const StagingSuffix = ".btrsync-staging"
+
+// replacedSuffix is appended to the destination to name the previous contents while a
+// staged subvolume is moved into place.
+const replacedSuffix = ".btrsync-replaced"
+
+func (n *directoryReceiver) stagingPath() string { return n.destPath + StagingSuffix }
+
+func (n *directoryReceiver) replacedPath() string { return n.destPath + replacedSuffix }
+
+// requireFullSend records that the destination was changed by an incremental stream
+// that cannot be completed, by forgetting the progress of the stream and leaving an
+// empty staging directory behind. Incremental streams are refused while there is a
+// staging directory, so the destination is only ever replaced by a full stream.
+func (n *directoryReceiver) requireFullSend(ctx receivers.ReceiveContext) error {
+	if err := os.Remove(n.currentOffsetPath(ctx)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.RemoveAll(n.stagingPath()); err != nil {
+		return err
+	}
+	return os.Mkdir(n.stagingPath(), 0755)
+}
+
+// checkStaging refuses an incremental stream if a full stream is pending.
+func (n *directoryReceiver) checkStaging() error {
+	if _, err := os.Stat(n.stagingPath()); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return fmt.Errorf("%w: %q is waiting for a full send", receivers.ErrCloneSourceUnavailable, n.destPath)
+}
+
+// startStaging prepares the staging directory for a full stream. A staging directory
+// left behind by an interrupted receive is kept when resuming.
+func (n *directoryReceiver) startStaging(ctx receivers.ReceiveContext) error {
+	n.staging = true
+	staging := n.stagingPath()
+	if n.currentOffset > 0 {
+		if _, err := os.Stat(staging); err == nil {
+			ctx.LogVerbose(2, "resuming staged subvolume at %q\n", staging)
+			return nil
+		}
+		// The progress does not match what is on disk, start over
+		n.currentOffset = 0
+	}
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	ctx.LogVerbose(2, "staging subvolume at %q\n", staging)
+	return os.MkdirAll(staging, 0755)
+}
+
+// finishStaging moves the staged subvolume into place of the destination. The progress
+// files are carried over from the previous contents.
+func (n *directoryReceiver) finishStaging(ctx receivers.ReceiveContext) error {
+	staging := n.stagingPath()
+	if _, err := os.Stat(staging); err != nil {
+		if os.IsNotExist(err) {
+			// Already moved into place by a previous receive
+			return nil
+		}
+		return err
+	}
+	replaced := n.replacedPath()
+	if err := os.RemoveAll(replaced); err != nil {
+		return err
+	}
+	ctx.LogVerbose(2, "moving staged subvolume %q to %q\n", staging, n.destPath)
+	if err := os.Rename(n.destPath, replaced); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, n.destPath); err != nil {
+		return err
+	}
+	return n.removeReplaced()
+}
+
+// recoverStaging completes or undoes moving a staged subvolume into place if a previous
+// receive was interrupted while doing so.
+func (n *directoryReceiver) recoverStaging(ctx receivers.ReceiveContext) error {
+	if _, err := os.Stat(n.replacedPath()); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if _, err := os.Stat(n.destPath); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		// The staged subvolume never made it into place, it is moved again once the
+		// stream is finished
+		ctx.LogVerbose(1, "restoring %q from interrupted swap\n", n.destPath)
+		return os.Rename(n.replacedPath(), n.destPath)
+	}
+	ctx.LogVerbose(1, "completing interrupted swap of %q\n", n.destPath)
+	return n.removeReplaced()
+}
+
+// removeReplaced moves the progress files out of the previous contents of the
+// destination and removes the rest.
+func (n *directoryReceiver) removeReplaced() error {
+	replaced := n.replacedPath()
+	offsets := filepath.Join(replaced, n.offsetDirectory)
+	if _, err := os.Stat(offsets); err == nil {
+		if err := os.Rename(offsets, filepath.Join(n.destPath, n.offsetDirectory)); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(replaced)
+}
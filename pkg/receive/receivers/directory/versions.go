@@ -0,0 +1,448 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package directory
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
+
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+)
+
+// PartialVersionPrefix is the prefix given to the directory of a version that is
+// still being received.
+const PartialVersionPrefix = ".partial-"
+
+// versionsDirectory is the directory inside the offset directory that maps subvolume
+// UUIDs to the names of their version directories.
+const versionsDirectory = "versions"
+
+// Option is a function that configures the directory receiver.
+type Option func(*directoryReceiver)
+
+// WithVersions will receive every subvolume into its own version directory instead of
+// updating the destination in place. The name of the version directory is computed by
+// calling nameFunc with the name of the received subvolume. Incremental streams start
+// from a copy of the parent version in which every file is hardlinked, and files are
+// only copied when the stream changes them. This keeps unchanged files shared between
+// versions.
+func WithVersions(nameFunc func(subvolume string) string) Option {
+	return func(n *directoryReceiver) {
+		n.versionName = nameFunc
+	}
+}
+
+// VersionDirectory returns the name of the version directory holding the subvolume
+// with the given UUID, as recorded by a receiver created with WithVersions.
+func VersionDirectory(destPath, offsetDirectory string, subvolUUID uuid.UUID) (string, error) {
+	data, err := os.ReadFile(filepath.Join(destPath, offsetDirectory, versionsDirectory, subvolUUID.String()))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (n *directoryReceiver) versioned() bool { return n.versionName != nil }
+
+func (n *directoryReceiver) partialPath() string {
+	return filepath.Join(n.destPath, PartialVersionPrefix+n.version)
+}
+
+// startVersion prepares the directory for the version being received. If parent is
+// not empty the new version is seeded with hardlinks to the parent version. A partial
+// version left behind by an interrupted receive is kept when resuming.
+func (n *directoryReceiver) startVersion(ctx receivers.ReceiveContext, subvolPath string, parent uuid.UUID) error {
+	n.version = n.versionName(filepath.Base(subvolPath))
+	n.fresh = make(map[uint64]struct{})
+	n.links = make(map[uint64][]string)
+	partial := n.partialPath()
+	if n.currentOffset > 0 {
+		if _, err := os.Stat(partial); err == nil {
+			ctx.LogVerbose(2, "resuming partial version at %q\n", partial)
+			n.links, err = indexLinks(partial)
+			return err
+		}
+		// The progress does not match what is on disk, start over
+		n.currentOffset = 0
+	}
+	if err := os.RemoveAll(partial); err != nil {
+		return err
+	}
+	if parent == uuid.Nil {
+		ctx.LogVerbose(2, "creating version directory at %q\n", partial)
+		return os.MkdirAll(partial, 0755)
+	}
+	parentVersion, err := VersionDirectory(n.destPath, n.offsetDirectory, parent)
+	if err != nil {
+		return fmt.Errorf("cannot find version for parent subvolume %s: %w", parent, err)
+	}
+	parentPath := filepath.Join(n.destPath, parentVersion)
+	ctx.LogVerbose(2, "linking version %q from parent %q\n", partial, parentPath)
+	n.links, err = linkTree(parentPath, partial)
+	return err
+}
+
+// finishVersion moves the completed version into place and records it in the index.
+func (n *directoryReceiver) finishVersion(ctx receivers.ReceiveContext) error {
+	final := filepath.Join(n.destPath, n.version)
+	if _, err := os.Stat(n.partialPath()); err != nil {
+		if os.IsNotExist(err) {
+			// Already completed by a previous receive
+			return nil
+		}
+		return err
+	}
+	if err := os.RemoveAll(final); err != nil {
+		return err
+	}
+	ctx.LogVerbose(2, "completing version at %q\n", final)
+	if err := os.Rename(n.partialPath(), final); err != nil {
+		return err
+	}
+	index := filepath.Join(n.destPath, n.offsetDirectory, versionsDirectory)
+	if err := os.MkdirAll(index, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(index, ctx.CurrentSubvolume().UUID.String()), []byte(n.version), 0644)
+}
+
+// writablePath resolves the path and makes sure that changing the file, or its
+// metadata, does not change a previous version that shares it.
+func (n *directoryReceiver) writablePath(ctx receivers.ReceiveContext, path string) (string, error) {
+	path = n.resolvePath(ctx, path)
+	if !n.versioned() {
+		return path, nil
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return "", &fs.PathError{Op: "lstat", Path: path, Err: err}
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR || st.Nlink <= 1 {
+		return path, nil
+	}
+	if _, ok := n.fresh[st.Ino]; ok {
+		return path, nil
+	}
+	ctx.LogVerbose(4, "breaking hardlink to previous version for %q\n", path)
+	if err := n.breakLink(path, &st); err != nil {
+		return "", fmt.Errorf("error copying %q from previous version: %w", path, err)
+	}
+	return path, nil
+}
+
+// breakLink replaces the file at path with a copy that is not shared with previous
+// versions. Other paths in the version that are hardlinked to the file are linked to
+// the copy.
+func (n *directoryReceiver) breakLink(path string, st *syscall.Stat_t) error {
+	links := []string{path}
+	for _, link := range n.links[st.Ino] {
+		var linkSt syscall.Stat_t
+		if link != path && syscall.Lstat(link, &linkSt) == nil && linkSt.Ino == st.Ino {
+			links = append(links, link)
+		}
+	}
+	for _, link := range links {
+		if err := n.files.Invalidate(link); err != nil {
+			return err
+		}
+	}
+	ino, err := copyNode(path, st)
+	if err != nil {
+		return err
+	}
+	for _, link := range links[1:] {
+		if err := replaceLink(path, link); err != nil {
+			return err
+		}
+	}
+	delete(n.links, st.Ino)
+	if len(links) > 1 {
+		n.links[ino] = links
+	}
+	n.fresh[ino] = struct{}{}
+	return nil
+}
+
+// markFresh records a file created by the current receive.
+func (n *directoryReceiver) markFresh(path string) {
+	if !n.versioned() {
+		return
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err == nil {
+		n.fresh[st.Ino] = struct{}{}
+	}
+}
+
+// addLink records a hardlink the stream made to a file still shared with previous
+// versions, so that both paths keep pointing at the same file once it is copied.
+func (n *directoryReceiver) addLink(path, linkTo string) {
+	if !n.versioned() {
+		return
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(linkTo, &st); err != nil {
+		return
+	}
+	if _, ok := n.fresh[st.Ino]; ok {
+		return
+	}
+	if len(n.links[st.Ino]) == 0 {
+		n.links[st.Ino] = []string{linkTo}
+	}
+	n.links[st.Ino] = append(n.links[st.Ino], path)
+}
+
+// renameLinks updates the recorded hardlinks after oldPath is renamed to newPath.
+func (n *directoryReceiver) renameLinks(oldPath, newPath string) {
+	if !n.versioned() {
+		return
+	}
+	prefix := oldPath + string(filepath.Separator)
+	for _, links := range n.links {
+		for i, link := range links {
+			if link == oldPath {
+				links[i] = newPath
+			} else if strings.HasPrefix(link, prefix) {
+				links[i] = filepath.Join(newPath, strings.TrimPrefix(link, prefix))
+			}
+		}
+	}
+}
+
+// linkTree recreates the directories under src at dest and hardlinks everything else.
+// The paths under dest of files that are hardlinked to each other within src are
+// returned by inode.
+func linkTree(src, dest string) (map[uint64][]string, error) {
+	var dirs []string
+	links := make(map[uint64][]string)
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if !d.IsDir() {
+			var st syscall.Stat_t
+			if err := syscall.Lstat(path, &st); err != nil {
+				return err
+			}
+			links[st.Ino] = append(links[st.Ino], target)
+			return os.Link(path, target)
+		}
+		if err := os.Mkdir(target, 0700); err != nil {
+			return err
+		}
+		dirs = append(dirs, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Directories may not be writable and their times change while they are
+	// populated, so their metadata is copied last.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		srcDir, destDir := filepath.Join(src, dirs[i]), filepath.Join(dest, dirs[i])
+		if err := copyMetadata(srcDir, destDir); err != nil {
+			return nil, err
+		}
+		if err := copyTimes(srcDir, destDir); err != nil {
+			return nil, err
+		}
+	}
+	return hardlinked(links), nil
+}
+
+// indexLinks returns the paths of files under root that are hardlinked to each other
+// by inode.
+func indexLinks(root string) (map[uint64][]string, error) {
+	links := make(map[uint64][]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		var st syscall.Stat_t
+		if err := syscall.Lstat(path, &st); err != nil {
+			return err
+		}
+		if st.Nlink > 1 {
+			links[st.Ino] = append(links[st.Ino], path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hardlinked(links), nil
+}
+
+// hardlinked removes the inodes with a single path.
+func hardlinked(links map[uint64][]string) map[uint64][]string {
+	for ino, paths := range links {
+		if len(paths) < 2 {
+			delete(links, ino)
+		}
+	}
+	return links
+}
+
+// copyNode replaces the file at path with a copy of itself and returns the inode of
+// the copy. Symlinks, device nodes, fifos and sockets are created anew.
+func copyNode(path string, st *syscall.Stat_t) (uint64, error) {
+	tmp := filepath.Join(filepath.Dir(path), ".btrsync-copy-"+filepath.Base(path))
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	var err error
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		err = copyData(path, tmp, fs.FileMode(st.Mode).Perm())
+	case syscall.S_IFLNK:
+		var target string
+		if target, err = os.Readlink(path); err == nil {
+			err = os.Symlink(target, tmp)
+		}
+	default:
+		err = syscall.Mknod(tmp, st.Mode, int(st.Rdev))
+	}
+	if err == nil {
+		err = copyMetadata(path, tmp)
+	}
+	if err == nil {
+		err = copyTimes(path, tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	var copied syscall.Stat_t
+	if err := syscall.Lstat(path, &copied); err != nil {
+		return 0, err
+	}
+	return copied.Ino, nil
+}
+
+func copyData(src, dest string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// replaceLink replaces the file at path with a hardlink to target.
+func replaceLink(target, path string) error {
+	tmp := filepath.Join(filepath.Dir(path), ".btrsync-link-"+filepath.Base(path))
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// copyMetadata copies the mode, ownership and extended attributes of src to dest.
+// Symlinks are not followed.
+func copyMetadata(src, dest string) error {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(src, &st); err != nil {
+		return err
+	}
+	if err := os.Lchown(dest, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		// The mode of a symlink cannot be changed
+		if err := syscall.Chmod(dest, st.Mode&07777); err != nil {
+			return err
+		}
+	}
+	return copyXattrs(src, dest)
+}
+
+func copyTimes(src, dest string) error {
+	var st unix.Stat_t
+	if err := unix.Lstat(src, &st); err != nil {
+		return err
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, dest, []unix.Timespec{st.Atim, st.Mtim}, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func copyXattrs(src, dest string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(src, buf)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, vsize)
+		if vsize > 0 {
+			if vsize, err = unix.Lgetxattr(src, name, value); err != nil {
+				return err
+			}
+		}
+		if err := unix.Lsetxattr(dest, name, value[:vsize], 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package directory
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
+
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/receivertest"
+	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+)
+
+const testXattr = "user.btrsync"
+
+func newVersionedReceiver(dest string) receivers.Receiver {
+	return New(dest, testOffsetDirectory, WithVersions(func(name string) string {
+		return strings.TrimPrefix(name, "root.")
+	}))
+}
+
+// readMetadata returns the mode, modification time and test xattr of everything
+// under root.
+func readMetadata(t *testing.T, root string) map[string]string {
+	t.Helper()
+	metadata := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(path, &st); err != nil {
+			return err
+		}
+		xattr := make([]byte, 64)
+		size, err := unix.Lgetxattr(path, testXattr, xattr)
+		if err != nil {
+			size = 0
+		}
+		rel, _ := filepath.Rel(root, path)
+		metadata[rel] = fmt.Sprintf("mode=%o mtime=%d xattr=%q", st.Mode, st.Mtim.Nano(), xattr[:size])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata
+}
+
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+	infoA, err := os.Lstat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infoB, err := os.Lstat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(infoA, infoB)
+}
+
+func TestVersionsKeepPreviousVersions(t *testing.T) {
+	dest := t.TempDir()
+	first, second := uuid.New(), uuid.New()
+	sent, changed := time.Unix(1669593600, 0), time.Unix(1669680000, 0)
+	xattrs := unix.Setxattr(dest, testXattr, []byte("test"), 0) == nil
+
+	full := receivertest.NewStream(t).
+		Cmd(sendstream.NewSubvolCommand("root.1", first, 1)).
+		Cmd(sendstream.NewMkdirCommand("dir", 257)).
+		Cmd(sendstream.NewMkfileCommand("dir/unchanged", 258)).
+		Cmd(sendstream.NewWriteCommand("dir/unchanged", 0, []byte("unchanged"))).
+		Cmd(sendstream.NewMkfileCommand("dir/shared", 259)).
+		Cmd(sendstream.NewWriteCommand("dir/shared", 0, []byte("shared"))).
+		Cmd(sendstream.NewMkfileCommand("data", 260)).
+		Cmd(sendstream.NewWriteCommand("data", 0, []byte("one"))).
+		Cmd(sendstream.NewMkfileCommand("linked", 261)).
+		Cmd(sendstream.NewWriteCommand("linked", 0, []byte("linked"))).
+		Cmd(sendstream.NewLinkCommand("linked2", "linked")).
+		Cmd(sendstream.NewSymlinkCommand("symlink", "data", 262)).
+		Cmd(sendstream.NewMkfifoCommand("fifo", 263)).
+		Cmd(sendstream.NewMksockCommand("socket", 264)).
+		Cmd(sendstream.NewMkfileCommand("tagged", 265)).
+		Cmd(sendstream.NewChmodCommand("fifo", 0644)).
+		Cmd(sendstream.NewUtimesCommand("symlink", sent, sent, sent)).
+		Cmd(sendstream.NewUtimesCommand("fifo", sent, sent, sent)).
+		Cmd(sendstream.NewUtimesCommand("socket", sent, sent, sent)).
+		End()
+	if err := receivertest.Receive(full, newVersionedReceiver(dest)); err != nil {
+		t.Fatal(err)
+	}
+	v1, v2 := filepath.Join(dest, "1"), filepath.Join(dest, "2")
+	previous := readMetadata(t, v1)
+
+	incremental := receivertest.NewStream(t).
+		Cmd(sendstream.NewSnapshotCommand("root.2", second, 2, first, 1)).
+		Cmd(sendstream.NewWriteCommand("data", 0, []byte("two"))).
+		Cmd(sendstream.NewWriteCommand("linked2", 0, []byte("LINKED"))).
+		Cmd(sendstream.NewChmodCommand("linked", 0600)).
+		Cmd(sendstream.NewUtimesCommand("symlink", changed, changed, changed)).
+		Cmd(sendstream.NewChmodCommand("fifo", 0600)).
+		Cmd(sendstream.NewUtimesCommand("fifo", changed, changed, changed)).
+		Cmd(sendstream.NewUtimesCommand("socket", changed, changed, changed)).
+		Cmd(sendstream.NewLinkCommand("dir/alias", "dir/shared")).
+		Cmd(sendstream.NewRenameCommand("dir", "moved")).
+		Cmd(sendstream.NewWriteCommand("moved/alias", 0, []byte("SHARED")))
+	if xattrs {
+		incremental.Cmd(sendstream.NewSetXattrCommand("tagged", testXattr, []byte("changed")))
+	} else {
+		t.Log("extended attributes are not supported, skipping set_xattr")
+	}
+	if err := receivertest.Receive(incremental.End(), newVersionedReceiver(dest)); err != nil {
+		t.Fatal(err)
+	}
+	checkComplete(t, dest, second)
+
+	// The previous version is unchanged
+	receivertest.CheckTree(t, v1, map[string]string{
+		"dir/": "", "dir/unchanged": "unchanged", "dir/shared": "shared",
+		"data": "one", "linked": "linked", "linked2": "linked", "symlink": "-> data",
+		"fifo": "p---------", "socket": "S---------", "tagged": "",
+	})
+	if got := readMetadata(t, v1); fmt.Sprint(got) != fmt.Sprint(previous) {
+		t.Errorf("metadata of the previous version changed:\ngot:  %v\nwant: %v", got, previous)
+	}
+
+	// The new version has the changes, with its own hardlinks intact
+	receivertest.CheckTree(t, v2, map[string]string{
+		"moved/": "", "moved/unchanged": "unchanged", "moved/shared": "SHARED", "moved/alias": "SHARED",
+		"data": "two", "linked": "LINKED", "linked2": "LINKED", "symlink": "-> data",
+		"fifo": "p---------", "socket": "S---------", "tagged": "",
+	})
+	current := readMetadata(t, v2)
+	for path, want := range map[string]string{
+		"linked":  fmt.Sprintf("mode=%o", unix.S_IFREG|0600),
+		"linked2": fmt.Sprintf("mode=%o", unix.S_IFREG|0600),
+		"fifo":    fmt.Sprintf("mode=%o mtime=%d", unix.S_IFIFO|0600, changed.UnixNano()),
+		"symlink": fmt.Sprintf("mtime=%d", changed.UnixNano()),
+		"socket":  fmt.Sprintf("mtime=%d", changed.UnixNano()),
+	} {
+		for _, field := range strings.Fields(want) {
+			if !strings.Contains(current[path], field) {
+				t.Errorf("expected %s to have %s, got %s", path, field, current[path])
+			}
+		}
+	}
+	if xattrs && !strings.Contains(current["tagged"], `xattr="changed"`) {
+		t.Errorf("expected tagged to have the xattr set, got %s", current["tagged"])
+	}
+	for _, pair := range [][2]string{{"linked", "linked2"}, {"moved/shared", "moved/alias"}} {
+		if !sameFile(t, filepath.Join(v2, pair[0]), filepath.Join(v2, pair[1])) {
+			t.Errorf("expected %s and %s to stay hardlinked", pair[0], pair[1])
+		}
+	}
+	if !sameFile(t, filepath.Join(v1, "dir/unchanged"), filepath.Join(v2, "moved/unchanged")) {
+		t.Error("expected the unchanged file to be shared between versions")
+	}
+}
@@ -14,256 +14,416 @@ If not, see <https://www.gnu.org/licenses/>.
 */
 
 // Package dispatch provides a receiver that dispatches to multiple receivers.
+//
+// By default commands are delivered to each target in order and the first error
+// aborts the stream. Targets can be given individual error policies, and delivery
+// can be made concurrent, in which case each target receives commands from its own
+// bounded queue and only blocks the stream when that queue is full. PreOp and PostOp
+// hooks are forwarded to every target that implements them, so receivers that track
+// their progress (such as the directory receiver) keep working behind a dispatcher.
 package dispatch
 
 import (
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 
 	"github.com/tinyzimmer/btrsync/pkg/btrfs"
 	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+	"github.com/tinyzimmer/btrsync/pkg/sendstream"
 )
 
-type dispatchReceiver struct {
-	receivers []receivers.Receiver
+// ErrNoTargets is returned when every target of a dispatcher has been dropped.
+var ErrNoTargets = errors.New("no dispatch targets remaining")
+
+// Dispatcher is a receiver that forwards every operation to a set of targets.
+type Dispatcher struct {
+	targets   []*target
+	queueSize int
+
+	// pending holds the command header seen by the last PreOp so that
+	// concurrent targets can run their own hooks around the operation.
+	pending *pendingCmd
+
+	mu     sync.Mutex
+	err    error
+	wg     sync.WaitGroup
+	closed bool
 }
 
-func New(receivers ...receivers.Receiver) receivers.Receiver {
-	return &dispatchReceiver{receivers: receivers}
+type pendingCmd struct {
+	hdr   sendstream.CmdHeader
+	attrs sendstream.CmdAttrs
 }
 
-func (n *dispatchReceiver) Subvol(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64) error {
-	for _, r := range n.receivers {
-		if err := r.Subvol(ctx, path, uuid, ctransid); err != nil {
-			return err
-		}
+type opFunc func(ctx receivers.ReceiveContext, r receivers.Receiver) error
+
+// New returns a receiver that dispatches every operation sequentially to the given
+// receivers. The first error returned by any of them is returned to the stream.
+func New(rcvrs ...receivers.Receiver) receivers.Receiver {
+	opts := make([]Option, len(rcvrs))
+	for i, r := range rcvrs {
+		opts[i] = WithTarget(r, FailAll)
 	}
-	return nil
+	return NewWithOptions(opts...)
 }
 
-func (n *dispatchReceiver) Snapshot(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64, cloneUUID uuid.UUID, cloneCtransid uint64) error {
-	for _, r := range n.receivers {
-		if err := r.Snapshot(ctx, path, uuid, ctransid, cloneUUID, cloneCtransid); err != nil {
-			return err
+// NewWithOptions returns a new dispatcher configured with the given options. If
+// concurrent delivery was requested, Close must be called once the stream has been
+// processed to release the target workers.
+func NewWithOptions(opts ...Option) *Dispatcher {
+	d := &Dispatcher{}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.queueSize > 0 {
+		for _, t := range d.targets {
+			t.queue = make(chan *op, d.queueSize)
+			d.wg.Add(1)
+			go d.runTarget(t)
 		}
 	}
-	return nil
+	return d
 }
 
-func (n *dispatchReceiver) Mkfile(ctx receivers.ReceiveContext, path string, ino uint64) error {
-	for _, r := range n.receivers {
-		if err := r.Mkfile(ctx, path, ino); err != nil {
-			return err
+// Close waits for all queued operations to be delivered and stops the target
+// workers. It returns the error that caused the dispatcher to fail, if any.
+func (d *Dispatcher) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return d.err
+	}
+	d.closed = true
+	d.mu.Unlock()
+	if d.queueSize > 0 {
+		for _, t := range d.targets {
+			close(t.queue)
 		}
+		d.wg.Wait()
 	}
-	return nil
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
 }
 
-func (n *dispatchReceiver) Mkdir(ctx receivers.ReceiveContext, path string, ino uint64) error {
-	for _, r := range n.receivers {
-		if err := r.Mkdir(ctx, path, ino); err != nil {
-			return err
+// Dropped returns the receivers that were dropped due to errors.
+func (d *Dispatcher) Dropped() []receivers.Receiver {
+	var dropped []receivers.Receiver
+	for _, t := range d.targets {
+		if t.isDropped() {
+			dropped = append(dropped, t.rcvr)
 		}
 	}
-	return nil
+	return dropped
 }
 
-func (n *dispatchReceiver) Mknod(ctx receivers.ReceiveContext, path string, ino uint64, mode uint32, rdev uint64) error {
-	for _, r := range n.receivers {
-		if err := r.Mknod(ctx, path, ino, mode, rdev); err != nil {
-			return err
-		}
-	}
-	return nil
+func (d *Dispatcher) failure() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
 }
 
-func (n *dispatchReceiver) Mkfifo(ctx receivers.ReceiveContext, path string, ino uint64) error {
-	for _, r := range n.receivers {
-		if err := r.Mkfifo(ctx, path, ino); err != nil {
-			return err
-		}
+func (d *Dispatcher) fail(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err == nil {
+		d.err = err
 	}
-	return nil
 }
 
-func (n *dispatchReceiver) Mksock(ctx receivers.ReceiveContext, path string, ino uint64) error {
-	for _, r := range n.receivers {
-		if err := r.Mksock(ctx, path, ino); err != nil {
-			return err
+func (d *Dispatcher) activeTargets() []*target {
+	active := make([]*target, 0, len(d.targets))
+	for _, t := range d.targets {
+		if !t.isDropped() {
+			active = append(active, t)
 		}
 	}
-	return nil
+	return active
 }
 
-func (n *dispatchReceiver) Symlink(ctx receivers.ReceiveContext, path string, ino uint64, linkTo string) error {
-	for _, r := range n.receivers {
-		if err := r.Symlink(ctx, path, ino, linkTo); err != nil {
-			return err
+// handleError applies the target's error policy and returns the error if it should
+// abort the stream.
+func (d *Dispatcher) handleError(ctx receivers.ReceiveContext, t *target, err error) error {
+	if err == nil || errors.Is(err, receivers.ErrSkipCommand) {
+		return nil
+	}
+	err = fmt.Errorf("dispatch target %d: %w", t.idx, err)
+	switch t.policy {
+	case DropTarget:
+		ctx.LogVerbose(0, "Dropping %s\n", err)
+		t.drop()
+		if len(d.activeTargets()) == 0 {
+			d.fail(ErrNoTargets)
+			return ErrNoTargets
 		}
+		return nil
+	case Continue:
+		ctx.LogVerbose(0, "Ignoring error from %s\n", err)
+		return nil
+	default:
+		d.fail(err)
+		return err
 	}
-	return nil
 }
 
-func (n *dispatchReceiver) Rename(ctx receivers.ReceiveContext, oldPath string, newPath string) error {
-	for _, r := range n.receivers {
-		if err := r.Rename(ctx, oldPath, newPath); err != nil {
-			return err
-		}
-	}
-	return nil
+func (d *Dispatcher) takePending() *pendingCmd {
+	p := d.pending
+	d.pending = nil
+	return p
 }
 
-func (n *dispatchReceiver) Link(ctx receivers.ReceiveContext, path string, linkTo string) error {
-	for _, r := range n.receivers {
-		if err := r.Link(ctx, path, linkTo); err != nil {
+// dispatch delivers an operation to all active targets.
+func (d *Dispatcher) dispatch(ctx receivers.ReceiveContext, fn opFunc) error {
+	if err := d.failure(); err != nil {
+		return err
+	}
+	if d.queueSize > 0 {
+		return d.enqueue(ctx, d.takePending(), fn, false)
+	}
+	for _, t := range d.activeTargets() {
+		if t.skip {
+			continue
+		}
+		if err := d.handleError(ctx, t, fn(ctx, t.rcvr)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (n *dispatchReceiver) Unlink(ctx receivers.ReceiveContext, path string) error {
-	for _, r := range n.receivers {
-		if err := r.Unlink(ctx, path); err != nil {
+// PreOp runs the PreOp hook of every target that implements it. When delivering
+// sequentially, targets that ask to skip the command do not receive it. The command
+// is only skipped for the stream when every target asks to skip it. When delivering
+// concurrently, the hooks are run by each target's worker instead.
+func (d *Dispatcher) PreOp(ctx receivers.ReceiveContext, hdr sendstream.CmdHeader, attrs sendstream.CmdAttrs) error {
+	if err := d.failure(); err != nil {
+		return err
+	}
+	if d.queueSize > 0 {
+		d.pending = &pendingCmd{hdr: hdr, attrs: attrs}
+		return nil
+	}
+	active := d.activeTargets()
+	var skipped int
+	for _, t := range active {
+		t.skip = false
+		preOp, ok := t.rcvr.(receivers.PreOpReceiver)
+		if !ok {
+			continue
+		}
+		err := preOp.PreOp(ctx, hdr, attrs)
+		if errors.Is(err, receivers.ErrSkipCommand) {
+			t.skip = true
+			skipped++
+			continue
+		}
+		if err := d.handleError(ctx, t, err); err != nil {
 			return err
 		}
 	}
+	if len(active) > 0 && skipped == len(active) {
+		return receivers.ErrSkipCommand
+	}
 	return nil
 }
 
-func (n *dispatchReceiver) Rmdir(ctx receivers.ReceiveContext, path string) error {
-	for _, r := range n.receivers {
-		if err := r.Rmdir(ctx, path); err != nil {
+// PostOp runs the PostOp hook of every target that implements it and did not skip
+// the current command.
+func (d *Dispatcher) PostOp(ctx receivers.ReceiveContext, hdr sendstream.CmdHeader, attrs sendstream.CmdAttrs) error {
+	if d.queueSize > 0 {
+		// The command was never delivered if the pending header is still set.
+		d.pending = nil
+		return d.failure()
+	}
+	for _, t := range d.activeTargets() {
+		if t.skip {
+			t.skip = false
+			continue
+		}
+		postOp, ok := t.rcvr.(receivers.PostOpReceiver)
+		if !ok {
+			continue
+		}
+		if err := d.handleError(ctx, t, postOp.PostOp(ctx, hdr, attrs)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (n *dispatchReceiver) Write(ctx receivers.ReceiveContext, path string, offset uint64, data []byte) error {
-	for _, r := range n.receivers {
-		if err := r.Write(ctx, path, offset, data); err != nil {
-			return err
-		}
-	}
-	return nil
+func (d *Dispatcher) Subvol(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Subvol(ctx, path, uuid, ctransid)
+	})
 }
 
-func (n *dispatchReceiver) EncodedWrite(ctx receivers.ReceiveContext, path string, op *btrfs.EncodedWriteOp) error {
-	for _, r := range n.receivers {
-		o := op
-		if err := r.EncodedWrite(ctx, path, o); err != nil {
-			return err
-		}
-	}
-	return nil
+func (d *Dispatcher) Snapshot(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64, cloneUUID uuid.UUID, cloneCtransid uint64) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Snapshot(ctx, path, uuid, ctransid, cloneUUID, cloneCtransid)
+	})
 }
 
-func (n *dispatchReceiver) Clone(ctx receivers.ReceiveContext, path string, offset uint64, len uint64, cloneUUID uuid.UUID, cloneCtransid uint64, clonePath string, cloneOffset uint64) error {
-	for _, r := range n.receivers {
-		if err := r.Clone(ctx, path, offset, len, cloneUUID, cloneCtransid, clonePath, cloneOffset); err != nil {
-			return err
-		}
-	}
-	return nil
+func (d *Dispatcher) Mkfile(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Mkfile(ctx, path, ino)
+	})
 }
 
-func (n *dispatchReceiver) SetXattr(ctx receivers.ReceiveContext, path string, name string, data []byte) error {
-	for _, r := range n.receivers {
-		if err := r.SetXattr(ctx, path, name, data); err != nil {
-			return err
-		}
-	}
-	return nil
+func (d *Dispatcher) Mkdir(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Mkdir(ctx, path, ino)
+	})
 }
 
-func (n *dispatchReceiver) RemoveXattr(ctx receivers.ReceiveContext, path string, name string) error {
-	for _, r := range n.receivers {
-		if err := r.RemoveXattr(ctx, path, name); err != nil {
-			return err
-		}
-	}
-	return nil
+func (d *Dispatcher) Mknod(ctx receivers.ReceiveContext, path string, ino uint64, mode uint32, rdev uint64) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Mknod(ctx, path, ino, mode, rdev)
+	})
 }
 
-func (n *dispatchReceiver) Truncate(ctx receivers.ReceiveContext, path string, size uint64) error {
-	for _, r := range n.receivers {
-		if err := r.Truncate(ctx, path, size); err != nil {
-			return err
-		}
-	}
-	return nil
+func (d *Dispatcher) Mkfifo(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Mkfifo(ctx, path, ino)
+	})
 }
 
-func (n *dispatchReceiver) Chmod(ctx receivers.ReceiveContext, path string, mode uint64) error {
-	for _, r := range n.receivers {
-		if err := r.Chmod(ctx, path, mode); err != nil {
-			return err
-		}
-	}
-	return nil
+func (d *Dispatcher) Mksock(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Mksock(ctx, path, ino)
+	})
 }
 
-func (n *dispatchReceiver) Chown(ctx receivers.ReceiveContext, path string, uid uint64, gid uint64) error {
-	for _, r := range n.receivers {
-		if err := r.Chown(ctx, path, uid, gid); err != nil {
-			return err
-		}
-	}
-	return nil
+func (d *Dispatcher) Symlink(ctx receivers.ReceiveContext, path string, ino uint64, linkTo string) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Symlink(ctx, path, ino, linkTo)
+	})
 }
 
-func (n *dispatchReceiver) Utimes(ctx receivers.ReceiveContext, path string, atime, mtime, ctime time.Time) error {
-	for _, r := range n.receivers {
-		if err := r.Utimes(ctx, path, atime, mtime, ctime); err != nil {
-			return err
-		}
-	}
-	return nil
+func (d *Dispatcher) Rename(ctx receivers.ReceiveContext, oldPath string, newPath string) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Rename(ctx, oldPath, newPath)
+	})
 }
 
-func (n *dispatchReceiver) UpdateExtent(ctx receivers.ReceiveContext, path string, fileOffset uint64, tmpSize uint64) error {
-	for _, r := range n.receivers {
-		if err := r.UpdateExtent(ctx, path, fileOffset, tmpSize); err != nil {
-			return err
-		}
-	}
-	return nil
+func (d *Dispatcher) Link(ctx receivers.ReceiveContext, path string, linkTo string) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Link(ctx, path, linkTo)
+	})
 }
 
-func (n *dispatchReceiver) EnableVerity(ctx receivers.ReceiveContext, path string, algorithm uint8, blockSize uint32, salt []byte, sig []byte) error {
-	for _, r := range n.receivers {
-		if err := r.EnableVerity(ctx, path, algorithm, blockSize, salt, sig); err != nil {
-			return err
-		}
-	}
-	return nil
+func (d *Dispatcher) Unlink(ctx receivers.ReceiveContext, path string) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Unlink(ctx, path)
+	})
 }
 
-func (n *dispatchReceiver) Fallocate(ctx receivers.ReceiveContext, path string, mode uint32, offset uint64, len uint64) error {
-	for _, r := range n.receivers {
-		if err := r.Fallocate(ctx, path, mode, offset, len); err != nil {
-			return err
-		}
-	}
-	return nil
+func (d *Dispatcher) Rmdir(ctx receivers.ReceiveContext, path string) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Rmdir(ctx, path)
+	})
 }
 
-func (n *dispatchReceiver) Fileattr(ctx receivers.ReceiveContext, path string, attr uint32) error {
-	for _, r := range n.receivers {
-		if err := r.Fileattr(ctx, path, attr); err != nil {
-			return err
-		}
-	}
-	return nil
+func (d *Dispatcher) Write(ctx receivers.ReceiveContext, path string, offset uint64, data []byte) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Write(ctx, path, offset, data)
+	})
 }
 
-func (n *dispatchReceiver) FinishSubvolume(ctx receivers.ReceiveContext) error {
-	for _, r := range n.receivers {
-		if err := r.FinishSubvolume(ctx); err != nil {
-			return err
-		}
+func (d *Dispatcher) EncodedWrite(ctx receivers.ReceiveContext, path string, op *btrfs.EncodedWriteOp) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		// Give each target its own copy of the op header, receivers may modify it
+		o := *op
+		return r.EncodedWrite(ctx, path, &o)
+	})
+}
+
+func (d *Dispatcher) Clone(ctx receivers.ReceiveContext, path string, offset uint64, len uint64, cloneUUID uuid.UUID, cloneCtransid uint64, clonePath string, cloneOffset uint64) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Clone(ctx, path, offset, len, cloneUUID, cloneCtransid, clonePath, cloneOffset)
+	})
+}
+
+func (d *Dispatcher) SetXattr(ctx receivers.ReceiveContext, path string, name string, data []byte) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.SetXattr(ctx, path, name, data)
+	})
+}
+
+func (d *Dispatcher) RemoveXattr(ctx receivers.ReceiveContext, path string, name string) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.RemoveXattr(ctx, path, name)
+	})
+}
+
+func (d *Dispatcher) Truncate(ctx receivers.ReceiveContext, path string, size uint64) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Truncate(ctx, path, size)
+	})
+}
+
+func (d *Dispatcher) Chmod(ctx receivers.ReceiveContext, path string, mode uint64) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Chmod(ctx, path, mode)
+	})
+}
+
+func (d *Dispatcher) Chown(ctx receivers.ReceiveContext, path string, uid uint64, gid uint64) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Chown(ctx, path, uid, gid)
+	})
+}
+
+func (d *Dispatcher) Utimes(ctx receivers.ReceiveContext, path string, atime, mtime, ctime time.Time) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Utimes(ctx, path, atime, mtime, ctime)
+	})
+}
+
+func (d *Dispatcher) UpdateExtent(ctx receivers.ReceiveContext, path string, fileOffset uint64, tmpSize uint64) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.UpdateExtent(ctx, path, fileOffset, tmpSize)
+	})
+}
+
+func (d *Dispatcher) EnableVerity(ctx receivers.ReceiveContext, path string, algorithm uint8, blockSize uint32, salt []byte, sig []byte) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.EnableVerity(ctx, path, algorithm, blockSize, salt, sig)
+	})
+}
+
+func (d *Dispatcher) Fallocate(ctx receivers.ReceiveContext, path string, mode uint32, offset uint64, len uint64) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Fallocate(ctx, path, mode, offset, len)
+	})
+}
+
+func (d *Dispatcher) Fileattr(ctx receivers.ReceiveContext, path string, attr uint32) error {
+	return d.dispatch(ctx, func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.Fileattr(ctx, path, attr)
+	})
+}
+
+// FinishSubvolume finishes the subvolume on all targets. When delivering concurrently
+// it blocks until every target has drained its queue and finished the subvolume.
+func (d *Dispatcher) FinishSubvolume(ctx receivers.ReceiveContext) error {
+	fn := func(ctx receivers.ReceiveContext, r receivers.Receiver) error {
+		return r.FinishSubvolume(ctx)
 	}
-	return nil
+	if d.queueSize == 0 {
+		return d.dispatch(ctx, fn)
+	}
+	if err := d.failure(); err != nil {
+		return err
+	}
+	// A subvolume is also finished when the next one begins, in which case the
+	// pending command belongs to the subvolume that follows.
+	var cmd *pendingCmd
+	if d.pending != nil && d.pending.hdr.Cmd == sendstream.BTRFS_SEND_C_END {
+		cmd = d.takePending()
+	}
+	return d.enqueue(ctx, cmd, fn, true)
 }
@@ -0,0 +1,333 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dispatch
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/nop"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/receivertest"
+	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+)
+
+var (
+	errTarget = errors.New("target failed")
+	// errFinish fails finishing a subvolume, the only error that fails the stream
+	// once it ended
+	errFinish = fmt.Errorf("target failed: %w", receivers.ErrVerificationFailed)
+)
+
+// recorder records the operations it receives and fails the one named by failOn.
+type recorder struct {
+	receivers.Receiver
+	failOn string
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func newRecorder(failOn string) *recorder {
+	return &recorder{Receiver: nop.New(), failOn: failOn}
+}
+
+func (r *recorder) record(call string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+	if call == r.failOn {
+		if call == "finish" {
+			return errFinish
+		}
+		return errTarget
+	}
+	return nil
+}
+
+func (r *recorder) Calls() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.calls...)
+}
+
+func (r *recorder) Subvol(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64) error {
+	return r.record("subvol " + path)
+}
+
+func (r *recorder) Mkfile(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	return r.record("mkfile " + path)
+}
+
+func (r *recorder) FinishSubvolume(ctx receivers.ReceiveContext) error {
+	return r.record("finish")
+}
+
+// hookRecorder is a recorder that also records its PreOp and PostOp hooks, and asks
+// to skip the command named by skip.
+type hookRecorder struct {
+	*recorder
+	skip string
+}
+
+func (r *hookRecorder) PreOp(ctx receivers.ReceiveContext, hdr sendstream.CmdHeader, attrs sendstream.CmdAttrs) error {
+	call := "pre " + commandName(hdr, attrs)
+	if err := r.record(call); err != nil {
+		return err
+	}
+	if call == "pre "+r.skip {
+		return receivers.ErrSkipCommand
+	}
+	return nil
+}
+
+func (r *hookRecorder) PostOp(ctx receivers.ReceiveContext, hdr sendstream.CmdHeader, attrs sendstream.CmdAttrs) error {
+	return r.record("post " + commandName(hdr, attrs))
+}
+
+func commandName(hdr sendstream.CmdHeader, attrs sendstream.CmdAttrs) string {
+	name := strings.ToLower(strings.TrimPrefix(hdr.Cmd.String(), "BTRFS_SEND_C_"))
+	if path, ok := attrs[sendstream.BTRFS_SEND_A_PATH]; ok {
+		name += " " + string(path)
+	}
+	return name
+}
+
+// testStream creates the files a, b and c in a new subvolume.
+func testStream(t *testing.T) *receivertest.Stream {
+	return receivertest.NewStream(t).
+		Cmd(sendstream.NewSubvolCommand("root", uuid.New(), 1)).
+		Cmd(sendstream.NewMkfileCommand("a", 257)).
+		Cmd(sendstream.NewMkfileCommand("b", 258)).
+		Cmd(sendstream.NewMkfileCommand("c", 259))
+}
+
+var allCalls = []string{"subvol root", "mkfile a", "mkfile b", "mkfile c", "finish"}
+
+func deliveryModes() map[string][]Option {
+	return map[string][]Option{
+		"sequential": nil,
+		"concurrent": {WithConcurrentDelivery(2)},
+	}
+}
+
+func TestErrorPolicies(t *testing.T) {
+	tc := []struct {
+		name    string
+		policy  ErrorPolicy
+		failOn  []string
+		wantErr error
+		// wantCalls are the calls of each target, or nil where they depend on
+		// the delivery mode
+		wantCalls [][]string
+		// wantDropped are the indexes of the dropped targets
+		wantDropped []int
+	}{
+		{
+			name:      "fail all",
+			policy:    FailAll,
+			failOn:    []string{"mkfile b", ""},
+			wantErr:   errTarget,
+			wantCalls: [][]string{{"subvol root", "mkfile a", "mkfile b"}, nil},
+		},
+		{
+			name:      "fail all on finish",
+			policy:    FailAll,
+			failOn:    []string{"", "finish"},
+			wantErr:   errFinish,
+			wantCalls: [][]string{nil, allCalls},
+		},
+		{
+			name:        "drop target",
+			policy:      DropTarget,
+			failOn:      []string{"mkfile b", ""},
+			wantCalls:   [][]string{{"subvol root", "mkfile a", "mkfile b"}, allCalls},
+			wantDropped: []int{0},
+		},
+		{
+			name:        "drop target on finish",
+			policy:      DropTarget,
+			failOn:      []string{"", "finish"},
+			wantCalls:   [][]string{allCalls, allCalls},
+			wantDropped: []int{1},
+		},
+		{
+			name:        "drop every target",
+			policy:      DropTarget,
+			failOn:      []string{"mkfile a", "mkfile b"},
+			wantErr:     ErrNoTargets,
+			wantCalls:   [][]string{{"subvol root", "mkfile a"}, {"subvol root", "mkfile a", "mkfile b"}},
+			wantDropped: []int{0, 1},
+		},
+		{
+			name:      "continue",
+			policy:    Continue,
+			failOn:    []string{"mkfile b", "finish"},
+			wantCalls: [][]string{allCalls, allCalls},
+		},
+	}
+	for mode, modeOpts := range deliveryModes() {
+		for _, tt := range tc {
+			t.Run(mode+"/"+tt.name, func(t *testing.T) {
+				var targets []*recorder
+				opts := append([]Option(nil), modeOpts...)
+				for _, failOn := range tt.failOn {
+					r := newRecorder(failOn)
+					targets = append(targets, r)
+					opts = append(opts, WithTarget(r, tt.policy))
+				}
+				d := NewWithOptions(opts...)
+				err := receivertest.Receive(testStream(t).End(), d)
+				closeErr := d.Close()
+				if tt.wantErr == nil {
+					if err != nil || closeErr != nil {
+						t.Fatalf("expected no error, got %v and %v from close", err, closeErr)
+					}
+				} else {
+					if !errors.Is(err, tt.wantErr) {
+						t.Errorf("expected %v, got %v", tt.wantErr, err)
+					}
+					if !errors.Is(closeErr, tt.wantErr) {
+						t.Errorf("expected %v from close, got %v", tt.wantErr, closeErr)
+					}
+				}
+				for i, want := range tt.wantCalls {
+					if want == nil {
+						continue
+					}
+					if got := targets[i].Calls(); !reflect.DeepEqual(got, want) {
+						t.Errorf("expected target %d to receive %q, got %q", i, want, got)
+					}
+				}
+				var dropped []int
+				for _, r := range d.Dropped() {
+					for i, target := range targets {
+						if r == target {
+							dropped = append(dropped, i)
+						}
+					}
+				}
+				if !reflect.DeepEqual(dropped, tt.wantDropped) {
+					t.Errorf("expected targets %v to be dropped, got %v", tt.wantDropped, dropped)
+				}
+			})
+		}
+	}
+}
+
+func TestFailAllSequential(t *testing.T) {
+	// Targets after the failing one do not receive the failed command
+	failing, next := newRecorder("mkfile b"), newRecorder("")
+	d := New(failing, next)
+	err := receivertest.Receive(testStream(t).End(), d)
+	if !errors.Is(err, errTarget) {
+		t.Fatalf("expected the target error, got %v", err)
+	}
+	want := []string{"subvol root", "mkfile a"}
+	if got := next.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the next target to receive %q, got %q", want, got)
+	}
+}
+
+func TestHookForwarding(t *testing.T) {
+	// Commands are delivered between their hooks
+	wantCalls := []string{
+		"pre subvol root", "subvol root", "post subvol root",
+		"pre mkfile a", "mkfile a", "post mkfile a",
+		"pre mkfile b", "mkfile b", "post mkfile b",
+		"pre mkfile c", "mkfile c", "post mkfile c",
+		"pre end", "finish",
+	}
+	for mode, modeOpts := range deliveryModes() {
+		t.Run(mode, func(t *testing.T) {
+			wantCalls := wantCalls
+			if mode == "concurrent" {
+				// The stream does not run PostOp for an end command it honors, but
+				// workers run both hooks around every command they deliver
+				wantCalls = append(wantCalls, "post end")
+			}
+			hooked := &hookRecorder{recorder: newRecorder("")}
+			plain := newRecorder("")
+			d := NewWithOptions(append(modeOpts, WithTarget(hooked, FailAll), WithTarget(plain, FailAll))...)
+			if err := receivertest.Receive(testStream(t).End(), d); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := hooked.Calls(); !reflect.DeepEqual(got, wantCalls) {
+				t.Errorf("expected the hooked target to receive\n%q\ngot\n%q", wantCalls, got)
+			}
+			if got := plain.Calls(); !reflect.DeepEqual(got, allCalls) {
+				t.Errorf("expected the plain target to receive %q, got %q", allCalls, got)
+			}
+		})
+	}
+}
+
+func TestHookSkip(t *testing.T) {
+	for mode, modeOpts := range deliveryModes() {
+		t.Run(mode, func(t *testing.T) {
+			skipping := &hookRecorder{recorder: newRecorder(""), skip: "mkfile b"}
+			plain := newRecorder("")
+			d := NewWithOptions(append(modeOpts, WithTarget(skipping, FailAll), WithTarget(plain, FailAll))...)
+			if err := receivertest.Receive(testStream(t).End(), d); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// Only the target that asked to skip the command does not receive it
+			for _, call := range skipping.Calls() {
+				if call == "mkfile b" || call == "post mkfile b" {
+					t.Errorf("expected the skipped command to not be delivered, got %q", call)
+				}
+			}
+			if got := plain.Calls(); !reflect.DeepEqual(got, allCalls) {
+				t.Errorf("expected the plain target to receive %q, got %q", allCalls, got)
+			}
+		})
+	}
+}
+
+func TestHookErrors(t *testing.T) {
+	for mode, modeOpts := range deliveryModes() {
+		for _, failOn := range []string{"pre mkfile b", "post mkfile b"} {
+			t.Run(fmt.Sprintf("%s/%s", mode, failOn), func(t *testing.T) {
+				hooked := &hookRecorder{recorder: newRecorder(failOn)}
+				d := NewWithOptions(append(modeOpts, WithTarget(hooked, FailAll))...)
+				err := receivertest.Receive(testStream(t).End(), d)
+				if closeErr := d.Close(); !errors.Is(closeErr, errTarget) {
+					t.Errorf("expected the hook error from close, got %v", closeErr)
+				}
+				if !errors.Is(err, errTarget) {
+					t.Errorf("expected the hook error, got %v", err)
+				}
+				for _, call := range hooked.Calls() {
+					if call == "mkfile c" || call == "finish" {
+						t.Errorf("expected delivery to stop after the hook failed, got %q", call)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,73 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dispatch
+
+import "github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+
+// ErrorPolicy determines how a dispatcher reacts to an error from one of its targets.
+type ErrorPolicy int
+
+const (
+	// FailAll stops delivery to every target and returns the error to the stream.
+	// This is the default policy.
+	FailAll ErrorPolicy = iota
+	// DropTarget stops delivery to the failing target while the remaining targets
+	// continue to receive the stream.
+	DropTarget
+	// Continue logs the error and keeps delivering subsequent commands to the target.
+	Continue
+)
+
+// String returns the name of the policy.
+func (p ErrorPolicy) String() string {
+	switch p {
+	case FailAll:
+		return "fail-all"
+	case DropTarget:
+		return "drop-target"
+	case Continue:
+		return "continue"
+	}
+	return "unknown"
+}
+
+// Option is a function that configures a Dispatcher.
+type Option func(*Dispatcher)
+
+// WithTarget adds a receiver to the dispatcher with the given error policy. Targets
+// receive operations in the order they were added.
+func WithTarget(rcvr receivers.Receiver, policy ErrorPolicy) Option {
+	return func(d *Dispatcher) {
+		d.targets = append(d.targets, &target{
+			idx:    len(d.targets),
+			rcvr:   rcvr,
+			policy: policy,
+		})
+	}
+}
+
+// WithConcurrentDelivery will deliver operations to each target from its own goroutine.
+// Every target is given a queue that holds up to queueSize operations, and the stream
+// only blocks when the queue of a target is full. A queueSize of zero or less keeps
+// delivery sequential.
+func WithConcurrentDelivery(queueSize int) Option {
+	return func(d *Dispatcher) {
+		if queueSize < 0 {
+			queueSize = 0
+		}
+		d.queueSize = queueSize
+	}
+}
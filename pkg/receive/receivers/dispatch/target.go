@@ -0,0 +1,140 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dispatch
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+)
+
+type target struct {
+	idx     int
+	rcvr    receivers.Receiver
+	policy  ErrorPolicy
+	queue   chan *op
+	dropped atomic.Bool
+	// skip is set by PreOp during sequential delivery when the target
+	// asked to skip the current command.
+	skip bool
+}
+
+func (t *target) drop()           { t.dropped.Store(true) }
+func (t *target) isDropped() bool { return t.dropped.Load() }
+
+// op is a single operation queued for a target during concurrent delivery.
+type op struct {
+	ctx receivers.ReceiveContext
+	cmd *pendingCmd
+	fn  opFunc
+	// done receives the error the operation aborts the stream with, if the
+	// caller waits for it.
+	done chan error
+}
+
+// deliver runs the operation against the target, surrounded by the target's
+// PreOp and PostOp hooks when the command header is known.
+func (t *target) deliver(o *op) error {
+	if o.cmd != nil {
+		if preOp, ok := t.rcvr.(receivers.PreOpReceiver); ok {
+			if err := preOp.PreOp(o.ctx, o.cmd.hdr, o.cmd.attrs); err != nil {
+				return err
+			}
+		}
+	}
+	err := o.fn(o.ctx, t.rcvr)
+	if errors.Is(err, receivers.ErrSkipCommand) {
+		err = nil
+	}
+	if o.cmd != nil {
+		if postOp, ok := t.rcvr.(receivers.PostOpReceiver); ok {
+			if perr := postOp.PostOp(o.ctx, o.cmd.hdr, o.cmd.attrs); perr != nil && err == nil {
+				err = perr
+			}
+		}
+	}
+	return err
+}
+
+func (d *Dispatcher) runTarget(t *target) {
+	defer d.wg.Done()
+	for o := range t.queue {
+		err := d.failure()
+		if err == nil && !t.isDropped() {
+			err = d.handleError(o.ctx, t, t.deliver(o))
+		}
+		if o.done != nil {
+			o.done <- err
+		}
+	}
+}
+
+// enqueue pushes an operation onto the queue of every active target. If wait is true
+// it blocks until every target has processed the operation and returns the first
+// error that aborted the stream.
+func (d *Dispatcher) enqueue(ctx receivers.ReceiveContext, cmd *pendingCmd, fn opFunc, wait bool) error {
+	active := d.activeTargets()
+	if len(active) == 0 {
+		return ErrNoTargets
+	}
+	octx := &opContext{
+		ReceiveContext: ctx,
+		offset:         ctx.CurrentOffset(),
+		subvol:         ctx.CurrentSubvolume(),
+	}
+	var done []chan error
+	for _, t := range active {
+		o := &op{ctx: octx, cmd: cmd, fn: fn}
+		if wait {
+			// Buffered so the worker never blocks if the caller gives up waiting
+			o.done = make(chan error, 1)
+			done = append(done, o.done)
+		}
+		select {
+		case t.queue <- o:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	var firstErr error
+	for _, ch := range done {
+		select {
+		case err := <-ch:
+			if firstErr == nil {
+				firstErr = err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return firstErr
+}
+
+// opContext freezes the stream position of a ReceiveContext at the time an operation
+// was queued, since the stream keeps advancing while targets work through their queues.
+type opContext struct {
+	receivers.ReceiveContext
+	offset uint64
+	subvol *sendstream.ReceivingSubvolume
+}
+
+func (c *opContext) CurrentOffset() uint64 { return c.offset }
+
+func (c *opContext) CurrentSubvolume() *sendstream.ReceivingSubvolume { return c.subvol }
+
+func (c *opContext) ResolvePath(path string) string { return c.subvol.ResolvePath(path) }
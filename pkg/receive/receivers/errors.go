@@ -19,4 +19,10 @@ import "errors"
 
 var (
 	ErrNotSupported = errors.New("operation not supported by receiver")
+	// ErrCloneSourceUnavailable is returned when a stream clones data from a snapshot
+	// the receiver cannot read it from. The snapshot can still be received in full.
+	ErrCloneSourceUnavailable = errors.New("clone source unavailable")
+	// ErrVerificationFailed is returned when a received subvolume does not match the
+	// stream it was received from.
+	ErrVerificationFailed = errors.New("received subvolume failed verification")
 )
@@ -14,6 +14,9 @@ If not, see <https://www.gnu.org/licenses/>.
 */
 
 // Package local implements a receiver that writes the received data to a local btrfs filesystem.
+// Files are kept open between writes in a cache of file descriptors, which can be tuned with
+// the options passed to New. When created with WithVerification, every subvolume is compared
+// against a manifest built from the stream before it is marked as received.
 package local
 
 import (
@@ -28,15 +31,56 @@ import (
 	"github.com/google/uuid"
 
 	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/receive/filecache"
+	"github.com/tinyzimmer/btrsync/pkg/receive/manifest"
 	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/dispatch"
+	"github.com/tinyzimmer/btrsync/pkg/sendstream"
 )
 
 type localReceiver struct {
 	destPath string
+	files    *filecache.Cache
+	manifest *manifest.Recorder
 }
 
-func New(destPath string) receivers.Receiver {
-	return &localReceiver{destPath: destPath}
+// Option is a function that configures the local receiver.
+type Option func(*localReceiver)
+
+// WithFileCache configures the cache of open files used for writes.
+func WithFileCache(opts ...filecache.Option) Option {
+	return func(n *localReceiver) {
+		n.files = filecache.New(opts...)
+	}
+}
+
+// WithVerification records a manifest of each subvolume from the stream and compares
+// the received subvolume against it when it is finished. A subvolume that does not
+// match is left writable and is not marked as received.
+func WithVerification() Option {
+	return func(n *localReceiver) {
+		n.manifest = manifest.NewRecorder()
+	}
+}
+
+func New(destPath string, opts ...Option) receivers.Receiver {
+	n := &localReceiver{destPath: destPath, files: filecache.New()}
+	for _, opt := range opts {
+		opt(n)
+	}
+	if n.manifest != nil {
+		// The recorder goes first so the manifest is complete when we finish
+		return dispatch.New(n.manifest, n)
+	}
+	return n
+}
+
+func (n *localReceiver) PreOp(ctx receivers.ReceiveContext, hdr sendstream.CmdHeader, attrs sendstream.CmdAttrs) error {
+	if hdr.Cmd == sendstream.BTRFS_SEND_C_WRITE {
+		return nil
+	}
+	// Any other command may depend on buffered writes having been made
+	return n.files.Flush()
 }
 
 func (n *localReceiver) resolvePath(ctx receivers.ReceiveContext, path string) string {
@@ -146,7 +190,7 @@ func (n *localReceiver) Mksock(ctx receivers.ReceiveContext, path string, ino ui
 
 func (n *localReceiver) Symlink(ctx receivers.ReceiveContext, path string, ino uint64, linkTo string) error {
 	path = n.resolvePath(ctx, path)
-	linkTo = n.resolvePath(ctx, linkTo)
+	// The target is stored verbatim, like btrfs receive does
 	ctx.LogVerbose(3, "creating symlink %q -> %q\n", path, linkTo)
 	return os.Symlink(linkTo, path)
 }
@@ -155,6 +199,9 @@ func (n *localReceiver) Rename(ctx receivers.ReceiveContext, oldPath string, new
 	oldPath = n.resolvePath(ctx, oldPath)
 	newPath = n.resolvePath(ctx, newPath)
 	ctx.LogVerbose(3, "rename %q to %q\n", oldPath, newPath)
+	if err := n.files.Rename(oldPath, newPath); err != nil {
+		return err
+	}
 	return os.Rename(oldPath, newPath)
 }
 
@@ -168,27 +215,25 @@ func (n *localReceiver) Link(ctx receivers.ReceiveContext, path string, linkTo s
 func (n *localReceiver) Unlink(ctx receivers.ReceiveContext, path string) error {
 	path = n.resolvePath(ctx, path)
 	ctx.LogVerbose(3, "unlinking %q\n", path)
+	if err := n.files.Remove(path); err != nil {
+		return err
+	}
 	return os.Remove(path)
 }
 
 func (n *localReceiver) Rmdir(ctx receivers.ReceiveContext, path string) error {
 	path = n.resolvePath(ctx, path)
 	ctx.LogVerbose(3, "removing directory %q\n", path)
+	if err := n.files.Remove(path); err != nil {
+		return err
+	}
 	return os.RemoveAll(path)
 }
 
 func (n *localReceiver) Write(ctx receivers.ReceiveContext, path string, offset uint64, data []byte) error {
 	path = n.resolvePath(ctx, path)
 	ctx.LogVerbose(3, "write %d bytes to %q at offset %d\n", len(data), path, offset)
-	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	if _, err := f.WriteAt(data, int64(offset)); err != nil {
-		return err
-	}
-	return nil
+	return n.files.WriteAt(path, data, int64(offset))
 }
 
 func (n *localReceiver) EncodedWrite(ctx receivers.ReceiveContext, path string, op *btrfs.EncodedWriteOp) error {
@@ -267,11 +312,10 @@ func (n *localReceiver) EnableVerity(ctx receivers.ReceiveContext, path string,
 func (n *localReceiver) Fallocate(ctx receivers.ReceiveContext, path string, mode uint32, offset uint64, len uint64) error {
 	path = n.resolvePath(ctx, path)
 	ctx.LogVerbose(3, "fallocate %q to %d bytes at offset %d\n", path, len, offset)
-	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	f, err := n.files.File(path)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 	return syscall.Fallocate(int(f.Fd()), mode, int64(offset), int64(len))
 }
 
@@ -287,8 +331,17 @@ func (n *localReceiver) Fileattr(ctx receivers.ReceiveContext, path string, attr
 }
 
 func (n *localReceiver) FinishSubvolume(ctx receivers.ReceiveContext) error {
+	if err := n.files.Close(); err != nil {
+		return err
+	}
 	curVol := ctx.CurrentSubvolume()
 	path := filepath.Join(n.destPath, curVol.Path)
+	if n.manifest != nil {
+		ctx.LogVerbose(2, "verifying subvolume %q against the stream\n", path)
+		if err := n.manifest.Verify(path); err != nil {
+			return fmt.Errorf("refusing to mark %q as received: %w", path, err)
+		}
+	}
 	isReadOnly, err := btrfs.IsSubvolumeReadOnly(path)
 	if err != nil {
 		return err
@@ -0,0 +1,150 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package receivertest provides helpers for testing receivers: a builder for send
+// streams, and functions to compare the trees they are received into.
+package receivertest
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tinyzimmer/btrsync/pkg/receive"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+)
+
+// Stream builds a send stream. Commands are added with the sendstream.New*Command
+// functions:
+//
+//	stream := receivertest.NewStream(t).
+//		Cmd(sendstream.NewSubvolCommand("root", uuid.New(), 1)).
+//		Cmd(sendstream.NewMkfileCommand("file", 257)).
+//		End()
+type Stream struct {
+	t   testing.TB
+	buf bytes.Buffer
+	w   *sendstream.Writer
+}
+
+// NewStream returns an empty send stream.
+func NewStream(t testing.TB) *Stream {
+	s := &Stream{t: t}
+	s.w = sendstream.NewWriter(&s.buf)
+	return s
+}
+
+// Cmd adds a command to the stream.
+func (s *Stream) Cmd(cmd sendstream.SendCommand, attrs sendstream.CmdAttrs) *Stream {
+	s.t.Helper()
+	if err := s.w.WriteCommand(cmd, attrs); err != nil {
+		s.t.Fatal(err)
+	}
+	return s
+}
+
+// End ends the stream and returns it.
+func (s *Stream) End() *bytes.Buffer {
+	s.t.Helper()
+	if err := s.w.End(); err != nil {
+		s.t.Fatal(err)
+	}
+	return &s.buf
+}
+
+// Receive applies the stream to the receiver, finishing the subvolume at the end
+// command.
+func Receive(stream io.Reader, rcvr receivers.Receiver, opts ...receive.Option) error {
+	opts = append([]receive.Option{receive.To(rcvr), receive.HonorEndCommand()}, opts...)
+	return receive.ProcessSendStream(stream, opts...)
+}
+
+// ReadTree returns the contents of everything under root keyed by the relative path.
+// Files map to their data, symlinks to "-> " followed by their target, and directories
+// are keyed with a trailing slash and map to an empty string. Paths in skip are left
+// out.
+func ReadTree(t testing.TB, root string, skip ...string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		for _, s := range skip {
+			if rel == s {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			tree[rel] = "-> " + target
+			return err
+		case d.IsDir():
+			if rel != "." {
+				tree[rel+"/"] = ""
+			}
+		case d.Type().IsRegular():
+			data, err := os.ReadFile(path)
+			tree[rel] = string(data)
+			return err
+		default:
+			tree[rel] = d.Type().String()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// CheckTree reports an error for every difference between the tree under root and
+// want, in the format returned by ReadTree.
+func CheckTree(t testing.TB, root string, want map[string]string, skip ...string) {
+	t.Helper()
+	got := ReadTree(t, root, skip...)
+	var diffs []string
+	for path, data := range want {
+		if have, ok := got[path]; !ok {
+			diffs = append(diffs, path+": missing")
+		} else if have != data {
+			diffs = append(diffs, path+": got "+strconv.Quote(have)+", want "+strconv.Quote(data))
+		}
+	}
+	for path := range got {
+		if _, ok := want[path]; !ok {
+			diffs = append(diffs, path+": unexpected")
+		}
+	}
+	sort.Strings(diffs)
+	if len(diffs) > 0 {
+		t.Errorf("unexpected contents of %s:\n%s", root, strings.Join(diffs, "\n"))
+	}
+}
@@ -0,0 +1,456 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sftpdir provides a receiver that receives snapshots into a directory over the SFTP
+// subsystem of an SSH connection. It behaves like the directory and sshdir receivers, but keeps
+// file handles open across writes and coalesces sequential writes into large requests that are
+// pipelined by the SFTP client. Operations that SFTP has no equivalent for, such as creating
+// device nodes or setting extended attributes, are run as commands over the SSH connection in
+// the same way as the sshdir receiver.
+//
+// Incremental streams are applied to the destination in place. Full streams are received
+// into a staging directory next to it, which replaces the destination once the stream is
+// complete.
+package sftpdir
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tinyzimmer/btrsync/pkg/btrfs"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/sshdir"
+	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+)
+
+// MaxBufferedWrite is the amount of sequential write data that is buffered for a file
+// before it is sent to the remote host.
+var MaxBufferedWrite = 4 * 1024 * 1024
+
+// NewClient returns an SFTP client over the given SSH connection that is tuned for
+// receiving snapshots.
+func NewClient(client *ssh.Client) (*sftp.Client, error) {
+	return sftp.NewClient(client,
+		sftp.UseConcurrentWrites(true),
+		sftp.MaxConcurrentRequestsPerFile(64),
+	)
+}
+
+type sftpReceiver struct {
+	sftpClient      *sftp.Client
+	fallback        receivers.Receiver
+	destPath        string
+	currentOffset   uint64
+	offsetDirectory string
+
+	// staging is set while a full stream is received into the staging directory, with
+	// stagingFallback running commands in it
+	staging         bool
+	stagingFallback receivers.Receiver
+
+	// The file currently open for writing and any data buffered for it
+	file        *sftp.File
+	filePath    string
+	buf         []byte
+	bufOffset   int64
+	bufCmdIndex uint64
+	// The progress file for the current subvolume
+	offsetFile *sftp.File
+}
+
+// New returns a receiver that writes to the given path over SFTP. Commands that cannot be
+// performed over SFTP are run over the SSH connection. The caller remains responsible for
+// closing both clients.
+func New(sshClient *ssh.Client, sftpClient *sftp.Client, path string, offsetDirectory string) receivers.Receiver {
+	return &sftpReceiver{
+		sftpClient:      sftpClient,
+		fallback:        sshdir.New(sshClient, path, offsetDirectory),
+		stagingFallback: sshdir.New(sshClient, path+StagingSuffix, offsetDirectory),
+		destPath:        path,
+		offsetDirectory: offsetDirectory,
+	}
+}
+
+func (n *sftpReceiver) resolvePath(ctx receivers.ReceiveContext, path string) string {
+	if n.staging {
+		return filepath.Join(n.stagingPath(), path)
+	}
+	return filepath.Join(n.destPath, path)
+}
+
+// commands returns the receiver for commands that are run over the SSH connection.
+func (n *sftpReceiver) commands() receivers.Receiver {
+	if n.staging {
+		return n.stagingFallback
+	}
+	return n.fallback
+}
+
+func (n *sftpReceiver) currentOffsetPath(ctx receivers.ReceiveContext) string {
+	return filepath.Join(n.destPath, n.offsetDirectory, ctx.CurrentSubvolume().UUID.String())
+}
+
+func (n *sftpReceiver) readCurrentOffset(ctx receivers.ReceiveContext) error {
+	f, err := n.sftpClient.Open(n.currentOffsetPath(ctx))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	var offset uint64
+	if _, err := fmt.Fscanf(f, "%d", &offset); err != nil {
+		return err
+	}
+	n.currentOffset = offset
+	return nil
+}
+
+func (n *sftpReceiver) writeOffset(ctx receivers.ReceiveContext, offset uint64) error {
+	if n.offsetFile == nil {
+		f, err := n.sftpClient.OpenFile(n.currentOffsetPath(ctx), os.O_CREATE|os.O_WRONLY)
+		if err != nil {
+			return err
+		}
+		n.offsetFile = f
+	}
+	ctx.LogVerbose(4, "writing offset %d to %q\n", offset, n.offsetFile.Name())
+	// Offsets only ever increase, so overwriting from the start is enough
+	_, err := n.offsetFile.WriteAt([]byte(fmt.Sprintf("%d", offset)), 0)
+	return err
+}
+
+func (n *sftpReceiver) closeOffsetFile() error {
+	if n.offsetFile == nil {
+		return nil
+	}
+	err := n.offsetFile.Close()
+	n.offsetFile = nil
+	return err
+}
+
+// openFile returns a handle for writing to the given file, reusing the open handle if
+// it refers to the same file.
+func (n *sftpReceiver) openFile(ctx receivers.ReceiveContext, path string) (*sftp.File, error) {
+	if n.file != nil && n.filePath == path {
+		return n.file, nil
+	}
+	if err := n.closeFile(ctx); err != nil {
+		return nil, err
+	}
+	f, err := n.sftpClient.OpenFile(path, os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+	n.file, n.filePath = f, path
+	return f, nil
+}
+
+// flush sends any buffered data to the remote host and records the offset of the last
+// write command that was buffered.
+func (n *sftpReceiver) flush(ctx receivers.ReceiveContext) error {
+	if len(n.buf) == 0 {
+		return nil
+	}
+	ctx.LogVerbose(4, "flushing %d bytes to %q at offset %d\n", len(n.buf), n.filePath, n.bufOffset)
+	if _, err := n.file.WriteAt(n.buf, n.bufOffset); err != nil {
+		return err
+	}
+	n.buf = n.buf[:0]
+	return n.writeOffset(ctx, n.bufCmdIndex)
+}
+
+// closeFile flushes and closes the open file handle.
+func (n *sftpReceiver) closeFile(ctx receivers.ReceiveContext) error {
+	if n.file == nil {
+		return nil
+	}
+	if err := n.flush(ctx); err != nil {
+		return err
+	}
+	err := n.file.Close()
+	n.file, n.filePath = nil, ""
+	return err
+}
+
+func (n *sftpReceiver) PreOp(ctx receivers.ReceiveContext, hdr sendstream.CmdHeader, attrs sendstream.CmdAttrs) error {
+	if n.currentOffset > ctx.CurrentOffset() {
+		ctx.LogVerbose(4, "skipping preop for %q, already at offset %d", attrs.GetPath(), n.currentOffset)
+		return receivers.ErrSkipCommand
+	}
+	switch hdr.Cmd {
+	case sendstream.BTRFS_SEND_C_WRITE, sendstream.BTRFS_SEND_C_ENCODED_WRITE:
+		// Writes to the open file may stay buffered
+		if n.resolvePath(ctx, attrs.GetPath()) == n.filePath {
+			return nil
+		}
+	}
+	// Every other command needs the remote to be up to date, and handles
+	// must not be held across changes to the tree.
+	return n.closeFile(ctx)
+}
+
+func (n *sftpReceiver) PostOp(ctx receivers.ReceiveContext, hdr sendstream.CmdHeader, attrs sendstream.CmdAttrs) error {
+	if ctx.CurrentOffset() < n.currentOffset {
+		return nil
+	}
+	if len(n.buf) > 0 {
+		// The progress is recorded once the buffered data is flushed
+		return nil
+	}
+	return n.writeOffset(ctx, ctx.CurrentOffset())
+}
+
+func (n *sftpReceiver) Subvol(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64) error {
+	ctx.LogVerbose(3, "creating directory at %q\n", n.destPath)
+	if err := n.closeOffsetFile(); err != nil {
+		return err
+	}
+	if err := n.recoverStaging(ctx); err != nil {
+		return err
+	}
+	if err := n.sftpClient.MkdirAll(filepath.Dir(n.currentOffsetPath(ctx))); err != nil {
+		return err
+	}
+	if err := n.readCurrentOffset(ctx); err != nil {
+		return err
+	}
+	return n.startStaging(ctx)
+}
+
+func (n *sftpReceiver) Snapshot(ctx receivers.ReceiveContext, path string, uuid uuid.UUID, ctransid uint64, cloneUUID uuid.UUID, cloneCtransid uint64) error {
+	n.staging = false
+	if err := n.closeOffsetFile(); err != nil {
+		return err
+	}
+	if err := n.recoverStaging(ctx); err != nil {
+		return err
+	}
+	if err := n.checkStaging(); err != nil {
+		return err
+	}
+	return n.readCurrentOffset(ctx)
+}
+
+func (n *sftpReceiver) Mkfile(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	path = n.resolvePath(ctx, path)
+	ctx.LogVerbose(3, "creating file at %q\n", path)
+	f, err := n.sftpClient.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	// Keep the handle for the writes that usually follow
+	n.file, n.filePath = f, path
+	return nil
+}
+
+func (n *sftpReceiver) Mkdir(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	path = n.resolvePath(ctx, path)
+	ctx.LogVerbose(3, "creating directory at %q\n", path)
+	return n.sftpClient.Mkdir(path)
+}
+
+func (n *sftpReceiver) Mknod(ctx receivers.ReceiveContext, path string, ino uint64, mode uint32, rdev uint64) error {
+	return n.commands().Mknod(ctx, path, ino, mode, rdev)
+}
+
+func (n *sftpReceiver) Mkfifo(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	return n.commands().Mkfifo(ctx, path, ino)
+}
+
+func (n *sftpReceiver) Mksock(ctx receivers.ReceiveContext, path string, ino uint64) error {
+	return n.commands().Mksock(ctx, path, ino)
+}
+
+func (n *sftpReceiver) Symlink(ctx receivers.ReceiveContext, path string, ino uint64, linkTo string) error {
+	path = n.resolvePath(ctx, path)
+	ctx.LogVerbose(3, "creating symlink at %q -> %q\n", path, linkTo)
+	return n.sftpClient.Symlink(linkTo, path)
+}
+
+func (n *sftpReceiver) Rename(ctx receivers.ReceiveContext, oldPath string, newPath string) error {
+	oldPath = n.resolvePath(ctx, oldPath)
+	newPath = n.resolvePath(ctx, newPath)
+	ctx.LogVerbose(3, "renaming %q -> %q\n", oldPath, newPath)
+	// Plain SFTP renames fail if the target exists
+	err := n.sftpClient.PosixRename(oldPath, newPath)
+	var statusErr *sftp.StatusError
+	if errors.As(err, &statusErr) && statusErr.FxCode() == sftp.ErrSSHFxOpUnsupported {
+		if err := n.sftpClient.Remove(newPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return n.sftpClient.Rename(oldPath, newPath)
+	}
+	return err
+}
+
+func (n *sftpReceiver) Link(ctx receivers.ReceiveContext, path string, linkTo string) error {
+	path = n.resolvePath(ctx, path)
+	linkTo = n.resolvePath(ctx, linkTo)
+	ctx.LogVerbose(3, "creating hard link at %q -> %q\n", path, linkTo)
+	return n.sftpClient.Link(linkTo, path)
+}
+
+func (n *sftpReceiver) Unlink(ctx receivers.ReceiveContext, path string) error {
+	path = n.resolvePath(ctx, path)
+	ctx.LogVerbose(3, "removing %q\n", path)
+	return n.sftpClient.Remove(path)
+}
+
+func (n *sftpReceiver) Rmdir(ctx receivers.ReceiveContext, path string) error {
+	path = n.resolvePath(ctx, path)
+	ctx.LogVerbose(3, "removing directory %q\n", path)
+	return n.sftpClient.RemoveDirectory(path)
+}
+
+func (n *sftpReceiver) Write(ctx receivers.ReceiveContext, path string, offset uint64, data []byte) error {
+	path = n.resolvePath(ctx, path)
+	ctx.LogVerbose(3, "writing %d bytes to %q at offset %d\n", len(data), path, offset)
+	if _, err := n.openFile(ctx, path); err != nil {
+		return err
+	}
+	if len(n.buf) > 0 && n.bufOffset+int64(len(n.buf)) != int64(offset) {
+		if err := n.flush(ctx); err != nil {
+			return err
+		}
+	}
+	if len(n.buf) == 0 {
+		n.bufOffset = int64(offset)
+	}
+	n.buf = append(n.buf, data...)
+	n.bufCmdIndex = ctx.CurrentOffset()
+	if len(n.buf) >= MaxBufferedWrite {
+		return n.flush(ctx)
+	}
+	return nil
+}
+
+func (n *sftpReceiver) EncodedWrite(ctx receivers.ReceiveContext, path string, op *btrfs.EncodedWriteOp) error {
+	data, err := op.Decompress()
+	if err != nil {
+		return err
+	}
+	return n.Write(ctx, path, op.Offset, data)
+}
+
+func (n *sftpReceiver) Clone(ctx receivers.ReceiveContext, path string, offset uint64, len uint64, cloneUUID uuid.UUID, cloneCtransid uint64, clonePath string, cloneOffset uint64) error {
+	if cloneUUID != ctx.CurrentSubvolume().UUID {
+		// Previous snapshots are received in place, so their contents are no longer
+		// there to clone from. The stream has already changed the destination, the
+		// snapshot has to be received again in full.
+		if err := n.requireFullSend(ctx); err != nil {
+			ctx.LogVerbose(0, "failed to prepare %q for a full send: %s\n", n.destPath, err)
+		}
+		return fmt.Errorf("cannot find source subvolume for clone: %w: %s is a previous snapshot received in place",
+			receivers.ErrCloneSourceUnavailable, cloneUUID)
+	}
+	clonePath = n.resolvePath(ctx, clonePath)
+	path = n.resolvePath(ctx, path)
+	ctx.LogVerbose(3, "copying %d bytes from %q at offset %d to %q at offset %d\n", len, clonePath, cloneOffset, path, offset)
+	src, err := n.sftpClient.Open(clonePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, err := n.sftpClient.OpenFile(path, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	if _, err := dest.Seek(int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(dest, io.NewSectionReader(src, int64(cloneOffset), int64(len)))
+	return err
+}
+
+func (n *sftpReceiver) SetXattr(ctx receivers.ReceiveContext, path string, name string, data []byte) error {
+	return n.commands().SetXattr(ctx, path, name, data)
+}
+
+func (n *sftpReceiver) RemoveXattr(ctx receivers.ReceiveContext, path string, name string) error {
+	return n.commands().RemoveXattr(ctx, path, name)
+}
+
+func (n *sftpReceiver) Truncate(ctx receivers.ReceiveContext, path string, size uint64) error {
+	path = n.resolvePath(ctx, path)
+	ctx.LogVerbose(3, "truncating %q to %d bytes\n", path, size)
+	return n.sftpClient.Truncate(path, int64(size))
+}
+
+func (n *sftpReceiver) Chmod(ctx receivers.ReceiveContext, path string, mode uint64) error {
+	path = n.resolvePath(ctx, path)
+	ctx.LogVerbose(3, "chmod %q to %o\n", path, mode)
+	return n.sftpClient.Chmod(path, os.FileMode(mode&07777))
+}
+
+func (n *sftpReceiver) Chown(ctx receivers.ReceiveContext, path string, uid uint64, gid uint64) error {
+	path = n.resolvePath(ctx, path)
+	ctx.LogVerbose(3, "chown %q to %d:%d\n", path, uid, gid)
+	return n.sftpClient.Chown(path, int(uid), int(gid))
+}
+
+func (n *sftpReceiver) Utimes(ctx receivers.ReceiveContext, path string, atime, mtime, ctime time.Time) error {
+	path = n.resolvePath(ctx, path)
+	ctx.LogVerbose(3, "utimes %q to %v:%v\n", path, atime, mtime)
+	return n.sftpClient.Chtimes(path, atime, mtime)
+}
+
+func (n *sftpReceiver) UpdateExtent(ctx receivers.ReceiveContext, path string, fileOffset uint64, tmpSize uint64) error {
+	/*
+	 * Sent with BTRFS_SEND_FLAG_NO_FILE_DATA, nothing to do.
+	 */
+	ctx.LogVerbose(3, "update extent %q at offset %d with %d bytes\n", path, fileOffset, tmpSize)
+	return nil
+}
+
+func (n *sftpReceiver) EnableVerity(ctx receivers.ReceiveContext, path string, algorithm uint8, blockSize uint32, salt []byte, sig []byte) error {
+	return receivers.ErrNotSupported
+}
+
+func (n *sftpReceiver) Fallocate(ctx receivers.ReceiveContext, path string, mode uint32, offset uint64, len uint64) error {
+	return n.commands().Fallocate(ctx, path, mode, offset, len)
+}
+
+func (n *sftpReceiver) Fileattr(ctx receivers.ReceiveContext, path string, attr uint32) error {
+	// Ignore
+	return nil
+}
+
+func (n *sftpReceiver) FinishSubvolume(ctx receivers.ReceiveContext) error {
+	if err := n.closeFile(ctx); err != nil {
+		return err
+	}
+	if n.staging {
+		if err := n.finishStaging(ctx); err != nil {
+			return err
+		}
+		n.staging = false
+	}
+	if err := n.writeOffset(ctx, math.MaxUint64-1); err != nil {
+		return err
+	}
+	return n.closeOffsetFile()
+}
@@ -0,0 +1,148 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sftpdir
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pkg/sftp"
+
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers/receivertest"
+	"github.com/tinyzimmer/btrsync/pkg/sendstream"
+)
+
+const testOffsetDirectory = ".btrsync"
+
+// newTestReceiver returns a receiver connected to an SFTP server serving the local
+// filesystem. Commands that need an SSH connection cannot be used.
+func newTestReceiver(t *testing.T, dest string) receivers.Receiver {
+	t.Helper()
+	serverRead, clientWrite := io.Pipe()
+	clientRead, serverWrite := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverRead, serverWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientRead, clientWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// The client waits for the server to close its end of the connection
+		server.Close()
+		client.Close()
+	})
+	return New(nil, client, dest, testOffsetDirectory)
+}
+
+func checkComplete(t *testing.T, dest string, subvol uuid.UUID) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dest, testOffsetDirectory, subvol.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := strconv.ParseUint(string(data), 10, 64); err != nil || offset != math.MaxUint64-1 {
+		t.Errorf("subvolume %s is not recorded as complete: %q", subvol, data)
+	}
+}
+
+func TestCloneSourceUnavailable(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "root")
+	first, second := uuid.New(), uuid.New()
+
+	full := receivertest.NewStream(t).
+		Cmd(sendstream.NewSubvolCommand("root.1", first, 1)).
+		Cmd(sendstream.NewMkdirCommand("dir", 257)).
+		Cmd(sendstream.NewMkfileCommand("dir/a", 258)).
+		Cmd(sendstream.NewWriteCommand("dir/a", 0, []byte("one"))).
+		Cmd(sendstream.NewMkfileCommand("dir/b", 259)).
+		Cmd(sendstream.NewMkfileCommand("kept", 260)).
+		Cmd(sendstream.NewWriteCommand("kept", 0, []byte("kept"))).
+		End()
+	if err := receivertest.Receive(full, newTestReceiver(t, dest)); err != nil {
+		t.Fatal(err)
+	}
+	receivertest.CheckTree(t, dest, map[string]string{
+		"dir/": "", "dir/a": "one", "dir/b": "", "kept": "kept",
+	}, testOffsetDirectory)
+	checkComplete(t, dest, first)
+
+	// The incremental stream changes the destination before it clones from the
+	// previous snapshot, which is no longer there.
+	incremental := func() io.Reader {
+		return receivertest.NewStream(t).
+			Cmd(sendstream.NewSnapshotCommand("root.2", second, 2, first, 1)).
+			Cmd(sendstream.NewUnlinkCommand("dir/b")).
+			Cmd(sendstream.NewWriteCommand("kept", 0, []byte("KEPT"))).
+			Cmd(sendstream.NewMkfileCommand("cloned", 262)).
+			Cmd(sendstream.NewCloneCommand("cloned", 0, 4, first, 1, "kept", 0)).
+			End()
+	}
+	err := receivertest.Receive(incremental(), newTestReceiver(t, dest))
+	if !errors.Is(err, receivers.ErrCloneSourceUnavailable) {
+		t.Fatalf("expected clone source to be unavailable, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, testOffsetDirectory, second.String())); !os.IsNotExist(err) {
+		t.Errorf("expected the progress of the incremental stream to be forgotten: %v", err)
+	}
+
+	// The destination is not touched by the incremental stream again
+	before := receivertest.ReadTree(t, dest, testOffsetDirectory)
+	err = receivertest.Receive(incremental(), newTestReceiver(t, dest))
+	if !errors.Is(err, receivers.ErrCloneSourceUnavailable) {
+		t.Fatalf("expected the incremental stream to be refused, got %v", err)
+	}
+	receivertest.CheckTree(t, dest, before, testOffsetDirectory)
+
+	// The full stream replaces the destination, even though the directory it renames
+	// into place already exists and is not empty.
+	resend := receivertest.NewStream(t).
+		Cmd(sendstream.NewSubvolCommand("root.2", second, 2)).
+		Cmd(sendstream.NewMkdirCommand("o257-2-0", 257)).
+		Cmd(sendstream.NewMkfileCommand("o257-2-0/a", 258)).
+		Cmd(sendstream.NewWriteCommand("o257-2-0/a", 0, []byte("one"))).
+		Cmd(sendstream.NewRenameCommand("o257-2-0", "dir")).
+		Cmd(sendstream.NewMkfileCommand("kept", 260)).
+		Cmd(sendstream.NewWriteCommand("kept", 0, []byte("KEPT"))).
+		Cmd(sendstream.NewMkfileCommand("cloned", 262)).
+		Cmd(sendstream.NewCloneCommand("cloned", 0, 4, second, 2, "kept", 0)).
+		End()
+	if err := receivertest.Receive(resend, newTestReceiver(t, dest)); err != nil {
+		t.Fatal(err)
+	}
+	receivertest.CheckTree(t, dest, map[string]string{
+		"dir/": "", "dir/a": "one", "kept": "KEPT", "cloned": "KEPT",
+	}, testOffsetDirectory)
+	checkComplete(t, dest, first)
+	checkComplete(t, dest, second)
+	for _, path := range []string{dest + StagingSuffix, dest + replacedSuffix} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %q to not exist: %v", path, err)
+		}
+	}
+}
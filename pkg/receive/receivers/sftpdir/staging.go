@@ -0,0 +1,188 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sftpdir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/tinyzimmer/btrsync/pkg/receive/receivers"
+)
+
+// StagingSuffix is appended to the destination to name the directory that full streams
+// are received into. The staged subvolume replaces the destination once it is
+// complete, so nothing left behind by a previous snapshot, or by an incremental stream
+// that failed part way, survives a full send.
+const StagingSuffix = ".btrsync-staging"
+
+// replacedSuffix is appended to the destination to name the previous contents while a
+// staged subvolume is moved into place.
+const replacedSuffix = ".btrsync-replaced"
+
+func (n *sftpReceiver) stagingPath() string { return n.destPath + StagingSuffix }
+
+func (n *sftpReceiver) replacedPath() string { return n.destPath + replacedSuffix }
+
+func (n *sftpReceiver) exists(path string) (bool, error) {
+	_, err := n.sftpClient.Lstat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// removeAll removes path and everything below it.
+func (n *sftpReceiver) removeAll(path string) error {
+	info, err := n.sftpClient.Lstat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return n.sftpClient.Remove(path)
+	}
+	entries, err := n.sftpClient.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := n.removeAll(filepath.Join(path, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return n.sftpClient.RemoveDirectory(path)
+}
+
+// requireFullSend records that the destination was changed by an incremental stream
+// that cannot be completed, by forgetting the progress of the stream and leaving an
+// empty staging directory behind. Incremental streams are refused while there is a
+// staging directory, so the destination is only ever replaced by a full stream.
+func (n *sftpReceiver) requireFullSend(ctx receivers.ReceiveContext) error {
+	if err := n.closeOffsetFile(); err != nil {
+		return err
+	}
+	if err := n.sftpClient.Remove(n.currentOffsetPath(ctx)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := n.removeAll(n.stagingPath()); err != nil {
+		return err
+	}
+	return n.sftpClient.Mkdir(n.stagingPath())
+}
+
+// checkStaging refuses an incremental stream if a full stream is pending.
+func (n *sftpReceiver) checkStaging() error {
+	staged, err := n.exists(n.stagingPath())
+	if err != nil || !staged {
+		return err
+	}
+	return fmt.Errorf("%w: %q is waiting for a full send", receivers.ErrCloneSourceUnavailable, n.destPath)
+}
+
+// startStaging prepares the staging directory for a full stream. A staging directory
+// left behind by an interrupted receive is kept when resuming.
+func (n *sftpReceiver) startStaging(ctx receivers.ReceiveContext) error {
+	n.staging = true
+	staging := n.stagingPath()
+	if n.currentOffset > 0 {
+		staged, err := n.exists(staging)
+		if err != nil {
+			return err
+		}
+		if staged {
+			ctx.LogVerbose(2, "resuming staged subvolume at %q\n", staging)
+			return nil
+		}
+		// The progress does not match what is on disk, start over
+		n.currentOffset = 0
+	}
+	if err := n.removeAll(staging); err != nil {
+		return err
+	}
+	ctx.LogVerbose(2, "staging subvolume at %q\n", staging)
+	return n.sftpClient.MkdirAll(staging)
+}
+
+// finishStaging moves the staged subvolume into place of the destination. The progress
+// files are carried over from the previous contents.
+func (n *sftpReceiver) finishStaging(ctx receivers.ReceiveContext) error {
+	staging := n.stagingPath()
+	staged, err := n.exists(staging)
+	if err != nil || !staged {
+		// Already moved into place by a previous receive
+		return err
+	}
+	if err := n.closeOffsetFile(); err != nil {
+		return err
+	}
+	replaced := n.replacedPath()
+	if err := n.removeAll(replaced); err != nil {
+		return err
+	}
+	ctx.LogVerbose(2, "moving staged subvolume %q to %q\n", staging, n.destPath)
+	if err := n.sftpClient.Rename(n.destPath, replaced); err != nil {
+		return err
+	}
+	if err := n.sftpClient.Rename(staging, n.destPath); err != nil {
+		return err
+	}
+	return n.removeReplaced()
+}
+
+// recoverStaging completes or undoes moving a staged subvolume into place if a previous
+// receive was interrupted while doing so.
+func (n *sftpReceiver) recoverStaging(ctx receivers.ReceiveContext) error {
+	interrupted, err := n.exists(n.replacedPath())
+	if err != nil || !interrupted {
+		return err
+	}
+	moved, err := n.exists(n.destPath)
+	if err != nil {
+		return err
+	}
+	if !moved {
+		// The staged subvolume never made it into place, it is moved again once the
+		// stream is finished
+		ctx.LogVerbose(1, "restoring %q from interrupted swap\n", n.destPath)
+		return n.sftpClient.Rename(n.replacedPath(), n.destPath)
+	}
+	ctx.LogVerbose(1, "completing interrupted swap of %q\n", n.destPath)
+	return n.removeReplaced()
+}
+
+// removeReplaced moves the progress files out of the previous contents of the
+// destination and removes the rest.
+func (n *sftpReceiver) removeReplaced() error {
+	replaced := n.replacedPath()
+	offsets := filepath.Join(replaced, n.offsetDirectory)
+	found, err := n.exists(offsets)
+	if err != nil {
+		return err
+	}
+	if found {
+		if err := n.sftpClient.Rename(offsets, filepath.Join(n.destPath, n.offsetDirectory)); err != nil {
+			return err
+		}
+	}
+	return n.removeAll(replaced)
+}
@@ -0,0 +1,151 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package repository
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Backend stores the files of a repository. Names are slash separated and relative
+// to the root of the repository.
+type Backend interface {
+	// ReadFile returns the contents of a file. Errors for missing files must match
+	// fs.ErrNotExist.
+	ReadFile(name string) ([]byte, error)
+	// WriteFile atomically replaces the contents of a file, creating any missing
+	// parent directories.
+	WriteFile(name string, data []byte) error
+	// Remove removes a file. Removing a missing file is not an error.
+	Remove(name string) error
+	// List returns the files in a directory. A missing directory has no files.
+	List(dir string) ([]FileInfo, error)
+	// Close releases any resources held by the backend.
+	Close() error
+}
+
+// FileInfo describes a file in a backend.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// tempSuffix is included in the names of files that are being written.
+const tempSuffix = ".tmp-"
+
+func tempName(name string) string {
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return name + tempSuffix + hex.EncodeToString(buf)
+}
+
+func isTempName(name string) bool {
+	return strings.Contains(path.Base(name), tempSuffix)
+}
+
+type localBackend struct {
+	root string
+}
+
+// NewLocalBackend returns a backend storing files in a local directory.
+func NewLocalBackend(root string) Backend {
+	return &localBackend{root: root}
+}
+
+func (b *localBackend) path(name string) string {
+	return filepath.Join(b.root, filepath.FromSlash(name))
+}
+
+func (b *localBackend) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(b.path(name))
+}
+
+func (b *localBackend) WriteFile(name string, data []byte) error {
+	dest := b.path(name)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp := tempName(dest)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (b *localBackend) Remove(name string) error {
+	err := os.Remove(b.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (b *localBackend) List(dir string) ([]FileInfo, error) {
+	entries, err := os.ReadDir(b.path(dir))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	files := make([]FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		files = append(files, FileInfo{
+			Name:    entry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			IsDir:   entry.IsDir(),
+		})
+	}
+	return files, nil
+}
+
+func (b *localBackend) Close() error { return nil }
@@ -0,0 +1,361 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package repository
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// PruneResult describes the chunks removed by Prune.
+type PruneResult struct {
+	// Referenced is the number of chunks still referenced by snapshots
+	Referenced int
+	// Removed is the number of chunks that were removed
+	Removed int
+	// RemovedBytes is the stored size of the removed chunks
+	RemovedBytes int64
+}
+
+// Prune removes the chunks that are not referenced by any snapshot, along with files
+// left behind by interrupted writes. It requires an exclusive lock and returns an
+// error matching ErrLocked if the repository is in use.
+func (r *Repository) Prune(ctx context.Context) (*PruneResult, error) {
+	lock, err := r.Lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	refs, broken, err := r.references()
+	if err != nil {
+		return nil, err
+	}
+	if len(broken) > 0 {
+		return nil, fmt.Errorf("refusing to prune with unreadable snapshot indexes, run a repair first: %s", strings.Join(broken, ", "))
+	}
+	res := &PruneResult{Referenced: len(refs)}
+	err = r.walkChunks(func(id string, info FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if refs[id] > 0 {
+			return nil
+		}
+		r.logVerbose(2, "Removing unreferenced chunk %s\n", id)
+		if err := r.backend.Remove(chunkPath(id)); err != nil {
+			return fmt.Errorf("error removing chunk %s: %w", id, err)
+		}
+		res.Removed++
+		res.RemovedBytes += info.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.removeTempFiles(); err != nil {
+		return nil, err
+	}
+	r.logVerbose(1, "Pruned %d unreferenced chunks totalling %d bytes, %d chunks remain\n",
+		res.Removed, res.RemovedBytes, res.Referenced)
+	return res, nil
+}
+
+// references counts the references to every chunk by the snapshots in the repository.
+// The names of indexes that could not be read are returned separately.
+func (r *Repository) references() (refs map[string]int, broken []string, err error) {
+	indexes, broken, err := r.scanSnapshots()
+	if err != nil {
+		return nil, nil, err
+	}
+	refs = make(map[string]int)
+	for _, idx := range indexes {
+		for _, chunk := range idx.Chunks {
+			refs[chunk.ID]++
+		}
+	}
+	return refs, broken, nil
+}
+
+// scanSnapshots reads the index of every snapshot in the repository, keyed by
+// <subvolume>/<name>. The names of indexes that could not be read are returned
+// separately.
+func (r *Repository) scanSnapshots() (indexes map[string]*Index, broken []string, err error) {
+	subvolumes, err := r.Subvolumes()
+	if err != nil {
+		return nil, nil, err
+	}
+	indexes = make(map[string]*Index)
+	for _, subvolume := range subvolumes {
+		files, err := r.backend.List(path.Join(snapshotsDir, subvolume))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, file := range files {
+			if file.IsDir || isTempName(file.Name) || !strings.HasSuffix(file.Name, indexExt) {
+				continue
+			}
+			name := path.Join(subvolume, strings.TrimSuffix(file.Name, indexExt))
+			data, err := r.backend.ReadFile(path.Join(snapshotsDir, subvolume, file.Name))
+			if err != nil {
+				return nil, nil, err
+			}
+			idx, err := r.decodeIndex(data)
+			if err != nil {
+				r.logVerbose(0, "Snapshot index %s is unreadable: %s\n", name, err)
+				broken = append(broken, name)
+				continue
+			}
+			indexes[name] = idx
+		}
+	}
+	return indexes, broken, nil
+}
+
+// removeTempFiles removes files left behind by interrupted writes. It must only be
+// called with an exclusive lock held.
+func (r *Repository) removeTempFiles() ([]string, error) {
+	temps, err := r.tempFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range temps {
+		r.logVerbose(2, "Removing leftover file %s\n", name)
+		if err := r.backend.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+	return temps, nil
+}
+
+func (r *Repository) tempFiles() ([]string, error) {
+	var temps []string
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		files, err := r.backend.List(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			name := path.Join(dir, file.Name)
+			if file.IsDir {
+				if err := walk(name); err != nil {
+					return err
+				}
+			} else if isTempName(file.Name) {
+				temps = append(temps, name)
+			}
+		}
+		return nil
+	}
+	for _, dir := range []string{dataDir, snapshotsDir, locksDir} {
+		if err := walk(dir); err != nil {
+			return nil, err
+		}
+	}
+	return temps, nil
+}
+
+// CheckResult is the result of checking a repository.
+type CheckResult struct {
+	// Snapshots is the number of snapshots in the repository
+	Snapshots int `json:"snapshots"`
+	// Chunks is the number of chunks in the repository
+	Chunks int `json:"chunks"`
+	// BrokenSnapshots are the snapshots that cannot be restored, because their index
+	// is unreadable or they reference missing or corrupt chunks
+	BrokenSnapshots []string `json:"brokenSnapshots,omitempty"`
+	// MissingChunks are the chunks referenced by snapshots that do not exist
+	MissingChunks []string `json:"missingChunks,omitempty"`
+	// CorruptChunks are the chunks whose contents do not match their ID. They are only
+	// found when data is read.
+	CorruptChunks []string `json:"corruptChunks,omitempty"`
+	// UnreferencedChunks are the chunks not referenced by any snapshot, which are
+	// removed by the next prune
+	UnreferencedChunks []string `json:"unreferencedChunks,omitempty"`
+	// TempFiles are files left behind by interrupted writes
+	TempFiles []string `json:"tempFiles,omitempty"`
+	// StaleLocks is the number of locks left behind by processes that are gone
+	StaleLocks int `json:"staleLocks,omitempty"`
+}
+
+// OK returns true if every snapshot in the repository can be restored.
+func (c *CheckResult) OK() bool {
+	return len(c.BrokenSnapshots) == 0 && len(c.MissingChunks) == 0 && len(c.CorruptChunks) == 0
+}
+
+// Check verifies that every snapshot in the repository references chunks that exist.
+// When readData is true every chunk is also read and its contents verified.
+func (r *Repository) Check(ctx context.Context, readData bool) (*CheckResult, error) {
+	lock, err := r.Lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	res, _, err := r.check(ctx, readData)
+	return res, err
+}
+
+// Repair checks the repository and removes everything that is broken: snapshots that
+// cannot be restored, corrupt and unreferenced chunks, leftover files and stale locks.
+// Removed snapshots are sent again by the next sync while their source snapshots
+// still exist. It requires an exclusive lock. The returned result describes what was
+// found before the repair.
+func (r *Repository) Repair(ctx context.Context, readData bool) (*CheckResult, error) {
+	stale, err := r.RemoveStaleLocks()
+	if err != nil {
+		return nil, err
+	}
+	lock, err := r.Lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	res, indexes, err := r.check(ctx, readData)
+	if err != nil {
+		return nil, err
+	}
+	res.StaleLocks = stale
+	for _, name := range res.BrokenSnapshots {
+		subvolume, snapshot := path.Split(name)
+		r.logVerbose(0, "Removing broken snapshot %s\n", name)
+		if err := r.DeleteSnapshot(strings.TrimSuffix(subvolume, "/"), snapshot); err != nil {
+			return nil, fmt.Errorf("error removing snapshot %s: %w", name, err)
+		}
+		delete(indexes, name)
+	}
+	for _, id := range res.CorruptChunks {
+		r.logVerbose(0, "Removing corrupt chunk %s\n", id)
+		if err := r.backend.Remove(chunkPath(id)); err != nil {
+			return nil, fmt.Errorf("error removing chunk %s: %w", id, err)
+		}
+	}
+	// Chunks only referenced by removed snapshots are now unreferenced as well
+	refs := make(map[string]int)
+	for _, idx := range indexes {
+		for _, chunk := range idx.Chunks {
+			refs[chunk.ID]++
+		}
+	}
+	err = r.walkChunks(func(id string, _ FileInfo) error {
+		if refs[id] > 0 {
+			return nil
+		}
+		r.logVerbose(1, "Removing unreferenced chunk %s\n", id)
+		return r.backend.Remove(chunkPath(id))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.removeTempFiles(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (r *Repository) check(ctx context.Context, readData bool) (*CheckResult, map[string]*Index, error) {
+	res := &CheckResult{}
+	indexes, broken, err := r.scanSnapshots()
+	if err != nil {
+		return nil, nil, err
+	}
+	res.Snapshots = len(indexes) + len(broken)
+	brokenSet := make(map[string]struct{})
+	for _, name := range broken {
+		brokenSet[name] = struct{}{}
+	}
+	r.logVerbose(1, "Checking %d snapshots\n", res.Snapshots)
+
+	existing := make(map[string]struct{})
+	err = r.walkChunks(func(id string, _ FileInfo) error {
+		existing[id] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing chunks: %w", err)
+	}
+	res.Chunks = len(existing)
+
+	if readData {
+		r.logVerbose(1, "Reading %d chunks\n", res.Chunks)
+		for id := range existing {
+			if err := ctx.Err(); err != nil {
+				return nil, nil, err
+			}
+			if _, err := r.loadChunk(id); err != nil {
+				r.logVerbose(0, "%s\n", err)
+				res.CorruptChunks = append(res.CorruptChunks, id)
+				delete(existing, id)
+			}
+		}
+	}
+
+	refs := make(map[string]struct{})
+	missing := make(map[string]struct{})
+	for name, idx := range indexes {
+		for _, chunk := range idx.Chunks {
+			refs[chunk.ID] = struct{}{}
+			if _, ok := existing[chunk.ID]; ok {
+				continue
+			}
+			if _, ok := brokenSet[name]; !ok {
+				r.logVerbose(0, "Snapshot %s references missing or corrupt chunk %s\n", name, chunk.ID)
+				brokenSet[name] = struct{}{}
+			}
+			if !isCorrupt(res.CorruptChunks, chunk.ID) {
+				missing[chunk.ID] = struct{}{}
+			}
+		}
+	}
+	for id := range missing {
+		res.MissingChunks = append(res.MissingChunks, id)
+	}
+	for id := range existing {
+		if _, ok := refs[id]; !ok {
+			res.UnreferencedChunks = append(res.UnreferencedChunks, id)
+		}
+	}
+	for name := range brokenSet {
+		res.BrokenSnapshots = append(res.BrokenSnapshots, name)
+	}
+	if res.TempFiles, err = r.tempFiles(); err != nil {
+		return nil, nil, err
+	}
+	locks, err := r.Locks()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, info := range locks {
+		if info.Stale() {
+			res.StaleLocks++
+		}
+	}
+	for _, list := range [][]string{res.BrokenSnapshots, res.MissingChunks, res.CorruptChunks, res.UnreferencedChunks} {
+		sort.Strings(list)
+	}
+	return res, indexes, nil
+}
+
+func isCorrupt(corrupt []string, id string) bool {
+	for _, c := range corrupt {
+		if c == id {
+			return true
+		}
+	}
+	return false
+}
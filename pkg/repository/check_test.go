@@ -0,0 +1,228 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package repository
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+)
+
+// checkRepository saves two snapshots sharing most of their chunks and returns the
+// chunks that are unique to each.
+func checkRepository(t *testing.T) (repo *Repository, data map[string][]byte, unique map[string][]string) {
+	t.Helper()
+	repo = openTestRepository(t, NewLocalBackend(t.TempDir()))
+	shared := testData(1, 64*1024)
+	data = map[string][]byte{
+		"root.1": append(testData(2, 16*1024), shared...),
+		"root.2": append(testData(3, 16*1024), shared...),
+	}
+	indexes := make(map[string]*Index)
+	refs := make(map[string]int)
+	for _, name := range []string{"root.1", "root.2"} {
+		indexes[name] = saveSnapshot(t, repo, "root", name, data[name])
+		for _, chunk := range indexes[name].Chunks {
+			refs[chunk.ID]++
+		}
+	}
+	unique = make(map[string][]string)
+	for name, idx := range indexes {
+		for _, chunk := range idx.Chunks {
+			if refs[chunk.ID] == 1 {
+				unique[name] = append(unique[name], chunk.ID)
+			}
+		}
+		if len(unique[name]) == 0 || len(unique[name]) == len(idx.Chunks) {
+			t.Fatalf("expected %s to have both unique and shared chunks", name)
+		}
+	}
+	return repo, data, unique
+}
+
+func TestCheck(t *testing.T) {
+	tc := []struct {
+		name     string
+		damage   func(t *testing.T, repo *Repository, id string)
+		readData bool
+		want     func(id string) *CheckResult
+	}{
+		{
+			name:   "missing chunk",
+			damage: func(t *testing.T, repo *Repository, id string) { repo.backend.Remove(chunkPath(id)) },
+			want: func(id string) *CheckResult {
+				return &CheckResult{BrokenSnapshots: []string{"root/root.1"}, MissingChunks: []string{id}}
+			},
+		},
+		{
+			name:   "corrupt chunk without reading data",
+			damage: corruptChunk,
+			want:   func(string) *CheckResult { return &CheckResult{} },
+		},
+		{
+			name:     "corrupt chunk",
+			damage:   corruptChunk,
+			readData: true,
+			want: func(id string) *CheckResult {
+				return &CheckResult{BrokenSnapshots: []string{"root/root.1"}, CorruptChunks: []string{id}}
+			},
+		},
+		{
+			name: "unreadable index",
+			damage: func(t *testing.T, repo *Repository, _ string) {
+				if err := repo.backend.WriteFile(indexPath("root", "root.1"), []byte("{")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: func(string) *CheckResult {
+				return &CheckResult{BrokenSnapshots: []string{"root/root.1"}}
+			},
+		},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, _, unique := checkRepository(t)
+			res, err := repo.Check(context.Background(), tt.readData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !res.OK() {
+				t.Fatalf("expected an undamaged repository to check OK, got %+v", res)
+			}
+
+			id := unique["root.1"][0]
+			tt.damage(t, repo, id)
+			res, err = repo.Check(context.Background(), tt.readData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.want(id)
+			got := &CheckResult{
+				BrokenSnapshots: res.BrokenSnapshots,
+				MissingChunks:   res.MissingChunks,
+				CorruptChunks:   res.CorruptChunks,
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %+v, got %+v", want, got)
+			}
+			if res.OK() != (len(want.BrokenSnapshots) == 0) {
+				t.Errorf("expected OK to be %t", len(want.BrokenSnapshots) == 0)
+			}
+		})
+	}
+}
+
+func corruptChunk(t *testing.T, repo *Repository, id string) {
+	t.Helper()
+	data, err := repo.backend.ReadFile(chunkPath(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := repo.backend.WriteFile(chunkPath(id), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	for _, damage := range []string{"missing", "corrupt"} {
+		t.Run(damage, func(t *testing.T) {
+			ctx := context.Background()
+			repo, data, unique := checkRepository(t)
+			if damage == "missing" {
+				repo.backend.Remove(chunkPath(unique["root.1"][0]))
+			} else {
+				corruptChunk(t, repo, unique["root.1"][0])
+			}
+			writeStaleLocks(t, repo)
+			if err := repo.backend.WriteFile(tempName(chunkPath(unique["root.1"][0])), []byte("partial")); err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := repo.Repair(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.OK() || len(res.TempFiles) != 1 || res.StaleLocks != 3 {
+				t.Errorf("expected the repair to report what it found, got %+v", res)
+			}
+
+			res, err = repo.Check(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !res.OK() || res.Snapshots != 1 || len(res.UnreferencedChunks) != 0 || len(res.TempFiles) != 0 || res.StaleLocks != 0 {
+				t.Errorf("expected a clean repository after the repair, got %+v", res)
+			}
+			// The chunks that only the broken snapshot referenced were removed
+			for _, id := range unique["root.1"] {
+				if _, err := repo.backend.ReadFile(chunkPath(id)); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("expected chunk %s of the broken snapshot to be removed", id)
+				}
+			}
+			if _, err := repo.Snapshot("root", "root.1"); err == nil {
+				t.Error("expected the broken snapshot to be removed")
+			}
+			restored, err := restoreSnapshot(repo, "root", "root.2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(restored, data["root.2"]) {
+				t.Error("the remaining snapshot does not restore after the repair")
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	repo, data, unique := checkRepository(t)
+	before := countChunks(t, repo)
+	if err := repo.DeleteSnapshot("root", "root.1"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := repo.Prune(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Removed != len(unique["root.1"]) || res.Referenced != before-res.Removed {
+		t.Errorf("expected %d chunks to be removed and %d kept, got %+v", len(unique["root.1"]), before-len(unique["root.1"]), res)
+	}
+	if got := countChunks(t, repo); got != res.Referenced {
+		t.Errorf("expected %d chunks to remain, got %d", res.Referenced, got)
+	}
+	restored, err := restoreSnapshot(repo, "root", "root.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored, data["root.2"]) {
+		t.Error("the remaining snapshot does not restore after pruning")
+	}
+
+	// Chunks are never removed while an index cannot be read, since they may be
+	// referenced by it
+	if err := repo.backend.WriteFile(indexPath("root", "root.2"), []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Prune(ctx); err == nil {
+		t.Error("expected prune to refuse with an unreadable index")
+	}
+	if got := countChunks(t, repo); got != res.Referenced {
+		t.Errorf("expected no chunks to be removed, got %d", res.Referenced-got)
+	}
+}
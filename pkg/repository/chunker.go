@@ -0,0 +1,144 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ChunkerParams are the parameters of the content-defined chunker. They are stored
+// in the repository configuration, since changing them changes every chunk boundary.
+type ChunkerParams struct {
+	// MinSize is the smallest chunk that will be cut, except at the end of a stream
+	MinSize int `json:"minSize"`
+	// MaxSize is the largest chunk that will be cut
+	MaxSize int `json:"maxSize"`
+	// AverageBits is the number of bits of the rolling hash that must be zero to cut a
+	// chunk. Chunks average MinSize + 2^AverageBits bytes.
+	AverageBits uint `json:"averageBits"`
+}
+
+// DefaultChunkerParams are the chunker parameters of new repositories.
+var DefaultChunkerParams = ChunkerParams{
+	MinSize:     256 * 1024,
+	MaxSize:     4 * 1024 * 1024,
+	AverageBits: 20,
+}
+
+func (p ChunkerParams) validate() error {
+	if p.MinSize <= 0 || p.MaxSize < p.MinSize || p.AverageBits == 0 || p.AverageBits > 32 {
+		return fmt.Errorf("invalid chunker parameters: %+v", p)
+	}
+	return nil
+}
+
+// gearTable maps each byte to a pseudo-random value for the rolling hash. It is
+// generated from a fixed seed so that chunk boundaries never change between releases.
+var gearTable = func() (table [256]uint64) {
+	// splitmix64
+	seed := uint64(0x62747273796e63)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// Chunker splits a stream into content-defined chunks using a gear rolling hash.
+// Boundaries depend only on the surrounding bytes, so data shared between streams is
+// cut into the same chunks even when it is preceded by different data.
+type Chunker struct {
+	r      io.Reader
+	params ChunkerParams
+	mask   uint64
+	buf    []byte
+	start  int
+	end    int
+	eof    bool
+}
+
+// NewChunker returns a chunker reading from r.
+func NewChunker(r io.Reader, params ChunkerParams) (*Chunker, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return &Chunker{
+		r:      r,
+		params: params,
+		// The high bits of the hash depend on the most bytes
+		mask: ((uint64(1) << params.AverageBits) - 1) << (64 - params.AverageBits),
+		buf:  make([]byte, params.MaxSize*2),
+	}, nil
+}
+
+// Next returns the next chunk of the stream, or io.EOF when the stream is exhausted.
+// The returned slice is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	data := c.buf[c.start:c.end]
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+	n := c.cut(data)
+	c.start += n
+	return data[:n], nil
+}
+
+// fill reads until at least MaxSize bytes are buffered or the stream ends.
+func (c *Chunker) fill() error {
+	if c.end-c.start >= c.params.MaxSize || c.eof {
+		return nil
+	}
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	for c.end < c.params.MaxSize && !c.eof {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if errors.Is(err, io.EOF) {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut returns the length of the chunk at the start of data.
+func (c *Chunker) cut(data []byte) int {
+	if len(data) <= c.params.MinSize {
+		return len(data)
+	}
+	if len(data) > c.params.MaxSize {
+		data = data[:c.params.MaxSize]
+	}
+	var hash uint64
+	for i := c.params.MinSize; i < len(data); i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
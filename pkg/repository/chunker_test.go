@@ -0,0 +1,124 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package repository
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func chunkSizes(t *testing.T, data []byte, params ChunkerParams) []int {
+	t.Helper()
+	chunker, err := NewChunker(bytes.NewReader(data), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	var joined []byte
+	for {
+		chunk, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(chunk))
+		joined = append(joined, chunk...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatal("chunks do not add up to the stream")
+	}
+	return sizes
+}
+
+func TestChunkerBoundaries(t *testing.T) {
+	// Boundaries are part of the repository format, changing them breaks deduplication
+	// against existing repositories
+	want := []int{2223, 3898, 1290, 1369, 3916, 6059, 1486, 2621, 2058, 3056, 6631, 8192, 3446, 8192, 4103, 1098, 5898}
+	got := chunkSizes(t, testData(1, 64*1024), testChunkerParams)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected chunk sizes %v, got %v", want, got)
+	}
+}
+
+func TestChunkerSizes(t *testing.T) {
+	tc := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"smaller than min", testData(1, 100)},
+		{"random", testData(2, 256*1024)},
+		{"zeroes", make([]byte, 64*1024)},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			sizes := chunkSizes(t, tt.data, testChunkerParams)
+			for i, size := range sizes {
+				if size > testChunkerParams.MaxSize {
+					t.Errorf("chunk %d is larger than the max size: %d", i, size)
+				}
+				if size < testChunkerParams.MinSize && i != len(sizes)-1 {
+					t.Errorf("chunk %d is smaller than the min size: %d", i, size)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkerResynchronizes(t *testing.T) {
+	data := testData(1, 128*1024)
+	want := chunkSizes(t, data, testChunkerParams)
+	for _, prefix := range [][]byte{[]byte("x"), testData(2, 1000), testData(3, 10000)} {
+		got := chunkSizes(t, append(append([]byte{}, prefix...), data...), testChunkerParams)
+		// Apart from the first few, the chunks of the shifted stream end at the same
+		// offsets in data
+		ends := make(map[int]bool)
+		var end int
+		for _, size := range want {
+			end += size
+			ends[end] = true
+		}
+		var shared int
+		end = -len(prefix)
+		for _, size := range got {
+			end += size
+			if ends[end] {
+				shared++
+			}
+		}
+		if shared < len(want)-2 {
+			t.Errorf("with a %d byte prefix only %d of %d chunk boundaries were kept", len(prefix), shared, len(want))
+		}
+	}
+}
+
+func TestChunkerInvalidParams(t *testing.T) {
+	for _, params := range []ChunkerParams{
+		{MinSize: 0, MaxSize: 8192, AverageBits: 11},
+		{MinSize: 8192, MaxSize: 1024, AverageBits: 11},
+		{MinSize: 1024, MaxSize: 8192, AverageBits: 0},
+		{MinSize: 1024, MaxSize: 8192, AverageBits: 33},
+	} {
+		if _, err := NewChunker(bytes.NewReader(nil), params); err == nil {
+			t.Errorf("expected an error for %+v", params)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package repository
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/tinyzimmer/btrsync/pkg/encryption"
+)
+
+// EncryptionConfig describes the encryption of a repository. Data is encrypted with a
+// random master key, which is stored wrapped with each of the keys that may open the
+// repository. Keys are rotated by wrapping the master key with a new key, without
+// re-encrypting any data.
+type EncryptionConfig struct {
+	Keys []WrappedKey `json:"keys"`
+}
+
+// WrappedKey is the master key of a repository encrypted with a user key.
+type WrappedKey struct {
+	KeyID string `json:"keyID"`
+	Data  []byte `json:"data"`
+}
+
+// masterKeySize is the size of a master key, which holds the key encrypting data and the
+// key deriving chunk IDs.
+const masterKeySize = encryption.KeySize * 2
+
+// WithKeys sets the keys used to open an encrypted repository. New repositories are
+// encrypted when keys are given. The primary key is added to the keys that can open
+// the repository if it is not one of them yet.
+func WithKeys(keys encryption.Keyring) Option {
+	return func(r *Repository) {
+		r.keys = keys
+	}
+}
+
+// Encrypted returns true if the repository is encrypted.
+func (r *Repository) Encrypted() bool { return r.config.Encryption != nil }
+
+// Keys returns the keys the repository was opened with.
+func (r *Repository) Keys() encryption.Keyring { return r.keys }
+
+// initEncryption generates the master key of a new repository.
+func (r *Repository) initEncryption() error {
+	master := make([]byte, masterKeySize)
+	if _, err := rand.Read(master); err != nil {
+		return err
+	}
+	r.config.Encryption = &EncryptionConfig{}
+	if err := r.wrapMasterKey(master, r.keys); err != nil {
+		return err
+	}
+	return r.setMasterKey(master)
+}
+
+// openEncryption unwraps the master key of an existing repository.
+func (r *Repository) openEncryption() error {
+	if !r.Encrypted() {
+		if len(r.keys) > 0 {
+			return errors.New("repository is not encrypted, remove the encryption keys or use a new repository")
+		}
+		return nil
+	}
+	if len(r.keys) == 0 {
+		return fmt.Errorf("%w: repository is encrypted and no keys were given", encryption.ErrNoKey)
+	}
+	master, err := r.unwrapMasterKey()
+	if err != nil {
+		return err
+	}
+	if err := r.setMasterKey(master); err != nil {
+		return err
+	}
+	if r.wrapIndex(r.keys.Primary()) < 0 {
+		r.logVerbose(0, "Adding key %s to repository\n", r.keys.Primary().ID())
+		if err := r.wrapMasterKey(master, r.keys[:1]); err != nil {
+			return err
+		}
+		return r.writeJSON(configFile, &r.config)
+	}
+	return nil
+}
+
+func (r *Repository) wrapIndex(key *encryption.Key) int {
+	for i, wrapped := range r.config.Encryption.Keys {
+		if wrapped.KeyID == key.ID().String() {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *Repository) wrapMasterKey(master []byte, keys encryption.Keyring) error {
+	for _, key := range keys {
+		if r.wrapIndex(key) >= 0 {
+			continue
+		}
+		data, err := encryption.Seal(key, master)
+		if err != nil {
+			return err
+		}
+		r.config.Encryption.Keys = append(r.config.Encryption.Keys, WrappedKey{
+			KeyID: key.ID().String(),
+			Data:  data,
+		})
+	}
+	return nil
+}
+
+func (r *Repository) unwrapMasterKey() ([]byte, error) {
+	for _, wrapped := range r.config.Encryption.Keys {
+		master, err := encryption.Open(r.keys, wrapped.Data)
+		if errors.Is(err, encryption.ErrNoKey) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error unwrapping master key with key %s: %w", wrapped.KeyID, err)
+		}
+		if len(master) != masterKeySize {
+			return nil, fmt.Errorf("master key wrapped with key %s has an invalid size", wrapped.KeyID)
+		}
+		return master, nil
+	}
+	return nil, fmt.Errorf("%w: none of the given keys can open the repository", encryption.ErrNoKey)
+}
+
+func (r *Repository) setMasterKey(master []byte) error {
+	dataKey, err := encryption.NewKey(master[:encryption.KeySize])
+	if err != nil {
+		return err
+	}
+	r.dataKey = dataKey
+	r.idKey = master[encryption.KeySize:]
+	return nil
+}
+
+// RotateKeys makes the given keys the only keys that can open the repository. Data is
+// not re-encrypted, since it is encrypted with the master key.
+func (r *Repository) RotateKeys(keep encryption.Keyring) error {
+	if !r.Encrypted() {
+		return errors.New("repository is not encrypted")
+	}
+	if len(keep) == 0 {
+		return errors.New("at least one key must be kept")
+	}
+	master, err := r.unwrapMasterKey()
+	if err != nil {
+		return err
+	}
+	var kept []WrappedKey
+	for _, wrapped := range r.config.Encryption.Keys {
+		if hasKey(keep, wrapped.KeyID) {
+			kept = append(kept, wrapped)
+			continue
+		}
+		r.logVerbose(0, "Removing key %s from repository\n", wrapped.KeyID)
+	}
+	r.config.Encryption.Keys = kept
+	if err := r.wrapMasterKey(master, keep); err != nil {
+		return err
+	}
+	return r.writeJSON(configFile, &r.config)
+}
+
+func hasKey(keys encryption.Keyring, id string) bool {
+	for _, key := range keys {
+		if key.ID().String() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// chunkID returns the ID of a chunk. Encrypted repositories use a keyed hash so that
+// IDs do not reveal the contents of chunks.
+func (r *Repository) chunkID(data []byte) string {
+	if r.idKey == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, r.idKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal encrypts data stored in an encrypted repository.
+func (r *Repository) seal(data []byte) ([]byte, error) {
+	if r.dataKey == nil {
+		return data, nil
+	}
+	return encryption.Seal(r.dataKey, data)
+}
+
+// open decrypts data stored in an encrypted repository.
+func (r *Repository) open(data []byte) ([]byte, error) {
+	if r.dataKey == nil {
+		return data, nil
+	}
+	return encryption.Open(encryption.Keyring{r.dataKey}, data)
+}
+
+// writeIndex writes the index of a snapshot, encrypted if the repository is.
+func (r *Repository) writeIndex(idx *Index) error {
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	if data, err = r.seal(data); err != nil {
+		return err
+	}
+	return r.backend.WriteFile(indexPath(idx.Subvolume, idx.Name), data)
+}
+
+// decodeIndex decodes the contents of an index file.
+func (r *Repository) decodeIndex(data []byte) (*Index, error) {
+	data, err := r.open(data)
+	if err != nil {
+		return nil, err
+	}
+	var idx Index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, err
+	}
+	return &idx, nil
+}
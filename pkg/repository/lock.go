@@ -0,0 +1,199 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrLocked is returned when a lock conflicts with a lock held by another process.
+var ErrLocked = errors.New("repository is locked")
+
+// StaleLockAge is how long a lock may go without being refreshed before it is
+// considered stale. Locks are refreshed while they are held.
+var StaleLockAge = 30 * time.Minute
+
+var lockRefreshInterval = 5 * time.Minute
+
+// LockInfo is the contents of a lock file.
+type LockInfo struct {
+	Exclusive bool      `json:"exclusive"`
+	Hostname  string    `json:"hostname"`
+	PID       int       `json:"pid"`
+	Time      time.Time `json:"time"`
+}
+
+// String describes the holder of the lock.
+func (l *LockInfo) String() string {
+	kind := "shared"
+	if l.Exclusive {
+		kind = "exclusive"
+	}
+	return fmt.Sprintf("%s lock held by pid %d on %s since %s", kind, l.PID, l.Hostname, l.Time.Format(time.RFC3339))
+}
+
+// Stale returns true if the process holding the lock is gone.
+func (l *LockInfo) Stale() bool {
+	if time.Since(l.Time) > StaleLockAge {
+		return true
+	}
+	if hostname, _ := os.Hostname(); hostname == l.Hostname {
+		return syscall.Kill(l.PID, 0) == syscall.ESRCH
+	}
+	return false
+}
+
+// Lock is a lock held on a repository.
+type Lock struct {
+	repo *Repository
+	name string
+	info LockInfo
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// Lock acquires a shared or exclusive lock on the repository. Any number of shared
+// locks can be held at once, but an exclusive lock excludes every other lock. ErrLocked
+// is returned if the lock conflicts with a lock that is not stale.
+func (r *Repository) Lock(exclusive bool) (*Lock, error) {
+	if err := r.checkLocks(exclusive, ""); err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	l := &Lock{
+		repo: r,
+		name: path.Join(locksDir, uuid.New().String()+".json"),
+		info: LockInfo{
+			Exclusive: exclusive,
+			Hostname:  hostname,
+			PID:       os.Getpid(),
+			Time:      time.Now().UTC(),
+		},
+		stop: make(chan struct{}),
+	}
+	if err := r.writeJSON(l.name, &l.info); err != nil {
+		return nil, fmt.Errorf("error writing lock: %w", err)
+	}
+	// Check again in case another process locked the repository at the same time
+	if err := r.checkLocks(exclusive, l.name); err != nil {
+		r.backend.Remove(l.name)
+		return nil, err
+	}
+	l.done.Add(1)
+	go l.refresh()
+	return l, nil
+}
+
+// checkLocks returns ErrLocked if a lock other than ignore conflicts with a new lock.
+func (r *Repository) checkLocks(exclusive bool, ignore string) error {
+	locks, err := r.Locks()
+	if err != nil {
+		return err
+	}
+	for name, info := range locks {
+		if name == ignore || info.Stale() {
+			continue
+		}
+		if exclusive || info.Exclusive {
+			return fmt.Errorf("%w: %s", ErrLocked, info)
+		}
+	}
+	return nil
+}
+
+// Locks returns the locks on the repository by the name of their file.
+func (r *Repository) Locks() (map[string]*LockInfo, error) {
+	files, err := r.backend.List(locksDir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing locks: %w", err)
+	}
+	locks := make(map[string]*LockInfo)
+	for _, file := range files {
+		if file.IsDir || isTempName(file.Name) || !strings.HasSuffix(file.Name, ".json") {
+			continue
+		}
+		name := path.Join(locksDir, file.Name)
+		data, err := r.backend.ReadFile(name)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		var info LockInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			// A lock that cannot be read is treated as stale
+			info = LockInfo{Time: file.ModTime.Add(-StaleLockAge)}
+		}
+		locks[name] = &info
+	}
+	return locks, nil
+}
+
+// RemoveStaleLocks removes locks left behind by processes that are gone and returns
+// how many were removed.
+func (r *Repository) RemoveStaleLocks() (int, error) {
+	locks, err := r.Locks()
+	if err != nil {
+		return 0, err
+	}
+	var removed int
+	for name, info := range locks {
+		if !info.Stale() {
+			continue
+		}
+		r.logVerbose(1, "Removing stale %s\n", info)
+		if err := r.backend.Remove(name); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func (l *Lock) refresh() {
+	defer l.done.Done()
+	ticker := time.NewTicker(lockRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.info.Time = time.Now().UTC()
+			if err := l.repo.writeJSON(l.name, &l.info); err != nil {
+				l.repo.logVerbose(0, "Failed to refresh repository lock: %s\n", err)
+			}
+		}
+	}
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	close(l.stop)
+	l.done.Wait()
+	return l.repo.backend.Remove(l.name)
+}
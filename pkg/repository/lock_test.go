@@ -0,0 +1,167 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package repository
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	tc := []struct {
+		name            string
+		held, exclusive bool
+		wantLocked      bool
+	}{
+		{"shared with shared", false, false, false},
+		{"exclusive with shared", false, true, true},
+		{"shared with exclusive", true, false, true},
+		{"exclusive with exclusive", true, true, true},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := NewLocalBackend(t.TempDir())
+			repo := openTestRepository(t, backend)
+			// Another process sharing the repository
+			other := openTestRepository(t, backend)
+			held, err := other.Lock(tt.held)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lock, err := repo.Lock(tt.exclusive)
+			if tt.wantLocked {
+				if !errors.Is(err, ErrLocked) {
+					t.Fatalf("expected ErrLocked, got %v", err)
+				}
+				locks, err := repo.Locks()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(locks) != 1 {
+					t.Errorf("expected the conflicting lock to not be left behind, got %d locks", len(locks))
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if err := lock.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Releasing the held lock allows any lock
+			if err := held.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+			lock, err = repo.Lock(tt.exclusive)
+			if err != nil {
+				t.Fatalf("expected to lock after unlocking, got %v", err)
+			}
+			if err := lock.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestLockBlocksPrune(t *testing.T) {
+	repo := openTestRepository(t, NewLocalBackend(t.TempDir()))
+	lock, err := repo.Lock(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Prune(context.Background()); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected prune to fail with ErrLocked, got %v", err)
+	}
+	if _, err := repo.Repair(context.Background(), false); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected repair to fail with ErrLocked, got %v", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Prune(context.Background()); err != nil {
+		t.Errorf("expected prune to succeed after unlocking, got %v", err)
+	}
+}
+
+// writeStaleLocks writes an exclusive lock of every kind that is considered stale.
+func writeStaleLocks(t *testing.T, repo *Repository) {
+	t.Helper()
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := map[string]*LockInfo{
+		// A process that no longer exists on this host
+		"dead.json": {Exclusive: true, Hostname: hostname, PID: 1 << 30, Time: time.Now().UTC()},
+		// A process on another host that stopped refreshing its lock
+		"old.json": {Exclusive: true, Hostname: "elsewhere", PID: 1, Time: time.Now().Add(-2 * StaleLockAge).UTC()},
+	}
+	for name, info := range stale {
+		if err := repo.writeJSON(path.Join(locksDir, name), info); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A lock file that cannot be read, written long enough ago
+	unreadable := path.Join(locksDir, "unreadable.json")
+	if err := repo.backend.WriteFile(unreadable, []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * StaleLockAge)
+	if err := os.Chtimes(repo.backend.(*localBackend).path(unreadable), old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStaleLocks(t *testing.T) {
+	repo := openTestRepository(t, NewLocalBackend(t.TempDir()))
+	writeStaleLocks(t, repo)
+
+	// A live lock on another host is not stale
+	if err := repo.writeJSON(path.Join(locksDir, "live.json"), &LockInfo{
+		Hostname: "elsewhere", PID: 1, Time: time.Now().UTC(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stale locks do not conflict
+	lock, err := repo.Lock(false)
+	if err != nil {
+		t.Fatalf("expected stale locks to be ignored, got %v", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Lock(true); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected the live lock to conflict with an exclusive lock, got %v", err)
+	}
+
+	removed, err := repo.RemoveStaleLocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Errorf("expected 3 stale locks to be removed, got %d", removed)
+	}
+	locks, err := repo.Locks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := locks[path.Join(locksDir, "live.json")]; !ok || len(locks) != 1 {
+		t.Errorf("expected only the live lock to remain, got %v", locks)
+	}
+}
@@ -0,0 +1,462 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package repository implements a content-addressed, deduplicating store for send
+// streams. Streams are split into content-defined chunks, and each chunk is stored
+// once under the SHA-256 of its contents, compressed with zstd. Repositories can be
+// encrypted, in which case chunks and indexes are encrypted after compression and
+// chunks are stored under a keyed hash of their contents instead. Every stored snapshot
+// has an index listing its chunks in order, so a stream is restored by concatenating
+// its chunks.
+//
+// The layout of a repository is:
+//
+//	config.json                        the repository configuration
+//	data/<id[:2]>/<id>                 chunks keyed by their hex encoded SHA-256
+//	snapshots/<subvolume>/<name>.json  the index of each snapshot
+//	locks/<lock>.json                  locks held by processes using the repository
+//
+// Chunks are only removed by Prune, which requires an exclusive lock, while writers
+// hold a shared lock. A repository can be shared by any number of subvolumes.
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/tinyzimmer/btrsync/pkg/encryption"
+)
+
+// Version is the version of the repository format.
+const Version = 1
+
+const (
+	configFile   = "config.json"
+	dataDir      = "data"
+	snapshotsDir = "snapshots"
+	locksDir     = "locks"
+	indexExt     = ".json"
+)
+
+// ErrSnapshotNotFound is returned when a snapshot has no index in the repository.
+var ErrSnapshotNotFound = errors.New("snapshot not found in repository")
+
+// Config is the configuration stored in a repository.
+type Config struct {
+	Version   int           `json:"version"`
+	ID        uuid.UUID     `json:"id"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Chunker   ChunkerParams `json:"chunker"`
+	// Encryption is set if the repository is encrypted
+	Encryption *EncryptionConfig `json:"encryption,omitempty"`
+}
+
+// Repository is a deduplicating store of send streams.
+type Repository struct {
+	backend   Backend
+	config    Config
+	logger    *log.Logger
+	verbosity int
+
+	keys    encryption.Keyring
+	dataKey *encryption.Key
+	idKey   []byte
+
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+
+	// known caches the IDs of chunks in the repository while it is locked
+	known   map[string]struct{}
+	knownMu sync.Mutex
+}
+
+// Option is a function that configures a repository.
+type Option func(*Repository)
+
+// WithLogger sets the logger and verbosity of the repository.
+func WithLogger(logger *log.Logger, verbosity int) Option {
+	return func(r *Repository) {
+		r.logger = logger
+		r.verbosity = verbosity
+	}
+}
+
+// Open opens the repository stored in the backend, initializing it if it does not
+// exist yet. The backend is closed with the repository.
+func Open(backend Backend, opts ...Option) (*Repository, error) {
+	r := &Repository{
+		backend: backend,
+		logger:  log.New(io.Discard, "", 0),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	data, err := backend.ReadFile(configFile)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &r.config); err != nil {
+			return nil, fmt.Errorf("error reading repository configuration: %w", err)
+		}
+		if r.config.Version != Version {
+			return nil, fmt.Errorf("unsupported repository version %d", r.config.Version)
+		}
+		if err := r.openEncryption(); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		r.config = Config{
+			Version:   Version,
+			ID:        uuid.New(),
+			CreatedAt: time.Now().UTC(),
+			Chunker:   DefaultChunkerParams,
+		}
+		r.logVerbose(0, "Initializing new repository %s\n", r.config.ID)
+		if len(r.keys) > 0 {
+			if err := r.initEncryption(); err != nil {
+				return nil, fmt.Errorf("error initializing repository encryption: %w", err)
+			}
+		}
+		if err := r.writeJSON(configFile, &r.config); err != nil {
+			return nil, fmt.Errorf("error initializing repository: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("error reading repository configuration: %w", err)
+	}
+	if err := r.config.Chunker.validate(); err != nil {
+		return nil, err
+	}
+	if r.enc, err = zstd.NewWriter(nil); err != nil {
+		return nil, err
+	}
+	if r.dec, err = zstd.NewReader(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Config returns the configuration of the repository.
+func (r *Repository) Config() Config { return r.config }
+
+// Close closes the repository and its backend.
+func (r *Repository) Close() error {
+	if r.enc != nil {
+		r.enc.Close()
+	}
+	if r.dec != nil {
+		r.dec.Close()
+	}
+	return r.backend.Close()
+}
+
+func (r *Repository) logVerbose(level int, format string, args ...interface{}) {
+	if r.verbosity >= level {
+		r.logger.Printf(format, args...)
+	}
+}
+
+func (r *Repository) writeJSON(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return r.backend.WriteFile(name, data)
+}
+
+// ChunkRef is a reference to a chunk in an index.
+type ChunkRef struct {
+	ID   string `json:"id"`
+	Size uint32 `json:"size"`
+}
+
+// Index lists the chunks of a stored snapshot.
+type Index struct {
+	Subvolume    string     `json:"subvolume"`
+	Name         string     `json:"name"`
+	UUID         uuid.UUID  `json:"uuid"`
+	Generation   uint64     `json:"generation"`
+	CreationTime time.Time  `json:"creationTime"`
+	StoredAt     time.Time  `json:"storedAt"`
+	Size         uint64     `json:"size"`
+	Chunks       []ChunkRef `json:"chunks"`
+}
+
+func chunkPath(id string) string {
+	return path.Join(dataDir, id[:2], id)
+}
+
+func indexPath(subvolume, name string) string {
+	return path.Join(snapshotsDir, subvolume, name+indexExt)
+}
+
+// refreshKnown lists the chunks in the repository. It must be called with a lock held,
+// since chunks may have been pruned since the last listing.
+func (r *Repository) refreshKnown() error {
+	r.knownMu.Lock()
+	defer r.knownMu.Unlock()
+	known := make(map[string]struct{})
+	err := r.walkChunks(func(id string, _ FileInfo) error {
+		known[id] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error listing chunks: %w", err)
+	}
+	r.known = known
+	return nil
+}
+
+// walkChunks calls fn for every chunk file in the repository. Temporary files are
+// skipped.
+func (r *Repository) walkChunks(fn func(id string, info FileInfo) error) error {
+	prefixes, err := r.backend.List(dataDir)
+	if err != nil {
+		return err
+	}
+	for _, prefix := range prefixes {
+		if !prefix.IsDir {
+			continue
+		}
+		files, err := r.backend.List(path.Join(dataDir, prefix.Name))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if file.IsDir || isTempName(file.Name) {
+				continue
+			}
+			if err := fn(file.Name, file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Repository) hasChunk(id string) bool {
+	r.knownMu.Lock()
+	defer r.knownMu.Unlock()
+	_, ok := r.known[id]
+	return ok
+}
+
+// saveChunk stores a chunk if it is not already in the repository and returns true
+// if it was written.
+func (r *Repository) saveChunk(data []byte) (string, bool, error) {
+	id := r.chunkID(data)
+	if r.hasChunk(id) {
+		return id, false, nil
+	}
+	sealed, err := r.seal(r.enc.EncodeAll(data, nil))
+	if err != nil {
+		return "", false, err
+	}
+	if err := r.backend.WriteFile(chunkPath(id), sealed); err != nil {
+		return "", false, fmt.Errorf("error writing chunk %s: %w", id, err)
+	}
+	r.knownMu.Lock()
+	r.known[id] = struct{}{}
+	r.knownMu.Unlock()
+	return id, true, nil
+}
+
+// loadChunk reads a chunk and verifies its contents.
+func (r *Repository) loadChunk(id string) ([]byte, error) {
+	data, err := r.backend.ReadFile(chunkPath(id))
+	if err != nil {
+		return nil, err
+	}
+	if data, err = r.open(data); err != nil {
+		return nil, fmt.Errorf("chunk %s is corrupt: %w", id, err)
+	}
+	data, err = r.dec.DecodeAll(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s is corrupt: %w", id, err)
+	}
+	if r.chunkID(data) != id {
+		return nil, fmt.Errorf("chunk %s is corrupt: content does not match its ID", id)
+	}
+	return data, nil
+}
+
+// Save splits a send stream into chunks and stores it under the given index, whose
+// chunks and size are filled in. The index is only written once every chunk is
+// stored, so an interrupted save leaves no snapshot behind.
+func (r *Repository) Save(ctx context.Context, idx *Index, stream io.Reader) error {
+	lock, err := r.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if err := r.refreshKnown(); err != nil {
+		return err
+	}
+	chunker, err := NewChunker(stream, r.config.Chunker)
+	if err != nil {
+		return err
+	}
+	idx.Chunks, idx.Size = nil, 0
+	var written, writtenBytes uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading stream: %w", err)
+		}
+		id, isNew, err := r.saveChunk(chunk)
+		if err != nil {
+			return err
+		}
+		if isNew {
+			written++
+			writtenBytes += uint64(len(chunk))
+		}
+		idx.Chunks = append(idx.Chunks, ChunkRef{ID: id, Size: uint32(len(chunk))})
+		idx.Size += uint64(len(chunk))
+	}
+	idx.StoredAt = time.Now().UTC()
+	if err := r.writeIndex(idx); err != nil {
+		return fmt.Errorf("error writing index: %w", err)
+	}
+	r.logVerbose(1, "Stored %q in %d chunks, %d new totalling %d of %d bytes\n",
+		idx.Name, len(idx.Chunks), written, writtenBytes, idx.Size)
+	return nil
+}
+
+// Subvolumes returns the names of the subvolumes with snapshots in the repository.
+func (r *Repository) Subvolumes() ([]string, error) {
+	dirs, err := r.backend.List(snapshotsDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, dir := range dirs {
+		if dir.IsDir {
+			names = append(names, dir.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Snapshots returns the indexes of a subvolume's snapshots, oldest first.
+func (r *Repository) Snapshots(subvolume string) ([]*Index, error) {
+	files, err := r.backend.List(path.Join(snapshotsDir, subvolume))
+	if err != nil {
+		return nil, err
+	}
+	var indexes []*Index
+	for _, file := range files {
+		if file.IsDir || isTempName(file.Name) || !strings.HasSuffix(file.Name, indexExt) {
+			continue
+		}
+		idx, err := r.Snapshot(subvolume, strings.TrimSuffix(file.Name, indexExt))
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, idx)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		if indexes[i].CreationTime.Equal(indexes[j].CreationTime) {
+			return indexes[i].Generation < indexes[j].Generation
+		}
+		return indexes[i].CreationTime.Before(indexes[j].CreationTime)
+	})
+	return indexes, nil
+}
+
+// Snapshot returns the index of a snapshot, or ErrSnapshotNotFound.
+func (r *Repository) Snapshot(subvolume, name string) (*Index, error) {
+	data, err := r.backend.ReadFile(indexPath(subvolume, name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s/%s", ErrSnapshotNotFound, subvolume, name)
+		}
+		return nil, err
+	}
+	idx, err := r.decodeIndex(data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading index of %s/%s: %w", subvolume, name, err)
+	}
+	return idx, nil
+}
+
+// DeleteSnapshot removes the index of a snapshot. Its chunks are left in place until
+// the next Prune.
+func (r *Repository) DeleteSnapshot(subvolume, name string) error {
+	return r.backend.Remove(indexPath(subvolume, name))
+}
+
+// OpenSnapshot returns the send stream of a snapshot, reassembled from its chunks. Each chunk
+// is verified as it is read.
+func (r *Repository) OpenSnapshot(idx *Index) io.ReadCloser {
+	return &streamReader{repo: r, chunks: idx.Chunks}
+}
+
+type streamReader struct {
+	repo   *Repository
+	chunks []ChunkRef
+	buf    *bytes.Reader
+	err    error
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.buf != nil && s.buf.Len() > 0 {
+			return s.buf.Read(p)
+		}
+		if len(s.chunks) == 0 {
+			return 0, io.EOF
+		}
+		ref := s.chunks[0]
+		s.chunks = s.chunks[1:]
+		data, err := s.repo.loadChunk(ref.ID)
+		if err != nil {
+			s.err = fmt.Errorf("error reading chunk %s: %w", ref.ID, err)
+			continue
+		}
+		if len(data) != int(ref.Size) {
+			s.err = fmt.Errorf("chunk %s has size %d, expected %d", ref.ID, len(data), ref.Size)
+			continue
+		}
+		s.buf = bytes.NewReader(data)
+	}
+}
+
+func (s *streamReader) Close() error {
+	s.chunks, s.buf = nil, nil
+	return nil
+}
@@ -0,0 +1,259 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package repository
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/sftp"
+
+	"github.com/tinyzimmer/btrsync/pkg/encryption"
+)
+
+// testChunkerParams cut small chunks, so that test data spans many of them.
+var testChunkerParams = ChunkerParams{MinSize: 1024, MaxSize: 8192, AverageBits: 11}
+
+// openTestRepository opens the repository in the backend, initializing new ones with
+// testChunkerParams.
+func openTestRepository(t *testing.T, backend Backend, opts ...Option) *Repository {
+	t.Helper()
+	defaults := DefaultChunkerParams
+	DefaultChunkerParams = testChunkerParams
+	defer func() { DefaultChunkerParams = defaults }()
+	repo, err := Open(backend, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+// sftpTestBackend is an sftpBackend connected to an in-process SFTP server.
+type sftpTestBackend struct {
+	*sftpBackend
+	server *sftp.Server
+}
+
+// Close stops the server first, as the client waits for it to close the connection.
+func (b *sftpTestBackend) Close() error {
+	b.server.Close()
+	return b.sftpBackend.Close()
+}
+
+// newSFTPTestBackend returns a backend storing files under root through an SFTP server
+// serving the local filesystem.
+func newSFTPTestBackend(t *testing.T, root string) Backend {
+	t.Helper()
+	serverRead, clientWrite := io.Pipe()
+	clientRead, serverWrite := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverRead, serverWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientRead, clientWrite)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return &sftpTestBackend{&sftpBackend{sftpClient: client, root: root}, server}
+}
+
+func testData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func testKey(t *testing.T) *encryption.Key {
+	t.Helper()
+	key, err := encryption.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func saveSnapshot(t *testing.T, repo *Repository, subvolume, name string, data []byte) *Index {
+	t.Helper()
+	idx := &Index{Subvolume: subvolume, Name: name}
+	if err := repo.Save(context.Background(), idx, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func restoreSnapshot(repo *Repository, subvolume, name string) ([]byte, error) {
+	idx, err := repo.Snapshot(subvolume, name)
+	if err != nil {
+		return nil, err
+	}
+	stream := repo.OpenSnapshot(idx)
+	defer stream.Close()
+	return io.ReadAll(stream)
+}
+
+func countChunks(t *testing.T, repo *Repository) int {
+	t.Helper()
+	var chunks int
+	if err := repo.walkChunks(func(string, FileInfo) error { chunks++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
+func TestSaveRestore(t *testing.T) {
+	backends := map[string]func(t *testing.T, root string) Backend{
+		"local": func(_ *testing.T, root string) Backend { return NewLocalBackend(root) },
+		"sftp":  newSFTPTestBackend,
+	}
+	for backendName, newBackend := range backends {
+		for _, encrypted := range []bool{false, true} {
+			for _, size := range []int{0, 100, 100 * 1024} {
+				name := fmt.Sprintf("%s/encrypted=%t/%d bytes", backendName, encrypted, size)
+				t.Run(name, func(t *testing.T) {
+					root := t.TempDir()
+					var opts []Option
+					if encrypted {
+						opts = append(opts, WithKeys(encryption.Keyring{testKey(t)}))
+					}
+					data := testData(int64(size), size)
+					repo := openTestRepository(t, newBackend(t, root), opts...)
+					idx := saveSnapshot(t, repo, "root", "root.1", data)
+					if idx.Size != uint64(size) {
+						t.Errorf("expected index size %d, got %d", size, idx.Size)
+					}
+					if size == 100*1024 && len(idx.Chunks) < 2 {
+						t.Errorf("expected the stream to span several chunks, got %d", len(idx.Chunks))
+					}
+
+					// Restore from a new instance of the repository
+					reopened := openTestRepository(t, newBackend(t, root), opts...)
+					restored, err := restoreSnapshot(reopened, "root", "root.1")
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(restored, data) {
+						t.Errorf("restored %d bytes that do not match the %d saved", len(restored), len(data))
+					}
+					if encrypted != reopened.Encrypted() {
+						t.Errorf("expected encrypted to be %t", encrypted)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestSaveDeduplicates(t *testing.T) {
+	repo := openTestRepository(t, NewLocalBackend(t.TempDir()))
+	data := testData(1, 200*1024)
+	first := saveSnapshot(t, repo, "root", "root.1", data)
+	chunks := countChunks(t, repo)
+
+	// The same data preceded by other data is cut into the same chunks once the
+	// rolling hash resynchronizes
+	shifted := append([]byte("a few bytes inserted at the start"), data...)
+	second := saveSnapshot(t, repo, "root", "root.2", shifted)
+	known := make(map[string]bool)
+	for _, chunk := range first.Chunks {
+		known[chunk.ID] = true
+	}
+	var added int
+	for _, chunk := range second.Chunks {
+		if !known[chunk.ID] {
+			added++
+		}
+	}
+	if added > 2 {
+		t.Errorf("expected at most 2 new chunks for the shifted stream, got %d of %d", added, len(second.Chunks))
+	}
+	if got := countChunks(t, repo); got != chunks+added {
+		t.Errorf("expected %d chunks in the repository, got %d", chunks+added, got)
+	}
+
+	// Saving the same data again writes nothing
+	saveSnapshot(t, repo, "other", "other.1", data)
+	if got := countChunks(t, repo); got != chunks+added {
+		t.Errorf("expected no new chunks for a duplicate stream, got %d", got-chunks-added)
+	}
+}
+
+func TestEncryptedRepository(t *testing.T) {
+	root := t.TempDir()
+	key, other := testKey(t), testKey(t)
+	data := testData(1, 50*1024)
+	repo := openTestRepository(t, NewLocalBackend(root), WithKeys(encryption.Keyring{key}))
+	idx := saveSnapshot(t, repo, "root", "root.1", data)
+
+	// Chunk IDs do not reveal the contents
+	sum := sha256.Sum256(data[:idx.Chunks[0].Size])
+	if idx.Chunks[0].ID == hex.EncodeToString(sum[:]) {
+		t.Error("expected chunk IDs of an encrypted repository to be keyed")
+	}
+	stored, err := NewLocalBackend(root).ReadFile(chunkPath(idx.Chunks[0].ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encryption.IsEncrypted(stored) {
+		t.Error("expected chunks to be encrypted")
+	}
+
+	for name, keys := range map[string]encryption.Keyring{
+		"without keys":   nil,
+		"with other key": {other},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Open(NewLocalBackend(root), WithKeys(keys))
+			if !errors.Is(err, encryption.ErrNoKey) {
+				t.Errorf("expected ErrNoKey, got %v", err)
+			}
+		})
+	}
+
+	// Opening with a new primary key adds it, and rotating removes the old key
+	rotated := openTestRepository(t, NewLocalBackend(root), WithKeys(encryption.Keyring{other, key}))
+	if err := rotated.RotateKeys(encryption.Keyring{other}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(NewLocalBackend(root), WithKeys(encryption.Keyring{key})); !errors.Is(err, encryption.ErrNoKey) {
+		t.Errorf("expected the rotated key to no longer open the repository, got %v", err)
+	}
+	restored, err := restoreSnapshot(openTestRepository(t, NewLocalBackend(root), WithKeys(encryption.Keyring{other})), "root", "root.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, data) {
+		t.Error("restored data does not match after rotating keys")
+	}
+
+	plain := NewLocalBackend(t.TempDir())
+	openTestRepository(t, plain)
+	if _, err := Open(plain, WithKeys(encryption.Keyring{key})); err == nil {
+		t.Error("expected opening an unencrypted repository with keys to fail")
+	}
+}
@@ -0,0 +1,125 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package repository
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+type sftpBackend struct {
+	sshClient  *ssh.Client
+	sftpClient *sftp.Client
+	root       string
+}
+
+// NewSFTPBackend returns a backend storing files under root on a remote host over
+// SFTP. The backend takes ownership of the SSH client and closes it with the backend.
+func NewSFTPBackend(sshClient *ssh.Client, root string) (Backend, error) {
+	sftpClient, err := sftp.NewClient(sshClient, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		return nil, err
+	}
+	return &sftpBackend{
+		sshClient:  sshClient,
+		sftpClient: sftpClient,
+		root:       root,
+	}, nil
+}
+
+func (b *sftpBackend) path(name string) string {
+	return path.Join(b.root, name)
+}
+
+func (b *sftpBackend) ReadFile(name string) ([]byte, error) {
+	f, err := b.sftpClient.Open(b.path(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (b *sftpBackend) WriteFile(name string, data []byte) error {
+	dest := b.path(name)
+	if err := b.sftpClient.MkdirAll(path.Dir(dest)); err != nil {
+		return err
+	}
+	tmp := tempName(dest)
+	f, err := b.sftpClient.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		b.sftpClient.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		b.sftpClient.Remove(tmp)
+		return err
+	}
+	if err := b.sftpClient.PosixRename(tmp, dest); err != nil {
+		b.sftpClient.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (b *sftpBackend) Remove(name string) error {
+	err := b.sftpClient.Remove(b.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (b *sftpBackend) List(dir string) ([]FileInfo, error) {
+	entries, err := b.sftpClient.ReadDir(b.path(dir))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	files := make([]FileInfo, len(entries))
+	for i, entry := range entries {
+		files[i] = FileInfo{
+			Name:    entry.Name(),
+			Size:    entry.Size(),
+			ModTime: entry.ModTime(),
+			IsDir:   entry.IsDir(),
+		}
+	}
+	return files, nil
+}
+
+func (b *sftpBackend) Close() error {
+	err := b.sftpClient.Close()
+	if b.sshClient == nil {
+		return err
+	}
+	if cerr := b.sshClient.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
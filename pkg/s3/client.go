@@ -0,0 +1,474 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package s3 implements a minimal client for S3-compatible object storage, covering
+// the operations needed to store send streams: listing, reading and deleting objects,
+// and resumable multipart uploads. Requests are signed with AWS Signature Version 4, so
+// the client works with AWS as well as MinIO and other compatible services.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRegion is the region used when none is configured.
+const DefaultRegion = "us-east-1"
+
+// Client is a client for an S3-compatible service.
+type Client struct {
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    *bool
+	httpClient   *http.Client
+}
+
+// Option is an option for a Client.
+type Option func(*Client) error
+
+// WithEndpoint sets the URL of the service, such as http://localhost:9000 for a local
+// MinIO server. It defaults to AWS in the configured region.
+func WithEndpoint(endpoint string) Option {
+	return func(c *Client) error {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid endpoint %q: scheme must be http or https", endpoint)
+		}
+		c.endpoint = u
+		return nil
+	}
+}
+
+// WithRegion sets the region requests are signed for. It defaults to the AWS_REGION
+// environment variable or DefaultRegion.
+func WithRegion(region string) Option {
+	return func(c *Client) error {
+		c.region = region
+		return nil
+	}
+}
+
+// WithCredentials sets the credentials requests are signed with. They default to the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+func WithCredentials(accessKey, secretKey, sessionToken string) Option {
+	return func(c *Client) error {
+		c.accessKey, c.secretKey, c.sessionToken = accessKey, secretKey, sessionToken
+		return nil
+	}
+}
+
+// WithPathStyle addresses buckets in the path of requests instead of the host name.
+// Most self-hosted services require it, and it is the default when an endpoint is set.
+func WithPathStyle(pathStyle bool) Option {
+	return func(c *Client) error {
+		c.pathStyle = &pathStyle
+		return nil
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to make requests.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) error {
+		c.httpClient = client
+		return nil
+	}
+}
+
+// New returns a new client.
+func New(opts ...Option) (*Client, error) {
+	c := &Client{httpClient: http.DefaultClient}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.region == "" {
+		if c.region = os.Getenv("AWS_REGION"); c.region == "" {
+			c.region = DefaultRegion
+		}
+	}
+	if c.accessKey == "" && c.secretKey == "" {
+		c.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		c.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, errors.New("no s3 credentials configured")
+	}
+	if c.pathStyle == nil {
+		pathStyle := c.endpoint != nil
+		c.pathStyle = &pathStyle
+	}
+	if c.endpoint == nil {
+		c.endpoint = &url.URL{Scheme: "https", Host: fmt.Sprintf("s3.%s.amazonaws.com", c.region)}
+	}
+	return c, nil
+}
+
+// Error is an error returned by the service.
+type Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+	Resource   string `xml:"Resource"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3 request failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3 request failed with status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// IsNotFound returns true if the error is caused by a missing object, bucket or upload.
+func IsNotFound(err error) bool {
+	var s3err *Error
+	if !errors.As(err, &s3err) {
+		return false
+	}
+	switch s3err.Code {
+	case "NoSuchKey", "NoSuchBucket", "NoSuchUpload":
+		return true
+	}
+	return s3err.StatusCode == http.StatusNotFound
+}
+
+// request is a request to the service.
+type request struct {
+	method string
+	bucket string
+	key    string
+	query  url.Values
+	header http.Header
+	body   []byte
+	// stream is set to return the body of the response instead of reading it
+	stream bool
+}
+
+func (c *Client) url(bucket, key string) *url.URL {
+	u := *c.endpoint
+	p := strings.TrimSuffix(u.Path, "/")
+	if *c.pathStyle {
+		p += "/" + bucket
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	if key != "" {
+		p += "/" + key
+	}
+	if p == "" {
+		p = "/"
+	}
+	u.Path = p
+	u.RawPath = encodePath(p)
+	return &u
+}
+
+func (c *Client) do(ctx context.Context, r *request) (*http.Response, error) {
+	u := c.url(r.bucket, r.key)
+	if r.query != nil {
+		u.RawQuery = encodeQuery(r.query)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.method, u.String(), bytes.NewReader(r.body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(r.body))
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+	sum := sha256.Sum256(r.body)
+	c.sign(req, hex.EncodeToString(sum[:]), time.Now().UTC())
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, parseError(resp)
+	}
+	if !r.stream {
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		// Some operations report errors in the body of a successful response
+		head := data
+		if len(head) > 256 {
+			head = head[:256]
+		}
+		if bytes.Contains(head, []byte("<Error>")) {
+			return nil, decodeError(resp.StatusCode, data)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+	}
+	return resp, nil
+}
+
+func parseError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	return decodeError(resp.StatusCode, data)
+}
+
+func decodeError(status int, data []byte) error {
+	e := &Error{StatusCode: status}
+	if len(data) > 0 {
+		if err := xml.Unmarshal(data, e); err != nil {
+			e.Message = strings.TrimSpace(string(data))
+		}
+	}
+	return e
+}
+
+func decodeXML(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding s3 response: %w", err)
+	}
+	return nil
+}
+
+// PutOptions are options for writing objects.
+type PutOptions struct {
+	// StorageClass is the storage class of the object, such as STANDARD_IA or GLACIER
+	StorageClass string
+	// ContentType is the content type of the object
+	ContentType string
+}
+
+func (o *PutOptions) header() http.Header {
+	h := make(http.Header)
+	if o == nil {
+		return h
+	}
+	if o.StorageClass != "" {
+		h.Set("X-Amz-Storage-Class", o.StorageClass)
+	}
+	if o.ContentType != "" {
+		h.Set("Content-Type", o.ContentType)
+	}
+	return h
+}
+
+// PutObject writes an object.
+func (c *Client) PutObject(ctx context.Context, bucket, key string, data []byte, opts *PutOptions) error {
+	_, err := c.do(ctx, &request{method: http.MethodPut, bucket: bucket, key: key, header: opts.header(), body: data})
+	return err
+}
+
+// GetObject returns a reader of the contents of an object.
+func (c *Client) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, &request{method: http.MethodGet, bucket: bucket, key: key, stream: true})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DeleteObject deletes an object. Deleting an object that does not exist is not an
+// error.
+func (c *Client) DeleteObject(ctx context.Context, bucket, key string) error {
+	_, err := c.do(ctx, &request{method: http.MethodDelete, bucket: bucket, key: key})
+	return err
+}
+
+// Object describes an object in a bucket.
+type Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	StorageClass string    `xml:"StorageClass"`
+}
+
+// ListResult is the result of listing a bucket.
+type ListResult struct {
+	// Objects are the objects matching the prefix
+	Objects []Object
+	// Prefixes are the common prefixes of keys when listing with a delimiter
+	Prefixes []string
+}
+
+type listBucketResult struct {
+	Contents       []Object `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// ListObjects lists the objects in a bucket with the given prefix. When delimiter is
+// set, keys containing it after the prefix are grouped into common prefixes.
+func (c *Client) ListObjects(ctx context.Context, bucket, prefix, delimiter string) (*ListResult, error) {
+	res := &ListResult{}
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.do(ctx, &request{method: http.MethodGet, bucket: bucket, query: query})
+		if err != nil {
+			return nil, err
+		}
+		var page listBucketResult
+		if err := decodeXML(resp, &page); err != nil {
+			return nil, err
+		}
+		res.Objects = append(res.Objects, page.Contents...)
+		for _, p := range page.CommonPrefixes {
+			res.Prefixes = append(res.Prefixes, p.Prefix)
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return res, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Part is an uploaded part of a multipart upload.
+type Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+	Size   int64  `xml:"Size"`
+}
+
+// CreateMultipartUpload starts a multipart upload and returns its ID.
+func (c *Client) CreateMultipartUpload(ctx context.Context, bucket, key string, opts *PutOptions) (string, error) {
+	resp, err := c.do(ctx, &request{
+		method: http.MethodPost,
+		bucket: bucket,
+		key:    key,
+		query:  url.Values{"uploads": {""}},
+		header: opts.header(),
+	})
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := decodeXML(resp, &res); err != nil {
+		return "", err
+	}
+	return res.UploadID, nil
+}
+
+// UploadPart uploads a part of a multipart upload and returns its ETag. Uploading a
+// part number again replaces the part.
+func (c *Client) UploadPart(ctx context.Context, bucket, key, uploadID string, number int, data []byte) (string, error) {
+	resp, err := c.do(ctx, &request{
+		method: http.MethodPut,
+		bucket: bucket,
+		key:    key,
+		query:  url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}},
+		body:   data,
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// ListParts lists the parts uploaded to a multipart upload.
+func (c *Client) ListParts(ctx context.Context, bucket, key, uploadID string) ([]Part, error) {
+	var parts []Part
+	var marker string
+	for {
+		query := url.Values{"uploadId": {uploadID}}
+		if marker != "" {
+			query.Set("part-number-marker", marker)
+		}
+		resp, err := c.do(ctx, &request{method: http.MethodGet, bucket: bucket, key: key, query: query})
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Parts                []Part `xml:"Part"`
+			IsTruncated          bool   `xml:"IsTruncated"`
+			NextPartNumberMarker string `xml:"NextPartNumberMarker"`
+		}
+		if err := decodeXML(resp, &page); err != nil {
+			return nil, err
+		}
+		parts = append(parts, page.Parts...)
+		if !page.IsTruncated || page.NextPartNumberMarker == "" {
+			return parts, nil
+		}
+		marker = page.NextPartNumberMarker
+	}
+}
+
+// CompleteMultipartUpload assembles the given parts into the object.
+func (c *Client) CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []Part) error {
+	type completedPart struct {
+		Number int    `xml:"PartNumber"`
+		ETag   string `xml:"ETag"`
+	}
+	body := struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{}
+	for _, part := range parts {
+		body.Parts = append(body.Parts, completedPart{Number: part.Number, ETag: part.ETag})
+	}
+	data, err := xml.Marshal(&body)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, &request{
+		method: http.MethodPost,
+		bucket: bucket,
+		key:    key,
+		query:  url.Values{"uploadId": {uploadID}},
+		header: http.Header{"Content-Type": {"application/xml"}},
+		body:   data,
+	})
+	return err
+}
+
+// AbortMultipartUpload aborts a multipart upload and deletes its parts.
+func (c *Client) AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error {
+	_, err := c.do(ctx, &request{
+		method: http.MethodDelete,
+		bucket: bucket,
+		key:    key,
+		query:  url.Values{"uploadId": {uploadID}},
+	})
+	return err
+}
@@ -0,0 +1,179 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/tinyzimmer/btrsync/pkg/s3/s3test"
+)
+
+func newTestClient(t *testing.T, buckets ...string) (*Client, *s3test.Server) {
+	t.Helper()
+	srv := s3test.NewServer(buckets...)
+	t.Cleanup(srv.Close)
+	client, err := New(WithEndpoint(srv.URL), WithCredentials("access", "secret", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, srv
+}
+
+func TestObjects(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newTestClient(t, "bucket")
+	data := []byte("stream contents")
+	if err := client.PutObject(ctx, "bucket", "mirror/root/snap.btrfs", data, &PutOptions{StorageClass: "STANDARD_IA"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := srv.Object("bucket", "mirror/root/snap.btrfs"); !bytes.Equal(got, data) {
+		t.Fatalf("stored %q, want %q", got, data)
+	}
+	rdr, err := client.GetObject(ctx, "bucket", "mirror/root/snap.btrfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rdr)
+	rdr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %q, want %q", got, data)
+	}
+	if err := client.DeleteObject(ctx, "bucket", "mirror/root/snap.btrfs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetObject(ctx, "bucket", "mirror/root/snap.btrfs"); !IsNotFound(err) {
+		t.Fatalf("expected a not found error reading a deleted object, got %v", err)
+	}
+	if err := client.DeleteObject(ctx, "bucket", "mirror/root/snap.btrfs"); err != nil {
+		t.Fatalf("deleting a missing object failed: %s", err)
+	}
+	if _, err := client.GetObject(ctx, "missing", "key"); !IsNotFound(err) {
+		t.Fatalf("expected a not found error for a missing bucket, got %v", err)
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newTestClient(t, "bucket")
+	for _, key := range []string{
+		"mirror/home/.offsets/a",
+		"mirror/home/.offsets/b",
+		"mirror/home/home.1.btrfs",
+		"mirror/home/home.2.btrfs",
+		"mirror/root/root.1.btrfs",
+		"mirror/roots.btrfs",
+		"other/home/home.1.btrfs",
+	} {
+		srv.PutObject("bucket", key, []byte(key))
+	}
+	keys := func(objects []Object) []string {
+		var keys []string
+		for _, obj := range objects {
+			keys = append(keys, obj.Key)
+		}
+		return keys
+	}
+	tests := []struct {
+		name, prefix, delimiter string
+		pageSize                int
+		objects, prefixes       []string
+	}{
+		{
+			name:   "prefix",
+			prefix: "mirror/home/",
+			objects: []string{
+				"mirror/home/.offsets/a", "mirror/home/.offsets/b",
+				"mirror/home/home.1.btrfs", "mirror/home/home.2.btrfs",
+			},
+		},
+		{
+			name:      "delimiter",
+			prefix:    "mirror/home/",
+			delimiter: "/",
+			objects:   []string{"mirror/home/home.1.btrfs", "mirror/home/home.2.btrfs"},
+			prefixes:  []string{"mirror/home/.offsets/"},
+		},
+		{
+			name:      "prefix that is not a directory",
+			prefix:    "mirror/root",
+			delimiter: "/",
+			objects:   []string{"mirror/roots.btrfs"},
+			prefixes:  []string{"mirror/root/"},
+		},
+		{
+			name:      "paginated",
+			prefix:    "mirror/",
+			delimiter: "/",
+			pageSize:  1,
+			objects:   []string{"mirror/roots.btrfs"},
+			prefixes:  []string{"mirror/home/", "mirror/root/"},
+		},
+		{
+			name:     "paginated without delimiter",
+			prefix:   "mirror/home/",
+			pageSize: 3,
+			objects: []string{
+				"mirror/home/.offsets/a", "mirror/home/.offsets/b",
+				"mirror/home/home.1.btrfs", "mirror/home/home.2.btrfs",
+			},
+		},
+		{
+			name:   "no matches",
+			prefix: "missing/",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv.PageSize = 1000
+			if tc.pageSize > 0 {
+				srv.PageSize = tc.pageSize
+			}
+			res, err := client.ListObjects(ctx, "bucket", tc.prefix, tc.delimiter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := keys(res.Objects); !reflect.DeepEqual(got, tc.objects) {
+				t.Errorf("objects %v, want %v", got, tc.objects)
+			}
+			if !reflect.DeepEqual(res.Prefixes, tc.prefixes) {
+				t.Errorf("prefixes %v, want %v", res.Prefixes, tc.prefixes)
+			}
+		})
+	}
+
+	// Deleting everything listed under a prefix leaves the other keys alone
+	srv.PageSize = 2
+	res, err := client.ListObjects(ctx, "bucket", "mirror/home/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, obj := range res.Objects {
+		if err := client.DeleteObject(ctx, "bucket", obj.Key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"mirror/root/root.1.btrfs", "mirror/roots.btrfs", "other/home/home.1.btrfs"}
+	if got := srv.Keys("bucket"); !reflect.DeepEqual(got, want) {
+		t.Errorf("keys after deleting the prefix %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,346 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package s3test provides an in-memory S3 server for testing. It implements the
+// path-style requests made by the s3 package: reading, writing, deleting and listing
+// objects, and multipart uploads.
+package s3test
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is an in-memory S3 server.
+type Server struct {
+	*httptest.Server
+
+	// PageSize is the number of keys returned by each list request. It defaults to
+	// 1000 like S3.
+	PageSize int
+	// Fail is called with every request, and the request fails with an internal error
+	// if it returns true.
+	Fail func(r *http.Request) bool
+
+	mu       sync.Mutex
+	buckets  map[string]map[string][]byte
+	uploads  map[string]*upload
+	uploadID int
+}
+
+type upload struct {
+	bucket string
+	key    string
+	parts  map[int][]byte
+}
+
+// NewServer starts a server with the given buckets. It must be closed when done.
+func NewServer(buckets ...string) *Server {
+	s := &Server{
+		PageSize: 1000,
+		buckets:  make(map[string]map[string][]byte),
+		uploads:  make(map[string]*upload),
+	}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = make(map[string][]byte)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Object returns the contents of an object and whether it exists.
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.buckets[bucket][key]
+	return data, ok
+}
+
+// PutObject writes an object.
+func (s *Server) PutObject(bucket, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket][key] = data
+}
+
+// Keys returns the keys of the objects in a bucket, sorted.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.buckets[bucket], "")
+}
+
+// Uploads returns the keys of the multipart uploads in progress in a bucket, sorted.
+func (s *Server) Uploads(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for _, u := range s.uploads {
+		if u.bucket == bucket {
+			keys = append(keys, u.key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Parts returns the numbers of the parts uploaded to a multipart upload, sorted.
+func (s *Server) Parts(uploadID string) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.uploads[uploadID]
+	if !ok {
+		return nil
+	}
+	numbers := make([]int, 0, len(u.parts))
+	for number := range u.parts {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+func sortedKeys(objects map[string][]byte, prefix string) []string {
+	var keys []string
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		writeError(w, http.StatusForbidden, "AccessDenied", "request is not signed")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "payload hash does not match")
+		return
+	}
+	if s.Fail != nil && s.Fail(r) {
+		writeError(w, http.StatusInternalServerError, "InternalError", "injected failure")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "the bucket does not exist")
+		return
+	}
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, objects, query.Get("prefix"), query.Get("delimiter"), query.Get("continuation-token"))
+	case key == "":
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.uploadID++
+		id := strconv.Itoa(s.uploadID)
+		s.uploads[id] = &upload{bucket: bucket, key: key, parts: make(map[int][]byte)}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string   `xml:"Bucket"`
+			Key      string   `xml:"Key"`
+			UploadID string   `xml:"UploadId"`
+		}{Bucket: bucket, Key: key, UploadID: id})
+	case query.Has("uploadId"):
+		u, ok := s.uploads[query.Get("uploadId")]
+		if !ok || u.bucket != bucket || u.key != key {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", "the upload does not exist")
+			return
+		}
+		s.multipart(w, r, objects, u, body)
+	case r.Method == http.MethodPut:
+		objects[key] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodGet:
+		data, ok := objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "the key does not exist")
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, objects map[string][]byte, prefix, delimiter, token string) {
+	type object struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+	}
+	type commonPrefix struct {
+		Prefix string `xml:"Prefix"`
+	}
+	res := struct {
+		XMLName               xml.Name       `xml:"ListBucketResult"`
+		Contents              []object       `xml:"Contents"`
+		CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+		IsTruncated           bool           `xml:"IsTruncated"`
+		NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	}{}
+	commonPrefixOf := func(key string) string {
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			return key[:len(prefix)+i+len(delimiter)]
+		}
+		return ""
+	}
+	// A prefix the previous page ended in was already returned
+	seen := make(map[string]bool)
+	if token != "" && strings.HasPrefix(token, prefix) {
+		if common := commonPrefixOf(token); common != "" {
+			seen[common] = true
+		}
+	}
+	var n int
+	for _, key := range sortedKeys(objects, prefix) {
+		if key <= token {
+			continue
+		}
+		common := commonPrefixOf(key)
+		// Keys grouped into a prefix already returned do not count towards the page
+		if common != "" && seen[common] {
+			res.NextContinuationToken = key
+			continue
+		}
+		if n == s.PageSize {
+			res.IsTruncated = true
+			break
+		}
+		res.NextContinuationToken = key
+		n++
+		if common != "" {
+			seen[common] = true
+			res.CommonPrefixes = append(res.CommonPrefixes, commonPrefix{Prefix: common})
+			continue
+		}
+		res.Contents = append(res.Contents, object{Key: key, Size: int64(len(objects[key])), ETag: etag(objects[key])})
+	}
+	if !res.IsTruncated {
+		res.NextContinuationToken = ""
+	}
+	writeXML(w, &res)
+}
+
+func (s *Server) multipart(w http.ResponseWriter, r *http.Request, objects map[string][]byte, u *upload, body []byte) {
+	query := r.URL.Query()
+	id := query.Get("uploadId")
+	switch r.Method {
+	case http.MethodPut:
+		number, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil || number < 1 {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", "invalid part number")
+			return
+		}
+		u.parts[number] = body
+		w.Header().Set("ETag", etag(body))
+	case http.MethodGet:
+		type part struct {
+			Number int    `xml:"PartNumber"`
+			ETag   string `xml:"ETag"`
+			Size   int64  `xml:"Size"`
+		}
+		res := struct {
+			XMLName xml.Name `xml:"ListPartsResult"`
+			Parts   []part   `xml:"Part"`
+		}{}
+		for number, data := range u.parts {
+			res.Parts = append(res.Parts, part{Number: number, ETag: etag(data), Size: int64(len(data))})
+		}
+		sort.Slice(res.Parts, func(i, j int) bool { return res.Parts[i].Number < res.Parts[j].Number })
+		writeXML(w, &res)
+	case http.MethodPost:
+		var req struct {
+			Parts []struct {
+				Number int    `xml:"PartNumber"`
+				ETag   string `xml:"ETag"`
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &req); err != nil {
+			writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+			return
+		}
+		var data []byte
+		for i, p := range req.Parts {
+			part, ok := u.parts[p.Number]
+			if !ok || p.Number != i+1 || etag(part) != p.ETag {
+				writeError(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d is invalid", p.Number))
+				return
+			}
+			data = append(data, part...)
+		}
+		objects[u.key] = data
+		delete(s.uploads, id)
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string   `xml:"Key"`
+		}{Key: u.key})
+	case http.MethodDelete:
+		delete(s.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
@@ -0,0 +1,208 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package s3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const (
+	// MinPartSize is the smallest part size allowed for multipart uploads.
+	MinPartSize = 5 * 1024 * 1024
+	// DefaultPartSize is the default part size for multipart uploads.
+	DefaultPartSize = 64 * 1024 * 1024
+	// MaxParts is the largest number of parts in a multipart upload.
+	MaxParts = 10000
+)
+
+// UploadState is the progress of a multipart upload. It is saved after every part so
+// that an interrupted upload can be resumed.
+type UploadState struct {
+	// Key is the key of the object being uploaded
+	Key string `json:"key"`
+	// UploadID is the ID of the multipart upload
+	UploadID string `json:"uploadID"`
+	// PartSize is the size of every part but the last
+	PartSize int64 `json:"partSize"`
+	// Parts are the parts uploaded so far
+	Parts []UploadedPart `json:"parts"`
+}
+
+// UploadedPart is a part of an upload in progress.
+type UploadedPart struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func (s *UploadState) part(number int) *UploadedPart {
+	for i := range s.Parts {
+		if s.Parts[i].Number == number {
+			return &s.Parts[i]
+		}
+	}
+	return nil
+}
+
+// Uploader writes an object with a multipart upload. Data is buffered into parts that
+// are uploaded as they fill up, and Close uploads the last part and completes the
+// upload.
+//
+// When resuming an upload, the same data must be written again. Parts whose contents
+// match a part that was already uploaded are skipped, and any other part replaces the
+// uploaded one.
+type Uploader struct {
+	ctx     context.Context
+	client  *Client
+	bucket  string
+	state   *UploadState
+	save    func(*UploadState) error
+	buf     []byte
+	number  int
+	skipped int
+	closed  bool
+}
+
+// NewUploader starts or resumes a multipart upload of an object. If resume is the state
+// of an upload of the same object that still exists it is resumed, otherwise a new
+// upload is started. The save function is called with the state of the upload every
+// time a part is uploaded.
+func (c *Client) NewUploader(ctx context.Context, bucket, key string, partSize int64, opts *PutOptions, resume *UploadState, save func(*UploadState) error) (*Uploader, error) {
+	if partSize == 0 {
+		partSize = DefaultPartSize
+	}
+	if partSize < MinPartSize {
+		return nil, fmt.Errorf("part size must be at least %d bytes", MinPartSize)
+	}
+	u := &Uploader{ctx: ctx, client: c, bucket: bucket, save: save}
+	if resume != nil && resume.Key == key && resume.PartSize == partSize {
+		parts, err := c.ListParts(ctx, bucket, key, resume.UploadID)
+		switch {
+		case err == nil:
+			u.state = &UploadState{Key: key, UploadID: resume.UploadID, PartSize: partSize}
+			// Only parts that are still stored as they were recorded can be skipped
+			for _, part := range parts {
+				if recorded := resume.part(part.Number); recorded != nil && recorded.ETag == part.ETag {
+					u.state.Parts = append(u.state.Parts, *recorded)
+				}
+			}
+		case IsNotFound(err):
+		default:
+			return nil, fmt.Errorf("error listing parts of upload %s: %w", resume.UploadID, err)
+		}
+	}
+	if u.state == nil {
+		uploadID, err := c.CreateMultipartUpload(ctx, bucket, key, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error creating upload of %s: %w", key, err)
+		}
+		u.state = &UploadState{Key: key, UploadID: uploadID, PartSize: partSize}
+		if err := u.save(u.state); err != nil {
+			return nil, err
+		}
+	}
+	u.buf = make([]byte, 0, partSize)
+	return u, nil
+}
+
+// State returns the state of the upload.
+func (u *Uploader) State() *UploadState { return u.state }
+
+// Resumed returns the number of parts that did not need to be uploaded again.
+func (u *Uploader) Resumed() int { return u.skipped }
+
+// Write buffers data and uploads every part that fills up.
+func (u *Uploader) Write(p []byte) (int, error) {
+	if u.closed {
+		return 0, errors.New("write to closed uploader")
+	}
+	var n int
+	for len(p) > 0 {
+		c := copy(u.buf[len(u.buf):cap(u.buf)], p)
+		u.buf = u.buf[:len(u.buf)+c]
+		p = p[c:]
+		n += c
+		if len(u.buf) == cap(u.buf) {
+			if err := u.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (u *Uploader) flush() error {
+	u.number++
+	if u.number > MaxParts {
+		return fmt.Errorf("object exceeds %d parts, use a larger part size", MaxParts)
+	}
+	sum := sha256.Sum256(u.buf)
+	part := UploadedPart{Number: u.number, Size: int64(len(u.buf)), SHA256: hex.EncodeToString(sum[:])}
+	if recorded := u.state.part(u.number); recorded != nil && recorded.SHA256 == part.SHA256 && recorded.Size == part.Size {
+		u.skipped++
+		u.buf = u.buf[:0]
+		return nil
+	}
+	etag, err := u.client.UploadPart(u.ctx, u.bucket, u.state.Key, u.state.UploadID, u.number, u.buf)
+	if err != nil {
+		return fmt.Errorf("error uploading part %d of %s: %w", u.number, u.state.Key, err)
+	}
+	part.ETag = etag
+	if recorded := u.state.part(u.number); recorded != nil {
+		*recorded = part
+	} else {
+		u.state.Parts = append(u.state.Parts, part)
+	}
+	u.buf = u.buf[:0]
+	return u.save(u.state)
+}
+
+// Close uploads the last part and completes the upload.
+func (u *Uploader) Close() error {
+	if u.closed {
+		return nil
+	}
+	u.closed = true
+	// The last part may be empty only if it is the only part
+	if len(u.buf) > 0 || u.number == 0 {
+		if err := u.flush(); err != nil {
+			return err
+		}
+	}
+	parts := make([]Part, 0, u.number)
+	for number := 1; number <= u.number; number++ {
+		recorded := u.state.part(number)
+		if recorded == nil {
+			return fmt.Errorf("part %d of %s was not uploaded", number, u.state.Key)
+		}
+		parts = append(parts, Part{Number: number, ETag: recorded.ETag, Size: recorded.Size})
+	}
+	if err := u.client.CompleteMultipartUpload(u.ctx, u.bucket, u.state.Key, u.state.UploadID, parts); err != nil {
+		return fmt.Errorf("error completing upload of %s: %w", u.state.Key, err)
+	}
+	return nil
+}
+
+// Abort aborts the upload and deletes its parts.
+func (u *Uploader) Abort() error {
+	u.closed = true
+	return u.client.AbortMultipartUpload(u.ctx, u.bucket, u.state.Key, u.state.UploadID)
+}
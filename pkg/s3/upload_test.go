@@ -0,0 +1,240 @@
+/*
+This file is part of btrsync.
+
+Btrsync is free software: you can redistribute it and/or modify it under the terms of the
+GNU Lesser General Public License as published by the Free Software Foundation, either
+version 3 of the License, or (at your option) any later version.
+
+Btrsync is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+See the GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License along with btrsync.
+If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// testData returns size bytes of random data.
+func testData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// upload writes data to an uploader in small writes and closes it.
+func upload(u *Uploader, data []byte) error {
+	for len(data) > 0 {
+		n := 100 * 1024
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := u.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return u.Close()
+}
+
+func TestUploader(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		parts int
+	}{
+		{"empty", 0, 1},
+		{"single part", 1024, 1},
+		{"exact parts", 2 * MinPartSize, 2},
+		{"short last part", 2*MinPartSize + 1, 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			client, srv := newTestClient(t, "bucket")
+			var saved int
+			u, err := client.NewUploader(ctx, "bucket", "snap.btrfs", MinPartSize, nil, nil, func(*UploadState) error {
+				saved++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := testData(tc.size)
+			if err := upload(u, data); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := srv.Object("bucket", "snap.btrfs"); !bytes.Equal(got, data) {
+				t.Fatalf("uploaded %d bytes, want %d", len(got), len(data))
+			}
+			if len(u.State().Parts) != tc.parts {
+				t.Errorf("uploaded %d parts, want %d", len(u.State().Parts), tc.parts)
+			}
+			// The state is saved when the upload is created and after every part
+			if saved != tc.parts+1 {
+				t.Errorf("state saved %d times, want %d", saved, tc.parts+1)
+			}
+			if uploads := srv.Uploads("bucket"); len(uploads) != 0 {
+				t.Errorf("uploads %v still in progress", uploads)
+			}
+		})
+	}
+}
+
+func TestUploaderPartSize(t *testing.T) {
+	client, _ := newTestClient(t, "bucket")
+	_, err := client.NewUploader(context.Background(), "bucket", "snap.btrfs", MinPartSize-1, nil, nil, func(*UploadState) error { return nil })
+	if err == nil {
+		t.Fatal("expected an error for a part size below the minimum")
+	}
+}
+
+func TestUploaderResume(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newTestClient(t, "bucket")
+	data := testData(3*MinPartSize + 1024)
+	var state *UploadState
+	save := func(s *UploadState) error {
+		state = &UploadState{Key: s.Key, UploadID: s.UploadID, PartSize: s.PartSize, Parts: append([]UploadedPart(nil), s.Parts...)}
+		return nil
+	}
+
+	// Interrupt the upload at the third part
+	srv.Fail = func(r *http.Request) bool {
+		return r.Method == http.MethodPut && r.URL.Query().Get("partNumber") == "3"
+	}
+	u, err := client.NewUploader(ctx, "bucket", "snap.btrfs", MinPartSize, nil, nil, save)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upload(u, data); err == nil {
+		t.Fatal("expected the interrupted upload to fail")
+	}
+	if _, ok := srv.Object("bucket", "snap.btrfs"); ok {
+		t.Fatal("interrupted upload created the object")
+	}
+	if len(state.Parts) != 2 {
+		t.Fatalf("saved %d parts, want 2", len(state.Parts))
+	}
+
+	// Resuming skips the parts that were uploaded
+	var uploaded []string
+	srv.Fail = func(r *http.Request) bool {
+		if r.Method == http.MethodPut {
+			uploaded = append(uploaded, r.URL.Query().Get("partNumber"))
+		}
+		return false
+	}
+	u, err = client.NewUploader(ctx, "bucket", "snap.btrfs", MinPartSize, nil, state, save)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.State().UploadID != state.UploadID {
+		t.Fatalf("started upload %s instead of resuming %s", u.State().UploadID, state.UploadID)
+	}
+	if err := upload(u, data); err != nil {
+		t.Fatal(err)
+	}
+	if u.Resumed() != 2 {
+		t.Errorf("resumed %d parts, want 2", u.Resumed())
+	}
+	if want := []string{"3", "4"}; !reflect.DeepEqual(uploaded, want) {
+		t.Errorf("uploaded parts %v, want %v", uploaded, want)
+	}
+	if got, _ := srv.Object("bucket", "snap.btrfs"); !bytes.Equal(got, data) {
+		t.Fatalf("resumed upload wrote %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestUploaderResumeChangedData(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newTestClient(t, "bucket")
+	var state *UploadState
+	save := func(s *UploadState) error {
+		state = &UploadState{Key: s.Key, UploadID: s.UploadID, PartSize: s.PartSize, Parts: append([]UploadedPart(nil), s.Parts...)}
+		return nil
+	}
+	srv.Fail = func(r *http.Request) bool {
+		return r.Method == http.MethodPut && r.URL.Query().Get("partNumber") == "2"
+	}
+	u, err := client.NewUploader(ctx, "bucket", "snap.btrfs", MinPartSize, nil, nil, save)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upload(u, testData(2*MinPartSize)); err == nil {
+		t.Fatal("expected the interrupted upload to fail")
+	}
+
+	// A part with different contents replaces the uploaded one
+	srv.Fail = nil
+	data := testData(2*MinPartSize + 1)
+	u, err = client.NewUploader(ctx, "bucket", "snap.btrfs", MinPartSize, nil, state, save)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upload(u, data); err != nil {
+		t.Fatal(err)
+	}
+	if u.Resumed() != 0 {
+		t.Errorf("resumed %d parts of different data", u.Resumed())
+	}
+	if got, _ := srv.Object("bucket", "snap.btrfs"); !bytes.Equal(got, data) {
+		t.Fatal("uploaded object does not match the data")
+	}
+}
+
+func TestUploaderResumeMissingUpload(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newTestClient(t, "bucket")
+	resume := &UploadState{Key: "snap.btrfs", UploadID: "gone", PartSize: MinPartSize, Parts: []UploadedPart{{Number: 1, ETag: `"etag"`}}}
+	u, err := client.NewUploader(ctx, "bucket", "snap.btrfs", MinPartSize, nil, resume, func(*UploadState) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.State().UploadID == "gone" || len(u.State().Parts) != 0 {
+		t.Fatalf("resumed an upload that no longer exists: %+v", u.State())
+	}
+	data := testData(1024)
+	if err := upload(u, data); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := srv.Object("bucket", "snap.btrfs"); !bytes.Equal(got, data) {
+		t.Fatal("uploaded object does not match the data")
+	}
+}
+
+func TestUploaderAbort(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newTestClient(t, "bucket")
+	u, err := client.NewUploader(ctx, "bucket", "snap.btrfs", MinPartSize, nil, nil, func(*UploadState) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Write(testData(MinPartSize)); err != nil {
+		t.Fatal(err)
+	}
+	if parts := srv.Parts(u.State().UploadID); len(parts) != 1 {
+		t.Fatalf("uploaded parts %v, want 1", parts)
+	}
+	if err := u.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if uploads := srv.Uploads("bucket"); len(uploads) != 0 {
+		t.Errorf("uploads %v still in progress after abort", uploads)
+	}
+	if _, err := u.Write([]byte("more")); err == nil {
+		t.Error("expected writing to an aborted upload to fail")
+	}
+	if err := client.AbortMultipartUpload(ctx, "bucket", "snap.btrfs", u.State().UploadID); !IsNotFound(err) {
+		t.Errorf("expected a not found error aborting twice, got %v", err)
+	}
+}